@@ -0,0 +1,725 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app_test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"app"
+	"app/apptest"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+var (
+	cronRuns = make(map[string]int)
+	scanned  []string
+	scanQ    = datastore.NewQuery("T")
+	jsonRuns []jsonArgs
+
+	moreClock *apptest.Clock
+	moreRuns  int
+	moreSteps []int
+)
+
+type jsonArgs struct {
+	CL    string
+	Count int
+}
+
+func init() {
+	app.Cron("test.minute", time.Minute, func(appengine.Context) error {
+		cronRuns["test.minute"]++
+		return nil
+	})
+	app.Cron("test.hour", time.Hour, func(appengine.Context) error {
+		cronRuns["test.hour"]++
+		return nil
+	})
+	app.ScanData("test", time.Minute, scanQ, func(ctxt appengine.Context, kind, key string) error {
+		scanned = append(scanned, kind+"."+key)
+		return nil
+	})
+	app.JSONTaskFunc("test.json", func(ctxt appengine.Context, args jsonArgs) error {
+		jsonRuns = append(jsonRuns, args)
+		return nil
+	}, "default", nil)
+	app.TaskFunc("test.more", moreTask, "default", nil)
+	app.SetTaskOptions("test.more", app.TaskOptions{SoftDeadline: time.Minute})
+	app.RegisterAPI("/api/test", "A test endpoint.", []string{"q"}, []*schemaResult(nil))
+	app.RegisterDataUpdater("GuardTest", func(*guardRecord) {})
+	app.RegisterDataCache("CacheTest", time.Minute)
+}
+
+type schemaBase struct {
+	ID int
+}
+
+type schemaResult struct {
+	schemaBase
+	Name    string `json:"name"`
+	Secret  string `json:"-"`
+	Time    time.Time
+	Data    []byte
+	Tags    map[string][]string
+	Inner   struct{ OK bool }
+	private int
+}
+
+// moreTask takes n steps of 30 seconds each, continuing in a new task
+// when it runs past its soft deadline.
+func moreTask(ctxt appengine.Context, n int) error {
+	moreRuns++
+	p := app.TaskProgress(ctxt)
+	step := 0
+	p.Load(ctxt, &step)
+	for step < n {
+		step++
+		moreSteps = append(moreSteps, step)
+		moreClock.Advance(30 * time.Second)
+		if p.Expired() {
+			p.Save(ctxt, step)
+			return app.ErrMoreTask
+		}
+	}
+	return nil
+}
+
+// setup installs a fresh store and a clock for the duration of a test.
+func setup(t *testing.T) (appengine.Context, *apptest.Store, *apptest.Clock, func()) {
+	s := apptest.NewStore()
+	clock := apptest.NewClock(time.Date(2014, 3, 1, 12, 0, 10, 0, time.UTC))
+	oldStore := app.SetStore(s)
+	oldClock := app.SetClock(clock.Now)
+	return apptest.NewContext(t), s, clock, func() {
+		app.SetStore(oldStore)
+		app.SetClock(oldClock)
+	}
+}
+
+// testTasks runs the queued tasks whose names start with prefix
+// and returns their names, sorted.
+func testTasks(t *testing.T, ctxt appengine.Context, s *apptest.Store, prefix string) []string {
+	var names []string
+	for _, task := range s.Tasks() {
+		form, err := url.ParseQuery(string(task.Payload))
+		if err != nil {
+			t.Fatalf("task payload %q: %v", task.Payload, err)
+		}
+		name := form.Get("task")
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if code := app.RunTask(ctxt, task.Task); code != 200 {
+			t.Errorf("task %s: status %d", name, code)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestCron(t *testing.T) {
+	ctxt, s, clock, done := setup(t)
+	defer done()
+	for k := range cronRuns {
+		delete(cronRuns, k)
+	}
+
+	app.RunCron(ctxt)
+	if names := testTasks(t, ctxt, s, "app.cron.test."); !reflect.DeepEqual(names, []string{"app.cron.test.hour", "app.cron.test.minute"}) {
+		t.Fatalf("first cron queued %v, want both test jobs", names)
+	}
+
+	// Same time again: nothing new to do.
+	app.RunCron(ctxt)
+	if names := testTasks(t, ctxt, s, "app.cron.test."); len(names) != 0 {
+		t.Fatalf("repeated cron queued %v, want nothing", names)
+	}
+
+	clock.Advance(time.Minute)
+	app.RunCron(ctxt)
+	if names := testTasks(t, ctxt, s, "app.cron.test."); !reflect.DeepEqual(names, []string{"app.cron.test.minute"}) {
+		t.Fatalf("cron a minute later queued %v, want only the minute job", names)
+	}
+
+	clock.Advance(time.Hour)
+	app.RunCron(ctxt)
+	if names := testTasks(t, ctxt, s, "app.cron.test."); !reflect.DeepEqual(names, []string{"app.cron.test.hour", "app.cron.test.minute"}) {
+		t.Fatalf("cron an hour later queued %v, want both test jobs", names)
+	}
+
+	if cronRuns["test.minute"] != 3 || cronRuns["test.hour"] != 2 {
+		t.Errorf("cron runs = %v, want minute 3, hour 2", cronRuns)
+	}
+}
+
+func TestLockExpiry(t *testing.T) {
+	ctxt, _, clock, done := setup(t)
+	defer done()
+
+	if !app.Lock(ctxt, "x", time.Minute) {
+		t.Fatal("first Lock failed")
+	}
+	if app.Lock(ctxt, "x", time.Minute) {
+		t.Fatal("second Lock succeeded while first held")
+	}
+	clock.Advance(59 * time.Second)
+	if app.Lock(ctxt, "x", time.Minute) {
+		t.Fatal("Lock succeeded before expiry")
+	}
+	clock.Advance(2 * time.Second)
+	if !app.Lock(ctxt, "x", time.Minute) {
+		t.Fatal("Lock failed after expiry")
+	}
+	app.Unlock(ctxt, "x")
+	if !app.Lock(ctxt, "x", time.Minute) {
+		t.Fatal("Lock failed after Unlock")
+	}
+}
+
+func TestScanDataFanout(t *testing.T) {
+	ctxt, s, _, done := setup(t)
+	defer done()
+	scanned = nil
+
+	s.SetKeys(scanQ,
+		app.StoreKey{Kind: "T", Key: "a"},
+		app.StoreKey{Kind: "T", Key: "b"},
+		app.StoreKey{Kind: "T", Key: "c"},
+	)
+	app.RunScan(ctxt, "test", scanQ)
+	tasks := s.Tasks()
+	if len(tasks) != 3 {
+		t.Fatalf("scan queued %d tasks, want 3", len(tasks))
+	}
+
+	// While the tasks are pending, another scan must not queue them again.
+	app.RunScan(ctxt, "test", scanQ)
+	if again := s.Tasks(); len(again) != 0 {
+		t.Fatalf("second scan queued %d tasks, want 0", len(again))
+	}
+
+	for _, task := range tasks {
+		if code := app.RunTask(ctxt, task.Task); code != 200 {
+			t.Errorf("task %s: status %d", task.Payload, code)
+		}
+	}
+	sort.Strings(scanned)
+	if want := []string{"T.a", "T.b", "T.c"}; !reflect.DeepEqual(scanned, want) {
+		t.Errorf("scanned %v, want %v", scanned, want)
+	}
+
+	// Once the tasks have run, the next scan queues them again.
+	app.RunScan(ctxt, "test", scanQ)
+	if again := s.Tasks(); len(again) != 3 {
+		t.Fatalf("scan after tasks ran queued %d tasks, want 3", len(again))
+	}
+}
+
+func TestScanDataCursor(t *testing.T) {
+	ctxt, s, _, done := setup(t)
+	defer done()
+	defer app.SetScanChunk(app.SetScanChunk(2))
+	scanned = nil
+
+	s.SetKeys(scanQ,
+		app.StoreKey{Kind: "T", Key: "a"},
+		app.StoreKey{Kind: "T", Key: "b"},
+		app.StoreKey{Kind: "T", Key: "c"},
+	)
+	var queued []string
+	for i := 0; ; i++ {
+		err := app.RunScan(ctxt, "test", scanQ)
+		for _, task := range s.Tasks() {
+			if code := app.RunTask(ctxt, task.Task); code != 200 {
+				t.Errorf("task %s: status %d", task.Payload, code)
+			}
+			queued = append(queued, task.Name)
+		}
+		if err == nil {
+			break
+		}
+		if err != app.ErrMoreCron {
+			t.Fatalf("RunScan: %v", err)
+		}
+		if i > 3 {
+			t.Fatalf("scan did not finish")
+		}
+	}
+	if len(queued) != 3 {
+		t.Errorf("scan queued %d tasks, want 3: %v", len(queued), queued)
+	}
+	sort.Strings(scanned)
+	if want := []string{"T.a", "T.b", "T.c"}; !reflect.DeepEqual(scanned, want) {
+		t.Errorf("scanned %v, want %v", scanned, want)
+	}
+
+	// The finished scan starts over at the beginning.
+	if err := app.RunScan(ctxt, "test", scanQ); err != app.ErrMoreCron {
+		t.Errorf("RunScan after finished scan = %v, want ErrMoreCron", err)
+	}
+	if again := s.Tasks(); len(again) != 2 {
+		t.Errorf("new scan queued %d tasks, want 2", len(again))
+	}
+}
+
+type bigRecord struct {
+	Name  string
+	Text  string    `datastore:",noindex"`
+	Spill app.Spill `datastore:",noindex"`
+}
+
+func TestSpill(t *testing.T) {
+	ctxt, s, _, done := setup(t)
+	defer done()
+
+	big := strings.Repeat("x", 1<<20)
+	r := &bigRecord{Name: "big", Text: big}
+	if err := app.WriteData(ctxt, "Big", "a", r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Text != big {
+		t.Fatal("WriteData did not restore spilled field")
+	}
+	if blobs := s.Records("Blob"); len(blobs) != 2 {
+		t.Fatalf("Blobs after large write = %v, want 2 chunks", blobs)
+	}
+
+	var r1 bigRecord
+	if err := app.ReadData(ctxt, "Big", "a", &r1); err != nil {
+		t.Fatal(err)
+	}
+	if r1.Name != "big" || r1.Text != big {
+		t.Fatalf("ReadData = %q, %d bytes of text, want big, %d bytes", r1.Name, len(r1.Text), len(big))
+	}
+
+	// A second large write uses new Blobs and deletes the old ones.
+	old := s.Records("Blob")
+	r1.Text = big + "y"
+	if err := app.WriteData(ctxt, "Big", "a", &r1); err != nil {
+		t.Fatal(err)
+	}
+	blobs := s.Records("Blob")
+	if len(blobs) != 2 || reflect.DeepEqual(blobs, old) {
+		t.Fatalf("Blobs after second large write = %v, want 2 chunks other than %v", blobs, old)
+	}
+	if err := app.ReadData(ctxt, "Big", "a", &r1); err != nil {
+		t.Fatal(err)
+	}
+	if r1.Text != big+"y" {
+		t.Fatalf("ReadData after second large write = %d bytes of text, want %d", len(r1.Text), len(big)+1)
+	}
+
+	r1.Text = "small"
+	if err := app.WriteData(ctxt, "Big", "a", &r1); err != nil {
+		t.Fatal(err)
+	}
+	if blobs := s.Records("Blob"); len(blobs) != 0 {
+		t.Fatalf("Blobs after small write = %v, want none", blobs)
+	}
+	var r2 bigRecord
+	if err := app.ReadData(ctxt, "Big", "a", &r2); err != nil {
+		t.Fatal(err)
+	}
+	if r2.Text != "small" || len(r2.Spill) != 0 {
+		t.Fatalf("ReadData after small write = %q, spill %v", r2.Text, r2.Spill)
+	}
+}
+
+func TestDataMulti(t *testing.T) {
+	ctxt, _, _, done := setup(t)
+	defer done()
+
+	big := strings.Repeat("x", 1<<20)
+	keys := []string{"a", "b"}
+	w := []*bigRecord{{Name: "a", Text: "small"}, {Name: "b", Text: big}}
+	if err := app.WriteDataMulti(ctxt, "Big", keys, w); err != nil {
+		t.Fatal(err)
+	}
+	if w[1].Text != big {
+		t.Fatal("WriteDataMulti did not restore spilled field")
+	}
+
+	r := []*bigRecord{new(bigRecord), new(bigRecord), new(bigRecord)}
+	err := app.ReadDataMulti(ctxt, "Big", []string{"a", "b", "c"}, r)
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		t.Fatalf("ReadDataMulti = %v, want MultiError", err)
+	}
+	if me[0] != nil || me[1] != nil || me[2] != datastore.ErrNoSuchEntity {
+		t.Fatalf("ReadDataMulti errors = %v, want nil, nil, ErrNoSuchEntity", me)
+	}
+	if r[0].Name != "a" || r[0].Text != "small" || r[1].Name != "b" || r[1].Text != big {
+		t.Fatalf("ReadDataMulti = %q %q, %q %d bytes", r[0].Name, r[0].Text, r[1].Name, len(r[1].Text))
+	}
+
+	if err := app.ReadDataMulti(ctxt, "Big", keys, r[:2]); err != nil {
+		t.Fatalf("ReadDataMulti of stored records: %v", err)
+	}
+	if err := app.ReadDataMulti(ctxt, "Big", keys, r); err == nil {
+		t.Fatal("ReadDataMulti with mismatched lengths succeeded")
+	}
+}
+
+func TestDataCache(t *testing.T) {
+	ctxt, _, _, done := setup(t)
+	defer done()
+
+	// Records written at another dataversion are ignored.
+	for _, dv := range []int{1, 2} {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(&guardRecord{DV: dv, X: 7}); err != nil {
+			t.Fatal(err)
+		}
+		var r guardRecord
+		ok := app.DecodeCached(buf.Bytes(), &r)
+		if want := dv == 2; ok != want || ok && r.X != 7 {
+			t.Errorf("decoding record at dataversion %d: %v, X=%d, want %v", dv, ok, r.X, want)
+		}
+	}
+
+	// Reads and writes in and out of transactions see the datastore.
+	if err := app.WriteData(ctxt, "CacheTest", "a", &bigRecord{Name: "a", Text: "one"}); err != nil {
+		t.Fatal(err)
+	}
+	err := app.Transaction(ctxt, func(ctxt appengine.Context) error {
+		var r bigRecord
+		if err := app.ReadData(ctxt, "CacheTest", "a", &r); err != nil {
+			return err
+		}
+		r.Text = "two"
+		return app.WriteData(ctxt, "CacheTest", "a", &r)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r bigRecord
+	if err := app.ReadData(ctxt, "CacheTest", "a", &r); err != nil || r.Text != "two" {
+		t.Fatalf("ReadData after transaction = %q, %v, want two", r.Text, err)
+	}
+	if err := app.DeleteData(ctxt, "CacheTest", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.ReadData(ctxt, "CacheTest", "a", &r); err != datastore.ErrNoSuchEntity {
+		t.Fatalf("ReadData after delete: %v, want ErrNoSuchEntity", err)
+	}
+}
+
+func TestJSONTask(t *testing.T) {
+	ctxt, s, _, done := setup(t)
+	defer done()
+	jsonRuns = nil
+
+	if err := app.Task(ctxt, "j1", "test.json", jsonArgs{"123", 1}); err != nil {
+		t.Fatal(err)
+	}
+	tasks := s.Tasks()
+	if len(tasks) != 1 {
+		t.Fatalf("queued %d tasks, want 1", len(tasks))
+	}
+	form, _ := url.ParseQuery(string(tasks[0].Payload))
+	if js := form.Get("json"); js != `{"CL":"123","Count":1}` {
+		t.Fatalf("task payload json = %q", js)
+	}
+
+	// Edit the pending arguments before the task runs.
+	var p app.PendingTask
+	if err := app.ReadData(ctxt, "PendingTask", "j1", &p); err != nil {
+		t.Fatal(err)
+	}
+	p.Args = `{"CL":"456","Count":2}`
+	if err := app.WriteData(ctxt, "PendingTask", "j1", &p); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := app.RunTask(ctxt, tasks[0].Task); code != 200 {
+		t.Fatalf("task: status %d", code)
+	}
+	if want := []jsonArgs{{"456", 2}}; !reflect.DeepEqual(jsonRuns, want) {
+		t.Fatalf("task ran with %v, want %v", jsonRuns, want)
+	}
+	if recs := s.Records("PendingTask"); len(recs) != 0 {
+		t.Fatalf("PendingTask records after run = %v, want none", recs)
+	}
+}
+
+func TestPostOnce(t *testing.T) {
+	ctxt, _, _, done := setup(t)
+	defer done()
+
+	posts := 0
+	post := func() error {
+		posts++
+		return nil
+	}
+	fail := func() error {
+		return fmt.Errorf("post failed")
+	}
+
+	if err := app.PostOnce(ctxt, "issue/1", "test", "hello", fail); err == nil {
+		t.Fatal("PostOnce did not return post error")
+	}
+	for i := 0; i < 3; i++ {
+		if err := app.PostOnce(ctxt, "issue/1", "test", "hello", post); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if posts != 1 {
+		t.Fatalf("posted %d times after failure and retries, want 1", posts)
+	}
+	app.PostOnce(ctxt, "issue/1", "test", "goodbye", post)
+	app.PostOnce(ctxt, "issue/2", "test", "hello", post)
+	if posts != 3 {
+		t.Fatalf("posted %d times, want 3 (different content and target)", posts)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	ctxt, _, _, done := setup(t)
+	defer done()
+
+	if r := app.RoleOf(ctxt, "gopher@golang.org"); r != app.Viewer {
+		t.Fatalf("default role = %v, want viewer", r)
+	}
+	r, err := app.ParseRole("reviewer-admin")
+	if err != nil || r != app.ReviewerAdmin {
+		t.Fatalf("ParseRole(reviewer-admin) = %v, %v", r, err)
+	}
+	if _, err := app.ParseRole("admin"); err == nil {
+		t.Fatal("ParseRole(admin) succeeded")
+	}
+	if err := app.SetRole(ctxt, "Gopher@golang.org", app.Triager, "op@golang.org"); err != nil {
+		t.Fatal(err)
+	}
+	if !app.HasRole(ctxt, "gopher@golang.org", app.Triager) || !app.HasRole(ctxt, "gopher@golang.org", app.Viewer) {
+		t.Fatal("triager lacks triager or viewer role")
+	}
+	if app.HasRole(ctxt, "gopher@golang.org", app.Operator) {
+		t.Fatal("triager has operator role")
+	}
+	if err := app.SetRole(ctxt, "gopher@golang.org", app.Viewer, "op@golang.org"); err != nil {
+		t.Fatal(err)
+	}
+	if r := app.RoleOf(ctxt, "gopher@golang.org"); r != app.Viewer {
+		t.Fatalf("role after reset = %v, want viewer", r)
+	}
+}
+
+func TestTaskContinuation(t *testing.T) {
+	ctxt, s, clock, done := setup(t)
+	defer done()
+	moreClock, moreRuns, moreSteps = clock, 0, nil
+
+	if err := app.Task(ctxt, "m1", "test.more", 5); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		tasks := s.Tasks()
+		if len(tasks) == 0 {
+			break
+		}
+		if code := app.RunTask(ctxt, tasks[0].Task); code != 200 {
+			t.Fatalf("run %d: status %d", i+1, code)
+		}
+	}
+	if want := []int{1, 2, 3, 4, 5}; moreRuns != 2 || !reflect.DeepEqual(moreSteps, want) {
+		t.Fatalf("%d runs took steps %v, want 2 runs taking %v", moreRuns, moreSteps, want)
+	}
+	var step int
+	if err := app.ReadMeta(ctxt, "app.progress.m1", &step); err != datastore.ErrNoSuchEntity {
+		t.Fatalf("saved progress after success: %d, %v", step, err)
+	}
+	if err := app.Task(ctxt, "m1", "test.more", 1); err != nil {
+		t.Fatalf("task name not released after continuation finished: %v", err)
+	}
+}
+
+// recordTransport records the URLs of the requests it is asked to make.
+type recordTransport struct {
+	urls []string
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.urls = append(t.urls, req.URL.String())
+	return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+func TestFetchPolicy(t *testing.T) {
+	ctxt, _, _, done := setup(t)
+	defer done()
+	rt := new(recordTransport)
+	defer app.SetTransport(app.SetTransport(rt))
+
+	client := app.Client(ctxt, "test")
+	for _, u := range []string{
+		"https://codereview.appspot.com/api/1234",
+		"http://codereview.appspot.com/api/5678",
+		"http://code.google.com:80/p/go/issues/list",
+	} {
+		if _, err := client.Get(u); err != nil {
+			t.Errorf("Get %s: %v", u, err)
+		}
+	}
+	for _, u := range []string{
+		"http://example.com/hook",
+		"ftp://codereview.appspot.com/api/1234",
+	} {
+		if _, err := client.Get(u); err == nil {
+			t.Errorf("Get %s succeeded, want error", u)
+		}
+	}
+
+	want := []string{
+		"https://codereview.appspot.com/api/1234",
+		"https://codereview.appspot.com/api/5678",
+		"https://code.google.com/p/go/issues/list",
+	}
+	if !reflect.DeepEqual(rt.urls, want) {
+		t.Errorf("fetched %q, want %q", rt.urls, want)
+	}
+}
+
+// statusTransport answers every request with the given status code
+// and counts the requests.
+type statusTransport struct {
+	code int
+	n    int
+}
+
+func (t *statusTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.n++
+	return &http.Response{StatusCode: t.code, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+func TestBreaker(t *testing.T) {
+	ctxt, _, clock, done := setup(t)
+	defer done()
+	rt := &statusTransport{code: 503}
+	defer app.SetTransport(app.SetTransport(rt))
+
+	client := app.Client(ctxt, "test")
+	get := func(u string) error {
+		res, err := client.Get(u)
+		if err == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+	const down = "https://codereview.appspot.com/api/1234"
+	for i := 0; i < 5; i++ {
+		if err := get(down); err != nil {
+			t.Fatalf("Get #%d: %v", i+1, err)
+		}
+	}
+	if err := get(down); !app.IsHostDown(err) {
+		t.Fatalf("Get after 5 failures: %v, want host down", err)
+	}
+	if err := get("https://code.google.com/p/go/issues/list"); err != nil {
+		t.Fatalf("Get from other host: %v", err)
+	}
+	if rt.n != 6 {
+		t.Fatalf("made %d requests, want 6", rt.n)
+	}
+
+	// After the cooldown, a failed trial reopens the breaker for twice as long.
+	clock.Advance(61 * time.Second)
+	if err := get(down); err != nil {
+		t.Fatalf("trial Get: %v", err)
+	}
+	clock.Advance(61 * time.Second)
+	if err := get(down); !app.IsHostDown(err) {
+		t.Fatalf("Get after failed trial: %v, want host down", err)
+	}
+	clock.Advance(60 * time.Second)
+	rt.code = 200
+	if err := get(down); err != nil {
+		t.Fatalf("second trial Get: %v", err)
+	}
+	if err := get(down); err != nil {
+		t.Fatalf("Get after successful trial: %v", err)
+	}
+	if rt.n != 9 {
+		t.Fatalf("made %d requests, want 9", rt.n)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	s := app.BuildSchema()
+	var api *app.SchemaAPI
+	for _, a := range s.APIs {
+		if a.Path == "/api/test" {
+			api = a
+		}
+	}
+	if api == nil {
+		t.Fatal("/api/test missing from schema")
+	}
+	if api.Result != "[]app_test.schemaResult" || !reflect.DeepEqual(api.Params, []string{"q"}) {
+		t.Errorf("/api/test: result %q, params %q", api.Result, api.Params)
+	}
+	var typ *app.SchemaType
+	for _, st := range s.Types {
+		if st.Name == "app_test.schemaResult" {
+			typ = st
+		}
+	}
+	if typ == nil {
+		t.Fatal("schemaResult missing from schema")
+	}
+	var fields []string
+	for _, f := range typ.Fields {
+		fields = append(fields, f.Name+" "+f.Type)
+	}
+	want := []string{"ID int", "name string", "Time time", "Data bytes", "Tags map[string][]string", "Inner {OK bool}"}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("schemaResult fields = %q, want %q", fields, want)
+	}
+}
+
+type guardRecord struct {
+	DV int `dataversion:"2"`
+	X  int
+}
+
+func TestDataGuard(t *testing.T) {
+	ctxt, _, _, done := setup(t)
+	defer done()
+	if err := app.StampVersion(ctxt); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.WriteData(ctxt, "GuardTest", "a", &guardRecord{X: 1}); err != nil {
+		t.Fatalf("writing current version: %v", err)
+	}
+
+	// A newer version has been deployed.
+	if err := app.WriteMeta(ctxt, "app.dataversions", map[string]int{"GuardTest": 3}); err != nil {
+		t.Fatal(err)
+	}
+	app.ClearDataGuard()
+	if err := app.WriteData(ctxt, "GuardTest", "a", &guardRecord{X: 2}); err == nil {
+		t.Errorf("writing outdated version succeeded")
+	}
+
+	// With the guard off, the write goes through.
+	if err := app.WriteMeta(ctxt, "flag.app.dataguard", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.WriteData(ctxt, "GuardTest", "a", &guardRecord{X: 3}); err != nil {
+		t.Errorf("writing with guard off: %v", err)
+	}
+	app.ClearDataGuard()
+}
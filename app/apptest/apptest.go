@@ -0,0 +1,258 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package apptest provides an in-memory datastore, a controllable clock,
+// and a logging context for testing code built on package app
+// without a development app server.
+//
+// A typical test installs the fakes for its duration:
+//
+//	s := apptest.NewStore()
+//	defer app.SetStore(app.SetStore(s))
+//	clock := apptest.NewClock(time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC))
+//	defer app.SetClock(app.SetClock(clock.Now))
+//	ctxt := apptest.NewContext(t)
+//
+// The fake datastore stores records by kind and key and does not
+// evaluate queries; tests say what a query returns using SetKeys.
+package apptest
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"app"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/taskqueue"
+	"appengine_internal"
+)
+
+// A Context is an appengine.Context that logs to a test.
+// It does not implement any App Engine services: calls to them fail,
+// which package app treats as a memcache miss.
+type Context struct {
+	t testing.TB
+}
+
+// NewContext returns a Context logging to t.
+func NewContext(t testing.TB) *Context {
+	return &Context{t}
+}
+
+func (c *Context) Debugf(format string, args ...interface{})    { c.t.Logf("D "+format, args...) }
+func (c *Context) Infof(format string, args ...interface{})     { c.t.Logf("I "+format, args...) }
+func (c *Context) Warningf(format string, args ...interface{})  { c.t.Logf("W "+format, args...) }
+func (c *Context) Errorf(format string, args ...interface{})    { c.t.Logf("E "+format, args...) }
+func (c *Context) Criticalf(format string, args ...interface{}) { c.t.Logf("C "+format, args...) }
+func (c *Context) FullyQualifiedAppID() string                  { return "apptest" }
+func (c *Context) Request() interface{}                         { return nil }
+
+var errNoService = errors.New("apptest: App Engine services not available")
+
+func (c *Context) Call(service, method string, in, out appengine_internal.ProtoMessage, opts *appengine_internal.CallOptions) error {
+	return errNoService
+}
+
+// A Store is an in-memory app.Store.
+// Records are copied in and out using gob, so the record types
+// must have only gob-encodable fields.
+type Store struct {
+	mu    sync.Mutex
+	data  map[app.StoreKey][]byte
+	snap  map[app.StoreKey][]byte // data as of the start of the running transaction
+	keys  map[*datastore.Query][]app.StoreKey
+	tasks []*Task
+}
+
+// A Task is a task added to a Store's task queue.
+type Task struct {
+	Queue string
+	*taskqueue.Task
+}
+
+// NewStore returns a new, empty Store.
+func NewStore() *Store {
+	return &Store{
+		data: make(map[app.StoreKey][]byte),
+		keys: make(map[*datastore.Query][]app.StoreKey),
+	}
+}
+
+func (s *Store) Get(ctxt appengine.Context, kind, key string, data interface{}) error {
+	s.mu.Lock()
+	m := s.data
+	if s.snap != nil {
+		m = s.snap
+	}
+	enc, ok := m[app.StoreKey{Kind: kind, Key: key}]
+	s.mu.Unlock()
+	if !ok {
+		return datastore.ErrNoSuchEntity
+	}
+	v := reflect.ValueOf(data).Elem()
+	v.Set(reflect.Zero(v.Type()))
+	return gob.NewDecoder(bytes.NewReader(enc)).Decode(data)
+}
+
+func (s *Store) Put(ctxt appengine.Context, kind, key string, data interface{}) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(data); err != nil {
+		return fmt.Errorf("apptest: encoding %s[%s]: %v", kind, key, err)
+	}
+	s.mu.Lock()
+	s.data[app.StoreKey{Kind: kind, Key: key}] = buf.Bytes()
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Store) GetMulti(ctxt appengine.Context, kind string, keys []string, data []interface{}) error {
+	errs := make(appengine.MultiError, len(keys))
+	failed := false
+	for i, key := range keys {
+		if errs[i] = s.Get(ctxt, kind, key, data[i]); errs[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+func (s *Store) PutMulti(ctxt appengine.Context, kind string, keys []string, data []interface{}) error {
+	for i, key := range keys {
+		if err := s.Put(ctxt, kind, key, data[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) Delete(ctxt appengine.Context, kind, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data[app.StoreKey{Kind: kind, Key: key}]; !ok {
+		return datastore.ErrNoSuchEntity
+	}
+	delete(s.data, app.StoreKey{Kind: kind, Key: key})
+	return nil
+}
+
+// Transaction runs f. As in the datastore, reads during f return
+// the records as they were before the call, not f's own writes.
+// If f returns an error, the records are rolled back to that state.
+// Transactions are not isolated from each other, and all reads
+// made while one runs, even outside it, see the earlier state.
+func (s *Store) Transaction(ctxt appengine.Context, f func(ctxt appengine.Context) error) error {
+	s.mu.Lock()
+	saved := make(map[app.StoreKey][]byte)
+	for k, v := range s.data {
+		saved[k] = v
+	}
+	s.snap = saved
+	s.mu.Unlock()
+
+	err := f(ctxt)
+	s.mu.Lock()
+	s.snap = nil
+	if err != nil {
+		s.data = saved
+	}
+	s.mu.Unlock()
+	return err
+}
+
+// SetKeys sets the keys that Keys returns for q.
+func (s *Store) SetKeys(q *datastore.Query, keys ...app.StoreKey) {
+	s.mu.Lock()
+	s.keys[q] = keys
+	s.mu.Unlock()
+}
+
+// Keys returns the keys set for q by SetKeys.
+// The cursors it returns are offsets into that list.
+func (s *Store) Keys(ctxt appengine.Context, q *datastore.Query, cursor string, limit int) ([]app.StoreKey, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := s.keys[q]
+	start := 0
+	if cursor != "" {
+		n, err := strconv.Atoi(cursor)
+		if err != nil || n < 0 || n > len(keys) {
+			return nil, "", fmt.Errorf("invalid cursor %q", cursor)
+		}
+		start = n
+	}
+	keys = keys[start:]
+	if len(keys) < limit {
+		return keys, "", nil
+	}
+	return keys[:limit], strconv.Itoa(start + limit), nil
+}
+
+func (s *Store) AddTask(ctxt appengine.Context, t *taskqueue.Task, queue string) error {
+	s.mu.Lock()
+	s.tasks = append(s.tasks, &Task{queue, t})
+	s.mu.Unlock()
+	return nil
+}
+
+// Records returns the keys of the stored records of the given kind, in sorted order.
+func (s *Store) Records(kind string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for k := range s.data {
+		if k.Kind == kind {
+			keys = append(keys, k.Key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Tasks returns the tasks added since the last call to Tasks
+// and clears the queue.
+func (s *Store) Tasks() []*Task {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tasks := s.tasks
+	s.tasks = nil
+	return tasks
+}
+
+// A Clock is a clock that only moves when told to.
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewClock returns a Clock set to t.
+func NewClock(t time.Time) *Clock {
+	return &Clock{now: t}
+}
+
+// Now returns the clock's current time.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
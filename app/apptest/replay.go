@@ -0,0 +1,96 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package apptest
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+var record = flag.Bool("record", false, "record HTTP fixtures from the network instead of replaying them")
+
+// A Replay is an http.RoundTripper that serves GET requests from
+// fixture files in a directory, typically testdata, so that loader tests
+// can run without network access. Install it with app.SetTransport.
+//
+// The fixture for a URL is the body of the response, stored in the file
+// named by FixtureName. When the test is run with -record, Replay
+// fetches the URL from the network and overwrites the fixture instead.
+type Replay struct {
+	dir string
+}
+
+// NewReplay returns a Replay serving fixtures from dir.
+func NewReplay(dir string) *Replay {
+	return &Replay{dir}
+}
+
+// FixtureName returns the name of the fixture file for url:
+// the URL without its scheme, with characters other than letters,
+// digits, dots, dashes and equal signs replaced by underscores.
+// Long names are shortened and given a hash of the full URL.
+func FixtureName(url string) string {
+	if i := strings.Index(url, "://"); i >= 0 {
+		url = url[i+3:]
+	}
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '.', r == '-', r == '=':
+			return r
+		}
+		return '_'
+	}, url)
+	if len(name) > 100 {
+		name = fmt.Sprintf("%s_%x", name[:80], sha1.Sum([]byte(url)))
+	}
+	return name
+}
+
+func (r *Replay) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" {
+		return nil, fmt.Errorf("apptest: cannot replay %s %s", req.Method, req.URL)
+	}
+	file := filepath.Join(r.dir, FixtureName(req.URL.String()))
+	if *record {
+		res, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode == 200 {
+			if err := ioutil.WriteFile(file, data, 0666); err != nil {
+				return nil, err
+			}
+		}
+		res.Body = ioutil.NopCloser(bytes.NewReader(data))
+		return res, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("apptest: no fixture for %s (run with -record to fetch it): %v", req.URL, err)
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    200,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"sort"
+	"sync"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+)
+
+// A Backfill is a loader registered with the backfill controller.
+//
+// The controller keeps the loaders from running each other out of quota.
+// All loaders share a global budget of outbound requests per minute,
+// which they draw on using Allow. Heavy loaders, the ones that may
+// fetch and write many records in a single run, are also serialized:
+// only one of them can be between Start and Done at a time. Routine
+// incremental loaders, which run every minute and fetch little each time,
+// should not be heavy, or they would end up waiting on each other.
+//
+// The budget is set by the "app.backfill" config:
+//
+//	{"FetchesPerMinute": 120}
+type Backfill struct {
+	Name  string
+	Heavy bool
+}
+
+var backfills struct {
+	sync.RWMutex
+	m map[string]*Backfill
+}
+
+// RegisterBackfill registers a loader with the backfill controller.
+func RegisterBackfill(name string, heavy bool) *Backfill {
+	backfills.Lock()
+	defer backfills.Unlock()
+	if backfills.m == nil {
+		backfills.m = make(map[string]*Backfill)
+	}
+	if backfills.m[name] != nil {
+		panic("app.RegisterBackfill: multiple registrations for " + name)
+	}
+	b := &Backfill{name, heavy}
+	backfills.m[name] = b
+	return b
+}
+
+type backfillConfig struct {
+	FetchesPerMinute int64
+}
+
+var defaultBackfillConfig = backfillConfig{
+	FetchesPerMinute: 120,
+}
+
+// backfillLease is how long a heavy backfill may hold the controller
+// before another can take over, in case Done is never called.
+// It matches the deadline for task invocation.
+const backfillLease = 10 * time.Minute
+
+// Start reports whether the backfill may run now.
+// For a heavy backfill, Start fails if another heavy backfill is running;
+// otherwise it succeeds, and the caller must call Done when finished.
+func (b *Backfill) Start(ctxt appengine.Context) bool {
+	if !b.Heavy {
+		return true
+	}
+	if !Lock(ctxt, "app.backfill", backfillLease) {
+		var holder string
+		ReadMeta(ctxt, "app.backfill.holder", &holder)
+		ctxt.Infof("backfill %s: waiting for %s", b.Name, holder)
+		return false
+	}
+	WriteMeta(ctxt, "app.backfill.holder", b.Name)
+	return true
+}
+
+// Done marks the end of a run started by a successful Start.
+func (b *Backfill) Done(ctxt appengine.Context) {
+	if !b.Heavy {
+		return
+	}
+	DeleteMeta(ctxt, "app.backfill.holder")
+	Unlock(ctxt, "app.backfill")
+}
+
+// Allow reports whether the backfill may make n more outbound requests
+// this minute, charging them against the global budget if so.
+// When Allow returns false, the backfill should stop and pick up
+// where it left off on its next run.
+func (b *Backfill) Allow(ctxt appengine.Context, n int) bool {
+	cfg := defaultBackfillConfig
+	ReadConfig(ctxt, "app.backfill", &cfg)
+	key := backfillBudgetKey(timeNow())
+	used, err := memcache.Increment(ctxt, key, int64(n), 0)
+	if err != nil {
+		// Without memcache there is no budget to enforce.
+		return true
+	}
+	if int64(used) > cfg.FetchesPerMinute {
+		memcache.Increment(ctxt, key, -int64(n), 0)
+		ctxt.Infof("backfill %s: over budget (%d fetches this minute)", b.Name, used-uint64(n))
+		return false
+	}
+	return true
+}
+
+func backfillBudgetKey(t time.Time) string {
+	return fmt.Sprintf("app.backfill.fetches.%d", t.Unix()/60)
+}
+
+func init() {
+	RegisterStatus("backfill", backfillStatus)
+}
+
+func backfillStatus(ctxt appengine.Context) string {
+	cfg := defaultBackfillConfig
+	ReadConfig(ctxt, "app.backfill", &cfg)
+
+	w := new(bytes.Buffer)
+	var holder string
+	if err := ReadMeta(ctxt, "app.backfill.holder", &holder); err == nil {
+		var until time.Time
+		ReadMeta(ctxt, "Lock:app.backfill", &until)
+		fmt.Fprintf(w, "heavy backfill running: %s (lease until %v)\n", holder, until)
+	} else if err == datastore.ErrNoSuchEntity {
+		fmt.Fprintf(w, "no heavy backfill running\n")
+	}
+	var used uint64
+	if it, err := memcache.Get(ctxt, backfillBudgetKey(timeNow())); err == nil {
+		fmt.Sscan(string(it.Value), &used)
+	}
+	fmt.Fprintf(w, "%d of %d fetches used this minute\n", used, cfg.FetchesPerMinute)
+
+	backfills.RLock()
+	var names []string
+	for name, b := range backfills.m {
+		if b.Heavy {
+			name += " (heavy)"
+		}
+		names = append(names, name)
+	}
+	backfills.RUnlock()
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "\t%s\n", name)
+	}
+	return "<pre>" + html.EscapeString(w.String()) + "</pre>"
+}
@@ -0,0 +1,199 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"appengine"
+)
+
+// Circuit breakers.
+//
+// When an upstream host such as codereview.appspot.com or code.google.com
+// is down, every cron run of every loader would otherwise keep fetching
+// from it, logging errors and making things worse. So each instance keeps
+// a circuit breaker per host: after Failures consecutive failed requests
+// (errors, 5xx responses, or 429 Too Many Requests) the breaker opens, and
+// for the next Cooldown seconds requests to the host fail immediately with
+// a *HostDownError, which loaders can recognize with IsHostDown. After the
+// cooldown one trial request is let through. If it succeeds the breaker
+// closes; if it fails the breaker opens again for twice as long, up to
+// MaxCooldown seconds. The settings come from the "app.breaker" config:
+//
+//	{"Failures": 5, "Cooldown": 60, "MaxCooldown": 1800}
+//
+// Failures set to 0 turns the breakers off. The state is kept in memory,
+// so each instance learns about a down host separately.
+
+type breakerConfig struct {
+	Failures    int // consecutive failures that open a breaker
+	Cooldown    int // seconds a breaker stays open the first time
+	MaxCooldown int // longest time, in seconds, a breaker stays open
+}
+
+var defaultBreakerConfig = breakerConfig{
+	Failures:    5,
+	Cooldown:    60,
+	MaxCooldown: 30 * 60,
+}
+
+// A HostDownError is the error for a request refused
+// because the breaker for its host is open.
+type HostDownError struct {
+	Host  string
+	Until time.Time // when the breaker lets a trial request through
+}
+
+func (e *HostDownError) Error() string {
+	return fmt.Sprintf("%s is down: not fetching until %s", e.Host, e.Until.UTC().Format(time.RFC3339))
+}
+
+// IsHostDown reports whether err, which may be the error from a request
+// made with Client, means the request was refused by an open breaker.
+func IsHostDown(err error) bool {
+	if e, ok := err.(*url.Error); ok {
+		err = e.Err
+	}
+	_, ok := err.(*HostDownError)
+	return ok
+}
+
+// A breaker records the recent failures of requests to a single host.
+type breaker struct {
+	failures  int           // consecutive failures
+	cooldown  time.Duration // length of the current open period
+	openUntil time.Time     // end of the current open period; zero if closed
+	trial     bool          // a trial request is in flight
+}
+
+var breakers struct {
+	sync.Mutex
+	hosts map[string]*breaker
+}
+
+func init() {
+	RegisterStatus("circuit breakers", breakerStatus)
+}
+
+// resetBreakers closes all breakers.
+func resetBreakers() {
+	breakers.Lock()
+	breakers.hosts = nil
+	breakers.Unlock()
+}
+
+// breakerTransport applies the breaker for each request's host.
+type breakerTransport struct {
+	ctxt   appengine.Context
+	module string
+	rt     http.RoundTripper
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := strings.ToLower(req.URL.Host)
+	if err := allowFetch(host); err != nil {
+		t.ctxt.Infof("circuit breaker: %s: %v", t.module, err)
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	res, err := t.rt.RoundTrip(req)
+	noteFetch(t.ctxt, host, err != nil || res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests)
+	return res, err
+}
+
+// allowFetch returns a *HostDownError if the breaker for host is open.
+// Once the cooldown has passed, it lets a single trial request through.
+func allowFetch(host string) error {
+	breakers.Lock()
+	defer breakers.Unlock()
+	b := breakers.hosts[host]
+	if b == nil || b.openUntil.IsZero() {
+		return nil
+	}
+	if timeNow().Before(b.openUntil) || b.trial {
+		return &HostDownError{host, b.openUntil}
+	}
+	b.trial = true
+	return nil
+}
+
+// noteFetch records the outcome of a request to host,
+// opening its breaker after too many failures in a row.
+func noteFetch(ctxt appengine.Context, host string, failed bool) {
+	if !failed {
+		breakers.Lock()
+		if b := breakers.hosts[host]; b != nil && !b.openUntil.IsZero() {
+			ctxt.Infof("circuit breaker: %s is back up", host)
+		}
+		delete(breakers.hosts, host)
+		breakers.Unlock()
+		return
+	}
+
+	// Read the config before locking: it may take a datastore round trip.
+	cfg := defaultBreakerConfig
+	ReadConfig(ctxt, "app.breaker", &cfg)
+	if cfg.Failures <= 0 {
+		return
+	}
+
+	breakers.Lock()
+	defer breakers.Unlock()
+	if breakers.hosts == nil {
+		breakers.hosts = make(map[string]*breaker)
+	}
+	b := breakers.hosts[host]
+	if b == nil {
+		b = new(breaker)
+		breakers.hosts[host] = b
+	}
+	b.failures++
+	switch {
+	case b.trial:
+		b.trial = false
+		b.cooldown *= 2
+		if max := time.Duration(cfg.MaxCooldown) * time.Second; b.cooldown > max {
+			b.cooldown = max
+		}
+	case b.openUntil.IsZero() && b.failures >= cfg.Failures:
+		b.cooldown = time.Duration(cfg.Cooldown) * time.Second
+	default:
+		return
+	}
+	b.openUntil = timeNow().Add(b.cooldown)
+	ctxt.Errorf("circuit breaker: %s failed %d times in a row; not fetching for %v", host, b.failures, b.cooldown)
+}
+
+func breakerStatus(ctxt appengine.Context) string {
+	breakers.Lock()
+	var hosts []string
+	for host := range breakers.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	w := new(bytes.Buffer)
+	fmt.Fprintf(w, "as seen by this instance\n")
+	for _, host := range hosts {
+		b := breakers.hosts[host]
+		state := "closed"
+		if !b.openUntil.IsZero() {
+			state = "open until " + b.openUntil.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s: %d failures in a row, %s\n", host, b.failures, state)
+	}
+	breakers.Unlock()
+	return "<pre>" + html.EscapeString(w.String()) + "</pre>"
+}
@@ -0,0 +1,24 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"appengine"
+)
+
+// ReadConfig reads the configuration value with the given name
+// into v, which should already hold the default settings.
+// Configuration values are stored as JSON metadata under the key
+// "config." + name and can be edited at /admin/app/metaedit.
+// Fields missing from the stored JSON keep their defaults,
+// and if there is no stored value at all, v is left unchanged.
+//
+// ReadConfig consults memcache (see ReadMetaCached), so changes
+// may take a little while to be noticed, and it should not be used
+// within a transaction.
+func ReadConfig(ctxt appengine.Context, name string, v interface{}) {
+	// ReadMetaCached logs any errors other than a missing value.
+	ReadMetaCached(ctxt, "config."+name, v)
+}
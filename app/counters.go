@@ -0,0 +1,202 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"sort"
+	"sync"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+type counter struct {
+	q           *datastore.Query
+	recountOnly bool
+}
+
+var counters struct {
+	sync.RWMutex
+	m map[string]*counter
+}
+
+// RegisterCounter registers the meta value name as a count of the
+// entities matched by q. Counters maintained by transactional increments
+// drift after failed tasks and retries, so once a day the app.counters cron
+// job recounts q using keys-only queries and records any drift between the
+// stored and the actual count for the status page.
+//
+// If the "app.counters" config sets AutoCorrect, the drift is also corrected,
+// by transactionally adding to the meta value the difference between the
+// recount and the value stored when the recount started, so that increments
+// made during the recount are kept. Counters that nothing else maintains
+// should pass recountOnly, which makes the correction always applied.
+func RegisterCounter(name string, q *datastore.Query, recountOnly bool) {
+	counters.Lock()
+	defer counters.Unlock()
+	if counters.m == nil {
+		counters.m = make(map[string]*counter)
+	}
+	if counters.m[name] != nil {
+		panic("app.RegisterCounter: multiple registrations for " + name)
+	}
+	counters.m[name] = &counter{q, recountOnly}
+}
+
+// A counterState records the progress and result of reconciling one counter.
+// It is stored as the meta value "app.counter.<name>".
+type counterState struct {
+	Cursor  string // cursor for the recount in progress, if any
+	Partial int64  // keys counted so far by the recount in progress
+	Start   time.Time
+	Base    int64 // stored value when the recount in progress started
+
+	Time    time.Time // when the last recount finished
+	Stored  int64     // stored value at that time
+	Counted int64     // recounted value
+	Fixed   bool      // whether the recount was written back
+}
+
+// counterChunk is the number of keys to count in a single cron run.
+// Larger counts continue in later runs, from a saved cursor.
+const counterChunk = 50000
+
+func init() {
+	Cron("app.counters", 24*time.Hour, reconcileCounters)
+	RegisterStatus("counters", counterStatus)
+}
+
+func counterNames() []string {
+	counters.RLock()
+	defer counters.RUnlock()
+	var names []string
+	for name := range counters.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// reconcileCounters recounts the registered counters, a chunk at a time.
+// It returns ErrMoreCron until every counter has been recounted.
+func reconcileCounters(ctxt appengine.Context) error {
+	var cfg struct {
+		AutoCorrect bool
+	}
+	ReadConfig(ctxt, "app.counters", &cfg)
+
+	more := false
+	for _, name := range counterNames() {
+		counters.RLock()
+		cn := counters.m[name]
+		counters.RUnlock()
+
+		var st counterState
+		if err := ReadMeta(ctxt, "app.counter."+name, &st); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if st.Cursor == "" && timeNow().Sub(st.Time) < 20*time.Hour {
+			continue
+		}
+		if st.Cursor == "" {
+			st.Partial = 0
+			st.Start = timeNow()
+			st.Base = 0
+			ReadMeta(ctxt, name, &st.Base)
+		}
+
+		kq := cn.q.KeysOnly().Limit(counterChunk)
+		if st.Cursor != "" {
+			c, err := datastore.DecodeCursor(st.Cursor)
+			if err != nil {
+				ctxt.Errorf("counter %s: bad cursor: %v", name, err)
+				st.Cursor = ""
+				WriteMeta(ctxt, "app.counter."+name, &st)
+				more = true
+				continue
+			}
+			kq = kq.Start(c)
+		}
+		n := 0
+		it := kq.Run(ctxt)
+		for {
+			_, err := it.Next(nil)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("counter %s: %v", name, err)
+			}
+			n++
+		}
+		st.Partial += int64(n)
+
+		if n == counterChunk {
+			c, err := it.Cursor()
+			if err != nil {
+				return fmt.Errorf("counter %s: %v", name, err)
+			}
+			st.Cursor = c.String()
+			if err := WriteMeta(ctxt, "app.counter."+name, &st); err != nil {
+				return err
+			}
+			more = true
+			continue
+		}
+
+		st.Cursor = ""
+		st.Time = timeNow()
+		st.Stored = st.Base
+		st.Counted = st.Partial
+		st.Fixed = false
+		if delta := st.Counted - st.Base; delta != 0 {
+			ctxt.Infof("counter %s: stored %d, counted %d", name, st.Base, st.Counted)
+			if cfg.AutoCorrect || cn.recountOnly {
+				err := Transaction(ctxt, func(ctxt appengine.Context) error {
+					var v int64
+					if err := ReadMeta(ctxt, name, &v); err != nil && err != datastore.ErrNoSuchEntity {
+						return err
+					}
+					return WriteMeta(ctxt, name, v+delta)
+				})
+				if err != nil {
+					return err
+				}
+				st.Fixed = true
+			}
+		}
+		if err := WriteMeta(ctxt, "app.counter."+name, &st); err != nil {
+			return err
+		}
+	}
+	if more {
+		return ErrMoreCron
+	}
+	return nil
+}
+
+func counterStatus(ctxt appengine.Context) string {
+	w := new(bytes.Buffer)
+	for _, name := range counterNames() {
+		var st counterState
+		if err := ReadMeta(ctxt, "app.counter."+name, &st); err != nil {
+			fmt.Fprintf(w, "%s: not yet reconciled\n", name)
+			continue
+		}
+		fmt.Fprintf(w, "%s: stored %d, counted %d, drift %+d", name, st.Stored, st.Counted, st.Stored-st.Counted)
+		if st.Fixed {
+			fmt.Fprintf(w, " (corrected)")
+		}
+		fmt.Fprintf(w, " at %v\n", st.Time)
+		if st.Cursor != "" {
+			fmt.Fprintf(w, "\trecount in progress since %v: %d so far\n", st.Start, st.Partial)
+		}
+	}
+	return "<pre>" + html.EscapeString(w.String()) + "</pre>"
+}
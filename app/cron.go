@@ -16,8 +16,6 @@ import (
 	"appengine"
 	"appengine/datastore"
 	"appengine/taskqueue"
-
-	"github.com/rsc/appstats"
 )
 
 var cron struct {
@@ -29,6 +27,7 @@ type cronEntry struct {
 	name string
 	dt   time.Duration
 	f    func(appengine.Context) error
+	opts TaskOptions // see SetCronOptions
 }
 
 // Cron registers a function to call once per period.
@@ -56,7 +55,7 @@ func Cron(name string, period time.Duration, f func(appengine.Context) error) {
 			panic("app.Cron: multiple registrations for " + name)
 		}
 	}
-	cron.list = append(cron.list, cronEntry{name, period, f})
+	cron.list = append(cron.list, cronEntry{name: name, dt: period, f: f})
 }
 
 // If a function registered and run by Cron returns ErrMoreWork,
@@ -65,7 +64,7 @@ func Cron(name string, period time.Duration, f func(appengine.Context) error) {
 var ErrMoreCron = errors.New("cron job has more work to do")
 
 func init() {
-	http.Handle("/admin/app/cron", appstats.NewHandler(cronHandler))
+	Handle("/admin/app/cron", cronHandler)
 	RegisterStatus("cron", cronStatus)
 }
 
@@ -96,7 +95,7 @@ func cronHandler(ctxt appengine.Context, w http.ResponseWriter, req *http.Reques
 
 	// We're being called by app engine master cron,
 	// so look for new work to queue in tasks.
-	now := time.Now()
+	now := timeNow()
 	var old time.Time
 	err := Transaction(ctxt, func(ctxt appengine.Context) error {
 		if err := ReadMeta(ctxt, "app.cron.time", &old); err != nil && err != datastore.ErrNoSuchEntity {
@@ -137,6 +136,9 @@ func cronExec(ctxt appengine.Context, name string) error {
 	return nil
 
 Found:
+	if cr.opts.SoftDeadline > 0 {
+		TaskProgress(ctxt).setDeadline(cr.opts.SoftDeadline)
+	}
 	if err := cr.f(ctxt); err != nil {
 		if err == ErrMoreCron {
 			// The cron job found that it had more work than it could do
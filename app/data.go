@@ -18,8 +18,6 @@ import (
 	"appengine/datastore"
 	"appengine/delay"
 	"appengine/taskqueue"
-
-	"github.com/rsc/appstats"
 )
 
 var updaters struct {
@@ -144,8 +142,9 @@ func DeleteData(ctxt appengine.Context, kind string, key string) error {
 		ctxt.Errorf("delete datastore %s[%s]: no key", kind, key)
 		return fmt.Errorf("missing key")
 	}
-	k := datastore.NewKey(ctxt, kind, key, 0, nil)
-	err := datastore.Delete(ctxt, k)
+	chargeQuota(ctxt, kindModule(kind), opWrite, 1)
+	err := store.Delete(ctxt, kind, key)
+	uncache(ctxt, kind, key)
 	if err != nil && err != datastore.ErrNoSuchEntity {
 		ctxt.Errorf("delete datastore %s[%s]: %v", kind, key, err)
 	}
@@ -155,16 +154,26 @@ func DeleteData(ctxt appengine.Context, kind string, key string) error {
 // ReadData reads a record with the given kind and key from the datastore into data.
 // It applies any registered updaters before returning. See RegisterDataUpdater.
 // If there is no such record, ReadData returns datastore.ErrNoSuchEntity.
+// Records of kinds registered with RegisterDataCache may come from memcache.
 func ReadData(ctxt appengine.Context, kind string, key string, data interface{}) error {
 	if key == "" {
 		ctxt.Errorf("read datastore %s[%s]: no key", kind, key)
 		return fmt.Errorf("missing key")
 	}
-	k := datastore.NewKey(ctxt, kind, key, 0, nil)
-	err := datastore.Get(ctxt, k, data)
+	if readCache(ctxt, kind, []string{key}, []interface{}{data})[0] {
+		return nil
+	}
+	chargeQuota(ctxt, kindModule(kind), opRead, 1)
+	err := store.Get(ctxt, kind, key, data)
+	if err == nil {
+		err = unspill(ctxt, kind, key, data)
+	}
 	if err == nil {
 		err = update(ctxt, kind, data)
 	}
+	if err == nil {
+		writeCache(ctxt, kind, []string{key}, []interface{}{data})
+	}
 	if err != nil && err != datastore.ErrNoSuchEntity {
 		ctxt.Errorf("read datastore %s[%s]: %v", kind, key, err)
 	}
@@ -173,15 +182,30 @@ func ReadData(ctxt appengine.Context, kind string, key string, data interface{})
 
 // WriteData writes a record with the given kind and key to the datastore from data.
 // It applies any registered updaters before the write. See RegisterDataUpdater.
+// Records nearing the datastore's size limit may be split up. See Spill.
+// WriteData refuses to write a record older than a deployed version of the
+// app expects. See dataguard.go.
 func WriteData(ctxt appengine.Context, kind string, key string, data interface{}) error {
 	if key == "" {
 		ctxt.Errorf("read datastore %s[%s]: no key", kind, key)
 		return fmt.Errorf("missing key")
 	}
-	err := update(ctxt, kind, data)
+	err := guardWrite(ctxt, kind, data)
+	if err == nil {
+		err = update(ctxt, kind, data)
+	}
 	if err == nil {
-		k := datastore.NewKey(ctxt, kind, key, 0, nil)
-		_, err = datastore.Put(ctxt, k, data)
+		var restore, cleanup func()
+		restore, cleanup, err = spill(ctxt, kind, key, data)
+		if err == nil {
+			chargeQuota(ctxt, kindModule(kind), opWrite, 1)
+			err = store.Put(ctxt, kind, key, data)
+			restore()
+			uncache(ctxt, kind, key)
+			if err == nil {
+				cleanup()
+			}
+		}
 	}
 	if err != nil {
 		ctxt.Errorf("write datastore %s[%s]: %v", kind, key, err)
@@ -189,6 +213,143 @@ func WriteData(ctxt appengine.Context, kind string, key string, data interface{}
 	return err
 }
 
+// ReadDataMulti is like ReadData but reads the records with the given kind
+// and keys, in a single datastore call, into the corresponding elements of
+// data, which must be a slice of pointers to records, as in []*MyRecord.
+// If any records cannot be read, ReadDataMulti returns an appengine.MultiError
+// holding the error for each record, datastore.ErrNoSuchEntity for a missing one.
+// Within a transaction, the records count toward the limit of 25 entity
+// groups in a cross-group transaction.
+func ReadDataMulti(ctxt appengine.Context, kind string, keys []string, data interface{}) error {
+	dst, err := dataSlice("ReadDataMulti", kind, keys, data)
+	if err != nil {
+		ctxt.Errorf("%v", err)
+		return err
+	}
+	errs := make(appengine.MultiError, len(keys))
+	var miss []int
+	var mkeys []string
+	var mdst []interface{}
+	for i, hit := range readCache(ctxt, kind, keys, dst) {
+		if !hit {
+			miss = append(miss, i)
+			mkeys = append(mkeys, keys[i])
+			mdst = append(mdst, dst[i])
+		}
+	}
+	if len(miss) == 0 {
+		return nil
+	}
+	chargeQuota(ctxt, kindModule(kind), opRead, int64(len(miss)))
+	if err := store.GetMulti(ctxt, kind, mkeys, mdst); err != nil {
+		me, ok := err.(appengine.MultiError)
+		if !ok {
+			ctxt.Errorf("read datastore %s[%d keys]: %v", kind, len(mkeys), err)
+			return err
+		}
+		for j, i := range miss {
+			errs[i] = me[j]
+		}
+	}
+	failed := false
+	var ckeys []string
+	var cdata []interface{}
+	for _, i := range miss {
+		key := keys[i]
+		if errs[i] == nil {
+			errs[i] = unspill(ctxt, kind, key, dst[i])
+		}
+		if errs[i] == nil {
+			errs[i] = update(ctxt, kind, dst[i])
+		}
+		if errs[i] != nil {
+			failed = true
+			if errs[i] != datastore.ErrNoSuchEntity {
+				ctxt.Errorf("read datastore %s[%s]: %v", kind, key, errs[i])
+			}
+			continue
+		}
+		ckeys = append(ckeys, key)
+		cdata = append(cdata, dst[i])
+	}
+	writeCache(ctxt, kind, ckeys, cdata)
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+// WriteDataMulti is like WriteData but writes the elements of data,
+// which must be a slice of pointers to records, as the records with
+// the given kind and keys, in a single datastore call.
+// If any of the records cannot be written, WriteDataMulti writes none of them,
+// except that a failure of the datastore call itself may leave some written.
+func WriteDataMulti(ctxt appengine.Context, kind string, keys []string, data interface{}) error {
+	src, err := dataSlice("WriteDataMulti", kind, keys, data)
+	if err != nil {
+		ctxt.Errorf("%v", err)
+		return err
+	}
+	var restores, cleanups []func()
+	defer func() {
+		for _, restore := range restores {
+			restore()
+		}
+	}()
+	for i, key := range keys {
+		err := guardWrite(ctxt, kind, src[i])
+		if err == nil {
+			err = update(ctxt, kind, src[i])
+		}
+		if err == nil {
+			var restore, cleanup func()
+			restore, cleanup, err = spill(ctxt, kind, key, src[i])
+			if err == nil {
+				restores = append(restores, restore)
+				cleanups = append(cleanups, cleanup)
+			}
+		}
+		if err != nil {
+			ctxt.Errorf("write datastore %s[%s]: %v", kind, key, err)
+			return err
+		}
+	}
+	chargeQuota(ctxt, kindModule(kind), opWrite, int64(len(keys)))
+	err = store.PutMulti(ctxt, kind, keys, src)
+	uncache(ctxt, kind, keys...)
+	if err != nil {
+		ctxt.Errorf("write datastore %s[%d keys]: %v", kind, len(keys), err)
+		return err
+	}
+	for _, cleanup := range cleanups {
+		cleanup()
+	}
+	return nil
+}
+
+// dataSlice returns the elements of data, a slice of pointers
+// with one element for each key, for ReadDataMulti or WriteDataMulti.
+func dataSlice(op, kind string, keys []string, data interface{}) ([]interface{}, error) {
+	v := reflect.ValueOf(data)
+	if v.Kind() != reflect.Slice || v.Type().Elem().Kind() != reflect.Ptr {
+		return nil, fmt.Errorf("%s %s: data is %T, not a slice of pointers", op, kind, data)
+	}
+	if v.Len() != len(keys) {
+		return nil, fmt.Errorf("%s %s: %d keys but %d records", op, kind, len(keys), v.Len())
+	}
+	out := make([]interface{}, len(keys))
+	for i, key := range keys {
+		if key == "" {
+			return nil, fmt.Errorf("%s %s: missing key", op, kind)
+		}
+		if v.Index(i).IsNil() {
+			return nil, fmt.Errorf("%s %s[%s]: nil record", op, kind, key)
+		}
+		out[i] = v.Index(i).Interface()
+	}
+	return out, nil
+}
+
 type kindType struct {
 	kind string
 	typ  reflect.Type
@@ -196,7 +357,7 @@ type kindType struct {
 
 func init() {
 	RegisterStatus("data updater", updateStatus)
-	http.Handle("/admin/app/update", appstats.NewHandler(startUpdate))
+	Handle("/admin/app/update", startUpdate)
 }
 
 func startUpdate(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
@@ -319,7 +480,10 @@ var scan = struct {
 // Scan registers a datastore trigger function.
 // Periodically, the app will scan the datastore for records matching
 // the query q, and for each such record will create a task
-// to run the function f.
+// to run the function f. The query is registered with RegisterQuery,
+// so that a missing index shows up on the status page.
+// A scan of more records than fit in one cron run resumes where it
+// left off in the next run, which starts right away.
 func ScanData(name string, period time.Duration, q *datastore.Query, f func(ctxt appengine.Context, kind, key string) error) {
 	scan.Lock()
 	defer scan.Unlock()
@@ -327,9 +491,9 @@ func ScanData(name string, period time.Duration, q *datastore.Query, f func(ctxt
 		panic("app.ScanData: multiple registrations for name: " + name)
 	}
 	scan.m[name] = f
+	RegisterQuery("scan."+name, q)
 	Cron("app.scan."+name, period, func(ctxt appengine.Context) error {
-		scanData(ctxt, name, period, q, f)
-		return nil
+		return scanData(ctxt, name, period, q, f)
 	})
 }
 
@@ -344,20 +508,44 @@ var scanRetry = &taskqueue.RetryOptions{
 	MaxBackoff: 1 * time.Hour,
 }
 
-func scanData(ctxt appengine.Context, name string, period time.Duration, q *datastore.Query, f func(ctxt appengine.Context, kind, key string) error) {
-	// TODO: Handle even more keys by using cursor.
-	const chunk = 100000
+// scanChunk is the number of records a single scanData call queues tasks for.
+var scanChunk = 10000
+
+// scanData queues tasks to run f for the next chunk of records matching q,
+// resuming at the cursor saved in the meta value "app.scan.<name>.cursor"
+// by the previous call, if any. It returns ErrMoreCron if the scan is not
+// finished, so that the cron job runs again soon to continue it.
+func scanData(ctxt appengine.Context, name string, period time.Duration, q *datastore.Query, f func(ctxt appengine.Context, kind, key string) error) error {
+	cursorKey := "app.scan." + name + ".cursor"
+	var cursor string
+	if err := ReadMeta(ctxt, cursorKey, &cursor); err != nil && err != datastore.ErrNoSuchEntity {
+		return nil
+	}
 
-	keys, err := q.Limit(chunk).KeysOnly().GetAll(ctxt, nil)
+	keys, next, err := store.Keys(ctxt, q, cursor, scanChunk)
+	if err != nil && cursor != "" {
+		// The saved cursor may no longer be usable, for example
+		// after a change to the query. Start over.
+		ctxt.Errorf("scandata %q: resuming at cursor: %v", name, err)
+		keys, next, err = store.Keys(ctxt, q, "", scanChunk)
+	}
 	if err != nil {
 		ctxt.Errorf("scandata %q: %v", name, err)
-		return
+		return nil
 	}
 
-	const maxBatch = 100
 	for _, key := range keys {
-		Task(ctxt, fmt.Sprintf("app.scandata.%s.%s", key.Kind(), key.StringID()), "scandata", name, key.Kind(), key.StringID())
+		Task(ctxt, fmt.Sprintf("app.scandata.%s.%s", key.Kind, key.Key), "scandata", name, key.Kind, key.Key)
+	}
+
+	if err := WriteMeta(ctxt, cursorKey, next); err != nil {
+		return nil
 	}
+	if next != "" {
+		ctxt.Infof("scandata %q: queued %d records, more to come", name, len(keys))
+		return ErrMoreCron
+	}
+	return nil
 }
 
 func init() {
@@ -379,3 +567,20 @@ func scanDataExec(ctxt appengine.Context, name, kind, key string) {
 		ctxt.Errorf("scandata %q %q %q: %v", name, kind, key, err)
 	}
 }
+
+// CountKeys returns the number of entities matching q,
+// counting with a keys-only query.
+func CountKeys(ctxt appengine.Context, q *datastore.Query) (int64, error) {
+	var n int64
+	it := q.KeysOnly().Run(ctxt)
+	for {
+		_, err := it.Next(nil)
+		if err == datastore.Done {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+}
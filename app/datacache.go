@@ -0,0 +1,148 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"sync"
+	"time"
+
+	"appengine"
+	"appengine/memcache"
+)
+
+// Data cache.
+//
+// Kinds registered with RegisterDataCache are cached in memcache:
+// ReadData and ReadDataMulti look for a gob-encoded copy of each record
+// before reading the datastore, and save a copy of each record they read
+// from the datastore, after restoring spilled fields and applying the
+// updaters. A copy written at another dataversion, as by an older or newer
+// version of the app, is ignored. WriteData, WriteDataMulti and DeleteData
+// delete the copies of the records they change, and those called within a
+// Transaction delete them again once the transaction is over, so that a
+// read racing the transaction does not leave the old record cached.
+// Reads within a transaction always use the datastore, and queries do not
+// use the cache at all.
+//
+// Like ReadMetaCached, the cache can be wrong once in a while: a read
+// that fetches a record just before a write and saves it just after will
+// leave the old record cached until it expires. Caching is meant for kinds
+// read by key much more often than they are written.
+
+var dataCache struct {
+	sync.RWMutex
+	kinds map[string]time.Duration
+}
+
+// RegisterDataCache makes ReadData and ReadDataMulti cache records of the
+// given kind in memcache, keeping each for at most expiration.
+func RegisterDataCache(kind string, expiration time.Duration) {
+	dataCache.Lock()
+	defer dataCache.Unlock()
+	if dataCache.kinds == nil {
+		dataCache.kinds = make(map[string]time.Duration)
+	}
+	dataCache.kinds[kind] = expiration
+}
+
+// cacheExpiration reports whether records of kind are cached
+// and, if so, for how long.
+func cacheExpiration(kind string) (time.Duration, bool) {
+	dataCache.RLock()
+	defer dataCache.RUnlock()
+	exp, ok := dataCache.kinds[kind]
+	return exp, ok
+}
+
+// useCache reports whether reads of kind should use the cache.
+func useCache(ctxt appengine.Context, kind string) bool {
+	if _, ok := ctxt.(*txContext); ok {
+		return false
+	}
+	_, ok := cacheExpiration(kind)
+	return ok
+}
+
+func dataCacheKey(kind, key string) string {
+	return "app.Data." + kind + "." + key
+}
+
+// readCache reads the cached copies of the records with the given keys
+// into the corresponding elements of dst and reports which it found.
+func readCache(ctxt appengine.Context, kind string, keys []string, dst []interface{}) []bool {
+	hit := make([]bool, len(keys))
+	if !useCache(ctxt, kind) {
+		return hit
+	}
+	var mkeys []string
+	for _, key := range keys {
+		mkeys = append(mkeys, dataCacheKey(kind, key))
+	}
+	items, err := memcache.GetMulti(ctxt, mkeys)
+	if err != nil {
+		return hit
+	}
+	for i, mkey := range mkeys {
+		if it := items[mkey]; it != nil {
+			hit[i] = decodeCached(it.Value, dst[i])
+		}
+	}
+	return hit
+}
+
+// decodeCached decodes the cached copy of a record into data,
+// reporting whether it succeeded. It ignores a copy written at
+// a different dataversion than data's type.
+func decodeCached(value []byte, data interface{}) bool {
+	t := reflect.TypeOf(data).Elem()
+	fresh := reflect.New(t)
+	if err := gob.NewDecoder(bytes.NewReader(value)).DecodeValue(fresh); err != nil {
+		return false
+	}
+	if dv := typeDataVersion(t); dv != 0 && fresh.Elem().Field(0).Int() != int64(dv) {
+		return false
+	}
+	reflect.ValueOf(data).Elem().Set(fresh.Elem())
+	return true
+}
+
+// writeCache saves copies of the records with the given keys.
+func writeCache(ctxt appengine.Context, kind string, keys []string, src []interface{}) {
+	if len(keys) == 0 || !useCache(ctxt, kind) {
+		return
+	}
+	exp, _ := cacheExpiration(kind)
+	var items []*memcache.Item
+	for i, key := range keys {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(src[i]); err != nil {
+			ctxt.Warningf("data cache: encoding %s[%s]: %v", kind, key, err)
+			continue
+		}
+		items = append(items, &memcache.Item{Key: dataCacheKey(kind, key), Value: buf.Bytes(), Expiration: exp})
+	}
+	if len(items) > 0 {
+		memcache.SetMulti(ctxt, items)
+	}
+}
+
+// uncache deletes the cached copies of the records with the given keys,
+// now and, within a transaction, again when the transaction is over.
+func uncache(ctxt appengine.Context, kind string, keys ...string) {
+	if _, ok := cacheExpiration(kind); !ok {
+		return
+	}
+	var mkeys []string
+	for _, key := range keys {
+		mkeys = append(mkeys, dataCacheKey(kind, key))
+	}
+	memcache.DeleteMulti(ctxt, mkeys)
+	if tc, ok := ctxt.(*txContext); ok {
+		tc.uncache = append(tc.uncache, mkeys...)
+	}
+}
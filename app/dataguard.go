@@ -0,0 +1,193 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Data version guard.
+//
+// Once a new version of the app has been deployed, its data updaters
+// (see RegisterDataUpdater) may have rewritten records at a higher
+// dataversion. If an older version keeps running, as during a canary
+// deployment or after a rollback, its writes would silently downgrade
+// those records, and the newer version would not know to update them
+// again. To prevent this, each instance stamps its version and the
+// dataversion of each registered kind into the meta value
+// "app.version.<version>" when it warms up, and raises the highest
+// dataversion seen for each kind in "app.dataversions". WriteData
+// refuses to write a record whose dataversion is lower than the highest
+// one seen for its kind. Turning off the app.dataguard flag makes it
+// log a warning and write the record anyway. After an intentional
+// rollback, the app.resetdataversions op, run on the old version,
+// resets the highest versions to its own.
+
+var dataGuardFlag = Flag("app.dataguard", true)
+
+// A versionStamp records the dataversions a version of the app writes.
+type versionStamp struct {
+	Version      string
+	Time         time.Time
+	DataVersions map[string]int
+}
+
+// dataGuardRefresh is how often an instance rereads "app.dataversions".
+const dataGuardRefresh = 1 * time.Minute
+
+var dataGuard struct {
+	sync.Mutex
+	loaded time.Time
+	max    map[string]int // highest dataversion seen for each kind
+}
+
+func init() {
+	RegisterWarmup("app.versionstamp", stampVersion)
+	RegisterStatus("data versions", dataVersionStatus)
+	RegisterOp("app.resetdataversions", "Reset the highest data versions seen to those of the version running this op, after an intentional rollback.", nil, func(ctxt appengine.Context, args map[string]string) (string, error) {
+		s := currentStamp(ctxt)
+		if err := WriteMeta(ctxt, "app.dataversions", s.DataVersions); err != nil {
+			return "", err
+		}
+		clearDataGuard()
+		return fmt.Sprintf("reset data versions to those of version %s", s.Version), nil
+	})
+}
+
+// currentStamp returns the stamp for the running version.
+func currentStamp(ctxt appengine.Context) *versionStamp {
+	s := &versionStamp{
+		Version:      appengine.VersionID(ctxt),
+		Time:         timeNow(),
+		DataVersions: make(map[string]int),
+	}
+	updaters.RLock()
+	for kind, t := range updaters.types {
+		s.DataVersions[kind] = typeDataVersion(t)
+	}
+	updaters.RUnlock()
+	return s
+}
+
+// typeDataVersion returns the dataversion of the record type t,
+// or 0 if it has none.
+func typeDataVersion(t reflect.Type) int {
+	if t.Kind() != reflect.Struct || t.NumField() == 0 {
+		return 0
+	}
+	dv, _ := strconv.Atoi(t.Field(0).Tag.Get("dataversion"))
+	return dv
+}
+
+// stampVersion records the running version's stamp
+// and raises the highest data versions to include it.
+func stampVersion(ctxt appengine.Context) error {
+	s := currentStamp(ctxt)
+	if err := WriteMeta(ctxt, "app.version."+s.Version, s); err != nil {
+		return err
+	}
+	err := Transaction(ctxt, func(ctxt appengine.Context) error {
+		max := make(map[string]int)
+		if err := ReadMeta(ctxt, "app.dataversions", &max); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		changed := false
+		for kind, dv := range s.DataVersions {
+			if max[kind] < dv {
+				max[kind] = dv
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+		return WriteMeta(ctxt, "app.dataversions", max)
+	})
+	clearDataGuard()
+	return err
+}
+
+func clearDataGuard() {
+	dataGuard.Lock()
+	dataGuard.loaded = time.Time{}
+	dataGuard.Unlock()
+}
+
+// maxDataVersion returns the highest dataversion seen for kind.
+func maxDataVersion(ctxt appengine.Context, kind string) int {
+	dataGuard.Lock()
+	stale := timeNow().Sub(dataGuard.loaded) > dataGuardRefresh
+	m := dataGuard.max
+	dataGuard.Unlock()
+	if !stale {
+		return m[kind]
+	}
+
+	// Read outside the lock: it may take a datastore round trip.
+	var max map[string]int
+	if err := ReadMetaCached(ctxt, "app.dataversions", &max); err != nil && err != datastore.ErrNoSuchEntity {
+		return m[kind]
+	}
+	dataGuard.Lock()
+	dataGuard.max = max
+	dataGuard.loaded = timeNow()
+	dataGuard.Unlock()
+	return max[kind]
+}
+
+// guardWrite checks that writing data, a record of the given kind,
+// would not downgrade it (see the comment at the top of this file).
+func guardWrite(ctxt appengine.Context, kind string, data interface{}) error {
+	dv := typeDataVersion(reflect.TypeOf(data).Elem())
+	if dv == 0 {
+		return nil
+	}
+	max := maxDataVersion(ctxt, kind)
+	if dv >= max {
+		return nil
+	}
+	if !dataGuardFlag.On(ctxt) {
+		ctxt.Warningf("data guard: writing %s at dataversion %d, older than %d (guard off)", kind, dv, max)
+		return nil
+	}
+	ctxt.Criticalf("data guard: refusing to write %s at dataversion %d, older than %d", kind, dv, max)
+	return fmt.Errorf("refusing to write %s at dataversion %d: a newer version of the app uses %d", kind, dv, max)
+}
+
+func dataVersionStatus(ctxt appengine.Context) string {
+	w := new(bytes.Buffer)
+	cur := currentStamp(ctxt)
+	var max map[string]int
+	ReadMeta(ctxt, "app.dataversions", &max)
+	var kinds []string
+	for kind := range cur.DataVersions {
+		kinds = append(kinds, kind)
+	}
+	for kind := range max {
+		if _, ok := cur.DataVersions[kind]; !ok {
+			kinds = append(kinds, kind)
+		}
+	}
+	sort.Strings(kinds)
+	fmt.Fprintf(w, "version %s (guard on: %v)\n", cur.Version, dataGuardFlag.On(ctxt))
+	for _, kind := range kinds {
+		note := ""
+		if cur.DataVersions[kind] < max[kind] {
+			note = " OUTDATED"
+		}
+		fmt.Fprintf(w, "%s: this version %d, highest %d%s\n", kind, cur.DataVersions[kind], max[kind], note)
+	}
+	return "<pre>" + html.EscapeString(w.String()) + "</pre>"
+}
@@ -0,0 +1,49 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"strconv"
+	"time"
+
+	"appengine"
+	"appengine/memcache"
+)
+
+// The data version identifies the state of the app's data as a whole.
+// It is the time of the most recent change, in milliseconds since 1970,
+// so that it both increases with each change and doubles as a
+// modification time for HTTP caching.
+//
+// The version is kept only in memcache. If it is evicted, DataVersion
+// starts over at the current time, which makes clients refetch
+// data that may not have changed but never lets them keep stale data.
+
+const dataVersionKey = "app.dataversion"
+
+// BumpDataVersion records that the app's data has changed.
+func BumpDataVersion(ctxt appengine.Context) {
+	v := strconv.FormatInt(time.Now().UnixNano()/1e6, 10)
+	if err := memcache.Set(ctxt, &memcache.Item{Key: dataVersionKey, Value: []byte(v)}); err != nil {
+		ctxt.Errorf("bump data version: %v", err)
+	}
+}
+
+// DataVersion returns the current data version.
+func DataVersion(ctxt appengine.Context) int64 {
+	if it, err := memcache.Get(ctxt, dataVersionKey); err == nil {
+		if v, err := strconv.ParseInt(string(it.Value), 10, 64); err == nil {
+			return v
+		}
+	}
+	v := time.Now().UnixNano() / 1e6
+	memcache.Add(ctxt, &memcache.Item{Key: dataVersionKey, Value: []byte(strconv.FormatInt(v, 10))})
+	return v
+}
+
+// DataVersionTime returns the modification time corresponding to the data version v.
+func DataVersionTime(v int64) time.Time {
+	return time.Unix(v/1e3, (v%1e3)*1e6)
+}
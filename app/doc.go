@@ -5,16 +5,15 @@
 // Package app implements various convenience functionality
 // for App Engine apps.
 //
-// This package assumes that URLs beginning with /admin have
-// been restricted to administrators of the app, such as by using
+// Access to URLs is controlled by the roles of the users making the
+// requests (see Handle and HandleRole), not by app.yaml: URLs beginning
+// with /admin/ require the operator role unless registered otherwise.
+// The app.yaml file should still serve /admin securely:
 //
 //	handlers:
 //	- url: /admin(/.*)?
 //	  script: _go_app
-//	  login: admin
 //	  secure: always
-//
-// in the app.yaml file.
 package app
 
 // BUG(rsc): Eventually, this package should go somewhere importable.
@@ -0,0 +1,146 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"sort"
+	"sync"
+	"time"
+
+	"appengine"
+	"appengine/taskqueue"
+)
+
+// An Event is a notification published by one part of the app
+// for the others to act on, such as a change to a CL's reviewers.
+type Event struct {
+	Topic string
+	Key   string          // what the event is about, such as a CL number
+	Time  time.Time       // when the event was published
+	Data  json.RawMessage // the published value, JSON-encoded
+}
+
+// Decode decodes the event's published value into v.
+func (e *Event) Decode(v interface{}) error {
+	return json.Unmarshal(e.Data, v)
+}
+
+type subscriber struct {
+	name string
+	f    func(appengine.Context, *Event) error
+}
+
+var events struct {
+	sync.RWMutex
+	m     map[string][]*subscriber // by topic
+	names map[string]bool
+}
+
+// Subscribe registers f to be called for each event published on topic.
+// The name identifies the subscriber and must be unique across all
+// calls to Subscribe.
+//
+// Each subscriber receives each event in its own task (see Publish),
+// which is retried if f returns an error, so f should be idempotent.
+func Subscribe(topic, name string, f func(ctxt appengine.Context, e *Event) error) {
+	events.Lock()
+	defer events.Unlock()
+	if events.m == nil {
+		events.m = make(map[string][]*subscriber)
+		events.names = make(map[string]bool)
+	}
+	if events.names[name] {
+		panic("app.Subscribe: multiple registrations for " + name)
+	}
+	events.names[name] = true
+	events.m[topic] = append(events.m[topic], &subscriber{name, f})
+}
+
+// eventArgs are the arguments to the app.event task.
+type eventArgs struct {
+	Subscriber string
+	Event      Event
+}
+
+var eventRetry = &taskqueue.RetryOptions{
+	RetryLimit: 10,
+	MinBackoff: 10 * time.Second,
+	MaxBackoff: 1 * time.Hour,
+}
+
+func init() {
+	JSONTaskFunc("app.event", deliverEvent, "default", eventRetry)
+}
+
+// Publish publishes an event on topic about key, with the value v,
+// which must be encodable as JSON. It creates one task per subscriber
+// to deliver the event, so delivery happens after the current request,
+// and a failing subscriber does not hold up the others.
+//
+// Publish should be called after the change being announced has been
+// committed, not inside a transaction: each task uses a transaction group.
+func Publish(ctxt appengine.Context, topic, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("app.Publish %s %s: %v", topic, key, err)
+	}
+	e := Event{Topic: topic, Key: key, Time: timeNow(), Data: data}
+
+	events.RLock()
+	subs := events.m[topic]
+	events.RUnlock()
+
+	var last error
+	for _, s := range subs {
+		name := fmt.Sprintf("app.event.%s.%s.%d", s.name, key, e.Time.UnixNano())
+		if err := Task(ctxt, name, "app.event", eventArgs{s.name, e}); err != nil {
+			last = err // already logged
+		}
+	}
+	return last
+}
+
+func deliverEvent(ctxt appengine.Context, args eventArgs) error {
+	events.RLock()
+	var f func(appengine.Context, *Event) error
+	for _, s := range events.m[args.Event.Topic] {
+		if s.name == args.Subscriber {
+			f = s.f
+		}
+	}
+	events.RUnlock()
+	if f == nil {
+		ctxt.Errorf("event %s %s: no subscriber %s", args.Event.Topic, args.Event.Key, args.Subscriber)
+		return nil
+	}
+	return f(ctxt, &args.Event)
+}
+
+func init() {
+	RegisterStatus("events", eventStatus)
+}
+
+func eventStatus(ctxt appengine.Context) string {
+	events.RLock()
+	var topics []string
+	for topic := range events.m {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	w := new(bytes.Buffer)
+	for _, topic := range topics {
+		fmt.Fprintf(w, "%s:", topic)
+		for _, sub := range events.m[topic] {
+			fmt.Fprintf(w, " %s", sub.name)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	events.RUnlock()
+	return "<pre>" + html.EscapeString(w.String()) + "</pre>"
+}
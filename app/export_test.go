@@ -0,0 +1,59 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/taskqueue"
+)
+
+// Exported for the tests in package app_test.
+
+func RunCron(ctxt appengine.Context) {
+	req, _ := http.NewRequest("GET", "/admin/app/cron", nil)
+	cronHandler(ctxt, httptest.NewRecorder(), req)
+}
+
+func RunScan(ctxt appengine.Context, name string, q *datastore.Query) error {
+	return scanData(ctxt, name, time.Minute, q, nil)
+}
+
+func SetScanChunk(n int) int {
+	old := scanChunk
+	scanChunk = n
+	return old
+}
+
+// RunTask runs the task t as the task queue would
+// and returns the HTTP status code of the result.
+func RunTask(ctxt appengine.Context, t *taskqueue.Task) int {
+	req, _ := http.NewRequest(t.Method, t.Path, bytes.NewReader(t.Payload))
+	req.Header = t.Header
+	w := httptest.NewRecorder()
+	taskpost(ctxt, w, req)
+	return w.Code
+}
+
+func BuildSchema() *Schema {
+	return buildSchema()
+}
+
+func StampVersion(ctxt appengine.Context) error {
+	return stampVersion(ctxt)
+}
+
+func DecodeCached(value []byte, data interface{}) bool {
+	return decodeCached(value, data)
+}
+
+func ClearDataGuard() {
+	clearDataGuard()
+}
@@ -0,0 +1,108 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"appengine"
+	"appengine/urlfetch"
+)
+
+var testTransport http.RoundTripper
+
+// Client returns the HTTP client that loaders should use to fetch
+// from other servers. It uses urlfetch unless a test has installed
+// a transport using SetTransport. Each request made with the client
+// is charged to the named module's quota (see RegisterQuota) and
+// subject to the fetch policy (see SecureTransport) and to the
+// circuit breaker for its host (see breaker.go).
+func Client(ctxt appengine.Context, module string) *http.Client {
+	rt := testTransport
+	if rt == nil {
+		rt = &urlfetch.Transport{Context: ctxt}
+	}
+	return &http.Client{Transport: SecureTransport(ctxt, module, &quotaTransport{ctxt, module, rt})}
+}
+
+// SetTransport makes Client use t and returns the previously installed transport.
+// It is meant for tests (see apptest.Replay); a nil t restores urlfetch.
+// It also closes all circuit breakers, since their state describes the
+// hosts as reached through the old transport.
+func SetTransport(t http.RoundTripper) http.RoundTripper {
+	old := testTransport
+	testTransport = t
+	resetBreakers()
+	return old
+}
+
+// Fetch policy.
+//
+// The loaders fetch with credentials and store what they fetch, so all
+// their requests must use https, including requests for URLs built from
+// fetched content and requests that follow redirects. An http request
+// for one of the secureHosts, which are known to serve https, is
+// rewritten to use https; any other non-https request is refused with
+// ErrInsecureFetch. Both are logged, since either way the URL that
+// caused it needs fixing.
+
+// secureHosts lists the hosts whose http URLs are rewritten to https.
+var secureHosts = map[string]bool{
+	"accounts.google.com":    true,
+	"code.google.com":        true,
+	"codereview.appspot.com": true,
+	"go.googlesource.com":    true,
+	"golang.org":             true,
+	"www.google.com":         true,
+}
+
+// ErrInsecureFetch is the error for a request refused by the fetch policy.
+var ErrInsecureFetch = errors.New("refusing to fetch non-https URL")
+
+// SecureTransport returns a transport that applies the fetch policy
+// and the circuit breakers to requests made by the named module before
+// passing them to rt. Client applies it already; code that must build its
+// own transport, for example to add OAuth credentials, should wrap it with
+// SecureTransport.
+func SecureTransport(ctxt appengine.Context, module string, rt http.RoundTripper) http.RoundTripper {
+	return &policyTransport{ctxt, module, &breakerTransport{ctxt, module, rt}}
+}
+
+type policyTransport struct {
+	ctxt   appengine.Context
+	module string
+	rt     http.RoundTripper
+}
+
+func (t *policyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch req.URL.Scheme {
+	case "https":
+		return t.rt.RoundTrip(req)
+	case "http":
+		host := strings.ToLower(req.URL.Host)
+		if h, port, err := net.SplitHostPort(host); err == nil && port == "80" {
+			host = h
+		}
+		if secureHosts[host] {
+			t.ctxt.Warningf("fetch policy: %s: rewriting %s to https", t.module, req.URL)
+			u := *req.URL
+			u.Scheme = "https"
+			u.Host = host
+			r := new(http.Request)
+			*r = *req
+			r.URL = &u
+			r.Host = ""
+			return t.rt.RoundTrip(r)
+		}
+	}
+	t.ctxt.Errorf("fetch policy: %s: refusing %s", t.module, req.URL)
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	return nil, ErrInsecureFetch
+}
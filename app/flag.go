@@ -0,0 +1,169 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"sync"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+)
+
+// A FlagVar is a feature flag registered with Flag.
+type FlagVar struct {
+	Name    string
+	Default bool
+}
+
+var flags struct {
+	sync.RWMutex
+	m map[string]*FlagVar
+}
+
+// Flag registers a feature flag with the given name and default value.
+// Flags gate risky behaviors, like bots that mail or post on behalf of the app,
+// so that those behaviors can be turned off in production without redeploying.
+// Flags are listed and toggled on /admin/app/flags.
+//
+// Flag is meant to be called during initialization, as in:
+//
+//	var summaryFlag = app.Flag("dash.summary", true)
+//
+// and then the flag consulted with summaryFlag.On(ctxt).
+func Flag(name string, def bool) *FlagVar {
+	flags.Lock()
+	defer flags.Unlock()
+	if flags.m == nil {
+		flags.m = make(map[string]*FlagVar)
+	}
+	if flags.m[name] != nil {
+		panic("app.Flag: multiple registrations for " + name)
+	}
+	f := &FlagVar{name, def}
+	flags.m[name] = f
+	return f
+}
+
+// On reports whether the flag is turned on.
+// The value is stored as the meta value "flag.<name>" and consulted through memcache
+// (see ReadMetaCached); if the flag has never been set, On returns its default.
+func (f *FlagVar) On(ctxt appengine.Context) bool {
+	on := f.Default
+	ReadMetaCached(ctxt, "flag."+f.Name, &on)
+	return on
+}
+
+// Set sets the flag. WriteMeta clears the memcache entry,
+// so the new value takes effect immediately.
+func (f *FlagVar) Set(ctxt appengine.Context, on bool) error {
+	return WriteMeta(ctxt, "flag."+f.Name, on)
+}
+
+// Reset clears the flag, restoring its default value.
+func (f *FlagVar) Reset(ctxt appengine.Context) error {
+	if err := DeleteMeta(ctxt, "flag."+f.Name); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	return nil
+}
+
+func init() {
+	Handle("/admin/app/flags", flagsPage)
+}
+
+var flagsTemplate = template.Must(template.New("flags").Parse(`<html>
+<head><title>Flags</title></head>
+<body>
+<h1>Flags</h1>
+{{if .Error}}<p><b>{{.Error}}</b></p>{{end}}
+<table>
+<tr><th>flag<th>value<th>default<th>
+{{range .Flags}}
+<tr><td>{{.Name}}<td>{{if .On}}<b>on</b>{{else}}<b>off</b>{{end}}<td>{{if .Default}}on{{else}}off{{end}}<td>
+	<form method="post">
+	<input type="hidden" name="xsrf" value="{{$.XSRF}}">
+	<input type="hidden" name="flag" value="{{.Name}}">
+	<input type="submit" name="op" value="{{if .On}}off{{else}}on{{end}}">
+	<input type="submit" name="op" value="default">
+	</form>
+{{end}}
+</table>
+</body>
+</html>
+`))
+
+type flagsByName []*FlagVar
+
+func (x flagsByName) Len() int           { return len(x) }
+func (x flagsByName) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+func (x flagsByName) Less(i, j int) bool { return x[i].Name < x[j].Name }
+
+func flagsPage(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	u := user.Current(ctxt)
+	if u == nil {
+		http.Error(w, "must be logged in", 403)
+		return
+	}
+
+	var list []*FlagVar
+	flags.RLock()
+	for _, f := range flags.m {
+		list = append(list, f)
+	}
+	flags.RUnlock()
+	sort.Sort(flagsByName(list))
+
+	var data struct {
+		Flags []struct {
+			*FlagVar
+			On bool
+		}
+		XSRF  string
+		Error string
+	}
+
+	if req.Method == "POST" {
+		flags.RLock()
+		f := flags.m[req.FormValue("flag")]
+		flags.RUnlock()
+		var err error
+		switch {
+		case !ValidXSRFToken(ctxt, req.FormValue("xsrf"), u.Email, "flags"):
+			data.Error = "invalid XSRF token; reload and try again"
+		case f == nil:
+			data.Error = "unknown flag"
+		case req.FormValue("op") == "on":
+			err = f.Set(ctxt, true)
+		case req.FormValue("op") == "off":
+			err = f.Set(ctxt, false)
+		case req.FormValue("op") == "default":
+			err = f.Reset(ctxt)
+		default:
+			data.Error = "unknown op"
+		}
+		if err != nil {
+			data.Error = err.Error()
+		}
+		if data.Error == "" {
+			ctxt.Infof("flag %s set %s by %s", f.Name, req.FormValue("op"), u.Email)
+		}
+	}
+
+	for _, f := range list {
+		data.Flags = append(data.Flags, struct {
+			*FlagVar
+			On bool
+		}{f, f.On(ctxt)})
+	}
+	data.XSRF = XSRFToken(ctxt, u.Email, "flags")
+
+	if err := flagsTemplate.Execute(w, data); err != nil {
+		ctxt.Errorf("execute: %v", err)
+	}
+}
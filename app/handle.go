@@ -0,0 +1,62 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"appengine"
+
+	"github.com/rsc/appstats"
+)
+
+// slowRequest is how long a request can take before Handle logs it as slow.
+const slowRequest = 10 * time.Second
+
+// Handle registers f to serve requests for the given pattern, as http.Handle does.
+// Every request is profiled by appstats and logged with its duration.
+// If f panics, Handle logs the panic and its stack trace and serves
+// a 500 error, so that a broken page does not show up only as a
+// terse runtime error in the logs.
+//
+// Handlers for patterns beginning with /admin/ serve only operators;
+// others serve anyone. Use HandleRole to require a different role.
+//
+// All handlers in the app should be registered with Handle or HandleRole.
+func Handle(pattern string, f func(ctxt appengine.Context, w http.ResponseWriter, req *http.Request)) {
+	r := Viewer
+	if strings.HasPrefix(pattern, "/admin/") {
+		r = Operator
+	}
+	HandleRole(pattern, r, f)
+}
+
+// HandleRole is like Handle but serves only users with at least the role r.
+// See the Roles comment in role.go.
+func HandleRole(pattern string, r Role, f func(ctxt appengine.Context, w http.ResponseWriter, req *http.Request)) {
+	http.Handle(pattern, appstats.NewHandler(func(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		defer func() {
+			if err := recover(); err != nil {
+				ctxt.Criticalf("%s %s: panic: %v\n%s", req.Method, req.URL, err, debug.Stack())
+				http.Error(w, "internal server error", 500)
+			}
+			if d := time.Since(start); d > slowRequest {
+				ctxt.Warningf("%s %s: slow request took %v", req.Method, req.URL.Path, d)
+			} else {
+				ctxt.Debugf("%s %s took %v", req.Method, req.URL.Path, d)
+			}
+		}()
+		if !checkRole(ctxt, w, req, r) {
+			return
+		}
+		qctxt, flush := withQuotaTally(ctxt)
+		defer flush()
+		f(qctxt, w, req)
+	}))
+}
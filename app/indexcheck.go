@@ -0,0 +1,117 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"sort"
+	"sync"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Index validation.
+//
+// A query that needs a composite index missing from index.yaml fails
+// when it runs, and a scan or status function that logs the failure
+// and carries on looks just like one that found nothing. To catch
+// missing indexes early, the queries registered with ScanData and
+// RegisterQuery are probed with a limit-1 query whenever an instance
+// warms up and whenever the app.checkindexes op runs. The result of
+// the last probe is stored as the meta value "app.indexcheck" and
+// listed in the "indexes" section of the status page.
+
+var queries struct {
+	sync.RWMutex
+	m map[string]*datastore.Query
+}
+
+// RegisterQuery registers q, a query the app runs, to be checked
+// for a satisfiable index. ScanData registers its queries itself;
+// other code, such as status functions, should register queries
+// that filter or sort on more than one property.
+func RegisterQuery(name string, q *datastore.Query) {
+	queries.Lock()
+	defer queries.Unlock()
+	if queries.m == nil {
+		queries.m = make(map[string]*datastore.Query)
+	}
+	if queries.m[name] != nil {
+		panic("app.RegisterQuery: multiple registrations for " + name)
+	}
+	queries.m[name] = q
+}
+
+// An indexCheck is the result of probing the registered queries.
+type indexCheck struct {
+	Time    time.Time
+	Checked int
+	Failed  []indexFailure
+}
+
+// An indexFailure records a registered query that failed its probe.
+type indexFailure struct {
+	Query string
+	Error string
+}
+
+func init() {
+	RegisterWarmup("app.indexcheck", func(ctxt appengine.Context) error {
+		_, err := checkIndexes(ctxt)
+		return err
+	})
+	RegisterStatus("indexes", indexStatus)
+	RegisterOp("app.checkindexes", "Probe every registered query for a missing datastore index.", nil, func(ctxt appengine.Context, args map[string]string) (string, error) {
+		c, err := checkIndexes(ctxt)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("checked %d queries, %d failed", c.Checked, len(c.Failed)), nil
+	})
+}
+
+// checkIndexes probes every registered query and records the result.
+func checkIndexes(ctxt appengine.Context) (*indexCheck, error) {
+	queries.RLock()
+	var names []string
+	for name := range queries.m {
+		names = append(names, name)
+	}
+	queries.RUnlock()
+	sort.Strings(names)
+
+	c := &indexCheck{Time: timeNow()}
+	for _, name := range names {
+		queries.RLock()
+		q := queries.m[name]
+		queries.RUnlock()
+		c.Checked++
+		if _, _, err := store.Keys(ctxt, q, "", 1); err != nil {
+			ctxt.Criticalf("query %s: %v", name, err)
+			c.Failed = append(c.Failed, indexFailure{name, err.Error()})
+		}
+	}
+	if err := WriteMeta(ctxt, "app.indexcheck", c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func indexStatus(ctxt appengine.Context) string {
+	var c indexCheck
+	if err := ReadMeta(ctxt, "app.indexcheck", &c); err != nil {
+		return "<pre>not checked yet; run the app.checkindexes op</pre>"
+	}
+	w := new(bytes.Buffer)
+	fmt.Fprintf(w, "%d queries checked at %s, %d failed\n", c.Checked, c.Time.Format("2006-01-02 15:04:05"), len(c.Failed))
+	for _, f := range c.Failed {
+		fmt.Fprintf(w, "%s: %s\n", f.Query, f.Error)
+	}
+	return "<pre>" + html.EscapeString(w.String()) + "</pre>"
+}
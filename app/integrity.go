@@ -0,0 +1,245 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"sort"
+	"sync"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+type check struct {
+	q *datastore.Query
+	f func(ctxt appengine.Context, kind, key string) (string, error)
+}
+
+var checks struct {
+	sync.RWMutex
+	m map[string]*check
+}
+
+// RegisterCheck registers a data integrity check.
+// Once a day the app.integrity cron job walks the keys matched by q,
+// calling f for each. If f finds a problem with the record, it returns
+// a short description of it; otherwise it returns an empty string.
+// If f returns datastore.ErrNoSuchEntity, as for a record deleted since
+// the keys were listed, the record is skipped. Other errors stop the run,
+// which is retried from the same point.
+//
+// The results are saved as an IntegrityReport record named for the check,
+// and the counts and a sample of the bad keys are served in the
+// "integrity" section on /admin/app/status, for manual repair.
+func RegisterCheck(name string, q *datastore.Query, f func(ctxt appengine.Context, kind, key string) (string, error)) {
+	checks.Lock()
+	defer checks.Unlock()
+	if checks.m == nil {
+		checks.m = make(map[string]*check)
+	}
+	if checks.m[name] != nil {
+		panic("app.RegisterCheck: multiple registrations for " + name)
+	}
+	checks.m[name] = &check{q, f}
+}
+
+// An IntegrityReport records the progress and result of one integrity check.
+type IntegrityReport struct {
+	Name    string
+	Start   time.Time // start of the latest pass
+	Cursor  string    // where to continue the latest pass, if still running
+	Checked int64     // records checked so far in the latest pass
+	Bad     int64     // problems found so far in the latest pass
+	Samples []string  `datastore:",noindex"` // sample problems found so far
+
+	// Results of the last complete pass.
+	Time        time.Time
+	LastChecked int64
+	LastBad     int64
+	LastSamples []string `datastore:",noindex"`
+}
+
+const (
+	checkChunk   = 100 // records to check in a single cron run
+	checkSamples = 20  // problems to keep in a report
+)
+
+func init() {
+	Cron("app.integrity", 24*time.Hour, runChecks)
+	RegisterStatus("integrity", integrityStatus)
+}
+
+func checkNames() []string {
+	checks.RLock()
+	defer checks.RUnlock()
+	var names []string
+	for name := range checks.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// runChecks runs the registered checks, a chunk at a time.
+// It returns ErrMoreCron until every check has made a complete pass.
+func runChecks(ctxt appengine.Context) error {
+	more := false
+	for _, name := range checkNames() {
+		checks.RLock()
+		c := checks.m[name]
+		checks.RUnlock()
+
+		var r IntegrityReport
+		if err := ReadData(ctxt, "IntegrityReport", name, &r); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if r.Cursor == "" && timeNow().Sub(r.Time) < 20*time.Hour {
+			continue
+		}
+		if r.Cursor == "" {
+			r = IntegrityReport{
+				Name:        name,
+				Start:       timeNow(),
+				Time:        r.Time,
+				LastChecked: r.LastChecked,
+				LastBad:     r.LastBad,
+				LastSamples: r.LastSamples,
+			}
+		}
+
+		q := c.q.KeysOnly().Limit(checkChunk)
+		if r.Cursor != "" {
+			cursor, err := datastore.DecodeCursor(r.Cursor)
+			if err != nil {
+				ctxt.Errorf("check %s: bad cursor: %v", name, err)
+				r.Cursor = ""
+				WriteData(ctxt, "IntegrityReport", name, &r)
+				more = true
+				continue
+			}
+			q = q.Start(cursor)
+		}
+		n := 0
+		it := q.Run(ctxt)
+		for {
+			k, err := it.Next(nil)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("check %s: %v", name, err)
+			}
+			n++
+			problem, err := c.f(ctxt, k.Kind(), k.StringID())
+			if err == datastore.ErrNoSuchEntity {
+				continue
+			}
+			r.Checked++
+			if err != nil {
+				return fmt.Errorf("check %s: %s[%s]: %v", name, k.Kind(), k.StringID(), err)
+			}
+			if problem != "" {
+				r.Bad++
+				if len(r.Samples) < checkSamples {
+					r.Samples = append(r.Samples, fmt.Sprintf("%s[%s]: %s", k.Kind(), k.StringID(), problem))
+				}
+			}
+		}
+
+		if n == checkChunk {
+			cursor, err := it.Cursor()
+			if err != nil {
+				return fmt.Errorf("check %s: %v", name, err)
+			}
+			r.Cursor = cursor.String()
+			more = true
+		} else {
+			r.Cursor = ""
+			r.Time = timeNow()
+			r.LastChecked = r.Checked
+			r.LastBad = r.Bad
+			r.LastSamples = r.Samples
+			if r.Bad > 0 {
+				ctxt.Errorf("check %s: %d problems in %d records", name, r.Bad, r.Checked)
+			}
+		}
+		if err := WriteData(ctxt, "IntegrityReport", name, &r); err != nil {
+			return err
+		}
+	}
+	if more {
+		return ErrMoreCron
+	}
+	return nil
+}
+
+// DataExistsMulti reports whether there are records with the given kind
+// and keys, using a single batched get that discards the records' contents.
+func DataExistsMulti(ctxt appengine.Context, kind string, keys []string) ([]bool, error) {
+	ok := make([]bool, len(keys))
+	if len(keys) == 0 {
+		return ok, nil
+	}
+	dkeys := make([]*datastore.Key, len(keys))
+	for i, key := range keys {
+		dkeys[i] = datastore.NewKey(ctxt, kind, key, 0, nil)
+	}
+	chargeQuota(ctxt, kindModule(kind), opRead, int64(len(keys)))
+	err := datastore.GetMulti(ctxt, dkeys, make([]discard, len(keys)))
+	me, _ := err.(appengine.MultiError)
+	if err != nil && me == nil {
+		return nil, err
+	}
+	for i := range keys {
+		switch {
+		case me == nil || me[i] == nil:
+			ok[i] = true
+		case me[i] != datastore.ErrNoSuchEntity:
+			return nil, me[i]
+		}
+	}
+	return ok, nil
+}
+
+// discard is a datastore entity that ignores its properties.
+type discard struct{}
+
+func (discard) Load(c <-chan datastore.Property) error {
+	for _ = range c {
+	}
+	return nil
+}
+
+func (discard) Save(c chan<- datastore.Property) error {
+	close(c)
+	return nil
+}
+
+func integrityStatus(ctxt appengine.Context) string {
+	w := new(bytes.Buffer)
+	for _, name := range checkNames() {
+		var r IntegrityReport
+		if err := ReadData(ctxt, "IntegrityReport", name, &r); err != nil {
+			fmt.Fprintf(w, "%s: not yet run\n", name)
+			continue
+		}
+		if r.Time.IsZero() {
+			fmt.Fprintf(w, "%s: first pass in progress\n", name)
+		} else {
+			fmt.Fprintf(w, "%s: %d problems in %d records at %v\n", name, r.LastBad, r.LastChecked, r.Time)
+			for _, s := range r.LastSamples {
+				fmt.Fprintf(w, "\t%s\n", s)
+			}
+		}
+		if r.Cursor != "" {
+			fmt.Fprintf(w, "\tpass in progress since %v: %d problems in %d records so far\n", r.Start, r.Bad, r.Checked)
+		}
+	}
+	return "<pre>" + html.EscapeString(w.String()) + "</pre>"
+}
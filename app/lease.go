@@ -11,8 +11,6 @@ import (
 
 	"appengine"
 	"appengine/datastore"
-
-	"github.com/rsc/appstats"
 )
 
 var errLocked = errors.New("locked")
@@ -24,7 +22,7 @@ var errLocked = errors.New("locked")
 // If successful, no other call to Lock will succeed until the duration dt has elapsed
 // or Unlock has been called with the same name.
 func Lock(ctxt appengine.Context, name string, dt time.Duration) bool {
-	now := time.Now()
+	now := timeNow()
 	err := Transaction(ctxt, func(ctxt appengine.Context) error {
 		var t time.Time
 		if err := ReadMeta(ctxt, "Lock:"+name, &t); err != nil && err != datastore.ErrNoSuchEntity {
@@ -51,5 +49,5 @@ func breaklock(ctxt appengine.Context, w http.ResponseWriter, req *http.Request)
 }
 
 func init() {
-	http.Handle("/admin/app/breaklock", appstats.NewHandler(breaklock))
+	HandleRole("/admin/app/breaklock", Operator, breaklock)
 }
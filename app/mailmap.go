@@ -0,0 +1,177 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+
+	"appengine"
+)
+
+// A Mailmap maps the names and email addresses people have used
+// to a single canonical name and address, like git's .mailmap file.
+type Mailmap struct {
+	entries []mailmapEntry
+}
+
+type mailmapEntry struct {
+	properName  string
+	properEmail string
+	commitName  string
+	commitEmail string
+}
+
+// ParseMailmap parses the text of a mailmap.
+// Each line has one of the forms understood by git:
+//
+//	Proper Name <commit@email>
+//	<proper@email> <commit@email>
+//	Proper Name <proper@email> <commit@email>
+//	Proper Name <proper@email> Commit Name <commit@email>
+//
+// Blank lines and text following a # are ignored.
+func ParseMailmap(text string) (*Mailmap, error) {
+	m := new(Mailmap)
+	for i, line := range strings.Split(text, "\n") {
+		if j := strings.Index(line, "#"); j >= 0 {
+			line = line[:j]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		var names, emails []string
+		for line != "" {
+			j := strings.Index(line, "<")
+			k := strings.Index(line, ">")
+			if j < 0 || k < j {
+				return nil, fmt.Errorf("mailmap line %d: malformed address", i+1)
+			}
+			names = append(names, strings.TrimSpace(line[:j]))
+			emails = append(emails, strings.ToLower(strings.TrimSpace(line[j+1:k])))
+			line = strings.TrimSpace(line[k+1:])
+		}
+		var e mailmapEntry
+		switch len(emails) {
+		case 1:
+			e = mailmapEntry{properName: names[0], commitEmail: emails[0]}
+		case 2:
+			e = mailmapEntry{properName: names[0], properEmail: emails[0], commitName: names[1], commitEmail: emails[1]}
+		default:
+			return nil, fmt.Errorf("mailmap line %d: too many addresses", i+1)
+		}
+		m.entries = append(m.entries, e)
+	}
+	return m, nil
+}
+
+// Lookup returns the canonical name and email for the given name and email.
+// If the mailmap has no entry for the address, Lookup returns its arguments unchanged.
+// Entries that also name the commit name take precedence over those that do not.
+func (m *Mailmap) Lookup(name, email string) (string, string) {
+	if m == nil {
+		return name, email
+	}
+	lower := strings.ToLower(email)
+	var match *mailmapEntry
+	for i := range m.entries {
+		e := &m.entries[i]
+		if e.commitEmail != lower {
+			continue
+		}
+		if e.commitName != "" {
+			if e.commitName != name {
+				continue
+			}
+			match = e
+			break
+		}
+		if match == nil {
+			match = e
+		}
+	}
+	if match == nil {
+		return name, email
+	}
+	if match.properName != "" {
+		name = match.properName
+	}
+	if match.properEmail != "" {
+		email = match.properEmail
+	}
+	return name, email
+}
+
+// ReadMailmap returns the mailmap stored in the datastore,
+// which is edited at /admin/app/mailmap.
+// If no mailmap has been stored, ReadMailmap returns an empty mailmap.
+// ReadMailmap consults memcache, so it should not be used within a transaction.
+func ReadMailmap(ctxt appengine.Context) *Mailmap {
+	var text string
+	ReadMetaCached(ctxt, "app.mailmap", &text)
+	m, err := ParseMailmap(text)
+	if err != nil {
+		ctxt.Errorf("reading mailmap: %v", err)
+		return new(Mailmap)
+	}
+	return m
+}
+
+// CanonicalAuthor returns the canonical name and email for an author,
+// according to the stored mailmap.
+func CanonicalAuthor(ctxt appengine.Context, name, email string) (string, string) {
+	return ReadMailmap(ctxt).Lookup(name, email)
+}
+
+// CanonicalEmail returns the canonical email address for email,
+// according to the stored mailmap.
+func CanonicalEmail(ctxt appengine.Context, email string) string {
+	_, email = CanonicalAuthor(ctxt, "", email)
+	return email
+}
+
+func init() {
+	Handle("/admin/app/mailmap", mailmapedit)
+}
+
+var mailmapForm = `<html>
+<h1>mailmap edit</h1>
+
+<p>One entry per line, in git .mailmap format:
+<pre>
+Proper Name &lt;commit@email&gt;
+&lt;proper@email&gt; &lt;commit@email&gt;
+Proper Name &lt;proper@email&gt; Commit Name &lt;commit@email&gt;
+</pre>
+
+%s
+<form method="post">
+<textarea name="value" cols=100 rows=40>%s</textarea>
+<br>
+<input type="submit" value="Write">
+</form>
+`
+
+func mailmapedit(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	var text string
+	ReadMeta(ctxt, "app.mailmap", &text)
+
+	msg := ""
+	if req.Method == "POST" {
+		text = req.FormValue("value")
+		if _, err := ParseMailmap(text); err != nil {
+			msg = fmt.Sprintf("<p>not saved: %s</p>", html.EscapeString(err.Error()))
+		} else if err := WriteMeta(ctxt, "app.mailmap", text); err != nil {
+			msg = fmt.Sprintf("<p>failed to write: %s</p>", html.EscapeString(err.Error()))
+		} else {
+			msg = "<p>saved</p>"
+		}
+	}
+
+	fmt.Fprintf(w, mailmapForm, msg, html.EscapeString(text))
+}
@@ -13,8 +13,6 @@ import (
 
 	"appengine"
 	"appengine/memcache"
-
-	"github.com/rsc/appstats"
 )
 
 type meta struct {
@@ -97,7 +95,7 @@ func DeleteMeta(ctxt appengine.Context, key string) error {
 }
 
 func init() {
-	http.Handle("/admin/app/metaedit", appstats.NewHandler(metaedit))
+	Handle("/admin/app/metaedit", metaedit)
 }
 
 var editForm = `<html>
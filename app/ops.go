@@ -0,0 +1,217 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+)
+
+// An op is a recovery action listed on the runbook page, /admin/app/ops.
+type op struct {
+	Name string
+	Doc  string
+	Args []string
+	f    func(ctxt appengine.Context, args map[string]string) (string, error)
+}
+
+var ops struct {
+	sync.RWMutex
+	m map[string]*op
+}
+
+// RegisterOp adds an operation to the runbook page, /admin/app/ops.
+// The page offers a form for each operation, with a text field for each
+// of the named arguments. Running an operation takes two steps:
+// the first shows what is about to happen and a confirmation button
+// carrying a token valid only for that operation and those arguments;
+// the second runs f. Every run is logged, along with its result,
+// and the most recent runs are listed on the page.
+func RegisterOp(name, doc string, args []string, f func(ctxt appengine.Context, args map[string]string) (string, error)) {
+	ops.Lock()
+	defer ops.Unlock()
+	if ops.m == nil {
+		ops.m = make(map[string]*op)
+	}
+	if ops.m[name] != nil {
+		panic("app.RegisterOp: multiple registrations for " + name)
+	}
+	ops.m[name] = &op{name, doc, args, f}
+}
+
+// An OpRun records a single run of an operation from the runbook page.
+type OpRun struct {
+	Time   time.Time
+	User   string
+	Op     string
+	Args   string `datastore:",noindex"`
+	Result string `datastore:",noindex"`
+	Error  string `datastore:",noindex"`
+}
+
+func init() {
+	Handle("/admin/app/ops", opsPage)
+
+	RegisterOp("app.cron", "Run the named cron job now, instead of waiting for its next period.", []string{"name"}, runCron)
+	RegisterOp("app.breaklock", "Break the named lock, held by a task that has died.", []string{"name"}, func(ctxt appengine.Context, args map[string]string) (string, error) {
+		Unlock(ctxt, args["name"])
+		return "unlocked " + args["name"], nil
+	})
+	RegisterOp("app.update", "Start the background data updater.", nil, func(ctxt appengine.Context, args map[string]string) (string, error) {
+		backgroundUpdate(ctxt)
+		return "started", nil
+	})
+}
+
+func runCron(ctxt appengine.Context, args map[string]string) (string, error) {
+	name := args["name"]
+	cron.RLock()
+	list := cron.list
+	cron.RUnlock()
+	for _, cr := range list {
+		if cr.name == name {
+			if err := Task(ctxt, "app.cron."+cr.name, "cron", cr.name); err != nil {
+				return "", err
+			}
+			return "queued " + name, nil
+		}
+	}
+	return "", fmt.Errorf("unknown cron job %q", name)
+}
+
+// opToken returns the confirmation token for running the named op with the given args.
+func opToken(ctxt appengine.Context, email, name string, args url.Values) string {
+	return XSRFToken(ctxt, email, "ops."+name+"?"+args.Encode())
+}
+
+var opsTemplate = template.Must(template.New("ops").Parse(`<html>
+<head><title>Operations</title></head>
+<body>
+<h1>Operations</h1>
+{{with .Confirm}}
+	<h2>Confirm</h2>
+	<form method="post">
+	<p>Run <b>{{.Op.Name}}</b>{{range $k, $v := .Args}} {{$k}}={{$v}}{{end}}?
+	<input type="hidden" name="op" value="{{.Op.Name}}">
+	{{range $k, $v := .Args}}<input type="hidden" name="arg.{{$k}}" value="{{$v}}">{{end}}
+	<input type="hidden" name="confirm" value="{{.Token}}">
+	<input type="submit" value="run">
+	</form>
+{{end}}
+{{with .Ran}}
+	<h2>Result</h2>
+	<p>{{.Op}} {{.Args}}: {{if .Error}}<b>error: {{.Error}}</b>{{else}}{{.Result}}{{end}}</p>
+{{end}}
+
+<h2>Available</h2>
+<table>
+{{range .Ops}}
+<tr><td><b>{{.Name}}</b><td>{{.Doc}}<td>
+	<form method="post">
+	<input type="hidden" name="op" value="{{.Name}}">
+	{{range .Args}}{{.}} <input type="text" name="arg.{{.}}" size="20"> {{end}}
+	<input type="submit" value="{{.Name}}...">
+	</form>
+{{end}}
+</table>
+
+<h2>Recent runs</h2>
+<table>
+<tr><th>time<th>user<th>op<th>args<th>result
+{{range .Runs}}
+<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}<td>{{.User}}<td>{{.Op}}<td>{{.Args}}<td>{{if .Error}}error: {{.Error}}{{else}}{{.Result}}{{end}}
+{{end}}
+</table>
+</body>
+</html>
+`))
+
+// An opConfirm is the confirmation step for running an op.
+type opConfirm struct {
+	Op    *op
+	Args  map[string]string
+	Token string
+}
+
+type opsByName []*op
+
+func (x opsByName) Len() int           { return len(x) }
+func (x opsByName) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+func (x opsByName) Less(i, j int) bool { return x[i].Name < x[j].Name }
+
+func opsPage(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	u := user.Current(ctxt)
+	if u == nil {
+		http.Error(w, "must be logged in", 403)
+		return
+	}
+
+	var data struct {
+		Ops     []*op
+		Confirm *opConfirm
+		Ran     *OpRun
+		Runs    []*OpRun
+	}
+	ops.RLock()
+	for _, o := range ops.m {
+		data.Ops = append(data.Ops, o)
+	}
+	ops.RUnlock()
+	sort.Sort(opsByName(data.Ops))
+
+	if req.Method == "POST" {
+		ops.RLock()
+		o := ops.m[req.FormValue("op")]
+		ops.RUnlock()
+		if o == nil {
+			http.Error(w, "unknown op", 400)
+			return
+		}
+		args := make(map[string]string)
+		form := url.Values{}
+		for _, name := range o.Args {
+			args[name] = req.FormValue("arg." + name)
+			form.Set(name, args[name])
+		}
+		if tok := req.FormValue("confirm"); tok == "" {
+			data.Confirm = &opConfirm{o, args, opToken(ctxt, u.Email, o.Name, form)}
+		} else if !ValidXSRFToken(ctxt, tok, u.Email, "ops."+o.Name+"?"+form.Encode()) {
+			http.Error(w, "invalid confirmation token; start over", 403)
+			return
+		} else {
+			run := &OpRun{Time: time.Now(), User: u.Email, Op: o.Name, Args: form.Encode()}
+			ctxt.Infof("op %s %s by %s", o.Name, run.Args, u.Email)
+			result, err := o.f(ctxt, args)
+			run.Result = result
+			if err != nil {
+				run.Error = err.Error()
+				ctxt.Errorf("op %s %s: %v", o.Name, run.Args, err)
+			}
+			WriteData(ctxt, "OpRun", fmt.Sprintf("%d", run.Time.UnixNano()), run)
+			data.Ran = run
+		}
+	}
+
+	_, err := datastore.NewQuery("OpRun").
+		Order("-Time").
+		Limit(20).
+		GetAll(ctxt, &data.Runs)
+	if err != nil {
+		ctxt.Errorf("loading op runs: %v", err)
+	}
+
+	if err := opsTemplate.Execute(w, data); err != nil {
+		ctxt.Errorf("execute: %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"html"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+)
+
+// Idempotent bot comments.
+//
+// Tasks are retried and scans overlap, so code that posts automated
+// comments to the code review site or the issue tracker can run twice
+// for the same comment. ClaimPost and FinishPost (or PostOnce, which
+// wraps them) guard each post with a PostRecord keyed by the target,
+// the kind of comment, and a hash of its content: only the first claim
+// succeeds, and later ones are counted as suppressed duplicates,
+// which the "duplicate bot comments" status section reports.
+//
+// A claim whose post fails is released so that a retry can post.
+// A task that dies between posting and finishing leaves its claim in
+// place; the comment is then never posted again, which is the safer
+// mistake.
+
+// A PostRecord records an automated comment that was posted
+// (or is being posted). It is stored under postKey(target, kind, content).
+type PostRecord struct {
+	Target     string // "cl/1234", "issue/5678"
+	Kind       string // "mailissue", "lint", ...
+	Hash       string // hash of the content
+	Time       time.Time
+	Done       bool // post finished
+	Suppressed int  // number of duplicates suppressed
+}
+
+func postHash(content string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(content)))
+}
+
+func postKey(target, kind, content string) string {
+	return target + "/" + kind + "/" + postHash(content)
+}
+
+// postStatusQuery finds the records with suppressed duplicates, most first.
+var postStatusQuery = datastore.NewQuery("PostRecord").
+	Filter("Suppressed >", 0).
+	Order("-Suppressed")
+
+func init() {
+	RegisterStatus("duplicate bot comments", postStatus)
+	RegisterQuery("app.postonce.status", postStatusQuery)
+}
+
+// ClaimPost reports whether the caller should post the comment content
+// of the given kind to target: it returns true the first time it is called
+// for a given target, kind, and content, and false after that.
+// Callers that get true must call FinishPost once they have tried to post.
+func ClaimPost(ctxt appengine.Context, target, kind, content string) (bool, error) {
+	key := postKey(target, kind, content)
+	claimed := false
+	err := Transaction(ctxt, func(ctxt appengine.Context) error {
+		claimed = false
+		var r PostRecord
+		err := ReadData(ctxt, "PostRecord", key, &r)
+		if err == nil {
+			r.Suppressed++
+			return WriteData(ctxt, "PostRecord", key, &r)
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		claimed = true
+		r = PostRecord{
+			Target: target,
+			Kind:   kind,
+			Hash:   postHash(content),
+			Time:   time.Now(),
+		}
+		return WriteData(ctxt, "PostRecord", key, &r)
+	})
+	if err != nil {
+		return false, err
+	}
+	if !claimed {
+		ctxt.Infof("suppressed duplicate %s comment on %s", kind, target)
+		memcache.Increment(ctxt, "app.postonce.suppressed", 1, 0)
+	}
+	return claimed, nil
+}
+
+// FinishPost records the result of posting a comment claimed by ClaimPost.
+// If postErr is non-nil, the claim is released so that the comment
+// can be posted by a later attempt.
+func FinishPost(ctxt appengine.Context, target, kind, content string, postErr error) {
+	key := postKey(target, kind, content)
+	if postErr != nil {
+		DeleteData(ctxt, "PostRecord", key)
+		return
+	}
+	Transaction(ctxt, func(ctxt appengine.Context) error {
+		var r PostRecord
+		if err := ReadData(ctxt, "PostRecord", key, &r); err != nil {
+			return err
+		}
+		r.Done = true
+		return WriteData(ctxt, "PostRecord", key, &r)
+	})
+}
+
+// PostOnce calls post to post the comment content of the given kind
+// to target, unless it has been posted already (see ClaimPost).
+// It returns the error from post, or nil if the post was suppressed.
+func PostOnce(ctxt appengine.Context, target, kind, content string, post func() error) error {
+	ok, err := ClaimPost(ctxt, target, kind, content)
+	if err != nil || !ok {
+		return err
+	}
+	err = post()
+	FinishPost(ctxt, target, kind, content, err)
+	return err
+}
+
+func postStatus(ctxt appengine.Context) string {
+	w := new(bytes.Buffer)
+	n, _ := memcache.Increment(ctxt, "app.postonce.suppressed", 0, 0)
+	fmt.Fprintf(w, "%d duplicates suppressed since memcache was last flushed\n", n)
+
+	var list []*PostRecord
+	_, err := postStatusQuery.
+		Limit(20).
+		GetAll(ctxt, &list)
+	if err != nil {
+		fmt.Fprintf(w, "loading records: %v\n", err)
+	}
+	for _, r := range list {
+		state := "posted"
+		if !r.Done {
+			state = "unfinished"
+		}
+		fmt.Fprintf(w, "%s %s: %s %s, %d duplicates\n", r.Target, r.Kind, state, r.Time.Format("2006-01-02 15:04"), r.Suppressed)
+	}
+	return "<pre>" + html.EscapeString(w.String()) + "</pre>"
+}
@@ -0,0 +1,231 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Task deadlines and progress.
+//
+// App Engine kills a task that runs for 10 minutes, losing whatever it
+// was in the middle of. A task function (see TaskFunc) or cron job
+// (see Cron) can instead be given a soft deadline with SetTaskOptions
+// or SetCronOptions. The task wrapper runs the function in a goroutine,
+// logging a heartbeat line every minute or so while it runs. Once the
+// soft deadline has passed, TaskProgress(ctxt).Expired reports true;
+// the function should then save its place with Progress.Save and return
+// ErrMoreTask (ErrMoreCron for a cron job), and the wrapper queues a
+// continuation, which picks up the saved state with Progress.Load.
+// The saved state is deleted when the task finally succeeds.
+
+// TaskOptions are optional settings for a task function or cron job.
+type TaskOptions struct {
+	// SoftDeadline is how long the function may run before
+	// its Progress reports that it has expired. Zero means no deadline.
+	SoftDeadline time.Duration
+
+	// Heartbeat is the interval between log lines reporting that the
+	// function is still running. Zero means defaultHeartbeat.
+	Heartbeat time.Duration
+}
+
+// defaultHeartbeat is the heartbeat interval when TaskOptions does not set one.
+const defaultHeartbeat = 1 * time.Minute
+
+// If a task function returns ErrMoreTask, the task is queued again
+// with the same arguments, to continue from its saved progress.
+var ErrMoreTask = errors.New("task has more work to do")
+
+// SetTaskOptions sets the options for the task function registered
+// with TaskFunc or JSONTaskFunc as name.
+func SetTaskOptions(name string, opts TaskOptions) {
+	taskfuncs.Lock()
+	defer taskfuncs.Unlock()
+	tf := taskfuncs.m[name]
+	if tf == nil {
+		panic("app.SetTaskOptions: unknown task function name: " + name)
+	}
+	tf.opts = opts
+}
+
+// SetCronOptions sets the options for the cron job registered with Cron as name.
+func SetCronOptions(name string, opts TaskOptions) {
+	cron.Lock()
+	defer cron.Unlock()
+	for i := range cron.list {
+		if cron.list[i].name == name {
+			cron.list[i].opts = opts
+			return
+		}
+	}
+	panic("app.SetCronOptions: unknown cron job: " + name)
+}
+
+// A Progress tracks a running task: its soft deadline, a note to
+// include in its heartbeat, and the state it saves for a continuation.
+type Progress struct {
+	task  string
+	start time.Time
+
+	mu       sync.Mutex
+	deadline time.Time
+	note     string
+	saved    bool // progress was saved or loaded, so clear must delete it
+}
+
+var progress struct {
+	sync.Mutex
+	m map[appengine.Context]*Progress
+}
+
+// TaskProgress returns the progress of the task running with the given
+// context, which must be the one passed to the task function or cron job.
+// Outside a task, it returns a Progress that never expires and saves nothing.
+func TaskProgress(ctxt appengine.Context) *Progress {
+	progress.Lock()
+	defer progress.Unlock()
+	if p := progress.m[ctxt]; p != nil {
+		return p
+	}
+	return &Progress{start: timeNow()}
+}
+
+// startProgress records the progress of a task starting with ctxt.
+// The caller must call endProgress when the task is done.
+func startProgress(ctxt appengine.Context, task string, opts TaskOptions) *Progress {
+	p := &Progress{task: task, start: timeNow()}
+	p.setDeadline(opts.SoftDeadline)
+	progress.Lock()
+	if progress.m == nil {
+		progress.m = make(map[appengine.Context]*Progress)
+	}
+	progress.m[ctxt] = p
+	progress.Unlock()
+	return p
+}
+
+func endProgress(ctxt appengine.Context) {
+	progress.Lock()
+	delete(progress.m, ctxt)
+	progress.Unlock()
+}
+
+func (p *Progress) setDeadline(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if d > 0 {
+		p.deadline = p.start.Add(d)
+	} else {
+		p.deadline = time.Time{}
+	}
+}
+
+// Expired reports whether the task's soft deadline has passed.
+func (p *Progress) Expired() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.deadline.IsZero() && timeNow().After(p.deadline)
+}
+
+// Note sets a short description of what the task is doing,
+// which is included in its heartbeat log lines.
+func (p *Progress) Note(format string, args ...interface{}) {
+	p.mu.Lock()
+	p.note = fmt.Sprintf(format, args...)
+	p.mu.Unlock()
+}
+
+// Save saves v, the task's partial progress, for a continuation to Load.
+func (p *Progress) Save(ctxt appengine.Context, v interface{}) error {
+	if p.task == "" {
+		return nil
+	}
+	p.mu.Lock()
+	p.saved = true
+	p.mu.Unlock()
+	return WriteMeta(ctxt, "app.progress."+p.task, v)
+}
+
+// Load loads the progress saved by an earlier run of the task into v.
+// It returns datastore.ErrNoSuchEntity if there is none.
+func (p *Progress) Load(ctxt appengine.Context, v interface{}) error {
+	if p.task == "" {
+		return datastore.ErrNoSuchEntity
+	}
+	err := ReadMeta(ctxt, "app.progress."+p.task, v)
+	if err == nil {
+		p.mu.Lock()
+		p.saved = true
+		p.mu.Unlock()
+	}
+	return err
+}
+
+// clear deletes the saved progress, if this run of the task saved or loaded any.
+// Continuations find their state with Load, so a task that finishes after
+// neither saving nor loading has nothing to delete.
+func (p *Progress) clear(ctxt appengine.Context) {
+	p.mu.Lock()
+	saved := p.saved
+	p.mu.Unlock()
+	if !saved {
+		return
+	}
+	if err := DeleteMeta(ctxt, "app.progress."+p.task); err != nil && err != datastore.ErrNoSuchEntity {
+		ctxt.Errorf("clearing progress of %s: %v", p.task, err)
+	}
+}
+
+// run calls fn with args in a new goroutine and waits for it to return,
+// logging a heartbeat line every interval in the meantime.
+// A panic in fn is passed on to the caller.
+func (p *Progress) run(ctxt appengine.Context, interval time.Duration, fn reflect.Value, args []reflect.Value) []reflect.Value {
+	type result struct {
+		ret   []reflect.Value
+		panic interface{}
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				done <- result{panic: err}
+			}
+		}()
+		done <- result{ret: fn.Call(args)}
+	}()
+
+	if interval <= 0 {
+		interval = defaultHeartbeat
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	warned := false
+	for {
+		select {
+		case r := <-done:
+			if r.panic != nil {
+				panic(r.panic)
+			}
+			return r.ret
+		case <-tick.C:
+			p.mu.Lock()
+			note := p.note
+			p.mu.Unlock()
+			ctxt.Infof("task %s: still running after %v: %s", p.task, timeNow().Sub(p.start), note)
+			if p.Expired() && !warned {
+				ctxt.Warningf("task %s: soft deadline passed", p.task)
+				warned = true
+			}
+		}
+	}
+}
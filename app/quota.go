@@ -0,0 +1,347 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/mail"
+	"appengine/memcache"
+)
+
+var quotas struct {
+	sync.RWMutex
+	kinds   map[string]string
+	modules map[string]bool
+}
+
+// RegisterQuota registers module for quota tracking and charges
+// datastore operations on records of the given kinds to it.
+//
+// Quota usage is counted per module: ReadData, WriteData and DeleteData
+// charge the module owning the record kind, and Client charges the module
+// named by its caller. Records of kinds no module has claimed, such as Meta,
+// are charged to "app".
+//
+// The counts accumulate in memcache, one counter per module, operation
+// and hour. A request served by a Handle handler adds up its own counts
+// and adds them to the counters once, when it finishes, rather than
+// making a memcache call per operation. The hourly app.quota cron job
+// copies the previous hour's
+// counts into a QuotaUsage record. Because the counters live in memcache,
+// an eviction can lose some counts; the totals are a lower bound.
+//
+// If a module's usage for the current day exceeds the budget set in the
+// "app.quota" config, the app logs an error and mails the app's admins,
+// once per module per day. For example:
+//
+//	{"Budgets": {"codereview": {"Reads": 200000, "Writes": 50000, "Fetches": 20000}}}
+//
+// The usage for the current day is served in the "quota" section
+// on /admin/app/status.
+func RegisterQuota(module string, kinds ...string) {
+	quotas.Lock()
+	defer quotas.Unlock()
+	if quotas.kinds == nil {
+		quotas.kinds = make(map[string]string)
+		quotas.modules = map[string]bool{"app": true}
+	}
+	for _, kind := range kinds {
+		if old := quotas.kinds[kind]; old != "" {
+			panic("app.RegisterQuota: kind " + kind + " registered to both " + old + " and " + module)
+		}
+		quotas.kinds[kind] = module
+	}
+	quotas.modules[module] = true
+}
+
+func kindModule(kind string) string {
+	quotas.RLock()
+	defer quotas.RUnlock()
+	if m := quotas.kinds[kind]; m != "" {
+		return m
+	}
+	return "app"
+}
+
+func quotaModules() []string {
+	quotas.RLock()
+	defer quotas.RUnlock()
+	names := []string{"app"}
+	for name := range quotas.modules {
+		if name != "app" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+// Usage is a count of quota-consuming operations.
+type Usage struct {
+	Reads   int64 // datastore reads
+	Writes  int64 // datastore writes and deletes
+	Fetches int64 // outbound HTTP requests
+}
+
+func (u *Usage) add(v Usage) {
+	u.Reads += v.Reads
+	u.Writes += v.Writes
+	u.Fetches += v.Fetches
+}
+
+// exceeds reports which of the nonzero limits in budget u exceeds.
+func (u Usage) exceeds(budget Usage) []string {
+	var over []string
+	if budget.Reads > 0 && u.Reads > budget.Reads {
+		over = append(over, fmt.Sprintf("%d reads (budget %d)", u.Reads, budget.Reads))
+	}
+	if budget.Writes > 0 && u.Writes > budget.Writes {
+		over = append(over, fmt.Sprintf("%d writes (budget %d)", u.Writes, budget.Writes))
+	}
+	if budget.Fetches > 0 && u.Fetches > budget.Fetches {
+		over = append(over, fmt.Sprintf("%d fetches (budget %d)", u.Fetches, budget.Fetches))
+	}
+	return over
+}
+
+// A QuotaUsage records the usage of each module during one hour.
+// It is stored with the hour, formatted by quotaHour, as its key.
+type QuotaUsage struct {
+	Hour    time.Time
+	Modules []ModuleUsage
+}
+
+// A ModuleUsage is one module's entry in a QuotaUsage.
+type ModuleUsage struct {
+	Module string
+	Usage
+}
+
+type quotaConfig struct {
+	Budgets map[string]Usage // daily budget by module
+}
+
+const (
+	opRead  = "read"
+	opWrite = "write"
+	opFetch = "fetch"
+)
+
+func quotaHour(t time.Time) string {
+	return t.UTC().Format("2006010215")
+}
+
+func quotaKey(hour, module, op string) string {
+	return "app.quota." + hour + "." + module + "." + op
+}
+
+// chargeQuota adds n operations of the given kind to module's count for this hour.
+func chargeQuota(ctxt appengine.Context, module, op string, n int64) {
+	key := quotaKey(quotaHour(timeNow()), module, op)
+	if t := tallyOf(ctxt); t != nil {
+		t.Lock()
+		t.counts[key] += n
+		t.Unlock()
+		return
+	}
+	// The counter must outlive the hour it counts, until the snapshot
+	// has been taken, so it is created without an expiration.
+	memcache.Increment(ctxt, key, n, 0)
+}
+
+// A quotaTally accumulates the quota charges made while serving a request.
+type quotaTally struct {
+	sync.Mutex
+	counts map[string]int64 // by quotaKey
+}
+
+// A quotaContext is the context passed to handlers registered with Handle.
+// It carries the request's quotaTally.
+type quotaContext struct {
+	appengine.Context
+	tally *quotaTally
+}
+
+// tallyOf returns the quotaTally of the request ctxt belongs to,
+// or nil if charges should go straight to memcache.
+func tallyOf(ctxt appengine.Context) *quotaTally {
+	switch c := ctxt.(type) {
+	case *quotaContext:
+		return c.tally
+	case *txContext:
+		return c.tally
+	}
+	return nil
+}
+
+// withQuotaTally returns a context that accumulates quota charges
+// and a function that adds them to the counters in memcache.
+func withQuotaTally(ctxt appengine.Context) (appengine.Context, func()) {
+	t := &quotaTally{counts: make(map[string]int64)}
+	flush := func() {
+		t.Lock()
+		counts := t.counts
+		t.counts = make(map[string]int64)
+		t.Unlock()
+		for key, n := range counts {
+			memcache.Increment(ctxt, key, n, 0)
+		}
+	}
+	return &quotaContext{ctxt, t}, flush
+}
+
+func readQuota(ctxt appengine.Context, hour, module string) Usage {
+	var u Usage
+	for _, x := range []struct {
+		op  string
+		ptr *int64
+	}{
+		{opRead, &u.Reads},
+		{opWrite, &u.Writes},
+		{opFetch, &u.Fetches},
+	} {
+		if it, err := memcache.Get(ctxt, quotaKey(hour, module, x.op)); err == nil {
+			*x.ptr, _ = strconv.ParseInt(string(it.Value), 10, 64)
+		}
+	}
+	return u
+}
+
+// quotaTransport counts the requests made by a module.
+type quotaTransport struct {
+	ctxt   appengine.Context
+	module string
+	rt     http.RoundTripper
+}
+
+func (t *quotaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	chargeQuota(t.ctxt, t.module, opFetch, 1)
+	return t.rt.RoundTrip(req)
+}
+
+func init() {
+	Cron("app.quota", 1*time.Hour, snapshotQuota)
+	RegisterStatus("quota", quotaStatus)
+}
+
+// snapshotQuota saves the previous hour's counts and checks the day's budgets.
+func snapshotQuota(ctxt appengine.Context) error {
+	now := timeNow().UTC()
+	prev := now.Add(-1 * time.Hour).Truncate(time.Hour)
+	hour := quotaHour(prev)
+
+	var q QuotaUsage
+	if err := ReadData(ctxt, "QuotaUsage", hour, &q); err == datastore.ErrNoSuchEntity {
+		q.Hour = prev
+		for _, module := range quotaModules() {
+			q.Modules = append(q.Modules, ModuleUsage{module, readQuota(ctxt, hour, module)})
+		}
+		if err := WriteData(ctxt, "QuotaUsage", hour, &q); err != nil {
+			return err
+		}
+	}
+
+	var cfg quotaConfig
+	ReadConfig(ctxt, "app.quota", &cfg)
+	if len(cfg.Budgets) == 0 {
+		return nil
+	}
+	day, err := dailyUsage(ctxt, now)
+	if err != nil {
+		return err
+	}
+	for module, budget := range cfg.Budgets {
+		over := day[module].exceeds(budget)
+		if len(over) == 0 {
+			continue
+		}
+		var alerted string
+		ReadMeta(ctxt, "app.quota.alerted."+module, &alerted)
+		today := now.Format("2006-01-02")
+		if alerted == today {
+			continue
+		}
+		ctxt.Errorf("quota: module %s over budget: %v", module, over)
+		msg := &mail.Message{
+			Sender:  fmt.Sprintf("Go dashboard <noreply@%s.appspotmail.com>", appengine.AppID(ctxt)),
+			Subject: fmt.Sprintf("quota: %s over daily budget", module),
+			Body: fmt.Sprintf("Module %s has used more than its daily budget on %s:\n\n", module, today) +
+				"\t" + strings.Join(over, "\n\t") + "\n\n" +
+				fmt.Sprintf("https://%s/admin/app/status\n", appengine.DefaultVersionHostname(ctxt)),
+		}
+		if err := mail.SendToAdmins(ctxt, msg); err != nil {
+			ctxt.Errorf("quota: mailing alert for %s: %v", module, err)
+			continue
+		}
+		WriteMeta(ctxt, "app.quota.alerted."+module, today)
+	}
+	return nil
+}
+
+// dailyUsage returns the usage by module for the UTC day containing now:
+// the saved snapshots for the completed hours plus the live counts
+// for the current hour.
+func dailyUsage(ctxt appengine.Context, now time.Time) (map[string]Usage, error) {
+	now = now.UTC()
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	day := make(map[string]Usage)
+	for t := start; t.Before(now.Truncate(time.Hour)); t = t.Add(time.Hour) {
+		var q QuotaUsage
+		err := ReadData(ctxt, "QuotaUsage", quotaHour(t), &q)
+		if err == datastore.ErrNoSuchEntity {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range q.Modules {
+			u := day[m.Module]
+			u.add(m.Usage)
+			day[m.Module] = u
+		}
+	}
+	for _, module := range quotaModules() {
+		u := day[module]
+		u.add(readQuota(ctxt, quotaHour(now), module))
+		day[module] = u
+	}
+	return day, nil
+}
+
+func quotaStatus(ctxt appengine.Context) string {
+	var cfg quotaConfig
+	ReadConfig(ctxt, "app.quota", &cfg)
+
+	w := new(bytes.Buffer)
+	now := timeNow()
+	day, err := dailyUsage(ctxt, now)
+	if err != nil {
+		fmt.Fprintf(w, "error reading usage: %v\n", err)
+	}
+	fmt.Fprintf(w, "usage for %s (UTC):\n", now.UTC().Format("2006-01-02"))
+	for _, module := range quotaModules() {
+		u := day[module]
+		fmt.Fprintf(w, "%s: %d reads, %d writes, %d fetches", module, u.Reads, u.Writes, u.Fetches)
+		if budget, ok := cfg.Budgets[module]; ok {
+			fmt.Fprintf(w, " (budget %d, %d, %d)", budget.Reads, budget.Writes, budget.Fetches)
+			if over := u.exceeds(budget); len(over) > 0 {
+				fmt.Fprintf(w, " OVER BUDGET")
+			}
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	return "<pre>" + html.EscapeString(w.String()) + "</pre>"
+}
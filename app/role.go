@@ -0,0 +1,195 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+)
+
+// Roles.
+//
+// Every user has a role, which limits what they can do. The roles are
+// ordered; each can do everything the ones before it can:
+//
+//	viewer          read the dashboard and manage their own preferences
+//	triager         triage issues and reassign other people's CLs
+//	security        see restricted security issues on the dashboard
+//	reviewer-admin  edit directory owners, use the code review admin pages
+//	operator        run ops, edit flags and tasks, break locks
+//
+// Roles are stored in UserRole records, which operators edit with the
+// app.setrole op. A user without a record is a viewer. Administrators
+// of the App Engine app are always operators.
+//
+// Handle enforces roles: a handler registered with HandleRole serves
+// only users with at least the given role, and a handler for a URL
+// beginning with /admin/ registered with Handle requires an operator.
+// Requests from the cron service and the task queue are always allowed.
+
+// A Role is the level of access a user has to the app.
+type Role int
+
+const (
+	Viewer Role = iota
+	Triager
+	Security
+	ReviewerAdmin
+	Operator
+)
+
+var roleNames = []string{
+	Viewer:        "viewer",
+	Triager:       "triager",
+	Security:      "security",
+	ReviewerAdmin: "reviewer-admin",
+	Operator:      "operator",
+}
+
+func (r Role) String() string {
+	if r < 0 || int(r) >= len(roleNames) {
+		return fmt.Sprintf("Role(%d)", int(r))
+	}
+	return roleNames[r]
+}
+
+// ParseRole returns the role with the given name.
+func ParseRole(name string) (Role, error) {
+	for r, n := range roleNames {
+		if n == name {
+			return Role(r), nil
+		}
+	}
+	return Viewer, fmt.Errorf("unknown role %q; want one of %s", name, strings.Join(roleNames, ", "))
+}
+
+// A UserRole records the role of a user.
+// It is stored under the user's email address.
+type UserRole struct {
+	Email string
+	Role  string
+	By    string `datastore:",noindex"` // operator who set the role
+}
+
+// RoleOf returns the role of the user with the given email address.
+// It does not know about App Engine administrators; see RequestRole.
+func RoleOf(ctxt appengine.Context, email string) Role {
+	if email == "" {
+		return Viewer
+	}
+	var ur UserRole
+	if err := ReadData(ctxt, "UserRole", strings.ToLower(email), &ur); err != nil {
+		return Viewer
+	}
+	r, err := ParseRole(ur.Role)
+	if err != nil {
+		ctxt.Errorf("role of %s: %v", email, err)
+		return Viewer
+	}
+	return r
+}
+
+// HasRole reports whether the user with the given email address
+// has at least the role r.
+func HasRole(ctxt appengine.Context, email string, r Role) bool {
+	return RoleOf(ctxt, email) >= r
+}
+
+// SetRole sets the role of the user with the given email address.
+// Setting the viewer role deletes the user's record.
+func SetRole(ctxt appengine.Context, email string, r Role, by string) error {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if !strings.Contains(email, "@") {
+		return fmt.Errorf("invalid email address %q", email)
+	}
+	if r == Viewer {
+		err := DeleteData(ctxt, "UserRole", email)
+		if err == datastore.ErrNoSuchEntity {
+			err = nil
+		}
+		return err
+	}
+	return WriteData(ctxt, "UserRole", email, &UserRole{Email: email, Role: r.String(), By: by})
+}
+
+// RequestRole returns the role of the user making the request.
+// Requests from the cron service and the task queue are made with
+// the operator role; App Engine strips the headers identifying them
+// from requests coming from outside.
+func RequestRole(ctxt appengine.Context, req *http.Request) Role {
+	if req.Header.Get("X-AppEngine-Cron") == "true" || req.Header.Get("X-AppEngine-QueueName") != "" {
+		return Operator
+	}
+	u := user.Current(ctxt)
+	if u == nil {
+		return Viewer
+	}
+	if u.Admin {
+		return Operator
+	}
+	return RoleOf(ctxt, CanonicalEmail(ctxt, u.Email))
+}
+
+// checkRole reports whether the request may be served by a handler
+// requiring role r. If not, it responds to the request itself:
+// users who are not logged in are sent to log in, others get an error.
+func checkRole(ctxt appengine.Context, w http.ResponseWriter, req *http.Request, r Role) bool {
+	if r == Viewer || RequestRole(ctxt, req) >= r {
+		return true
+	}
+	if user.Current(ctxt) == nil && req.Method == "GET" {
+		if url, err := user.LoginURL(ctxt, req.URL.String()); err == nil {
+			http.Redirect(w, req, url, 302)
+			return false
+		}
+	}
+	ctxt.Warningf("%s %s: denied, need role %s", req.Method, req.URL.Path, r)
+	http.Error(w, "forbidden: requires role "+r.String(), 403)
+	return false
+}
+
+func init() {
+	RegisterStatus("roles", roleStatus)
+	RegisterOp("app.setrole", "Set the role (viewer, triager, security, reviewer-admin, or operator) of the user with the given email address.", []string{"email", "role"}, func(ctxt appengine.Context, args map[string]string) (string, error) {
+		r, err := ParseRole(strings.TrimSpace(args["role"]))
+		if err != nil {
+			return "", err
+		}
+		by := ""
+		if u := user.Current(ctxt); u != nil {
+			by = u.Email
+		}
+		if err := SetRole(ctxt, args["email"], r, by); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s is now %s", args["email"], r), nil
+	})
+}
+
+func roleStatus(ctxt appengine.Context) string {
+	w := new(bytes.Buffer)
+	var list []*UserRole
+	if _, err := datastore.NewQuery("UserRole").Order("Email").GetAll(ctxt, &list); err != nil {
+		fmt.Fprintf(w, "loading roles: %v\n", err)
+	}
+	for _, ur := range list {
+		fmt.Fprintf(w, "%s %s", ur.Email, ur.Role)
+		if ur.By != "" {
+			fmt.Fprintf(w, " (set by %s)", ur.By)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	if len(list) == 0 {
+		fmt.Fprintf(w, "no roles set; everyone but app admins is a viewer\n")
+	}
+	return "<pre>" + html.EscapeString(w.String()) + "</pre>"
+}
@@ -0,0 +1,229 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"appengine"
+)
+
+// API schema.
+//
+// /api/schema describes the app's public JSON API for clients outside
+// the app: each endpoint registered with RegisterAPI, with its parameters
+// and the type of its result, and the fields of every type those results
+// use and of every kind registered with RegisterDataUpdater. The types
+// are described by reflection from the Go definitions, using the names
+// encoding/json gives the fields, so the schema cannot drift from what
+// the endpoints actually return.
+//
+// A field's type is one of string, int, number, bool, time (an RFC 3339
+// string), bytes (a base64 string), any, []T, map[string]T, the name of
+// a type listed in the schema, or {Field T, ...} for an unnamed struct.
+
+// A Schema is the result of /api/schema.
+type Schema struct {
+	APIs  []*SchemaAPI
+	Types []*SchemaType
+}
+
+// A SchemaAPI describes an endpoint registered with RegisterAPI.
+type SchemaAPI struct {
+	Path   string
+	Doc    string
+	Params []string
+	Result string // type of the JSON result; empty if the result is not JSON
+}
+
+// A SchemaType describes a struct type used by the API.
+type SchemaType struct {
+	Name   string
+	Kind   string `json:",omitempty"` // datastore kind stored with this type, if any
+	Fields []*SchemaField
+}
+
+// A SchemaField describes a field of a struct type, by its JSON name.
+type SchemaField struct {
+	Name string
+	Type string
+}
+
+type api struct {
+	path   string
+	doc    string
+	params []string
+	result reflect.Type
+}
+
+var apis struct {
+	sync.RWMutex
+	m map[string]*api
+}
+
+// RegisterAPI describes the endpoint at path for /api/schema.
+// A path ending in / serves a tree; the doc should say how.
+// The params are the names of the form parameters the endpoint accepts,
+// and result is a value of the type it returns as JSON, such as
+// []*CL(nil), or nil if it does not return JSON.
+func RegisterAPI(path, doc string, params []string, result interface{}) {
+	apis.Lock()
+	defer apis.Unlock()
+	if apis.m == nil {
+		apis.m = make(map[string]*api)
+	}
+	if apis.m[path] != nil {
+		panic("app.RegisterAPI: multiple registrations for " + path)
+	}
+	a := &api{path: path, doc: doc, params: params}
+	if result != nil {
+		a.result = reflect.TypeOf(result)
+	}
+	apis.m[path] = a
+}
+
+func init() {
+	Handle("/api/schema", serveSchema)
+	RegisterAPI("/api/schema", "This description of the API.", nil, (*Schema)(nil))
+}
+
+func serveSchema(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	js, err := json.MarshalIndent(buildSchema(), "", "\t")
+	if err != nil {
+		ctxt.Errorf("encoding schema: %v", err)
+		http.Error(w, "error encoding JSON", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(js)
+}
+
+// buildSchema describes the registered APIs and kinds.
+func buildSchema() *Schema {
+	b := &schemaBuilder{types: make(map[reflect.Type]*SchemaType)}
+
+	updaters.RLock()
+	for kind, t := range updaters.types {
+		b.typeName(t)
+		b.types[t].Kind = kind
+	}
+	updaters.RUnlock()
+
+	s := new(Schema)
+	apis.RLock()
+	for _, a := range apis.m {
+		sa := &SchemaAPI{Path: a.path, Doc: a.doc, Params: a.params}
+		if a.result != nil {
+			sa.Result = b.typeName(a.result)
+		}
+		s.APIs = append(s.APIs, sa)
+	}
+	apis.RUnlock()
+	sort.Sort(apisByPath(s.APIs))
+
+	for _, st := range b.types {
+		s.Types = append(s.Types, st)
+	}
+	sort.Sort(typesByName(s.Types))
+	return s
+}
+
+type schemaBuilder struct {
+	types map[reflect.Type]*SchemaType
+}
+
+// typeName returns the description of t as a field type,
+// adding the named struct types it uses to b.types.
+func (b *schemaBuilder) typeName(t reflect.Type) string {
+	if t == timeType {
+		return "time"
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return b.typeName(t.Elem())
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "bool"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "int"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "bytes"
+		}
+		return "[]" + b.typeName(t.Elem())
+	case reflect.Map:
+		return "map[string]" + b.typeName(t.Elem())
+	case reflect.Struct:
+		if t.Name() == "" {
+			var list []string
+			for _, f := range b.fields(t) {
+				list = append(list, f.Name+" "+f.Type)
+			}
+			return "{" + strings.Join(list, ", ") + "}"
+		}
+		name := path.Base(t.PkgPath()) + "." + t.Name()
+		if b.types[t] == nil {
+			st := &SchemaType{Name: name}
+			b.types[t] = st // before fields, for recursive types
+			st.Fields = b.fields(t)
+		}
+		return name
+	}
+	return "any"
+}
+
+// fields returns the fields of the struct type t as encoding/json encodes them.
+func (b *schemaBuilder) fields(t reflect.Type) []*SchemaField {
+	var list []*SchemaField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := f.Name
+		if i := strings.Index(tag, ","); i >= 0 {
+			tag = tag[:i]
+		}
+		if tag != "" {
+			name = tag
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && tag == "" && ft.Kind() == reflect.Struct {
+			list = append(list, b.fields(ft)...)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		list = append(list, &SchemaField{name, b.typeName(f.Type)})
+	}
+	return list
+}
+
+type apisByPath []*SchemaAPI
+
+func (x apisByPath) Len() int           { return len(x) }
+func (x apisByPath) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+func (x apisByPath) Less(i, j int) bool { return x[i].Path < x[j].Path }
+
+type typesByName []*SchemaType
+
+func (x typesByName) Len() int           { return len(x) }
+func (x typesByName) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+func (x typesByName) Less(i, j int) bool { return x[i].Name < x[j].Name }
@@ -0,0 +1,306 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Spill records which fields of a record WriteData has moved
+// out of the record to keep it under the datastore's 1MB entity limit.
+//
+// A record type that may grow that large, such as a CL with a very long
+// review thread, opts in by including a field
+//
+//	Spill app.Spill `datastore:",noindex"`
+//
+// When such a record approaches the limit, WriteData moves its largest
+// noindex fields, largest first, into Blob records and lists them in Spill;
+// ReadData reads the Blobs back into the fields. Like DV, the Spill field
+// is owned by package app and should not be written by clients.
+//
+// Each spill writes a new generation of Blobs, under keys the previous
+// generation does not use, and deletes the previous generation only after
+// the record itself has been written. A failed write, or a read racing the
+// write, therefore still finds the Blobs the stored record lists.
+//
+// Oversized records without a Spill field are written as is, with a logged
+// warning, so that the problem shows up before the datastore rejects them.
+type Spill []string
+
+// A Blob holds one chunk of a spilled field, gob-encoded.
+// Its key is the record's kind and key, the field name and spill generation
+// separated by a dot, and the chunk number, separated by slashes.
+// Blobs written before generations were introduced omit the generation.
+type Blob struct {
+	Data []byte `datastore:",noindex"`
+}
+
+const (
+	spillSize = 900 << 10 // spill fields from records estimated larger than this
+	blobChunk = 900 << 10 // maximum bytes of data in a single Blob
+)
+
+var spillType = reflect.TypeOf(Spill(nil))
+
+// spillField returns the record's Spill field, if it has one.
+func spillField(data interface{}) (reflect.Value, bool) {
+	v := reflect.ValueOf(data)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+	f := v.Elem().FieldByName("Spill")
+	if !f.IsValid() || f.Type() != spillType {
+		return reflect.Value{}, false
+	}
+	return f, true
+}
+
+// A spillEntry is a parsed element of Spill: "name:gen:chunks",
+// or, for Blobs written before generations, "name:chunks", with gen 0.
+type spillEntry struct {
+	name   string
+	gen    int
+	chunks int
+}
+
+func (e spillEntry) String() string {
+	return e.name + ":" + strconv.Itoa(e.gen) + ":" + strconv.Itoa(e.chunks)
+}
+
+func parseSpill(s Spill) []spillEntry {
+	var list []spillEntry
+	for _, x := range s {
+		f := strings.Split(x, ":")
+		if len(f) < 2 || len(f) > 3 {
+			continue
+		}
+		var e spillEntry
+		var err error
+		e.name = f[0]
+		if e.chunks, err = strconv.Atoi(f[len(f)-1]); err != nil {
+			continue
+		}
+		if len(f) == 3 {
+			if e.gen, err = strconv.Atoi(f[1]); err != nil {
+				continue
+			}
+		}
+		list = append(list, e)
+	}
+	return list
+}
+
+// nextGen returns the generation for Blobs replacing those in old.
+func nextGen(old []spillEntry) int {
+	gen := 0
+	for _, e := range old {
+		if gen < e.gen {
+			gen = e.gen
+		}
+	}
+	return gen + 1
+}
+
+func blobKey(kind, key string, e spillEntry, i int) string {
+	if e.gen == 0 {
+		return fmt.Sprintf("%s/%s/%s/%d", kind, key, e.name, i)
+	}
+	return fmt.Sprintf("%s/%s/%s.%d/%d", kind, key, e.name, e.gen, i)
+}
+
+// unspill reads the spilled fields of a record back from their Blobs.
+func unspill(ctxt appengine.Context, kind, key string, data interface{}) error {
+	sf, ok := spillField(data)
+	if !ok || sf.Len() == 0 {
+		return nil
+	}
+	v := reflect.ValueOf(data).Elem()
+	for _, e := range parseSpill(sf.Interface().(Spill)) {
+		f := v.FieldByName(e.name)
+		if !f.IsValid() {
+			return fmt.Errorf("spilled field %s missing from %s", e.name, v.Type())
+		}
+		var buf bytes.Buffer
+		for i := 0; i < e.chunks; i++ {
+			var b Blob
+			chargeQuota(ctxt, kindModule(kind), opRead, 1)
+			if err := store.Get(ctxt, "Blob", blobKey(kind, key, e, i), &b); err != nil {
+				return fmt.Errorf("reading spilled %s: %v", e.name, err)
+			}
+			buf.Write(b.Data)
+		}
+		if err := gob.NewDecoder(&buf).DecodeValue(f.Addr()); err != nil {
+			return fmt.Errorf("decoding spilled %s: %v", e.name, err)
+		}
+	}
+	return nil
+}
+
+// spill moves the largest noindex fields of an oversized record into Blobs
+// and clears them, so that the record itself can be written.
+// It returns a function to restore the cleared fields after the write,
+// and a function to delete Blobs left over from an earlier spill,
+// to be called once the write has succeeded.
+func spill(ctxt appengine.Context, kind, key string, data interface{}) (restore, cleanup func(), err error) {
+	restore, cleanup = func() {}, func() {}
+	sf, ok := spillField(data)
+	v := reflect.ValueOf(data).Elem()
+	size := entitySize(v, "")
+	if size <= spillSize {
+		if ok && sf.Len() > 0 {
+			// Small again: the old Blobs are no longer needed.
+			old := parseSpill(sf.Interface().(Spill))
+			sf.Set(reflect.Zero(spillType))
+			cleanup = func() { deleteBlobs(ctxt, kind, key, old) }
+		}
+		return restore, cleanup, nil
+	}
+	if !ok {
+		ctxt.Warningf("write datastore %s[%s]: record is about %d bytes, near the datastore limit", kind, key, size)
+		return restore, cleanup, nil
+	}
+
+	var fields []spillCandidate
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sft := t.Field(i)
+		if sft.PkgPath != "" || sft.Type == spillType || !strings.Contains(sft.Tag.Get("datastore"), "noindex") {
+			continue
+		}
+		fields = append(fields, spillCandidate{i, entitySize(v.Field(i), sft.Name)})
+	}
+	sort.Sort(bySize(fields))
+
+	old := parseSpill(sf.Interface().(Spill))
+	gen := nextGen(old)
+	var spilled []spillEntry
+	var saved []reflect.Value
+	var indexes []int
+	for _, c := range fields {
+		if size <= spillSize {
+			break
+		}
+		f := v.Field(c.index)
+		name := t.Field(c.index).Name
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).EncodeValue(f); err != nil {
+			return restore, cleanup, fmt.Errorf("encoding %s for spill: %v", name, err)
+		}
+		enc := buf.Bytes()
+		e := spillEntry{name: name, gen: gen}
+		for len(enc) > 0 || e.chunks == 0 {
+			chunk := enc
+			if len(chunk) > blobChunk {
+				chunk = chunk[:blobChunk]
+			}
+			enc = enc[len(chunk):]
+			chargeQuota(ctxt, kindModule(kind), opWrite, 1)
+			if err := store.Put(ctxt, "Blob", blobKey(kind, key, e, e.chunks), &Blob{chunk}); err != nil {
+				return restore, cleanup, fmt.Errorf("writing spilled %s: %v", name, err)
+			}
+			e.chunks++
+		}
+		spilled = append(spilled, e)
+		saved = append(saved, reflect.ValueOf(f.Interface()))
+		indexes = append(indexes, c.index)
+		f.Set(reflect.Zero(f.Type()))
+		size -= c.size
+	}
+	if size > spillSize {
+		ctxt.Warningf("write datastore %s[%s]: record is about %d bytes even after spilling", kind, key, size)
+	}
+
+	var list Spill
+	for _, e := range spilled {
+		list = append(list, e.String())
+	}
+	sf.Set(reflect.ValueOf(list))
+	ctxt.Infof("write datastore %s[%s]: spilled %v", kind, key, list)
+
+	restore = func() {
+		for i, x := range indexes {
+			v.Field(x).Set(saved[i])
+		}
+	}
+	cleanup = func() { deleteBlobs(ctxt, kind, key, old) }
+	return restore, cleanup, nil
+}
+
+type spillCandidate struct {
+	index int // field index
+	size  int // estimated size
+}
+
+type bySize []spillCandidate
+
+func (x bySize) Len() int           { return len(x) }
+func (x bySize) Less(i, j int) bool { return x[i].size > x[j].size }
+func (x bySize) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+
+// deleteBlobs deletes the Blobs of an earlier spill generation.
+func deleteBlobs(ctxt appengine.Context, kind, key string, old []spillEntry) {
+	for _, e := range old {
+		for i := 0; i < e.chunks; i++ {
+			chargeQuota(ctxt, kindModule(kind), opWrite, 1)
+			if err := store.Delete(ctxt, "Blob", blobKey(kind, key, e, i)); err != nil && err != datastore.ErrNoSuchEntity {
+				ctxt.Errorf("delete spilled %s[%s] %s: %v", kind, key, e.name, err)
+			}
+		}
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// propertyOverhead approximates the per-value bytes the datastore
+// adds to a property beyond its name and data.
+const propertyOverhead = 16
+
+// entitySize estimates the stored size of v, which is saved under the property name.
+// Slices of structs store every field name once per element, which the
+// estimate counts; it errs on the side of being too large.
+func entitySize(v reflect.Value, name string) int {
+	switch v.Kind() {
+	case reflect.String:
+		return len(name) + propertyOverhead + v.Len()
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return len(name) + propertyOverhead + v.Len()
+		}
+		n := 0
+		for i := 0; i < v.Len(); i++ {
+			n += entitySize(v.Index(i), name)
+		}
+		return n
+	case reflect.Struct:
+		if v.Type() == timeType {
+			return len(name) + propertyOverhead + 8
+		}
+		n := 0
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).PkgPath != "" {
+				continue
+			}
+			sub := t.Field(i).Name
+			if name != "" {
+				sub = name + "." + sub
+			}
+			n += entitySize(v.Field(i), sub)
+		}
+		return n
+	}
+	return len(name) + propertyOverhead + 8
+}
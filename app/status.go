@@ -11,8 +11,6 @@ import (
 	"sync"
 
 	"appengine"
-
-	"github.com/rsc/appstats"
 )
 
 type statusElem struct {
@@ -45,7 +43,7 @@ func RegisterStatus(heading string, content func(ctxt appengine.Context) string)
 // For example, if the status page should be made publicly visible:
 //
 //	func init() {
-//		http.Handle("/status", appstats.NewHandler(app.StatusPage))
+//		app.Handle("/status", app.StatusPage)
 //	}
 //
 func StatusPage(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
@@ -64,5 +62,5 @@ func StatusPage(ctxt appengine.Context, w http.ResponseWriter, req *http.Request
 }
 
 func init() {
-	http.Handle("/admin/app/status", appstats.NewHandler(StatusPage))
+	Handle("/admin/app/status", StatusPage)
 }
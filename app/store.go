@@ -0,0 +1,162 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/taskqueue"
+)
+
+// A Store provides the storage and task queue used by package app:
+// ReadData, WriteData, DeleteData, Transaction, ScanData and Task
+// all go through the current Store. By default it is the App Engine
+// datastore and task queue; tests can substitute an in-memory
+// implementation (see package app/apptest) using SetStore.
+//
+// Other queries, like the ones used for status pages, go directly to the datastore.
+type Store interface {
+	// Get reads the record with the given kind and key into data.
+	// If there is no such record, Get returns datastore.ErrNoSuchEntity.
+	Get(ctxt appengine.Context, kind, key string, data interface{}) error
+
+	// Put writes data as the record with the given kind and key.
+	Put(ctxt appengine.Context, kind, key string, data interface{}) error
+
+	// GetMulti reads the records with the given kind and keys
+	// into the corresponding elements of data, which are pointers.
+	// If any records cannot be read, GetMulti returns an
+	// appengine.MultiError holding the error for each record,
+	// datastore.ErrNoSuchEntity for a missing one.
+	GetMulti(ctxt appengine.Context, kind string, keys []string, data []interface{}) error
+
+	// PutMulti writes the elements of data as the records
+	// with the given kind and keys.
+	PutMulti(ctxt appengine.Context, kind string, keys []string, data []interface{}) error
+
+	// Delete deletes the record with the given kind and key.
+	Delete(ctxt appengine.Context, kind, key string) error
+
+	// Transaction runs f in a cross-group transaction.
+	Transaction(ctxt appengine.Context, f func(ctxt appengine.Context) error) error
+
+	// Keys returns the keys of up to limit records matching q,
+	// starting at cursor, or at the beginning if cursor is empty.
+	// It also returns the cursor for the records that follow,
+	// or "" if there are no more.
+	Keys(ctxt appengine.Context, q *datastore.Query, cursor string, limit int) (keys []StoreKey, next string, err error)
+
+	// AddTask adds t to the named task queue.
+	AddTask(ctxt appengine.Context, t *taskqueue.Task, queue string) error
+}
+
+// A StoreKey identifies a record in a Store.
+type StoreKey struct {
+	Kind string
+	Key  string
+}
+
+var store Store = datastoreStore{}
+
+// timeNow is the clock used by package app.
+var timeNow = time.Now
+
+// SetStore makes s the Store used by package app and returns the previous one.
+// It is meant for tests; a nil s restores the App Engine datastore.
+func SetStore(s Store) Store {
+	old := store
+	if s == nil {
+		s = datastoreStore{}
+	}
+	store = s
+	return old
+}
+
+// SetClock makes now the clock used by package app for cron scheduling,
+// lock expiry and the like, and returns the previous clock.
+// It is meant for tests; a nil now restores time.Now.
+func SetClock(now func() time.Time) func() time.Time {
+	old := timeNow
+	if now == nil {
+		now = time.Now
+	}
+	timeNow = now
+	return old
+}
+
+// datastoreStore is the Store backed by the App Engine datastore and task queue.
+type datastoreStore struct{}
+
+func (datastoreStore) Get(ctxt appengine.Context, kind, key string, data interface{}) error {
+	return datastore.Get(ctxt, datastore.NewKey(ctxt, kind, key, 0, nil), data)
+}
+
+func (datastoreStore) Put(ctxt appengine.Context, kind, key string, data interface{}) error {
+	_, err := datastore.Put(ctxt, datastore.NewKey(ctxt, kind, key, 0, nil), data)
+	return err
+}
+
+func (datastoreStore) GetMulti(ctxt appengine.Context, kind string, keys []string, data []interface{}) error {
+	return datastore.GetMulti(ctxt, datastoreKeys(ctxt, kind, keys), data)
+}
+
+func (datastoreStore) PutMulti(ctxt appengine.Context, kind string, keys []string, data []interface{}) error {
+	_, err := datastore.PutMulti(ctxt, datastoreKeys(ctxt, kind, keys), data)
+	return err
+}
+
+func datastoreKeys(ctxt appengine.Context, kind string, keys []string) []*datastore.Key {
+	var dk []*datastore.Key
+	for _, key := range keys {
+		dk = append(dk, datastore.NewKey(ctxt, kind, key, 0, nil))
+	}
+	return dk
+}
+
+func (datastoreStore) Delete(ctxt appengine.Context, kind, key string) error {
+	return datastore.Delete(ctxt, datastore.NewKey(ctxt, kind, key, 0, nil))
+}
+
+func (datastoreStore) Transaction(ctxt appengine.Context, f func(ctxt appengine.Context) error) error {
+	return datastore.RunInTransaction(ctxt, f, &datastore.TransactionOptions{XG: true})
+}
+
+func (datastoreStore) Keys(ctxt appengine.Context, q *datastore.Query, cursor string, limit int) ([]StoreKey, string, error) {
+	q = q.Limit(limit).KeysOnly()
+	if cursor != "" {
+		c, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		q = q.Start(c)
+	}
+	var out []StoreKey
+	it := q.Run(ctxt)
+	for {
+		k, err := it.Next(nil)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		out = append(out, StoreKey{k.Kind(), k.StringID()})
+	}
+	if len(out) < limit {
+		return out, "", nil
+	}
+	c, err := it.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	return out, c.String(), nil
+}
+
+func (datastoreStore) AddTask(ctxt appengine.Context, t *taskqueue.Task, queue string) error {
+	_, err := taskqueue.Add(ctxt, t, queue)
+	return err
+}
@@ -7,6 +7,7 @@ package app
 import (
 	"bytes"
 	"encoding/gob"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -18,8 +19,6 @@ import (
 
 	"appengine"
 	"appengine/taskqueue"
-
-	"github.com/rsc/appstats"
 )
 
 var taskfuncs = struct {
@@ -34,6 +33,8 @@ type taskFunc struct {
 	fn    reflect.Value
 	queue string
 	retry *taskqueue.RetryOptions
+	json  bool        // args are JSON-encoded (see JSONTaskFunc)
+	opts  TaskOptions // see SetTaskOptions
 }
 
 // TaskFunc registers a task-handling function.
@@ -115,6 +116,14 @@ func Task(ctxt appengine.Context, taskName, funcName string, args ...interface{}
 			panic(fmt.Sprintf("app.TaskFunc: arg %d has type %s, not assignable to type %s", i, v.Type(), t.In(1+i)))
 		}
 		v = v.Convert(t.In(1 + i))
+		if tf.json {
+			js, err := json.Marshal(v.Interface())
+			if err != nil {
+				panic(fmt.Sprintf("app.TaskFunc: JSON-encoding arg %d: %v", i, err))
+			}
+			buf.Write(js)
+			continue
+		}
 		if err := enc.EncodeValue(v); err != nil {
 			panic(fmt.Sprintf("app.TaskFunc: gob-encoding arg %d: %v", i, err))
 		}
@@ -142,13 +151,19 @@ func Task(ctxt appengine.Context, taskName, funcName string, args ...interface{}
 		return err
 	}
 
-	task := taskqueue.NewPOSTTask("/admin/app/taskpost", url.Values{
+	form := url.Values{
 		"task": {taskName},
 		"func": {funcName},
-		"gob":  {buf.String()},
-	})
+	}
+	if tf.json {
+		form.Set("json", buf.String())
+		savePendingTask(ctxt, taskName, funcName, buf.String())
+	} else {
+		form.Set("gob", buf.String())
+	}
+	task := taskqueue.NewPOSTTask("/admin/app/taskpost", form)
 	task.RetryOptions = tf.retry
-	if _, err := taskqueue.Add(ctxt, task, tf.queue); err != nil {
+	if err := store.AddTask(ctxt, task, tf.queue); err != nil {
 		ctxt.Errorf("app.Task: creating task %q: taskqueue.Add: %v", taskName, err)
 		Unlock(ctxt, lockName)
 		return err
@@ -157,7 +172,7 @@ func Task(ctxt appengine.Context, taskName, funcName string, args ...interface{}
 }
 
 func init() {
-	http.Handle("/admin/app/taskpost", appstats.NewHandler(taskpost))
+	Handle("/admin/app/taskpost", taskpost)
 }
 
 func taskpost(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
@@ -197,11 +212,20 @@ func taskpost(ctxt appengine.Context, w http.ResponseWriter, req *http.Request)
 		Unlock(ctxt, "TaskExec."+taskName)
 	}()
 
-	dec := gob.NewDecoder(strings.NewReader(gobenc))
 	var vargs []reflect.Value
 	vargs = append(vargs, reflect.ValueOf(&ctxt).Elem())
 	t := tf.fn.Type()
-	for i := 1; i < t.NumIn(); i++ {
+	if tf.json {
+		v, err := pendingTaskArgs(ctxt, taskName, funcName, req.FormValue("json"), t.In(1))
+		if err != nil {
+			ctxt.Errorf("app.Task: taskpost[%q,%q]: %v", taskName, funcName, err)
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+		vargs = append(vargs, v)
+	}
+	dec := gob.NewDecoder(strings.NewReader(gobenc))
+	for i := len(vargs); i < t.NumIn(); i++ {
 		v := reflect.New(t.In(i)).Elem()
 		if err := dec.DecodeValue(v); err != nil {
 			ctxt.Errorf("app.Task: taskpost[%q,%q]: arg %d: gob decode failure: %v", taskName, funcName, i, err)
@@ -211,9 +235,26 @@ func taskpost(ctxt appengine.Context, w http.ResponseWriter, req *http.Request)
 		vargs = append(vargs, v)
 	}
 
-	ret := tf.fn.Call(vargs)
+	taskfuncs.RLock()
+	opts := tf.opts
+	taskfuncs.RUnlock()
+	p := startProgress(ctxt, taskName, opts)
+	defer endProgress(ctxt)
+
+	ret := p.run(ctxt, opts.Heartbeat, tf.fn, vargs)
 	if len(ret) > 0 {
 		err := ret[0].Interface()
+		if err == ErrMoreTask {
+			// Queue a continuation, which inherits the task's name lock.
+			ctxt.Infof("app.Task: taskpost[%q,%q]: more to do; continuing", taskName, funcName)
+			task := taskqueue.NewPOSTTask("/admin/app/taskpost", req.PostForm)
+			task.RetryOptions = tf.retry
+			if err := store.AddTask(ctxt, task, tf.queue); err != nil {
+				ctxt.Errorf("app.Task: taskpost[%q,%q]: queueing continuation: %v", taskName, funcName, err)
+				w.WriteHeader(http.StatusNotAcceptable)
+			}
+			return
+		}
 		if err != nil {
 			ctxt.Errorf("app.Task: taskpost[%q,%q]: function returned %v", taskName, funcName, err)
 			w.WriteHeader(http.StatusNotAcceptable)
@@ -222,6 +263,10 @@ func taskpost(ctxt appengine.Context, w http.ResponseWriter, req *http.Request)
 	}
 
 	// Success!
+	p.clear(ctxt)
+	if tf.json {
+		DeleteData(ctxt, "PendingTask", taskName)
+	}
 	Unlock(ctxt, "Task."+taskName)
 	return
 }
@@ -229,7 +274,7 @@ func taskpost(ctxt appengine.Context, w http.ResponseWriter, req *http.Request)
 func init() {
 	TaskFunc("ping", ping, "default", nil)
 	TaskFunc("pong", pong, "default", nil)
-	http.Handle("/admin/app/pingpong", appstats.NewHandler(startPing))
+	Handle("/admin/app/pingpong", startPing)
 }
 
 func startPing(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
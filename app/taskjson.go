@@ -0,0 +1,185 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"reflect"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/taskqueue"
+	"appengine/user"
+)
+
+// JSONTaskFunc is like TaskFunc but encodes the task's arguments as JSON
+// instead of gob. The function fn must take exactly one argument after the
+// appengine.Context, of struct type, and the struct should be kept
+// backward compatible: the encoded arguments of pending tasks must still
+// decode after the app is redeployed.
+//
+// While a task created with a JSON task function is pending, its arguments
+// are also kept in a PendingTask record, which can be inspected and edited
+// on /admin/app/tasks. The edited arguments take effect the next time the
+// task runs, including on retry.
+func JSONTaskFunc(name string, fn interface{}, queue string, retry *taskqueue.RetryOptions) {
+	t := reflect.TypeOf(fn)
+	if t == nil || t.Kind() != reflect.Func || t.NumIn() != 2 || t.In(1).Kind() != reflect.Struct {
+		panic("app.JSONTaskFunc: fn must be a func(appengine.Context, T) for a struct type T")
+	}
+	TaskFunc(name, fn, queue, retry)
+	taskfuncs.Lock()
+	taskfuncs.m[name].json = true
+	taskfuncs.Unlock()
+}
+
+// A PendingTask records the JSON-encoded arguments of a pending task.
+// It is stored under the task name.
+type PendingTask struct {
+	Func    string
+	Args    string `datastore:",noindex"`
+	Created time.Time
+	Edited  string // who last edited Args, if anyone
+}
+
+func savePendingTask(ctxt appengine.Context, taskName, funcName, args string) {
+	// The task payload has the arguments too, so the task
+	// can still run if this write fails.
+	WriteData(ctxt, "PendingTask", taskName, &PendingTask{Func: funcName, Args: args, Created: timeNow()})
+}
+
+// pendingTaskArgs decodes the arguments for the named task,
+// preferring the PendingTask record, which may have been edited,
+// to the arguments in the task payload.
+func pendingTaskArgs(ctxt appengine.Context, taskName, funcName, args string, typ reflect.Type) (reflect.Value, error) {
+	var p PendingTask
+	if err := ReadData(ctxt, "PendingTask", taskName, &p); err == nil && p.Func == funcName {
+		args = p.Args
+	}
+	v := reflect.New(typ)
+	if err := json.Unmarshal([]byte(args), v.Interface()); err != nil {
+		return reflect.Value{}, fmt.Errorf("JSON decode failure: %v", err)
+	}
+	return v.Elem(), nil
+}
+
+func init() {
+	Handle("/admin/app/tasks", tasksPage)
+}
+
+var tasksTemplate = template.Must(template.New("tasks").Parse(`<html>
+<head><title>Pending tasks</title></head>
+<body>
+<h1>Pending tasks</h1>
+{{if .Error}}<p><b>{{.Error}}</b></p>{{end}}
+<p>Tasks created with JSON arguments that have not yet completed.
+Edited arguments take effect the next time the task runs.
+{{range .Tasks}}
+<h2>{{.Name}}</h2>
+<p>{{.Func}}, created {{.Created}}{{if .Edited}}, edited by {{.Edited}}{{end}}
+<form method="post">
+<input type="hidden" name="xsrf" value="{{$.XSRF}}">
+<input type="hidden" name="task" value="{{.Name}}">
+<textarea name="args" cols=80 rows=8>{{.Args}}</textarea>
+<br>
+<input type="submit" value="Save">
+</form>
+{{else}}
+<p>None.
+{{end}}
+</body>
+</html>
+`))
+
+func tasksPage(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	u := user.Current(ctxt)
+	if u == nil {
+		http.Error(w, "must be logged in", 403)
+		return
+	}
+
+	var data struct {
+		Tasks []struct {
+			Name string
+			*PendingTask
+		}
+		XSRF  string
+		Error string
+	}
+
+	if req.Method == "POST" {
+		data.Error = editPendingTask(ctxt, req, u.Email)
+		if data.Error == "" {
+			ctxt.Infof("pending task %s edited by %s", req.FormValue("task"), u.Email)
+		}
+	}
+
+	var list []*PendingTask
+	keys, err := datastore.NewQuery("PendingTask").Limit(1000).GetAll(ctxt, &list)
+	if err != nil {
+		data.Error = err.Error()
+	}
+	for i, p := range list {
+		var buf bytes.Buffer
+		if json.Indent(&buf, []byte(p.Args), "", "\t") == nil {
+			p.Args = buf.String()
+		}
+		data.Tasks = append(data.Tasks, struct {
+			Name string
+			*PendingTask
+		}{keys[i].StringID(), p})
+	}
+	data.XSRF = XSRFToken(ctxt, u.Email, "tasks")
+
+	if err := tasksTemplate.Execute(w, data); err != nil {
+		ctxt.Errorf("execute: %v", err)
+	}
+}
+
+// editPendingTask saves the arguments posted for a pending task,
+// returning a description of the problem if it cannot.
+func editPendingTask(ctxt appengine.Context, req *http.Request, email string) string {
+	if !ValidXSRFToken(ctxt, req.FormValue("xsrf"), email, "tasks") {
+		return "invalid XSRF token; reload and try again"
+	}
+	name := req.FormValue("task")
+	args := req.FormValue("args")
+	err := Transaction(ctxt, func(ctxt appengine.Context) error {
+		var p PendingTask
+		if err := ReadData(ctxt, "PendingTask", name, &p); err != nil {
+			if err == datastore.ErrNoSuchEntity {
+				return fmt.Errorf("task %s is no longer pending", name)
+			}
+			return err
+		}
+		taskfuncs.RLock()
+		tf := taskfuncs.m[p.Func]
+		taskfuncs.RUnlock()
+		if tf == nil || !tf.json {
+			return fmt.Errorf("unknown task function %s", p.Func)
+		}
+		// Check that the new arguments decode.
+		v := reflect.New(tf.fn.Type().In(1))
+		if err := json.Unmarshal([]byte(args), v.Interface()); err != nil {
+			return fmt.Errorf("invalid arguments: %v", err)
+		}
+		js, err := json.Marshal(v.Interface())
+		if err != nil {
+			return err
+		}
+		p.Args = string(js)
+		p.Edited = email
+		return WriteData(ctxt, "PendingTask", name, &p)
+	})
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
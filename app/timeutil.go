@@ -0,0 +1,97 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"sort"
+	"sync"
+	"time"
+
+	"appengine"
+)
+
+// ParseTime parses value using layout, interpreting it in loc if it
+// has no time zone, like time.ParseInLocation. The kind names the source
+// of the timestamp, such as "codereview.modified", for reporting.
+//
+// If value cannot be parsed, ParseTime returns the zero time and an error,
+// leaving the caller to decide whether to skip the record or use the zero
+// time. It also logs the first bad value of each kind seen by this instance
+// and counts the failures by kind in the "time parsing" section on
+// /admin/app/status. Failures should be rare, so the counts are kept
+// in a single meta value.
+func ParseTime(ctxt appengine.Context, kind, layout, value string, loc *time.Location) (time.Time, error) {
+	t, err := time.ParseInLocation(layout, value, loc)
+	if err == nil {
+		return t, nil
+	}
+	timeParse.Lock()
+	if timeParse.logged == nil {
+		timeParse.logged = make(map[string]bool)
+	}
+	first := !timeParse.logged[kind]
+	timeParse.logged[kind] = true
+	timeParse.Unlock()
+	if first {
+		ctxt.Errorf("parsing %s time %q: %v", kind, value, err)
+	}
+
+	Transaction(ctxt, func(ctxt appengine.Context) error {
+		var m map[string]*timeParseStats
+		ReadMeta(ctxt, "app.timeparse", &m)
+		if m == nil {
+			m = make(map[string]*timeParseStats)
+		}
+		st := m[kind]
+		if st == nil {
+			st = new(timeParseStats)
+			m[kind] = st
+		}
+		st.Count++
+		st.Last = value
+		st.Time = timeNow()
+		return WriteMeta(ctxt, "app.timeparse", m)
+	})
+	return time.Time{}, fmt.Errorf("parsing %s time %q: %v", kind, value, err)
+}
+
+var timeParse struct {
+	sync.Mutex
+	logged map[string]bool
+}
+
+// timeParseStats counts the failures of one kind of timestamp.
+type timeParseStats struct {
+	Count int64
+	Last  string    // most recent bad value
+	Time  time.Time // when it was seen
+}
+
+func init() {
+	RegisterStatus("time parsing", timeParseStatus)
+}
+
+func timeParseStatus(ctxt appengine.Context) string {
+	var m map[string]*timeParseStats
+	ReadMeta(ctxt, "app.timeparse", &m)
+	var kinds []string
+	for kind := range m {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	w := new(bytes.Buffer)
+	if len(kinds) == 0 {
+		fmt.Fprintf(w, "no failures\n")
+	}
+	for _, kind := range kinds {
+		st := m[kind]
+		fmt.Fprintf(w, "%s: %d failures, last %q at %v\n", kind, st.Count, st.Last, st.Time)
+	}
+	return "<pre>" + html.EscapeString(w.String()) + "</pre>"
+}
@@ -6,16 +6,35 @@ package app
 
 import (
 	"appengine"
-	"appengine/datastore"
+	"appengine/memcache"
 )
 
 // Transaction executes f in a transaction.
 // If an error occurs, Transaction returns it but also logs it using ctxt.Errorf.
 // All transactions are marked as "cross-group" (there is no harm in doing so).
 func Transaction(ctxt appengine.Context, f func(ctxt appengine.Context) error) error {
-	err := datastore.RunInTransaction(ctxt, f, &datastore.TransactionOptions{XG: true})
+	outer := ctxt
+	var tc *txContext
+	err := store.Transaction(ctxt, func(ctxt appengine.Context) error {
+		tc = &txContext{Context: ctxt, tally: tallyOf(outer)}
+		return f(tc)
+	})
+	if tc != nil && len(tc.uncache) > 0 {
+		memcache.DeleteMulti(ctxt, tc.uncache)
+	}
 	if err != nil {
 		ctxt.Errorf("transaction failed: %v", err)
 	}
 	return err
 }
+
+// A txContext is the context passed to a function run by Transaction.
+// It tells ReadData not to use the data cache and collects the cache
+// keys to delete once the transaction is over (see datacache.go).
+// It also carries the quota tally of the request running the
+// transaction, if any (see quota.go).
+type txContext struct {
+	appengine.Context
+	uncache []string
+	tally   *quotaTally
+}
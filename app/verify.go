@@ -0,0 +1,226 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+type verifier struct {
+	kind string
+	f    func(ctxt appengine.Context, key string) ([]string, error)
+}
+
+var verifiers struct {
+	sync.RWMutex
+	m map[string]*verifier
+}
+
+// ErrStale is returned by a verification function registered with
+// RegisterVerifier when the upstream copy of the record has changed
+// since the record was loaded, so that the two cannot be compared.
+var ErrStale = errors.New("record changed upstream since it was loaded")
+
+// RegisterVerifier registers a check of mirrored records of the given kind
+// against their source. Every hour the app.verify cron job picks a few
+// records of that kind at random and calls f with each key. The function
+// refetches the record from upstream and returns the names of the fields
+// that differ from the stored copy, or ErrStale if the comparison is
+// not meaningful.
+//
+// The keys of the records must be decimal numbers, as those of CLs and
+// issues are. The divergence rate, the fields found to differ, and the
+// most recent divergent records are served in the "mirror verification"
+// section on /admin/app/status, to catch loaders that silently lose data.
+func RegisterVerifier(name, kind string, f func(ctxt appengine.Context, key string) ([]string, error)) {
+	verifiers.Lock()
+	defer verifiers.Unlock()
+	if verifiers.m == nil {
+		verifiers.m = make(map[string]*verifier)
+	}
+	if verifiers.m[name] != nil {
+		panic("app.RegisterVerifier: multiple registrations for " + name)
+	}
+	verifiers.m[name] = &verifier{kind, f}
+}
+
+// verifyStats records the results of a verifier.
+// It is stored as the meta value "app.verify.<name>".
+type verifyStats struct {
+	Since    time.Time        // first run
+	Checked  int64            // records compared
+	Stale    int64            // records skipped as changed upstream
+	Diverged int64            // records found to differ
+	Fields   map[string]int64 // divergent records by field
+	Recent   []string         // most recent divergences, newest first
+	Time     time.Time        // last run
+}
+
+const (
+	verifySample = 5  // records to check per verifier in each run
+	verifyRecent = 20 // divergences to keep in verifyStats.Recent
+)
+
+func init() {
+	Cron("app.verify", 1*time.Hour, runVerifiers)
+	RegisterStatus("mirror verification", verifyStatus)
+}
+
+func verifierNames() []string {
+	verifiers.RLock()
+	defer verifiers.RUnlock()
+	var names []string
+	for name := range verifiers.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func runVerifiers(ctxt appengine.Context) error {
+	for _, name := range verifierNames() {
+		verifiers.RLock()
+		v := verifiers.m[name]
+		verifiers.RUnlock()
+
+		keys, err := sampleKeys(ctxt, v.kind, verifySample)
+		if err != nil {
+			ctxt.Errorf("verify %s: sampling %s: %v", name, v.kind, err)
+			continue
+		}
+
+		var st verifyStats
+		if err := ReadMeta(ctxt, "app.verify."+name, &st); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if st.Since.IsZero() {
+			st.Since = timeNow()
+		}
+		if st.Fields == nil {
+			st.Fields = make(map[string]int64)
+		}
+		for _, key := range keys {
+			diffs, err := v.f(ctxt, key)
+			if err == ErrStale {
+				st.Stale++
+				continue
+			}
+			if err != nil {
+				ctxt.Errorf("verify %s: %s[%s]: %v", name, v.kind, key, err)
+				continue
+			}
+			st.Checked++
+			if len(diffs) == 0 {
+				continue
+			}
+			ctxt.Errorf("verify %s: %s[%s] differs from upstream: %s", name, v.kind, key, strings.Join(diffs, ", "))
+			st.Diverged++
+			for _, f := range diffs {
+				st.Fields[f]++
+			}
+			st.Recent = append([]string{fmt.Sprintf("%s %s: %s", timeNow().Format("2006-01-02 15:04"), key, strings.Join(diffs, ", "))}, st.Recent...)
+			if len(st.Recent) > verifyRecent {
+				st.Recent = st.Recent[:verifyRecent]
+			}
+		}
+		st.Time = timeNow()
+		if err := WriteMeta(ctxt, "app.verify."+name, &st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sampleKeys returns the keys of up to n records of the given kind,
+// chosen approximately at random. The keys must be decimal numbers.
+// sampleKeys picks random numbers between the smallest and largest keys
+// and takes the first key at or after each one in key order,
+// so records after gaps in the numbering are picked more often.
+func sampleKeys(ctxt appengine.Context, kind string, n int) ([]string, error) {
+	var lo, hi int64
+	for _, order := range []string{"__key__", "-__key__"} {
+		keys, err := datastore.NewQuery(kind).Order(order).KeysOnly().Limit(1).GetAll(ctxt, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			return nil, nil
+		}
+		x, err := strconv.ParseInt(keys[0].StringID(), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("key %q is not a number", keys[0].StringID())
+		}
+		if order == "__key__" {
+			lo = x
+		} else {
+			hi = x
+		}
+	}
+	// Keys sort as strings, so the smallest and largest keys need not
+	// be the smallest and largest numbers.
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+
+	seen := make(map[string]bool)
+	var list []string
+	for i := 0; i < 2*n && len(list) < n; i++ {
+		start := strconv.FormatInt(lo+rand.Int63n(hi-lo+1), 10)
+		keys, err := datastore.NewQuery(kind).
+			Filter("__key__ >=", datastore.NewKey(ctxt, kind, start, 0, nil)).
+			KeysOnly().
+			Limit(1).
+			GetAll(ctxt, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) > 0 && !seen[keys[0].StringID()] {
+			seen[keys[0].StringID()] = true
+			list = append(list, keys[0].StringID())
+		}
+	}
+	return list, nil
+}
+
+func verifyStatus(ctxt appengine.Context) string {
+	w := new(bytes.Buffer)
+	for _, name := range verifierNames() {
+		var st verifyStats
+		if err := ReadMeta(ctxt, "app.verify."+name, &st); err != nil {
+			fmt.Fprintf(w, "%s: not yet run\n", name)
+			continue
+		}
+		rate := 0.0
+		if st.Checked > 0 {
+			rate = 100 * float64(st.Diverged) / float64(st.Checked)
+		}
+		fmt.Fprintf(w, "%s: %d of %d records differ from upstream (%.1f%%) since %v; %d skipped as changed upstream; last run %v\n",
+			name, st.Diverged, st.Checked, rate, st.Since, st.Stale, st.Time)
+		var fields []string
+		for f, n := range st.Fields {
+			fields = append(fields, fmt.Sprintf("%s %d", f, n))
+		}
+		if len(fields) > 0 {
+			sort.Strings(fields)
+			fmt.Fprintf(w, "\tdiffering fields: %s\n", strings.Join(fields, ", "))
+		}
+		for _, s := range st.Recent {
+			fmt.Fprintf(w, "\t%s\n", s)
+		}
+	}
+	return "<pre>" + html.EscapeString(w.String()) + "</pre>"
+}
@@ -0,0 +1,69 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"appengine"
+)
+
+type warmupEntry struct {
+	name string
+	f    func(appengine.Context) error
+}
+
+var warmups struct {
+	sync.RWMutex
+	list []warmupEntry
+}
+
+// RegisterWarmup registers a function to call when a new instance starts,
+// to load whatever the first real request would otherwise have to:
+// parsed templates, configuration, and other values cached in memcache
+// or instance memory. Errors are logged but otherwise ignored.
+//
+// Warm-up requests are only sent to apps that list warmup
+// among their inbound services in app.yaml:
+//
+//	inbound_services:
+//	- warmup
+func RegisterWarmup(name string, f func(appengine.Context) error) {
+	warmups.Lock()
+	defer warmups.Unlock()
+	for _, w := range warmups.list {
+		if w.name == name {
+			panic("app.RegisterWarmup: multiple registrations for " + name)
+		}
+	}
+	warmups.list = append(warmups.list, warmupEntry{name, f})
+}
+
+func init() {
+	Handle("/_ah/warmup", warmup)
+
+	RegisterWarmup("app", func(ctxt appengine.Context) error {
+		ReadMailmap(ctxt)
+		_, err := xsrfKey(ctxt)
+		return err
+	})
+}
+
+func warmup(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	warmups.RLock()
+	list := warmups.list
+	warmups.RUnlock()
+
+	for _, wu := range list {
+		start := time.Now()
+		if err := wu.f(ctxt); err != nil {
+			ctxt.Errorf("warmup %s: %v", wu.name, err)
+			continue
+		}
+		ctxt.Infof("warmup %s: %v", wu.name, time.Since(start))
+	}
+}
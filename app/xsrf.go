@@ -0,0 +1,90 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// xsrfValid is how long a token returned by XSRFToken remains valid.
+const xsrfValid = 24 * time.Hour
+
+// xsrfKey returns the secret key used to sign XSRF tokens,
+// creating it if necessary.
+func xsrfKey(ctxt appengine.Context) ([]byte, error) {
+	var key []byte
+	if err := ReadMetaCached(ctxt, "app.xsrf.key", &key); err == nil && len(key) > 0 {
+		return key, nil
+	}
+	err := Transaction(ctxt, func(ctxt appengine.Context) error {
+		if err := ReadMeta(ctxt, "app.xsrf.key", &key); err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		key = make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return err
+		}
+		return WriteMeta(ctxt, "app.xsrf.key", key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func xsrfSign(key []byte, user, action string, t int64) string {
+	h := hmac.New(sha256.New, key)
+	fmt.Fprintf(h, "%s\x00%s\x00%d", user, action, t)
+	return fmt.Sprintf("%d:%x", t, h.Sum(nil))
+}
+
+// XSRFToken returns a token authorizing the given user to perform the named action.
+// The token should be embedded in the page offering the action and sent back
+// with the request performing it, which should check it with ValidXSRFToken.
+// Tokens expire after one day.
+//
+// If the signing key cannot be loaded, XSRFToken returns the empty string,
+// which ValidXSRFToken never accepts.
+func XSRFToken(ctxt appengine.Context, user, action string) string {
+	key, err := xsrfKey(ctxt)
+	if err != nil {
+		ctxt.Errorf("xsrf token: %v", err)
+		return ""
+	}
+	return xsrfSign(key, user, action, time.Now().Unix())
+}
+
+// ValidXSRFToken reports whether token was returned by XSRFToken
+// for the given user and action and has not yet expired.
+func ValidXSRFToken(ctxt appengine.Context, token, user, action string) bool {
+	i := strings.Index(token, ":")
+	if i < 0 {
+		return false
+	}
+	t, err := strconv.ParseInt(token[:i], 10, 64)
+	if err != nil {
+		return false
+	}
+	issued := time.Unix(t, 0)
+	if now := time.Now(); now.Before(issued.Add(-1*time.Minute)) || now.After(issued.Add(xsrfValid)) {
+		return false
+	}
+	key, err := xsrfKey(ctxt)
+	if err != nil {
+		ctxt.Errorf("xsrf check: %v", err)
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(xsrfSign(key, user, action, t)))
+}
@@ -0,0 +1,357 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codereview
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"app"
+	"codereview/rietveld"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Formatting advisories.
+//
+// When a new patch set of an active CL is loaded, the codereview.advisory
+// scan downloads its diff, applies it to the base files fetched from the
+// repository, and runs gofmt over the resulting Go files. If any of them
+// are not formatted (or do not parse), it posts a comment listing them.
+// The comment is advice only: it does not change the CL's state.
+//
+// Running go vet needs the go command and the packages' dependencies,
+// neither of which is available on App Engine, so only gofmt is checked.
+//
+// The bot is off unless the codereview.advisory flag is set.
+// The owner of a CL can opt out by putting NOADVISORY in its description;
+// an admin can opt a CL out with the codereview.advisory.optout op.
+
+var advisoryFlag = app.Flag("codereview.advisory", false)
+
+const (
+	maxAdvisoryDiff  = 1 << 20 // largest diff considered
+	maxAdvisoryFile  = 1 << 20 // largest base file fetched
+	maxAdvisoryFiles = 20      // most Go files checked per patch set
+)
+
+// advisoryPending reports whether the CL's latest patch set
+// still needs to be checked by the advisory bot.
+func (cl *CL) advisoryPending() bool {
+	if !cl.Active || !cl.PatchSetsLoaded || len(cl.PatchSets) == 0 {
+		return false
+	}
+	if cl.NoAdvisory || strings.Contains(cl.Desc, "NOADVISORY") {
+		return false
+	}
+	return cl.AdvisedPatchSet != cl.PatchSets[len(cl.PatchSets)-1]
+}
+
+func init() {
+	app.ScanData("codereview.advisory", 5*time.Minute,
+		datastore.NewQuery("CL").Filter("AdvisoryPending =", true),
+		advise)
+
+	app.RegisterOp("codereview.advisory.optout", "Stop (or, with on=1, resume) formatting advisories on a CL.", []string{"cl", "on"}, func(ctxt appengine.Context, args map[string]string) (string, error) {
+		on := args["on"] == "1"
+		err := app.Transaction(ctxt, func(ctxt appengine.Context) error {
+			var cl CL
+			if err := app.ReadData(ctxt, "CL", args["cl"], &cl); err != nil {
+				return err
+			}
+			cl.NoAdvisory = !on
+			return app.WriteData(ctxt, "CL", args["cl"], &cl)
+		})
+		if err != nil {
+			return "", err
+		}
+		if on {
+			return "advisories on for CL " + args["cl"], nil
+		}
+		return "advisories off for CL " + args["cl"], nil
+	})
+}
+
+// advise checks the latest patch set of the CL with the given key
+// and posts a comment if it finds problems.
+func advise(ctxt appengine.Context, kind, key string) error {
+	if !advisoryFlag.On(ctxt) {
+		return nil
+	}
+	cl, p, err := LatestPatch(ctxt, key)
+	if err != nil {
+		ctxt.Errorf("advise %s: %v", key, err)
+		return nil
+	}
+	if !cl.AdvisoryPending {
+		return nil
+	}
+	ps := cl.PatchSets[len(cl.PatchSets)-1]
+
+	r, err := login(ctxt)
+	if err != nil {
+		return err
+	}
+	msg, err := checkPatchSet(ctxt, r, cl, p)
+	if err != nil {
+		// Record the patch set as checked anyway:
+		// a diff that cannot be checked now will not improve.
+		ctxt.Errorf("advise %s/%s: %v", key, ps, err)
+	} else if msg != "" {
+		n, _ := strconv.Atoi(key)
+		issue, err := r.Issue(n)
+		if err != nil {
+			ctxt.Criticalf("issue: %s", err)
+			return err
+		}
+		c := advisoryComment(ps, msg)
+		err = app.PostOnce(ctxt, "cl/"+key, "advisory", c.Message, func() error {
+			return r.AddComment(issue, c)
+		})
+		if err != nil {
+			ctxt.Criticalf("addcomment: %s", err)
+			return err
+		}
+	}
+
+	return app.Transaction(ctxt, func(ctxt appengine.Context) error {
+		var cl CL
+		if err := app.ReadData(ctxt, "CL", key, &cl); err != nil {
+			return err
+		}
+		cl.AdvisedPatchSet = ps
+		return app.WriteData(ctxt, "CL", key, &cl)
+	})
+}
+
+var diffRevRE = regexp.MustCompile(`diff -r ([0-9a-f]+) `)
+
+// checkPatchSet runs gofmt over the Go files changed by the CL's latest
+// patch set p. It returns a summary of the problems found, or "" if none.
+func checkPatchSet(ctxt appengine.Context, r *rietveld.Rietveld, cl *CL, p *Patch) (string, error) {
+	m := diffRevRE.FindStringSubmatch(p.Message)
+	if m == nil {
+		return "", fmt.Errorf("no base revision in patch set message")
+	}
+	rev := m[1]
+
+	n, err := strconv.Atoi(cl.CL)
+	if err != nil {
+		return "", fmt.Errorf("invalid cl number %q", cl.CL)
+	}
+	psn, err := strconv.Atoi(p.PatchSet)
+	if err != nil {
+		return "", fmt.Errorf("invalid patch set %q", p.PatchSet)
+	}
+	dl, err := r.DownloadPatchSet(n, psn)
+	if err != nil {
+		return "", err
+	}
+	defer dl.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(dl, maxAdvisoryDiff+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxAdvisoryDiff {
+		return "", fmt.Errorf("diff too large")
+	}
+
+	var out bytes.Buffer
+	checked := 0
+	for _, fd := range parseDiff(string(data)) {
+		if !strings.HasSuffix(fd.name, ".go") || fd.deleted {
+			continue
+		}
+		if checked++; checked > maxAdvisoryFiles {
+			fmt.Fprintf(&out, "(stopped after %d files)\n", maxAdvisoryFiles)
+			break
+		}
+		var base []byte
+		if !fd.created {
+			base, err = fetchBase(ctxt, cl.Repo, rev, fd.name)
+			if err != nil {
+				return "", err
+			}
+		}
+		src, err := fd.apply(base)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", fd.name, err)
+		}
+		if s := gofmtProblem(src); s != "" {
+			fmt.Fprintf(&out, "%s: %s\n", fd.name, s)
+		}
+	}
+	return out.String(), nil
+}
+
+// gofmtProblem returns a description of why src is not gofmt-formatted,
+// or "" if it is.
+func gofmtProblem(src []byte) string {
+	res, err := format.Source(src)
+	if err != nil {
+		return "does not parse: " + err.Error()
+	}
+	if bytes.Equal(res, src) {
+		return ""
+	}
+	a := strings.Split(string(src), "\n")
+	b := strings.Split(string(res), "\n")
+	line := 1
+	for line <= len(a) && line <= len(b) && a[line-1] == b[line-1] {
+		line++
+	}
+	return fmt.Sprintf("needs gofmt (first difference at line %d)", line)
+}
+
+// fetchBase returns the content of the named file at revision rev
+// of the repository, which must be hosted on code.google.com.
+func fetchBase(ctxt appengine.Context, repo, rev, name string) ([]byte, error) {
+	// Project repo "go" is go.googlecode.com; subrepo "go.tools" is tools.go.googlecode.com.
+	var host string
+	switch {
+	case repo == "go":
+		host = "go.googlecode.com"
+	case strings.HasPrefix(repo, "go."):
+		host = strings.TrimPrefix(repo, "go.") + ".go.googlecode.com"
+	default:
+		return nil, fmt.Errorf("cannot fetch files from repo %q", repo)
+	}
+	url := fmt.Sprintf("https://%s/hg-history/%s/%s", host, rev, name)
+	res, err := app.Client(ctxt, "codereview").Get(url)
+	if err != nil {
+		ctxt.Errorf("fetch URL <%s>: %v", url, err)
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		ctxt.Errorf("fetch URL <%s>: %v", url, res.Status)
+		return nil, fmt.Errorf("http %v", res.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxAdvisoryFile+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxAdvisoryFile {
+		return nil, fmt.Errorf("%s too large", name)
+	}
+	return data, nil
+}
+
+// A fileDiff is the part of a unified diff that changes a single file.
+type fileDiff struct {
+	name    string
+	created bool // file is new in the patch set
+	deleted bool // file is removed by the patch set
+	hunks   []*hunk
+}
+
+// A hunk is a single @@ section of a fileDiff.
+type hunk struct {
+	oldStart int      // first line of the base file covered, counting from 1
+	lines    []string // lines with their ' ', '-' or '+' prefix
+}
+
+var hunkRE = regexp.MustCompile(`^@@ -([0-9]+)(?:,([0-9]+))? \+([0-9]+)(?:,([0-9]+))? @@`)
+
+// parseDiff splits the unified diff text, as served by Rietveld,
+// into its per-file parts.
+func parseDiff(text string) []*fileDiff {
+	var (
+		files []*fileDiff
+		fd    *fileDiff
+		h     *hunk
+	)
+	for _, line := range strings.Split(text, "\n") {
+		switch {
+		case strings.HasPrefix(line, "Index: "):
+			fd = &fileDiff{name: strings.TrimSpace(strings.TrimPrefix(line, "Index: "))}
+			files = append(files, fd)
+			h = nil
+		case fd == nil:
+			// preamble
+		case h == nil && strings.HasPrefix(line, "--- "):
+			if strings.HasPrefix(line, "--- /dev/null") {
+				fd.created = true
+			}
+		case h == nil && strings.HasPrefix(line, "+++ "):
+			if strings.HasPrefix(line, "+++ /dev/null") {
+				fd.deleted = true
+			}
+		case strings.HasPrefix(line, "@@ "):
+			m := hunkRE.FindStringSubmatch(line)
+			if m == nil {
+				h = nil
+				continue
+			}
+			start, _ := strconv.Atoi(m[1])
+			if start == 0 && m[2] == "0" {
+				fd.created = true
+			}
+			h = &hunk{oldStart: start}
+			fd.hunks = append(fd.hunks, h)
+		case h != nil && line != "" && strings.IndexByte(" -+", line[0]) >= 0:
+			h.lines = append(h.lines, line)
+		}
+	}
+	return files
+}
+
+// apply applies the diff to the base file content and returns the result.
+func (fd *fileDiff) apply(base []byte) ([]byte, error) {
+	var old []string
+	if len(base) > 0 {
+		old = strings.Split(strings.TrimSuffix(string(base), "\n"), "\n")
+	}
+	var out []string
+	i := 0 // next line of old to copy
+	for _, h := range fd.hunks {
+		start := h.oldStart - 1
+		if start < 0 {
+			start = 0
+		}
+		if start < i || start > len(old) {
+			return nil, fmt.Errorf("hunk at line %d out of order", h.oldStart)
+		}
+		out = append(out, old[i:start]...)
+		i = start
+		for _, line := range h.lines {
+			switch line[0] {
+			case ' ', '-':
+				if i >= len(old) || old[i] != line[1:] {
+					return nil, fmt.Errorf("hunk at line %d does not match base", h.oldStart)
+				}
+				if line[0] == ' ' {
+					out = append(out, old[i])
+				}
+				i++
+			case '+':
+				out = append(out, line[1:])
+			}
+		}
+	}
+	out = append(out, old[i:]...)
+	if len(out) == 0 {
+		return nil, nil
+	}
+	return []byte(strings.Join(out, "\n") + "\n"), nil
+}
+
+// advisoryComment returns the comment reporting the problems found
+// in patch set ps.
+func advisoryComment(ps, problems string) *rietveld.Comment {
+	return &rietveld.Comment{
+		Message: "gofmt found problems in patch set " + ps + ":\n\n" + problems +
+			"\nThis is an automated advisory; it does not affect the review.\n" +
+			"To stop these messages for this CL, add NOADVISORY to its description.\n",
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codereview
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"app"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"appengine/user"
+)
+
+// Reviewer availability.
+//
+// A reviewer who will be away, on vacation or otherwise, records the
+// dates in an Away record, either on the dashboard's /settings page or,
+// on their behalf, with the codereview.away op. While the record covers
+// the current time, SuggestAvailable skips the reviewer, so that the
+// dashboard suggests and assigns CLs to someone else, and the dashboard
+// marks the reviewer as away wherever it shows them.
+
+// An Away records that a reviewer is unavailable from From until Until.
+// It is stored in the datastore under the reviewer's email address, in lower case.
+type Away struct {
+	Email string
+	From  time.Time
+	Until time.Time
+	Note  string `datastore:",noindex"` // shown with the away marker, such as "back on the 12th"
+	By    string `datastore:",noindex"` // who recorded it, if not the reviewer
+}
+
+// Covers reports whether the reviewer is away at time t.
+func (a *Away) Covers(t time.Time) bool {
+	return !t.Before(a.From) && t.Before(a.Until)
+}
+
+// Absences maps lower-case email addresses to the Away records
+// of the reviewers away at a particular time (see LoadAway).
+type Absences map[string]*Away
+
+// Lookup returns the Away record for email, or nil if email is not away.
+func (m Absences) Lookup(email string) *Away {
+	return m[strings.ToLower(email)]
+}
+
+// IsAway reports whether email is away.
+func (m Absences) IsAway(email string) bool {
+	return m.Lookup(email) != nil
+}
+
+const awayCacheKey = "codereview.away"
+
+func init() {
+	app.RegisterStatus("codereview reviewers away", awayStatus)
+	app.RegisterOp("codereview.away", "Record that a reviewer is away from one date (default today) until another, inclusive, in YYYY-MM-DD form. An empty until clears the record.",
+		[]string{"email", "from", "until", "note"}, func(ctxt appengine.Context, args map[string]string) (string, error) {
+			email := strings.TrimSpace(args["email"])
+			if email == "" {
+				return "", fmt.Errorf("missing email")
+			}
+			if strings.TrimSpace(args["until"]) == "" {
+				if err := ClearAway(ctxt, email); err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("%s is no longer away", email), nil
+			}
+			a, err := ParseAway(email, args["from"], args["until"], args["note"])
+			if err != nil {
+				return "", err
+			}
+			if u := user.Current(ctxt); u != nil {
+				a.By = u.Email
+			}
+			if err := SetAway(ctxt, a); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s is away from %s, back %s", email, a.From.Format("2006-01-02"), a.Until.Format("2006-01-02")), nil
+		})
+}
+
+// ParseAway returns the Away record for email being away from the date from,
+// or today if from is empty, through the date until, both in YYYY-MM-DD form.
+// Dates are taken to be in UTC; the record ends at the start of the day after until.
+func ParseAway(email, from, until, note string) (*Away, error) {
+	a := &Away{Email: email, Note: strings.TrimSpace(note)}
+	if from = strings.TrimSpace(from); from == "" {
+		a.From = time.Now().UTC().Truncate(24 * time.Hour)
+	} else {
+		t, err := time.Parse("2006-01-02", from)
+		if err != nil {
+			return nil, fmt.Errorf("invalid from date %q", from)
+		}
+		a.From = t
+	}
+	t, err := time.Parse("2006-01-02", strings.TrimSpace(until))
+	if err != nil {
+		return nil, fmt.Errorf("invalid until date %q", until)
+	}
+	a.Until = t.Add(24 * time.Hour)
+	if !a.From.Before(a.Until) {
+		return nil, fmt.Errorf("until date is before from date")
+	}
+	return a, nil
+}
+
+// SetAway stores the Away record a, replacing any earlier one for the same reviewer.
+func SetAway(ctxt appengine.Context, a *Away) error {
+	if err := app.WriteData(ctxt, "Away", strings.ToLower(a.Email), a); err != nil {
+		return err
+	}
+	memcache.Delete(ctxt, awayCacheKey)
+	return nil
+}
+
+// ClearAway deletes the Away record for email, if any.
+func ClearAway(ctxt appengine.Context, email string) error {
+	err := app.DeleteData(ctxt, "Away", strings.ToLower(email))
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	memcache.Delete(ctxt, awayCacheKey)
+	return nil
+}
+
+// ReadAway returns the Away record for email, which may have ended
+// or not yet begun, or nil if there is none.
+func ReadAway(ctxt appengine.Context, email string) *Away {
+	var a Away
+	if err := app.ReadData(ctxt, "Away", strings.ToLower(email), &a); err != nil {
+		return nil
+	}
+	return &a
+}
+
+// LoadAway returns the reviewers away at time t.
+// The records are cached in memcache, so t should be close to the current time.
+func LoadAway(ctxt appengine.Context, t time.Time) (Absences, error) {
+	var list []*Away
+	if _, err := memcache.JSON.Get(ctxt, awayCacheKey, &list); err != nil {
+		_, err := datastore.NewQuery("Away").
+			Filter("Until >", time.Now()).
+			GetAll(ctxt, &list)
+		if err != nil {
+			ctxt.Errorf("loading away records: %v", err)
+			return nil, fmt.Errorf("loading away records failed")
+		}
+		memcache.JSON.Set(ctxt, &memcache.Item{Key: awayCacheKey, Object: list, Expiration: 1 * time.Hour})
+	}
+	return absencesAt(list, t), nil
+}
+
+// absencesAt returns the reviewers in list away at time t.
+func absencesAt(list []*Away, t time.Time) Absences {
+	m := make(Absences)
+	for _, a := range list {
+		if a.Covers(t) {
+			m[strings.ToLower(a.Email)] = a
+		}
+	}
+	return m
+}
+
+// SuggestAvailable is like SuggestReviewers but omits the owners who are away.
+// If all the owners of a directory are away, it suggests the owners of the
+// closest parent directory with someone available instead.
+func (o Owners) SuggestAvailable(cl *CL, away Absences) []string {
+	var out []string
+	seen := map[string]bool{cl.OwnerEmail: true}
+	for _, dir := range cl.Dirs() {
+		for d := o.Lookup(dir); d != nil; d = o.parent(d.Dir) {
+			found := false
+			for _, who := range d.Owners {
+				if away.IsAway(who) {
+					continue
+				}
+				found = true
+				if !seen[who] {
+					seen[who] = true
+					out = append(out, who)
+				}
+			}
+			if found {
+				break
+			}
+		}
+	}
+	return out
+}
+
+// parent returns the DirOwner for the closest parent of dir that has one,
+// or nil if there is none.
+func (o Owners) parent(dir string) *DirOwner {
+	i := strings.LastIndex(dir, "/")
+	if i < 0 {
+		return nil
+	}
+	return o.Lookup(dir[:i])
+}
+
+func awayStatus(ctxt appengine.Context) string {
+	var list []*Away
+	_, err := datastore.NewQuery("Away").
+		Filter("Until >", time.Now()).
+		Order("Until").
+		GetAll(ctxt, &list)
+	w := new(bytes.Buffer)
+	if err != nil {
+		fmt.Fprintf(w, "error loading away records: %v\n", err)
+	}
+	if len(list) == 0 {
+		fmt.Fprintf(w, "nobody away\n")
+	}
+	now := time.Now()
+	for _, a := range list {
+		state := "away"
+		if !a.Covers(now) {
+			state = "will be away"
+		}
+		fmt.Fprintf(w, "%s %s from %s, back %s", a.Email, state, a.From.Format("2006-01-02"), a.Until.Format("2006-01-02"))
+		if a.Note != "" {
+			fmt.Fprintf(w, ": %s", a.Note)
+		}
+		if a.By != "" {
+			fmt.Fprintf(w, " (recorded by %s)", a.By)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	return "<pre>" + html.EscapeString(w.String()) + "</pre>"
+}
@@ -0,0 +1,132 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codereview
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"time"
+
+	"app"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// A BuildResult is the result of building and testing
+// one patch set of a CL on a single builder.
+type BuildResult struct {
+	PatchSet string
+	Builder  string
+	OK       bool
+	URL      string // log or status page
+	Time     time.Time
+}
+
+// maxBuildResults limits the number of results kept per CL.
+const maxBuildResults = 50
+
+func init() {
+	app.Handle("/api/codereview/build", postBuild)
+	app.RegisterAPI("/api/codereview/build", "POST a build result for a CL's patch set. Requires the build key.",
+		[]string{"cl", "patchset", "builder", "ok", "url", "key"}, nil)
+}
+
+// postBuild records a build result reported by a builder.
+// The request must be a POST with parameters cl, patchset, builder, ok (true or false),
+// url, and key, which must match the codereview.build.key metadata.
+func postBuild(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "must POST", 405)
+		return
+	}
+	var key string
+	if err := app.ReadMetaCached(ctxt, "codereview.build.key", &key); err != nil || key == "" {
+		ctxt.Errorf("reading build key: %v", err)
+		http.Error(w, "build reporting not configured", 500)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(req.FormValue("key")), []byte(key)) != 1 {
+		http.Error(w, "invalid key", 403)
+		return
+	}
+
+	r := BuildResult{
+		PatchSet: req.FormValue("patchset"),
+		Builder:  req.FormValue("builder"),
+		OK:       req.FormValue("ok") == "true",
+		URL:      req.FormValue("url"),
+		Time:     time.Now(),
+	}
+	if r.PatchSet == "" || r.Builder == "" {
+		http.Error(w, "missing patchset or builder", 400)
+		return
+	}
+	if err := addBuildResult(ctxt, req.FormValue("cl"), r); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	fmt.Fprintf(w, "OK\n")
+}
+
+// addBuildResult records r in the CL with the given number,
+// replacing any earlier result from the same builder for the same patch set.
+func addBuildResult(ctxt appengine.Context, clnumber string, r BuildResult) error {
+	err := app.Transaction(ctxt, func(ctxt appengine.Context) error {
+		var cl CL
+		if err := app.ReadData(ctxt, "CL", clnumber, &cl); err != nil {
+			if err == datastore.ErrNoSuchEntity {
+				return fmt.Errorf("unknown CL %s", clnumber)
+			}
+			return err
+		}
+		var list []BuildResult
+		for _, old := range cl.BuildResults {
+			if old.PatchSet != r.PatchSet || old.Builder != r.Builder {
+				list = append(list, old)
+			}
+		}
+		list = append(list, r)
+		if len(list) > maxBuildResults {
+			list = list[len(list)-maxBuildResults:]
+		}
+		cl.BuildResults = list
+		cl.Updated = time.Now()
+		return app.WriteData(ctxt, "CL", clnumber, &cl)
+	})
+	if err != nil {
+		ctxt.Errorf("storing build result for CL %s: %v", clnumber, err)
+		return err
+	}
+	app.BumpDataVersion(ctxt)
+	return nil
+}
+
+// LatestBuildResults returns the build results for the CL's most recent patch set.
+func (cl *CL) LatestBuildResults() []BuildResult {
+	if len(cl.PatchSets) == 0 {
+		return nil
+	}
+	ps := cl.PatchSets[len(cl.PatchSets)-1]
+	var list []BuildResult
+	for _, r := range cl.BuildResults {
+		if r.PatchSet == ps {
+			list = append(list, r)
+		}
+	}
+	return list
+}
+
+// updateBuildOK sets cl.BuildOK.
+func (cl *CL) updateBuildOK() {
+	list := cl.LatestBuildResults()
+	cl.BuildOK = len(list) > 0
+	for _, r := range list {
+		if !r.OK {
+			cl.BuildOK = false
+		}
+	}
+}
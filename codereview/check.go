@@ -0,0 +1,58 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codereview
+
+import (
+	"fmt"
+	"strings"
+
+	"appengine"
+	"appengine/datastore"
+
+	"app"
+)
+
+func init() {
+	app.RegisterCheck("codereview.patches",
+		datastore.NewQuery("CL").Filter("PatchSetsLoaded =", true),
+		checkPatches)
+
+	// The dashboard attaches active CLs to the issues named in their
+	// descriptions, so a dead CL that is still active shows up as
+	// pending on those issues.
+	app.RegisterCheck("codereview.dead",
+		datastore.NewQuery("CL").Filter("Dead =", true).Filter("Active =", true),
+		func(ctxt appengine.Context, kind, key string) (string, error) {
+			return "dead CL still active", nil
+		})
+}
+
+// checkPatches checks that every patch set listed in a loaded CL
+// has a stored Patch, except those pruned by the retention policy.
+func checkPatches(ctxt appengine.Context, kind, key string) (string, error) {
+	var cl CL
+	if err := app.ReadData(ctxt, "CL", key, &cl); err != nil {
+		return "", err
+	}
+	live := cl.livePatchSets()
+	keys := make([]string, len(live))
+	for i, ps := range live {
+		keys[i] = cl.CL + "/" + ps
+	}
+	ok, err := app.DataExistsMulti(ctxt, "Patch", keys)
+	if err != nil {
+		return "", err
+	}
+	var missing []string
+	for i, ps := range live {
+		if !ok[i] {
+			missing = append(missing, ps)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Sprintf("missing patch sets %s", strings.Join(missing, ", ")), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codereview
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"time"
+
+	"app"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// A staleError reports that Rietveld sent a CL older than the stored one.
+type staleError struct {
+	CL   string
+	Have time.Time
+	Sent time.Time
+}
+
+func (e *staleError) Error() string {
+	return fmt.Sprintf("CL %v: have %v but Rietveld sent %v", e.CL, e.Have, e.Sent)
+}
+
+// maxClockSkew is the largest regression in a CL's modification time
+// that is attributed to clock skew between Rietveld servers.
+const maxClockSkew = 5 * time.Minute
+
+// A Conflict records a CL whose Rietveld modification time went backward,
+// for an admin to look at. It is stored under the CL number.
+// While it exists, the loaders leave the stored CL alone.
+type Conflict struct {
+	CL   string
+	Have time.Time // stored modification time
+	Sent time.Time // modification time of the refetched CL
+	Time time.Time // when the conflict was found
+}
+
+// resolveConflict handles a staleError from storing cl.
+//
+// Search results can lag behind the CL itself, so resolveConflict first
+// refetches the CL, and if the refetched CL is not older than the stored
+// one, stores that instead. If it is older, but only by a little, the
+// difference is put down to clock skew and Rietveld's copy is stored.
+// Otherwise Rietveld's modification time has genuinely gone backward;
+// the CL is recorded as a Conflict, to be resolved with the
+// codereview.conflict.accept op, and left alone until then.
+//
+// Either way, resolveConflict advances the loader's modification time,
+// so that a single CL cannot wedge the load.
+func resolveConflict(ctxt appengine.Context, cl *CL, stale *staleError, mtimeKey, modified string) error {
+	var c Conflict
+	if err := app.ReadData(ctxt, "Conflict", cl.CL, &c); err == nil && c.Have.Equal(stale.Have) {
+		// Already recorded, waiting for an admin.
+		return advanceMtime(ctxt, mtimeKey, modified)
+	}
+
+	fresh, err := fetchCL(ctxt, cl.CL)
+	if err != nil {
+		ctxt.Errorf("resolving %v: refetch: %v", stale, err)
+		return err
+	}
+	if !fresh.Modified.Before(stale.Have) {
+		ctxt.Infof("resolving %v: refetched CL has %v", stale, fresh.Modified)
+		return storeCL(ctxt, fresh, mtimeKey, modified, false)
+	}
+	if stale.Have.Sub(fresh.Modified) <= maxClockSkew {
+		ctxt.Infof("resolving %v: refetched CL has %v, within clock skew", stale, fresh.Modified)
+		return storeCL(ctxt, fresh, mtimeKey, modified, true)
+	}
+
+	ctxt.Errorf("resolving %v: refetched CL has %v; recording conflict", stale, fresh.Modified)
+	c = Conflict{CL: cl.CL, Have: stale.Have, Sent: fresh.Modified, Time: time.Now()}
+	if err := app.WriteData(ctxt, "Conflict", cl.CL, &c); err != nil {
+		return err
+	}
+	return advanceMtime(ctxt, mtimeKey, modified)
+}
+
+func advanceMtime(ctxt appengine.Context, mtimeKey, modified string) error {
+	if mtimeKey == "" {
+		return nil
+	}
+	return app.WriteMeta(ctxt, mtimeKey, modified)
+}
+
+// fetchCL fetches the CL with the given number, with messages, from Rietveld.
+func fetchCL(ctxt appengine.Context, key string) (*CL, error) {
+	var jcl jsonCL
+	err := fetchJSON(ctxt, &jcl, urlWithParams(issueTmpl, map[string]string{
+		"CL": key,
+	}))
+	if err != nil {
+		return nil, err
+	}
+	cl, err := jcl.toCL(ctxt)
+	if err != nil {
+		return nil, err
+	}
+	cl.MessagesLoaded = true
+	return cl, nil
+}
+
+func init() {
+	app.RegisterStatus("codereview conflicts", conflictStatus)
+	app.RegisterOp("codereview.conflict.accept", "Store Rietveld's copy of a CL recorded as a modification time conflict, replacing the newer stored copy.", []string{"cl"}, func(ctxt appengine.Context, args map[string]string) (string, error) {
+		key := args["cl"]
+		var c Conflict
+		if err := app.ReadData(ctxt, "Conflict", key, &c); err != nil {
+			return "", fmt.Errorf("no conflict recorded for CL %s", key)
+		}
+		cl, err := fetchCL(ctxt, key)
+		if err != nil {
+			return "", err
+		}
+		if err := storeCL(ctxt, cl, "", "", true); err != nil {
+			return "", err
+		}
+		app.DeleteData(ctxt, "Conflict", key)
+		return fmt.Sprintf("stored CL %s modified %v (had %v)", key, cl.Modified, c.Have), nil
+	})
+}
+
+func conflictStatus(ctxt appengine.Context) string {
+	var list []*Conflict
+	_, err := datastore.NewQuery("Conflict").Order("Time").Limit(100).GetAll(ctxt, &list)
+	w := new(bytes.Buffer)
+	if err != nil {
+		fmt.Fprintf(w, "error: %v\n", err)
+	}
+	if len(list) == 0 {
+		fmt.Fprintf(w, "no conflicts\n")
+	}
+	for _, c := range list {
+		fmt.Fprintf(w, "CL %s: have %v, Rietveld has %v (found %v)\n", c.CL, c.Have, c.Sent, c.Time)
+	}
+	return "<pre>" + html.EscapeString(w.String()) + "</pre>"
+}
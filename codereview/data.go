@@ -8,13 +8,19 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"app"
+	"identity"
+	"issue"
+
+	"appengine"
+	"appengine/datastore"
 )
 
 type CL struct {
-	DV int `dataversion:"21"`
+	DV int `dataversion:"27"`
 
 	// Fields mirrored from codereview.appspot.com.
 	// If you add a field here, update load.go.
@@ -44,6 +50,8 @@ type CL struct {
 	MoreFiles       bool      // files modified list is truncated (at >100 files)
 	FilesModified   time.Time // time of last patch set
 	Delta           int64     // lines modified, learned from patch sets
+	PatchSetsPruned int       // leading PatchSets whose records were deleted (see retain.go)
+	PrunedComments  int       // comments on the pruned patch sets
 	PrimaryReviewer string    // derived from messages
 	NeedsReview     bool      // time for reviewer to look at CL
 	LGTM            []string  // lgtms
@@ -51,6 +59,45 @@ type CL struct {
 	DescIssue       []string  // issue numbers in latest description
 	MailedIssue     []string  // issues notified about this CL
 	NeedMailIssue   []string  // issues that need mail
+	SkippedIssue    []string  // mentioned issues not mailed because they are missing, closed, or moved
+
+	// InheritedPriority is the priority of the most urgent open issue
+	// in DescIssue (see priority.go).
+	InheritedPriority int
+
+	// Urgent is the first urgency phrase, such as "security",
+	// mentioned in the description or messages (see issue.Urgency).
+	Urgent string
+
+	// Updated is the time this app last changed the CL,
+	// used to find changed CLs (see app.DataVersion).
+	Updated time.Time
+
+	// Indexed reports whether the CL is up to date
+	// in the search index (see search.go).
+	Indexed bool
+
+	// Build results, reported by the builders (see build.go).
+	BuildResults []BuildResult `datastore:",noindex"`
+	BuildOK      bool          // all results for the latest patch set passed
+
+	// NeedsSecond is the reviewer who asked for a second reviewer
+	// to look at the CL, if any (see SetNeedsSecond).
+	NeedsSecond string
+
+	// Problems found in the description (see lint.go).
+	DescLint      []string `datastore:",noindex"`
+	LintPending   bool     // findings not yet posted as a comment
+	LintCommented bool     // findings posted, or too late to post
+
+	// Formatting advisories (see advisory.go).
+	AdvisedPatchSet string // latest patch set checked
+	AdvisoryPending bool   // latest patch set not yet checked
+	NoAdvisory      bool   // CL opted out
+
+	// Spill is managed by package app, for CLs with very long
+	// review threads.
+	Spill app.Spill `datastore:",noindex"`
 }
 
 func isSubmitted(cl *CL) bool {
@@ -79,6 +126,12 @@ func updateCL(cl *CL) {
 	sort.Strings(cl.DescIssue)
 	sort.Strings(cl.MailedIssue)
 
+	cl.Urgent = cl.urgency()
+
+	cl.updateBuildOK()
+	cl.updateLint()
+	cl.AdvisoryPending = cl.advisoryPending()
+
 	cl.NeedMailIssue = nil
 	/*
 		if cl.Active && (strings.HasPrefix(cl.Repo, "go.") || cl.Repo == "go") {
@@ -86,6 +139,9 @@ func updateCL(cl *CL) {
 			for _, issue := range cl.MailedIssue {
 				mailed[issue] = true
 			}
+			for _, issue := range cl.SkippedIssue {
+				mailed[issue] = true
+			}
 			for _, issue := range cl.DescIssue {
 				if !mailed[issue] {
 					cl.NeedMailIssue = append(cl.NeedMailIssue, issue)
@@ -115,8 +171,68 @@ func updateCL(cl *CL) {
 	cl.Summary = s
 }
 
+// urgency returns the first urgency phrase in the CL's description
+// or messages (see issue.Urgency).
+func (cl *CL) urgency() string {
+	if u := issue.Urgency(cl.Desc); u != "" {
+		return u
+	}
+	for _, m := range cl.Messages {
+		if u := issue.Urgency(m.Text); u != "" {
+			return u
+		}
+	}
+	return ""
+}
+
+// clCacheTime is how long a CL stays in the data cache (see app.RegisterDataCache).
+const clCacheTime = 1 * time.Hour
+
 func init() {
 	app.RegisterDataUpdater("CL", updateCL)
+	app.RegisterDataCache("CL", clCacheTime)
+}
+
+// LoadActive returns up to limit active CLs.
+// It queries only for their keys and reads the CLs through the data cache,
+// so that the dashboard, which loads them all for every page, mostly
+// avoids reading them from the datastore.
+func LoadActive(ctxt appengine.Context, limit int) ([]*CL, error) {
+	keys, err := datastore.NewQuery("CL").
+		Filter("Active =", true).
+		KeysOnly().
+		Limit(limit).
+		GetAll(ctxt, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	names := make([]string, len(keys))
+	cls := make([]*CL, len(keys))
+	for i, k := range keys {
+		names[i] = k.StringID()
+		cls[i] = new(CL)
+	}
+	err = app.ReadDataMulti(ctxt, "CL", names, cls)
+	if me, ok := err.(appengine.MultiError); ok {
+		// Skip CLs deleted since the query.
+		var found []*CL
+		for i, err := range me {
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return nil, err
+			}
+			if err == nil {
+				found = append(found, cls[i])
+			}
+		}
+		return found, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cls, nil
 }
 
 type Message struct {
@@ -139,7 +255,8 @@ type Patch struct {
 	Modified    time.Time
 	Owner       string
 	NumComments int
-	Message     string `datastore:",noindex"`
+	Message     string    `datastore:",noindex"`
+	Spill       app.Spill `datastore:",noindex"` // managed by package app
 }
 
 type File struct {
@@ -218,7 +335,7 @@ func (cl *CL) Dirs() []string {
 }
 
 var (
-	reviewerRE   = regexp.MustCompile(`(?m)^(?:TB)?R=([\w\-.]+)\b`)
+	reviewerRE   = regexp.MustCompile(`(?m)^(?:TB)?R=([\w\-.]+)(@[\w\-.]+)?\b`)
 	qRE          = regexp.MustCompile(`(?m)^Q=(\w+)\b`)
 	lgtmRE       = regexp.MustCompile(`(?im)^LGTM`)
 	notlgtmRE    = regexp.MustCompile(`(?im)^NOT LGTM`)
@@ -226,8 +343,62 @@ var (
 	helloRepoRE  = regexp.MustCompile(`(?m)Hello[^\n]+\n\nI'd like you to review this change to\nhttps?://(?:[^/]*@)?(code.google.com/[pr]/[a-z0-9_.\-]+)`)
 	helloRepoRE2 = regexp.MustCompile(`(?m)Hello[^\n]+\n\nI'd like you to review this change to\nhttps?://(?:[^/]*@)?([a-z0-9_\-]+)\.googlecode\.com`)
 	ptalRE       = regexp.MustCompile(`(?im)^(PTAL|Please take a(nother)? look|I'd like you to review this change)`)
+	delegatedRE  = regexp.MustCompile(`(?m)^\(sent by ([\w\-.+]+@[\w\-.]+) via the Go dashboard\)$`)
 )
 
+// The bot account used by SetReviewer and SendLGTM, the one logged in
+// at /admin/codelogin, is named by the "codereview.bot" config:
+//
+//	{"Email": "gobot@golang.org"}
+//
+// LGTMs it sends on behalf of committers (see delegatedRE) are credited
+// to those committers, and it is left out of the roster.
+
+type botConfig struct {
+	Email string
+}
+
+var defaultBotConfig = botConfig{
+	Email: "gobot@golang.org",
+}
+
+var bot struct {
+	sync.RWMutex
+	email string
+}
+
+// loadBot rereads the bot's address from the config and returns it.
+// Like identity.Load, it should be called before parsing CLs, since
+// botEmail, which the parsing consults, has no context to read it with.
+func loadBot(ctxt appengine.Context) string {
+	cfg := defaultBotConfig
+	app.ReadConfig(ctxt, "codereview.bot", &cfg)
+	bot.Lock()
+	bot.email = cfg.Email
+	bot.Unlock()
+	return cfg.Email
+}
+
+// botEmail returns the bot's address as of the last loadBot.
+func botEmail() string {
+	bot.RLock()
+	defer bot.RUnlock()
+	if bot.email == "" {
+		return defaultBotConfig.Email
+	}
+	return bot.email
+}
+
+// lgtmSender returns the address to credit for an LGTM or NOT LGTM in m.
+func lgtmSender(m Message) string {
+	if m.Sender == botEmail() {
+		if d := delegatedRE.FindStringSubmatch(m.Text); d != nil {
+			return d[1]
+		}
+	}
+	return m.Sender
+}
+
 func stringKeys(m map[string]bool) []string {
 	var x []string
 	for k := range m {
@@ -237,67 +408,18 @@ func stringKeys(m map[string]bool) []string {
 	return x
 }
 
-var committers = []string{
-	// https://code.google.com/p/go/people/list
-	// Last updated: 2013-12-17
-	"0xe2.0x9a.0x9b@gmail.com",
-	"adg@golang.org",
-	"adonovan@google.com",
-	"agl@golang.org",
-	"alex.brainman@gmail.com",
-	"ality@pbrane.org",
-	"bgarcia@golang.org",
-	"bradfitz@golang.org",
-	"campoy@golang.org",
-	"cmang@golang.org",
-	"crawshaw@google.com",
-	"cshapiro@golang.org",
-	"daniel.morsing@gmail.com",
-	"dave@cheney.net",
-	"djd@golang.org",
-	"dsymonds@golang.org",
-	"dvyukov@google.com",
-	"gri@golang.org",
-	"hectorchu@gmail.com",
-	"iant@golang.org",
-	"jdpoirier@gmail.com",
-	"jsing@google.com",
-	"ken@golang.org",
-	"khr@golang.org",
-	"lvd@golang.org",
-	"mikesamuel@gmail.com",
-	"mikioh.mikioh@gmail.com",
-	"minux.ma@gmail.com",
-	"mpvl@golang.org",
-	"n13m3y3r@gmail.com",
-	"nigeltao@golang.org",
-	"pjw@golang.org",
-	"r@golang.org",
-	"remyoudompheng@gmail.com",
-	"rminnich@gmail.com",
-	"rogpeppe@gmail.com",
-	"rsc@golang.org",
-	"sameer@golang.org",
-}
-
+// IsReviewer returns the canonical email address of the committer
+// with the given address, or the empty string if there is none.
 func IsReviewer(email string) string {
 	return isReviewer(email)
 }
 
 func isReviewer(email string) string {
-	other := ""
-	if strings.HasSuffix(email, "@google.com") {
-		other = strings.TrimSuffix(email, "@google.com") + "@golang.org"
-	}
-	for _, c := range committers {
-		if c == email || c == other {
-			return c
-		}
-
-	}
-	return ""
+	return identity.Current().Committer(email)
 }
 
+// ExpandReviewer is like IsReviewer but also accepts the part of
+// a committer's canonical address before the @.
 func ExpandReviewer(short string) string {
 	return expandReviewer(short)
 }
@@ -306,14 +428,38 @@ func expandReviewer(short string) string {
 	if strings.Contains(short, "@") {
 		return isReviewer(short)
 	}
-	for _, c := range committers {
-		if i := strings.Index(c, "@"); i >= 0 && c[:i] == short {
-			return c
-		}
+	if p := identity.Current().Expand(short); p != nil {
+		return p.Email
 	}
 	return ""
 }
 
+// WaitingOn returns the email address of the person the CL is waiting on:
+// the primary reviewer if the CL needs review, or else the owner.
+// It returns the empty string for a CL that needs review but has
+// no primary reviewer assigned.
+func (cl *CL) WaitingOn() string {
+	if cl.NeedsReview {
+		return cl.PrimaryReviewer
+	}
+	return cl.OwnerEmail
+}
+
+// WantsSecond reports whether the CL is waiting for a second reviewer:
+// someone asked for one and nobody but the primary reviewer
+// and the person asking has said LGTM yet.
+func (cl *CL) WantsSecond() bool {
+	if cl.NeedsSecond == "" {
+		return false
+	}
+	for _, who := range cl.LGTM {
+		if who != cl.PrimaryReviewer && who != cl.NeedsSecond {
+			return false
+		}
+	}
+	return true
+}
+
 // parseMessages updates CL state based on parsing the messages.
 func (cl *CL) parseMessages() {
 	// Determine reviewer and LGTM / not-LGTM.
@@ -333,13 +479,13 @@ func (cl *CL) parseMessages() {
 	cl.Mailed = false
 	cl.Submitted = false
 	for _, m := range cl.Messages {
-		if isReviewer(m.Sender) != "" {
+		if sender := lgtmSender(m); isReviewer(sender) != "" {
 			if notlgtmRE.MatchString(m.Text) {
-				notlgtm[m.Sender] = true
-				delete(lgtm, m.Sender)
+				notlgtm[sender] = true
+				delete(lgtm, sender)
 			} else if lgtmRE.MatchString(m.Text) {
-				lgtm[m.Sender] = true
-				delete(notlgtm, m.Sender)
+				lgtm[sender] = true
+				delete(notlgtm, sender)
 			}
 		}
 		if m := helloRE.FindStringSubmatch(m.Text); m != nil {
@@ -367,10 +513,16 @@ func (cl *CL) parseMessages() {
 				explicitReviewer = "golang-dev"
 			} else if x := expandReviewer(m[1]); x != "" {
 				explicitReviewer = x
+			} else if m[2] != "" {
+				// A full address, perhaps of a contributor
+				// who is not a committer (see ResolveReviewer).
+				explicitReviewer = m[1] + m[2]
 			}
 		}
-		if s := isReviewer(m.Sender); s != "" && m.Sender != cl.OwnerEmail && isReviewer(cl.OwnerEmail) != s && firstResponder == "" {
-			firstResponder = s
+		if sender := lgtmSender(m); firstResponder == "" && sender != cl.OwnerEmail {
+			if s := isReviewer(sender); s != "" && isReviewer(cl.OwnerEmail) != s {
+				firstResponder = s
+			}
 		}
 	}
 
@@ -404,7 +556,7 @@ func (cl *CL) parseMessages() {
 			if ptalRE.MatchString(m.Text) {
 				cl.NeedsReview = true
 			}
-			if m.Sender == cl.PrimaryReviewer {
+			if lgtmSender(m) == cl.PrimaryReviewer {
 				cl.NeedsReview = false
 			}
 		}
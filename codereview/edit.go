@@ -10,13 +10,12 @@ import (
 
 	"app"
 	"codereview/rietveld"
+	"identity"
 
 	"appengine"
 	"appengine/datastore"
 	"appengine/urlfetch"
 	"appengine/user"
-
-	"github.com/rsc/appstats"
 )
 
 type pw struct {
@@ -28,26 +27,42 @@ func (p *pw) Credentials(_, _ string) (user, passwd string, err error) {
 	return p.User, p.Password, nil
 }
 
-func SetReviewer(ctxt appengine.Context, clnumber, who string) error {
-	n, err := strconv.Atoi(clnumber)
-	if err != nil {
-		return fmt.Errorf("invalid cl number %q", clnumber)
-	}
-	u := user.Current(ctxt)
-	if u == nil || u.Email == "" {
-		return fmt.Errorf("must be logged in")
-	}
+// login returns a Rietveld client logged in as the bot account
+// whose password is stored in the codereview.gobot.pw metadata.
+func login(ctxt appengine.Context) (*rietveld.Rietveld, error) {
 	var password pw
 	if err := app.ReadMeta(ctxt, "codereview.gobot.pw", &password); err != nil {
-		return err
+		return nil, err
 	}
-	tr := &urlfetch.Transport{Context: ctxt}
+	tr := app.SecureTransport(ctxt, "codereview", &urlfetch.Transport{Context: ctxt})
 	auth := rietveld.NewAuth(&password, false, "", ctxt)
 	if err := auth.Login("https://codereview.appspot.com/", time.Time{}, tr); err != nil {
 		ctxt.Criticalf("login: %s", err)
+		return nil, err
+	}
+	return rietveld.New("https://codereview.appspot.com/", auth, tr), nil
+}
+
+func SetReviewer(ctxt appengine.Context, clnumber, who string) error {
+	u := user.Current(ctxt)
+	if u == nil || u.Email == "" {
+		return fmt.Errorf("must be logged in")
+	}
+	return SetReviewerBy(ctxt, clnumber, who, u.Email)
+}
+
+// SetReviewerBy is like SetReviewer but records the assignment as made
+// by the user with the given email address instead of the logged-in user.
+// It is for callers that have identified the user some other way.
+func SetReviewerBy(ctxt appengine.Context, clnumber, who, by string) error {
+	n, err := strconv.Atoi(clnumber)
+	if err != nil {
+		return fmt.Errorf("invalid cl number %q", clnumber)
+	}
+	r, err := login(ctxt)
+	if err != nil {
 		return err
 	}
-	r := rietveld.New("https://codereview.appspot.com/", auth, tr)
 	issue, err := r.Issue(n)
 	if err != nil {
 		ctxt.Criticalf("issue: %s", err)
@@ -58,7 +73,7 @@ func SetReviewer(ctxt appengine.Context, clnumber, who string) error {
 		rev = append(rev, who)
 	}
 	c := &rietveld.Comment{
-		Message:   "R=" + who + " (assigned by " + u.Email + ")",
+		Message:   "R=" + who + " (assigned by " + by + ")",
 		Reviewers: rev,
 		Cc:        issue.CcNicks,
 	}
@@ -71,6 +86,71 @@ func SetReviewer(ctxt appengine.Context, clnumber, who string) error {
 	return nil
 }
 
+// SendLGTM posts an LGTM (or, if lgtm is false, a NOT LGTM) on the CL
+// on behalf of the user with the given email address, who must be a committer.
+// The comment is sent by the bot account and names the user;
+// parseMessages credits it to the user (see delegatedRE).
+func SendLGTM(ctxt appengine.Context, clnumber, from string, lgtm bool) error {
+	n, err := strconv.Atoi(clnumber)
+	if err != nil {
+		return fmt.Errorf("invalid cl number %q", clnumber)
+	}
+	email := identity.Load(ctxt).Committer(app.CanonicalEmail(ctxt, from))
+	if email == "" {
+		return fmt.Errorf("%s is not a committer", from)
+	}
+	r, err := login(ctxt)
+	if err != nil {
+		return err
+	}
+	issue, err := r.Issue(n)
+	if err != nil {
+		ctxt.Criticalf("issue: %s", err)
+		return err
+	}
+	msg := "LGTM"
+	if !lgtm {
+		msg = "NOT LGTM"
+	}
+	c := &rietveld.Comment{
+		Message: msg + "\n\n(sent by " + email + " via the Go dashboard)",
+	}
+	if err := r.AddComment(issue, c); err != nil {
+		ctxt.Criticalf("addcomment: %s", err)
+		return err
+	}
+
+	loadmsg(ctxt, "CL", clnumber)
+	return nil
+}
+
+// SetNeedsSecond records that the committer with the given email address
+// wants (or, if on is false, no longer wants) a second reviewer for the CL.
+func SetNeedsSecond(ctxt appengine.Context, clnumber, by string, on bool) error {
+	email := identity.Load(ctxt).Committer(app.CanonicalEmail(ctxt, by))
+	if email == "" {
+		return fmt.Errorf("%s is not a committer", by)
+	}
+	err := app.Transaction(ctxt, func(ctxt appengine.Context) error {
+		var cl CL
+		if err := app.ReadData(ctxt, "CL", clnumber, &cl); err != nil {
+			return err
+		}
+		if on {
+			cl.NeedsSecond = email
+		} else {
+			cl.NeedsSecond = ""
+		}
+		cl.Updated = time.Now()
+		return app.WriteData(ctxt, "CL", clnumber, &cl)
+	})
+	if err != nil {
+		return err
+	}
+	app.BumpDataVersion(ctxt)
+	return nil
+}
+
 func RefreshCL(ctxt appengine.Context, clnumber string) {
 	loadmsg(ctxt, "CL", clnumber)
 }
@@ -80,32 +160,87 @@ func refresh(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
 }
 
 func init() {
-	http.Handle("/admin/codereview/setreviewer", appstats.NewHandler(setreviewer))
-	http.Handle("/admin/codereview/fixone", appstats.NewHandler(fixone))
-	http.Handle("/admin/codereview/refresh", appstats.NewHandler(refresh))
+	app.HandleRole("/admin/codereview/setreviewer", app.ReviewerAdmin, setreviewer)
+	app.Handle("/admin/codereview/fixone", fixone)
+	app.Handle("/admin/codereview/refresh", refresh)
+
+	app.RegisterOp("codereview.refresh", "Reload the CL from Rietveld.", []string{"cl"}, func(ctxt appengine.Context, args map[string]string) (string, error) {
+		if err := loadmsg(ctxt, "CL", args["cl"]); err != nil {
+			return "", err
+		}
+		return "reloaded CL " + args["cl"], nil
+	})
+	app.RegisterOp("codereview.recount", "Recount the stored CLs and reset codereview.count.", nil, func(ctxt appengine.Context, args map[string]string) (string, error) {
+		n, err := app.CountKeys(ctxt, datastore.NewQuery("CL"))
+		if err != nil {
+			return "", err
+		}
+		if err := app.WriteMeta(ctxt, "codereview.count", n); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("codereview.count = %d", n), nil
+	})
 
 	app.RegisterStatus("codereview golang-dev ⇒ golang-codereviews conversion", fixgolangstatus)
+	app.RegisterQuery("codereview.golangdev.reviewers", golangDevQuery("Reviewers"))
+	app.RegisterQuery("codereview.golangdev.cc", golangDevQuery("CC"))
 
-	app.ScanData("codereview.fixgolang-reviewer", 5*time.Minute,
-		datastore.NewQuery("CL").
-			Filter("Active =", true).
-			Filter("Reviewers =", "golang-dev@googlegroups.com"),
-		fixgolang)
+	app.Cron("codereview.fixgolang", 5*time.Minute, fixgolangCron)
+}
 
-	app.ScanData("codereview.fixgolang-cc", 5*time.Minute,
-		datastore.NewQuery("CL").
-			Filter("Active =", true).
-			Filter("CC =", "golang-dev@googlegroups.com"),
-		fixgolang)
+// golangDevQuery returns the query for the active CLs that list
+// golang-dev in the given field, Reviewers or CC.
+func golangDevQuery(field string) *datastore.Query {
+	return datastore.NewQuery("CL").
+		Filter("Active =", true).
+		Filter(field+" =", "golang-dev@googlegroups.com")
+}
+
+// fixgolangChunk is the number of CLs per field that fixgolangCron
+// converts in a single run.
+const fixgolangChunk = 50
+
+// fixgolangCron converts a chunk of the active CLs that still list golang-dev
+// as a reviewer or CC, all with a single Rietveld login.
+func fixgolangCron(ctxt appengine.Context) error {
+	var keys []string
+	seen := make(map[string]bool)
+	more := false
+	for _, field := range []string{"Reviewers", "CC"} {
+		ks, err := golangDevQuery(field).
+			KeysOnly().
+			Limit(fixgolangChunk).
+			GetAll(ctxt, nil)
+		if err != nil {
+			return err
+		}
+		if len(ks) == fixgolangChunk {
+			more = true
+		}
+		for _, k := range ks {
+			if !seen[k.StringID()] {
+				seen[k.StringID()] = true
+				keys = append(keys, k.StringID())
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := fixgolang(ctxt, keys...); err != nil {
+		return err
+	}
+	if more {
+		return app.ErrMoreCron
+	}
+	return nil
 }
 
 func fixgolangstatus(ctxt appengine.Context) string {
 	w := new(bytes.Buffer)
 
 	const chunk = 1000
-	keys, err := datastore.NewQuery("CL").
-		Filter("Active =", true).
-		Filter("Reviewers =", "golang-dev@googlegroups.com").
+	keys, err := golangDevQuery("Reviewers").
 		KeysOnly().
 		Limit(chunk).
 		GetAll(ctxt, nil)
@@ -122,9 +257,7 @@ func fixgolangstatus(ctxt appengine.Context) string {
 		fmt.Fprintf(w, "found %d active CLs with R=golang-dev: %v\n", len(keys), ids)
 	}
 
-	keys, err = datastore.NewQuery("CL").
-		Filter("Active =", true).
-		Filter("CC =", "golang-dev@googlegroups.com").
+	keys, err = golangDevQuery("CC").
 		KeysOnly().
 		Limit(chunk).
 		GetAll(ctxt, nil)
@@ -153,36 +286,63 @@ func setreviewer(ctxt appengine.Context, w http.ResponseWriter, req *http.Reques
 }
 
 func fixone(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
-	if err := fixgolang(ctxt, "CL", req.FormValue("cl")); err != nil {
+	if err := fixgolang(ctxt, req.FormValue("cl")); err != nil {
 		fmt.Fprintf(w, "ERROR: %s\n", err)
 	} else {
 		fmt.Fprintf(w, "OK\n")
 	}
 }
 
-func fixgolang(ctxt appengine.Context, kind, key string) error {
-	ctxt.Infof("fixgolang %s", key)
-	n, err := strconv.Atoi(key)
-	if err != nil {
-		return fmt.Errorf("invalid cl number %q", key)
-	}
-	var password pw
-	if err := app.ReadMeta(ctxt, "codereview.gobot.pw", &password); err != nil {
-		return err
-	}
-	tr := &urlfetch.Transport{Context: ctxt}
-	auth := rietveld.NewAuth(&password, false, "", ctxt)
-	if err := auth.Login("https://codereview.appspot.com/", time.Time{}, tr); err != nil {
-		ctxt.Criticalf("login: %s", err)
-		return err
+// fixgolang replaces golang-dev with golang-codereviews on the CLs
+// with the given numbers, using a single Rietveld batch.
+// It returns the last error encountered, after trying every CL.
+//
+// Each comment is claimed with app.ClaimPost before the batch sends it,
+// so that overlapping runs do not post the same change twice.
+func fixgolang(ctxt appengine.Context, keys ...string) error {
+	ctxt.Infof("fixgolang %v", keys)
+	var ops []rietveld.Op
+	claimed := make([]string, len(keys)) // content claimed for each CL, if any
+	for i, key := range keys {
+		n, err := strconv.Atoi(key)
+		if err != nil {
+			return fmt.Errorf("invalid cl number %q", key)
+		}
+		i, key := i, key
+		ops = append(ops, rietveld.Op{Id: n, Comment: func(issue *rietveld.Issue) *rietveld.Comment {
+			c := fixgolangComment(issue)
+			if c == nil {
+				return nil
+			}
+			content := fmt.Sprintf("%s\nR=%v\nCC=%v", c.Message, c.Reviewers, c.Cc)
+			if ok, err := app.ClaimPost(ctxt, "cl/"+key, "fixgolang", content); err != nil || !ok {
+				return nil
+			}
+			claimed[i] = content
+			return c
+		}})
 	}
-	defer loadmsg(ctxt, "CL", key)
-	r := rietveld.New("https://codereview.appspot.com/", auth, tr)
-	issue, err := r.Issue(n)
+	r, err := login(ctxt)
 	if err != nil {
-		ctxt.Criticalf("issue: %s", err)
 		return err
 	}
+	var last error
+	for i, res := range r.Batch(ops) {
+		if res.Err != nil {
+			ctxt.Criticalf("fixgolang %s: %s", keys[i], res.Err)
+			last = res.Err
+		}
+		if claimed[i] != "" {
+			app.FinishPost(ctxt, "cl/"+keys[i], "fixgolang", claimed[i], res.Err)
+		}
+		loadmsg(ctxt, "CL", keys[i])
+	}
+	return last
+}
+
+// fixgolangComment returns the comment replacing golang-dev with
+// golang-codereviews on the issue, or nil if the issue does not need one.
+func fixgolangComment(issue *rietveld.Issue) *rietveld.Comment {
 	fixed := false
 	for i, addr := range issue.ReviewerMails {
 		if addr == "golang-dev@googlegroups.com" {
@@ -199,17 +359,11 @@ func fixgolang(ctxt appengine.Context, kind, key string) error {
 	if !fixed {
 		return nil // already good
 	}
-	c := &rietveld.Comment{
+	return &rietveld.Comment{
 		Message:   golangCodereviewMessage,
 		Reviewers: issue.ReviewerMails,
 		Cc:        issue.CcMails,
 	}
-	if err := r.AddComment(issue, c); err != nil {
-		ctxt.Criticalf("addcomment: %s", err)
-		return err
-	}
-
-	return nil
 }
 
 var golangCodereviewMessage = `Replacing golang-dev with golang-codereviews.
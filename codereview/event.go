@@ -0,0 +1,140 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codereview
+
+// A ReviewersEvent is published on the "codereview.reviewers" topic
+// (see app.Publish) when the loader finds that people have been added
+// to a CL's reviewers or CC list on Rietveld. The event key is the CL number.
+//
+// CLs seen for the first time do not generate events, so that the
+// initial load does not announce every reviewer of every CL.
+type ReviewersEvent struct {
+	CL         string
+	Summary    string
+	OwnerEmail string
+	Reviewers  []string // added reviewers
+	CC         []string // added CCs
+}
+
+// reviewersAdded returns the event announcing the reviewers and CCs
+// added between old and cl, or nil if there are none.
+func reviewersAdded(old, cl *CL) *ReviewersEvent {
+	e := &ReviewersEvent{
+		CL:         cl.CL,
+		Summary:    cl.Summary,
+		OwnerEmail: cl.OwnerEmail,
+		Reviewers:  added(old.Reviewers, cl.Reviewers),
+		CC:         added(old.CC, cl.CC),
+	}
+	if len(e.Reviewers) == 0 && len(e.CC) == 0 {
+		return nil
+	}
+	return e
+}
+
+// added returns the elements of cur not in old.
+func added(old, cur []string) []string {
+	had := make(map[string]bool)
+	for _, x := range old {
+		had[x] = true
+	}
+	var list []string
+	for _, x := range cur {
+		if !had[x] {
+			list = append(list, x)
+		}
+	}
+	return list
+}
+
+// An IssuesEvent is published on the "codereview.issues" topic when an
+// active CL becomes linked to issues by mentioning them in its description.
+// The event key is the CL number.
+//
+// The event is only published once the CL's files are known, so that
+// subscribers can use Dirs to tell what the CL is about: a CL that mentions
+// issues before its patch sets are loaded is announced when they are.
+type IssuesEvent struct {
+	CL      string
+	Summary string
+	Dirs    []string // cl.Dirs()
+	Issues  []string // newly linked issue numbers
+}
+
+// issuesLinked returns the event announcing the issues linked
+// between old and cl, or nil if there are none.
+func issuesLinked(old, cl *CL) *IssuesEvent {
+	if !cl.Active || len(cl.Files) == 0 {
+		return nil
+	}
+	var issues []string
+	if len(old.Files) == 0 || !old.Active {
+		issues = cl.DescIssue
+	} else {
+		issues = added(old.DescIssue, cl.DescIssue)
+	}
+	if len(issues) == 0 {
+		return nil
+	}
+	return &IssuesEvent{
+		CL:      cl.CL,
+		Summary: cl.Summary,
+		Dirs:    cl.Dirs(),
+		Issues:  issues,
+	}
+}
+
+// A ChangeEvent is published on the "codereview.changed" topic when the
+// loader finds that a CL's state has changed in a way people watching it
+// would want to know about. The event key is the CL number.
+// Like ReviewersEvent, it is not published for CLs seen for the first time.
+type ChangeEvent struct {
+	CL         string
+	Summary    string
+	OwnerEmail string
+	Dirs       []string // cl.Dirs()
+	Changes    []string // descriptions of the changes, such as "submitted"
+	Urgent     string   // the CL's urgency phrase, if any (see issue.Urgency)
+}
+
+// clChanged returns the event describing the changes between old and cl,
+// or nil if there are none worth announcing.
+func clChanged(old, cl *CL) *ChangeEvent {
+	var list []string
+	switch {
+	case !old.Submitted && cl.Submitted:
+		list = append(list, "submitted")
+	case !old.Closed && cl.Closed:
+		list = append(list, "closed")
+	case old.Closed && !cl.Closed:
+		list = append(list, "reopened")
+	}
+	if len(cl.PatchSets) > len(old.PatchSets) {
+		list = append(list, "new patch set")
+	}
+	if old.MessagesLoaded && cl.MessagesLoaded && len(cl.Messages) > len(old.Messages) {
+		list = append(list, "new message")
+	}
+	if cl.PrimaryReviewer != old.PrimaryReviewer && cl.PrimaryReviewer != "" {
+		list = append(list, "reviewer now "+cl.PrimaryReviewer)
+	}
+	for _, who := range added(old.LGTM, cl.LGTM) {
+		list = append(list, "LGTM from "+who)
+	}
+	if old.Urgent == "" && cl.Urgent != "" {
+		list = append(list, "flagged urgent: "+cl.Urgent)
+	}
+	if len(list) == 0 {
+		return nil
+	}
+	return &ChangeEvent{
+		CL:         cl.CL,
+		Summary:    cl.Summary,
+		OwnerEmail: cl.OwnerEmail,
+		Dirs:       cl.Dirs(),
+		Changes:    list,
+		Urgent:     cl.Urgent,
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codereview
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"sort"
+	"time"
+
+	"app"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Review fairness.
+//
+// To help rebalance directories whose review load falls on one or two
+// people, the codereview.fairness cron job counts, for each directory,
+// the CLs created during a recent window that each roster member was
+// primary reviewer for, and measures the skew of those counts with the
+// Gini coefficient: 0 when everyone reviewed the same number of CLs,
+// approaching 1 when one person reviewed them all. The directory's owners
+// (see DirOwner) count as reviewers even if they reviewed nothing, since
+// they are the people who could have. A CL counts toward its first
+// directory in CL.Dirs order.
+//
+// The report is stored in the "codereview.fairness" meta value, served
+// as JSON by /api/codereview/fairness, and summarized on the status page.
+// The window and the fewest reviews a directory needs to be reported
+// are set by the "codereview.fairness" config:
+//
+//	{"Days": 90, "MinReviews": 10}
+
+type fairnessConfig struct {
+	Days       int // length of the window
+	MinReviews int // directories with fewer reviews are omitted
+}
+
+var defaultFairnessConfig = fairnessConfig{
+	Days:       90,
+	MinReviews: 10,
+}
+
+// A FairnessReport describes the distribution of reviews
+// across roster members in each directory.
+type FairnessReport struct {
+	Time  time.Time // when the report was computed
+	Since time.Time // start of the window
+	Dirs  []*DirFairness
+}
+
+// A DirFairness describes the distribution of reviews in a single directory.
+type DirFairness struct {
+	Dir       string
+	Reviews   int
+	Gini      float64 // skew of the distribution, from 0 (even) to 1
+	Reviewers []ReviewerCount
+}
+
+// A ReviewerCount is the number of reviews by a single reviewer.
+type ReviewerCount struct {
+	Reviewer string
+	Reviews  int
+}
+
+// maxFairnessStatus limits the directories listed on the status page.
+const maxFairnessStatus = 20
+
+func init() {
+	app.Cron("codereview.fairness", 24*time.Hour, updateFairness)
+	app.RegisterStatus("codereview review fairness", fairnessStatus)
+	app.Handle("/api/codereview/fairness", serveFairness)
+	app.RegisterAPI("/api/codereview/fairness", "The distribution of reviews across roster members in each directory, most skewed first.",
+		nil, (*FairnessReport)(nil))
+}
+
+// updateFairness recomputes the report from the CLs created during the window.
+func updateFairness(ctxt appengine.Context) error {
+	cfg := defaultFairnessConfig
+	app.ReadConfig(ctxt, "codereview.fairness", &cfg)
+	if cfg.Days < 1 {
+		cfg.Days = 1
+	}
+
+	owners, err := LoadOwners(ctxt)
+	if err != nil {
+		return err
+	}
+	roster := make(map[string]bool)
+	for _, p := range loadRoster(ctxt) {
+		roster[p.Email] = true
+	}
+
+	since := time.Now().Add(-time.Duration(cfg.Days) * 24 * time.Hour)
+	var cls []*CL
+	it := datastore.NewQuery("CL").
+		Filter("Created >=", since).
+		Run(ctxt)
+	for {
+		var cl CL
+		_, err := it.Next(&cl)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			ctxt.Errorf("loading CLs for fairness report: %v", err)
+			return err
+		}
+		cls = append(cls, &cl)
+	}
+
+	r := computeFairness(cls, roster, owners, cfg.MinReviews)
+	r.Time = time.Now()
+	r.Since = since
+	return app.WriteMeta(ctxt, "codereview.fairness", r)
+}
+
+// computeFairness computes the report for cls, counting only the reviewers
+// in roster and omitting directories with fewer than minReviews reviews.
+func computeFairness(cls []*CL, roster map[string]bool, owners Owners, minReviews int) *FairnessReport {
+	counts := make(map[string]map[string]int)
+	for _, cl := range cls {
+		who := cl.PrimaryReviewer
+		dirs := cl.Dirs()
+		if !roster[who] || who == cl.OwnerEmail || len(dirs) == 0 {
+			continue
+		}
+		m := counts[dirs[0]]
+		if m == nil {
+			m = make(map[string]int)
+			counts[dirs[0]] = m
+		}
+		m[who]++
+	}
+
+	r := &FairnessReport{Dirs: []*DirFairness{}}
+	for dir, m := range counts {
+		d := &DirFairness{Dir: dir}
+		for who, n := range m {
+			d.Reviewers = append(d.Reviewers, ReviewerCount{who, n})
+			d.Reviews += n
+		}
+		if d.Reviews < minReviews {
+			continue
+		}
+		if o := owners.Lookup(dir); o != nil {
+			for _, who := range o.Owners {
+				if roster[who] && m[who] == 0 {
+					d.Reviewers = append(d.Reviewers, ReviewerCount{who, 0})
+				}
+			}
+		}
+		sort.Sort(reviewerCounts(d.Reviewers))
+		d.Gini = gini(d.Reviewers)
+		r.Dirs = append(r.Dirs, d)
+	}
+	sort.Sort(dirsBySkew(r.Dirs))
+	return r
+}
+
+// gini returns the Gini coefficient of the review counts.
+func gini(list []ReviewerCount) float64 {
+	var counts []int
+	total := 0
+	for _, c := range list {
+		counts = append(counts, c.Reviews)
+		total += c.Reviews
+	}
+	n := len(counts)
+	if n < 2 || total == 0 {
+		return 0
+	}
+	sort.Ints(counts)
+	sum := 0
+	for i, x := range counts {
+		sum += (2*(i+1) - n - 1) * x
+	}
+	return float64(sum) / float64(n*total)
+}
+
+type reviewerCounts []ReviewerCount
+
+func (x reviewerCounts) Len() int      { return len(x) }
+func (x reviewerCounts) Swap(i, j int) { x[i], x[j] = x[j], x[i] }
+func (x reviewerCounts) Less(i, j int) bool {
+	if x[i].Reviews != x[j].Reviews {
+		return x[i].Reviews > x[j].Reviews
+	}
+	return x[i].Reviewer < x[j].Reviewer
+}
+
+type dirsBySkew []*DirFairness
+
+func (x dirsBySkew) Len() int      { return len(x) }
+func (x dirsBySkew) Swap(i, j int) { x[i], x[j] = x[j], x[i] }
+func (x dirsBySkew) Less(i, j int) bool {
+	if x[i].Gini != x[j].Gini {
+		return x[i].Gini > x[j].Gini
+	}
+	return x[i].Dir < x[j].Dir
+}
+
+// LoadFairness returns the most recently computed fairness report.
+func LoadFairness(ctxt appengine.Context) (*FairnessReport, error) {
+	var r FairnessReport
+	if err := app.ReadMetaCached(ctxt, "codereview.fairness", &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func serveFairness(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	r, err := LoadFairness(ctxt)
+	if err == datastore.ErrNoSuchEntity {
+		http.Error(w, "fairness report not computed yet", 404)
+		return
+	}
+	if err != nil {
+		ctxt.Errorf("loading fairness report: %v", err)
+		http.Error(w, "error loading report", 500)
+		return
+	}
+	js, err := json.Marshal(r)
+	if err != nil {
+		ctxt.Errorf("encoding fairness JSON: %v", err)
+		http.Error(w, "error encoding JSON", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(js)
+}
+
+func fairnessStatus(ctxt appengine.Context) string {
+	r, err := LoadFairness(ctxt)
+	if err != nil {
+		return "<pre>" + html.EscapeString(fmt.Sprintf("no report: %v", err)) + "</pre>"
+	}
+	w := new(bytes.Buffer)
+	fmt.Fprintf(w, "computed %v from CLs created since %v\n", r.Time.Format(time.RFC3339), r.Since.Format(time.RFC3339))
+	for i, d := range r.Dirs {
+		if i >= maxFairnessStatus {
+			fmt.Fprintf(w, "... and %d more directories\n", len(r.Dirs)-i)
+			break
+		}
+		fmt.Fprintf(w, "%.2f %s (%d reviews):", d.Gini, d.Dir, d.Reviews)
+		for _, c := range d.Reviewers {
+			fmt.Fprintf(w, " %s %d", c.Reviewer, c.Reviews)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	return "<pre>" + html.EscapeString(w.String()) + "</pre>"
+}
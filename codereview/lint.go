@@ -0,0 +1,170 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codereview
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"app"
+	"codereview/rietveld"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// CL description lint.
+//
+// updateCL checks each CL description against the usual conventions
+// and records what it finds in CL.DescLint, which the dashboard shows
+// next to the CL. If the "codereview.lint" config enables it:
+//
+//	{"Comment": true}
+//
+// the codereview.lint scan also posts the findings as a comment on the CL,
+// once, shortly after the CL is first mailed.
+
+type lintConfig struct {
+	Comment bool // post findings as a Rietveld comment
+}
+
+const (
+	// lintMaxSummary is the longest first line lintDesc accepts.
+	lintMaxSummary = 76
+
+	// lintWindow is how soon after the first mail a CL must be seen
+	// for the lint comment to be posted. Older CLs are left alone,
+	// so that enabling the comment does not flood existing reviews.
+	lintWindow = 48 * time.Hour
+)
+
+var (
+	lintPrefixRE = regexp.MustCompile(`^[\w.\-/*{}, ]+: \S`)
+	lintFixesRE  = regexp.MustCompile(`(?im)^\s*(fixes|updates)\s+(?:issue\s+|#)[0-9]+`)
+)
+
+// lintDesc returns the problems found in a CL description, if any.
+//
+// The first line should start with the affected packages, as in
+// "net/http: fix typo", and be short enough to read in a log.
+// Not every CL fixes an issue, so a missing "Fixes issue N" line is
+// only reported for descriptions that mention an issue some other way.
+func lintDesc(desc string) []string {
+	desc = strings.TrimSpace(desc)
+	if desc == "" {
+		return nil
+	}
+	first := desc
+	if i := strings.Index(first, "\n"); i >= 0 {
+		first = first[:i]
+	}
+	first = strings.TrimSpace(first)
+
+	var list []string
+	if !lintPrefixRE.MatchString(first) && !strings.HasPrefix(first, "undo CL") && !strings.HasPrefix(first, "[") {
+		list = append(list, "first line has no package prefix")
+	}
+	if len(first) > lintMaxSummary {
+		list = append(list, fmt.Sprintf("first line longer than %d characters", lintMaxSummary))
+	}
+	if issueRE.MatchString(desc) && !lintFixesRE.MatchString(desc) {
+		list = append(list, `mentions an issue but has no "Fixes issue N" line`)
+	}
+	return list
+}
+
+// updateLint sets the CL's lint fields. It is called by updateCL.
+func (cl *CL) updateLint() {
+	cl.DescLint = lintDesc(cl.Desc)
+	cl.LintPending = len(cl.DescLint) > 0 && cl.Active && !cl.LintCommented
+}
+
+// firstMailed returns the time of the CL's first review request,
+// or the zero time if it has not been mailed.
+func (cl *CL) firstMailed() time.Time {
+	for _, m := range cl.Messages {
+		if helloRE.MatchString(m.Text) {
+			return m.Time
+		}
+	}
+	return time.Time{}
+}
+
+func init() {
+	app.ScanData("codereview.lint", 15*time.Minute,
+		datastore.NewQuery("CL").Filter("LintPending =", true),
+		lintComment)
+}
+
+// lintComment posts the lint findings for the CL with the given key
+// as a Rietveld comment, if the config enables it.
+func lintComment(ctxt appengine.Context, kind, key string) error {
+	var cfg lintConfig
+	app.ReadConfig(ctxt, "codereview.lint", &cfg)
+	if !cfg.Comment {
+		return nil
+	}
+
+	var cl CL
+	if err := app.ReadData(ctxt, "CL", key, &cl); err != nil {
+		return nil // error already logged
+	}
+	if !cl.LintPending {
+		return nil
+	}
+	if t := cl.firstMailed(); !t.IsZero() && time.Since(t) < lintWindow {
+		n, err := strconv.Atoi(key)
+		if err != nil {
+			return fmt.Errorf("invalid cl number %q", key)
+		}
+		r, err := login(ctxt)
+		if err != nil {
+			return err
+		}
+		issue, err := r.Issue(n)
+		if err != nil {
+			ctxt.Criticalf("issue: %s", err)
+			return err
+		}
+		c := &rietveld.Comment{Message: lintMessage(cl.DescLint)}
+		err = app.PostOnce(ctxt, "cl/"+key, "lint", c.Message, func() error {
+			return r.AddComment(issue, c)
+		})
+		if err != nil {
+			ctxt.Criticalf("addcomment: %s", err)
+			return err
+		}
+	}
+
+	err := app.Transaction(ctxt, func(ctxt appengine.Context) error {
+		var cl CL
+		if err := app.ReadData(ctxt, "CL", key, &cl); err != nil {
+			return err
+		}
+		cl.LintCommented = true
+		return app.WriteData(ctxt, "CL", key, &cl)
+	})
+	if err != nil {
+		ctxt.Errorf("lint %s: %v", key, err)
+		return err
+	}
+	return nil
+}
+
+// lintMessage returns the text of the comment listing the lint findings.
+func lintMessage(list []string) string {
+	var buf bytes.Buffer
+	buf.WriteString("A few notes on the CL description, in case they help:\n\n")
+	for _, s := range list {
+		fmt.Fprintf(&buf, "\t- %s\n", s)
+	}
+	buf.WriteString("\nSee http://golang.org/doc/contribute.html#Code_review for the conventions.\n" +
+		"This is an automated message; please ignore it if the description is as intended.\n")
+	return buf.String()
+}
@@ -11,6 +11,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"html"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"reflect"
@@ -20,12 +21,11 @@ import (
 	"time"
 
 	"app"
+	"identity"
+	"issue"
 
 	"appengine"
 	"appengine/datastore"
-	"appengine/urlfetch"
-
-	"github.com/rsc/appstats"
 )
 
 type jsonCL struct {
@@ -42,22 +42,28 @@ type jsonCL struct {
 	PatchSets  []int64        `json:"patchsets"`
 }
 
-func parseTime(ctxt appengine.Context, s string) time.Time {
-	t, err := time.ParseInLocation(timeFormat, s, time.UTC)
-	if err != nil {
-		return time.Unix(0, 0)
-	}
-	return t
+// parseTime parses a Rietveld timestamp.
+// The kind says which field it came from, for error reporting (see app.ParseTime).
+func parseTime(ctxt appengine.Context, kind, s string) (time.Time, error) {
+	return app.ParseTime(ctxt, "codereview."+kind, timeFormat, s, time.UTC)
 }
 
-func (j *jsonCL) toCL(ctxt appengine.Context) *CL {
+// toCL converts the JSON form of a CL.
+// Bad timestamps are left as zero times, except for the modification time,
+// which writeCL depends on: a CL with a bad modification time is an error.
+func (j *jsonCL) toCL(ctxt appengine.Context) (*CL, error) {
+	created, _ := parseTime(ctxt, "created", j.Created)
+	modified, err := parseTime(ctxt, "modified", j.Modified)
+	if err != nil {
+		return nil, fmt.Errorf("CL %d: %v", j.Issue, err)
+	}
 	cl := &CL{
 		CL:         fmt.Sprint(j.Issue),
 		Desc:       j.Desc,
-		OwnerEmail: j.OwnerEmail,
+		OwnerEmail: app.CanonicalEmail(ctxt, j.OwnerEmail),
 		Owner:      j.Owner,
-		Created:    parseTime(ctxt, j.Created),
-		Modified:   parseTime(ctxt, j.Modified),
+		Created:    created,
+		Modified:   modified,
 		Reviewers:  j.Reviewers,
 		CC:         j.CC,
 		Closed:     j.Closed,
@@ -68,7 +74,7 @@ func (j *jsonCL) toCL(ctxt appengine.Context) *CL {
 	for _, p := range j.PatchSets {
 		cl.PatchSets = append(cl.PatchSets, fmt.Sprint(p))
 	}
-	return cl
+	return cl, nil
 }
 
 type jsonMessage struct {
@@ -78,10 +84,11 @@ type jsonMessage struct {
 }
 
 func (j *jsonMessage) toMessage(ctxt appengine.Context) Message {
+	t, _ := parseTime(ctxt, "message", j.Date)
 	return Message{
 		Sender: j.Sender,
 		Text:   j.Text,
-		Time:   parseTime(ctxt, j.Date),
+		Time:   t,
 	}
 }
 
@@ -97,11 +104,13 @@ type jsonPatch struct {
 }
 
 func (j *jsonPatch) toPatch(ctxt appengine.Context) *Patch {
+	created, _ := parseTime(ctxt, "patch.created", j.Created)
+	modified, _ := parseTime(ctxt, "patch.modified", j.Modified)
 	p := &Patch{
 		CL:          fmt.Sprint(j.Issue),
 		PatchSet:    fmt.Sprint(j.PatchSet),
-		Created:     parseTime(ctxt, j.Created),
-		Modified:    parseTime(ctxt, j.Modified),
+		Created:     created,
+		Modified:    modified,
 		Owner:       j.Owner,
 		NumComments: j.NumComments,
 		Message:     j.Message,
@@ -143,7 +152,7 @@ func (j *jsonFile) toFile(ctxt appengine.Context, name string) File {
 }
 
 func init() {
-	http.Handle("/admin/codereview/show/", appstats.NewHandler(show))
+	app.Handle("/admin/codereview/show/", show)
 }
 
 func show(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
@@ -164,14 +173,33 @@ func show(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
 	w.Write(buf.Bytes())
 }
 
+var backfill = app.RegisterBackfill("codereview.load", false)
+
 func init() {
+	// The deadline for task invocation is 10 minutes.
+	// Stop after 5 minutes and ask to be rescheduled.
 	app.Cron("codereview.load", 1*time.Minute, load)
+	app.SetCronOptions("codereview.load", app.TaskOptions{SoftDeadline: 5 * time.Minute})
+}
+
+// A loadProgress records where a rescheduled load should continue:
+// the search it was paging through, and the cursor for the next page.
+type loadProgress struct {
+	Group        string
+	ReviewerOrCC string
+	MTime        string
+	Cursor       string
 }
 
 func load(ctxt appengine.Context) error {
-	// The deadline for task invocation is 10 minutes.
-	// Stop when we've run for 5 minutes and ask to be rescheduled.
-	deadline := time.Now().Add(5 * time.Minute)
+	if !backfill.Start(ctxt) {
+		return nil
+	}
+	defer backfill.Done(ctxt)
+
+	progress := app.TaskProgress(ctxt)
+	var saved loadProgress
+	progress.Load(ctxt, &saved)
 
 	for _, group := range []string{"golang-dev", "golang-codereviews"} {
 		for _, reviewerOrCC := range []string{"reviewer", "cc"} {
@@ -192,8 +220,18 @@ func load(ctxt appengine.Context) error {
 				mtime = mtime[:i]
 			}
 
+			// Continue the search a rescheduled load was paging through.
+			// A cursor is only good for the search that returned it.
+			if saved.Group == group && saved.ReviewerOrCC == reviewerOrCC && saved.Cursor != "" {
+				mtime, cursor = saved.MTime, saved.Cursor
+				saved = loadProgress{}
+			}
+
 			const itemsPerPage = 100
 			for n := 0; ; n++ {
+				if !backfill.Allow(ctxt, 1) {
+					return nil
+				}
 				var q struct {
 					Cursor  string    `json:"cursor"`
 					Results []*jsonCL `json:"results"`
@@ -206,6 +244,9 @@ func load(ctxt appengine.Context) error {
 					"Cursor":        cursor,
 					"Limit":         fmt.Sprint(itemsPerPage),
 				}))
+				if app.IsHostDown(err) {
+					return err // the other searches would fail too
+				}
 				if err != nil {
 					ctxt.Errorf("loading codereview by %s: URL <%s>: %v", reviewerOrCC, q, err)
 					break
@@ -216,20 +257,28 @@ func load(ctxt appengine.Context) error {
 				}
 				cursor = q.Cursor
 
+				var cls []*CL
+				var modified []string
 				for _, jcl := range q.Results {
-					cl := jcl.toCL(ctxt)
-					if err := writeCL(ctxt, cl, mtimeKey, jcl.Modified); err != nil {
-						break // error already logged
+					cl, err := jcl.toCL(ctxt)
+					if err != nil {
+						ctxt.Errorf("loading codereview by %s: %v", reviewerOrCC, err)
+						continue
 					}
+					cls = append(cls, cl)
+					modified = append(modified, jcl.Modified)
 				}
+				writeCLs(ctxt, cls, mtimeKey, modified) // errors already logged
 
 				if len(q.Results) < itemsPerPage {
 					ctxt.Infof("reached end of results - codereview by %s up to date", reviewerOrCC)
 					break
 				}
 
-				if time.Now().After(deadline) {
+				progress.Note("codereview by %s in %s, page %d", reviewerOrCC, group, n)
+				if progress.Expired() {
 					ctxt.Infof("more to do for codereview by %s - rescheduling", reviewerOrCC)
+					progress.Save(ctxt, &loadProgress{group, reviewerOrCC, mtime, cursor})
 					return app.ErrMoreCron
 				}
 			}
@@ -240,60 +289,278 @@ func load(ctxt appengine.Context) error {
 	return nil
 }
 
+// writeCL stores the Rietveld information in cl, which is from the
+// search results or a direct fetch, into the stored CL.
+// If the stored CL is newer, writeCL resolves the conflict (see resolveConflict).
 func writeCL(ctxt appengine.Context, cl *CL, mtimeKey, modified string) error {
+	err := storeCL(ctxt, cl, mtimeKey, modified, false)
+	if e, ok := err.(*staleError); ok {
+		return resolveConflict(ctxt, cl, e, mtimeKey, modified)
+	}
+	return err
+}
+
+// storeCL does the work of writeCL.
+// If force is set, it stores cl even if the stored CL is newer.
+func storeCL(ctxt appengine.Context, cl *CL, mtimeKey, modified string, force bool) error {
+	// Refresh the directory and bot address consulted when parsing messages.
+	identity.Load(ctxt)
+	loadBot(ctxt)
+
+	var u *clUpdate
 	err := app.Transaction(ctxt, func(ctxt appengine.Context) error {
 		var old CL
 		if err := app.ReadData(ctxt, "CL", cl.CL, &old); err != nil && err != datastore.ErrNoSuchEntity {
 			return err
 		}
 		if old.CL == "" { // no old data
-			var count int64
-			app.ReadMeta(ctxt, "codereview.count", &count)
-			app.WriteMeta(ctxt, "codereview.count", count+1)
-		}
-
-		// Copy CL into original structure.
-		// This allows us to maintain other information in the CL structure
-		// and not overwrite it when the Rietveld information is updated.
-		if cl.Dead {
-			old.Dead = true
-		} else {
-			old.Dead = false
-			if old.Modified.After(cl.Modified) {
-				return fmt.Errorf("CL %v: have %v but Rietveld sent %v", cl.CL, old.Modified, cl.Modified)
-			}
-			old.CL = cl.CL
-			old.Desc = cl.Desc
-			old.Owner = cl.Owner
-			old.OwnerEmail = cl.OwnerEmail
-			old.Created = cl.Created
-			old.Modified = cl.Modified
-			old.MessagesLoaded = cl.MessagesLoaded
-			if cl.MessagesLoaded {
-				old.Messages = cl.Messages
-				old.Submitted = cl.Submitted
-			}
-			old.Reviewers = cl.Reviewers
-			old.CC = cl.CC
-			old.Closed = cl.Closed
-			if !reflect.DeepEqual(old.PatchSets, cl.PatchSets) {
-				old.PatchSets = cl.PatchSets
-				old.PatchSetsLoaded = false
-			}
+			countNewCLs(ctxt, 1)
+		}
+		var err error
+		u, err = mergeCL(&old, cl, force)
+		if err != nil {
+			return err
 		}
-
 		if err := app.WriteData(ctxt, "CL", cl.CL, &old); err != nil {
 			return err
 		}
+		u.noteWrite(&old)
 		if mtimeKey != "" {
 			app.WriteMeta(ctxt, mtimeKey, modified)
 		}
 		return nil
 	})
+	if _, ok := err.(*staleError); ok {
+		return err
+	}
 	if err != nil {
 		ctxt.Errorf("storing CL %v: %v", cl.CL, err)
+		return err
+	}
+	if u.changed {
+		app.BumpDataVersion(ctxt)
+	}
+	u.publish(ctxt, cl.CL)
+	return nil
+}
+
+// maxBatchCLs is the number of CLs writeCLs stores in a single transaction.
+// A cross-group transaction can use at most 25 entity groups. Each CL is
+// one, the meta values written along with them take up two more, and
+// guardWrite may read app.dataversions. The rest is left for the Blobs
+// of spilled CLs, each chunk of which is its own entity group, and the
+// Blobs of their previous spills, which are deleted in the same transaction.
+const maxBatchCLs = 10
+
+// writeCLs is like calling writeCL for each of cls in turn, with the
+// corresponding modified times, but stores the CLs in batches of up to
+// maxBatchCLs, reading and writing each batch with a single datastore call.
+// The CLs that turn out to be stale are resolved one at a time afterward.
+// If a batch cannot be stored, for example because its spilled CLs take
+// it over the entity group limit, its CLs are written one at a time instead.
+func writeCLs(ctxt appengine.Context, cls []*CL, mtimeKey string, modified []string) error {
+	for len(cls) > 0 {
+		n := len(cls)
+		if n > maxBatchCLs {
+			n = maxBatchCLs
+		}
+		stale, err := storeCLBatch(ctxt, cls[:n], mtimeKey, modified[:n])
+		if err != nil {
+			ctxt.Warningf("storing batch of %d CLs: %v; storing them one at a time", n, err)
+			for i := 0; i < n; i++ {
+				if err := writeCL(ctxt, cls[i], mtimeKey, modified[i]); err != nil {
+					return err
+				}
+			}
+			cls, modified = cls[n:], modified[n:]
+			continue
+		}
+		for i := 0; i < n; i++ {
+			if e := stale[i]; e != nil {
+				if err := resolveConflict(ctxt, cls[i], e, mtimeKey, modified[i]); err != nil {
+					return err
+				}
+			}
+		}
+		cls, modified = cls[n:], modified[n:]
+	}
+	return nil
+}
+
+// storeCLBatch stores cls in a single transaction, as storeCL would
+// without force, and returns the staleErrors for the CLs it could not
+// store, keyed by index in cls. It advances the modification time stored
+// under mtimeKey only up to the first stale CL; resolving that CL
+// advances it further.
+func storeCLBatch(ctxt appengine.Context, cls []*CL, mtimeKey string, modified []string) (map[int]*staleError, error) {
+	// Refresh the directory and bot address consulted when parsing messages.
+	identity.Load(ctxt)
+	loadBot(ctxt)
+
+	keys := make([]string, len(cls))
+	for i, cl := range cls {
+		keys[i] = cl.CL
+	}
+	var updates []*clUpdate
+	var stale map[int]*staleError
+	err := app.Transaction(ctxt, func(ctxt appengine.Context) error {
+		updates = make([]*clUpdate, len(cls))
+		stale = make(map[int]*staleError)
+		olds := make([]*CL, len(cls))
+		for i := range olds {
+			olds[i] = new(CL)
+		}
+		if err := app.ReadDataMulti(ctxt, "CL", keys, olds); err != nil {
+			me, ok := err.(appengine.MultiError)
+			if !ok {
+				return err
+			}
+			for _, err := range me {
+				if err != nil && err != datastore.ErrNoSuchEntity {
+					return err
+				}
+			}
+		}
+
+		var wkeys []string
+		var wcls []*CL
+		var added int64
+		mtime := ""
+		for i, old := range olds {
+			if old.CL == "" { // no old data
+				added++
+			}
+			u, err := mergeCL(old, cls[i], false)
+			if e, ok := err.(*staleError); ok {
+				stale[i] = e
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			updates[i] = u
+			wkeys = append(wkeys, keys[i])
+			wcls = append(wcls, old)
+			if len(stale) == 0 {
+				mtime = modified[i]
+			}
+		}
+		if len(wkeys) > 0 {
+			if err := app.WriteDataMulti(ctxt, "CL", wkeys, wcls); err != nil {
+				return err
+			}
+		}
+		// Reads in the transaction do not see its own writes,
+		// so count the new CLs once for the whole batch.
+		if added > 0 {
+			countNewCLs(ctxt, added)
+		}
+		for i, u := range updates {
+			if u != nil {
+				u.noteWrite(olds[i])
+			}
+		}
+		if mtimeKey != "" && mtime != "" {
+			app.WriteMeta(ctxt, mtimeKey, mtime)
+		}
+		return nil
+	})
+	if err != nil {
+		ctxt.Errorf("storing CLs %v: %v", keys, err)
+		return nil, err
+	}
+	changed := false
+	for i, u := range updates {
+		if u != nil {
+			changed = changed || u.changed
+			u.publish(ctxt, cls[i].CL)
+		}
+	}
+	if changed {
+		app.BumpDataVersion(ctxt)
+	}
+	return stale, nil
+}
+
+// countNewCLs adds n to the count of stored CLs.
+func countNewCLs(ctxt appengine.Context, n int64) {
+	var count int64
+	app.ReadMeta(ctxt, "codereview.count", &count)
+	app.WriteMeta(ctxt, "codereview.count", count+n)
+}
+
+// A clUpdate records the effects of storing a CL,
+// to be announced once the transaction storing it has committed.
+type clUpdate struct {
+	before  CL // the stored CL before the update
+	changed bool
+	added   *ReviewersEvent
+	linked  *IssuesEvent
+	change  *ChangeEvent
+}
+
+// mergeCL copies the Rietveld information in cl into old, the stored CL,
+// which maintains other information not overwritten by the update.
+// If the stored CL is newer than cl and force is not set,
+// mergeCL returns a staleError instead.
+func mergeCL(old, cl *CL, force bool) (*clUpdate, error) {
+	u := &clUpdate{before: *old}
+	if cl.Dead {
+		old.Dead = true
+	} else {
+		old.Dead = false
+		if old.Modified.After(cl.Modified) && !force {
+			return nil, &staleError{cl.CL, old.Modified, cl.Modified}
+		}
+		old.CL = cl.CL
+		old.Desc = cl.Desc
+		old.Owner = cl.Owner
+		old.OwnerEmail = cl.OwnerEmail
+		old.Created = cl.Created
+		old.Modified = cl.Modified
+		old.MessagesLoaded = cl.MessagesLoaded
+		if cl.MessagesLoaded {
+			old.Messages = cl.Messages
+			old.Submitted = cl.Submitted
+		}
+		old.Reviewers = cl.Reviewers
+		old.CC = cl.CC
+		old.Closed = cl.Closed
+		if !reflect.DeepEqual(old.PatchSets, cl.PatchSets) {
+			old.PatchSets = cl.PatchSets
+			old.PatchSetsLoaded = false
+		}
+	}
+
+	u.changed = !reflect.DeepEqual(u.before, *old)
+	if u.changed {
+		old.Updated = time.Now()
+		old.Indexed = false
+	}
+	return u, nil
+}
+
+// noteWrite computes the events announcing the update,
+// given the CL as written, with its derived fields updated.
+func (u *clUpdate) noteWrite(cur *CL) {
+	if u.before.CL != "" {
+		u.added = reviewersAdded(&u.before, cur)
+		u.linked = issuesLinked(&u.before, cur)
+		u.change = clChanged(&u.before, cur)
+	}
+}
+
+// publish announces the events for the update to CL number cl.
+func (u *clUpdate) publish(ctxt appengine.Context, cl string) {
+	if u.added != nil {
+		app.Publish(ctxt, "codereview.reviewers", cl, u.added)
+	}
+	if u.linked != nil {
+		app.Publish(ctxt, "codereview.issues", cl, u.linked)
+	}
+	if u.change != nil {
+		app.Publish(ctxt, "codereview.changed", cl, u.change)
 	}
-	return err
 }
 
 func init() {
@@ -311,10 +578,7 @@ func init() {
 }
 
 func loadmsg(ctxt appengine.Context, kind, key string) error {
-	var jcl jsonCL
-	err := fetchJSON(ctxt, &jcl, urlWithParams(issueTmpl, map[string]string{
-		"CL": key,
-	}))
+	cl, err := fetchCL(ctxt, key)
 	if err != nil {
 		// Should do a better job returning a distinct error, but this will do for now.
 		if strings.Contains(err.Error(), "404 Not Found") {
@@ -324,10 +588,9 @@ func loadmsg(ctxt appengine.Context, kind, key string) error {
 			}
 			writeCL(ctxt, cl, "", "")
 		}
-		return nil // error already logged
+		ctxt.Errorf("loadmsg %s: %v", key, err)
+		return nil
 	}
-	cl := jcl.toCL(ctxt)
-	cl.MessagesLoaded = true
 	writeCL(ctxt, cl, "", "")
 	return nil
 }
@@ -351,7 +614,7 @@ func loadpatch(ctxt appengine.Context, kind, key string) error {
 	}
 
 	var last *Patch
-	for _, id := range cl.PatchSets {
+	for _, id := range cl.livePatchSets() {
 		var jp jsonPatch
 		err := fetchJSON(ctxt, &jp, fmt.Sprintf("https://codereview.appspot.com/api/%s/%s", cl.CL, id))
 		if err != nil {
@@ -364,11 +627,14 @@ func loadpatch(ctxt appengine.Context, kind, key string) error {
 		last = p
 	}
 
+	var linked *IssuesEvent
 	err = app.Transaction(ctxt, func(ctxt appengine.Context) error {
+		linked = nil
 		var old CL
 		if err := app.ReadData(ctxt, "CL", key, &old); err != nil {
 			return err
 		}
+		before := old
 		if len(old.PatchSets) > len(cl.PatchSets) {
 			return fmt.Errorf("more patch sets added")
 		}
@@ -392,13 +658,20 @@ func loadpatch(ctxt appengine.Context, kind, key string) error {
 			old.Repo = "code.google.com/p/" + m[2] + "." + m[1]
 		}
 		// NOTE: updateCL will shorten code.google.com/p/go to go.
-		return app.WriteData(ctxt, "CL", key, &old)
+		if err := app.WriteData(ctxt, "CL", key, &old); err != nil {
+			return err
+		}
+		linked = issuesLinked(&before, &old)
+		return nil
 	})
+	if err == nil && linked != nil {
+		app.Publish(ctxt, "codereview.issues", key, linked)
+	}
 	return err
 }
 
 func init() {
-	http.Handle("/admin/codereview/mailissue", appstats.NewHandler(testmailissue))
+	app.Handle("/admin/codereview/mailissue", testmailissue)
 }
 
 func testmailissue(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
@@ -410,7 +683,13 @@ func testmailissue(ctxt appengine.Context, w http.ResponseWriter, req *http.Requ
 	fmt.Fprintf(w, "OK!\n")
 }
 
+// mailIssueFlag gates the comments posted on issues mentioned by CLs.
+var mailIssueFlag = app.Flag("codereview.mailissue", true)
+
 func mailissue(ctxt appengine.Context, kind, key string) error {
+	if !mailIssueFlag.On(ctxt) {
+		return nil
+	}
 	ctxt.Infof("mailissue %s", key)
 	var cl CL
 	err := app.ReadData(ctxt, "CL", key, &cl)
@@ -422,9 +701,21 @@ func mailissue(ctxt appengine.Context, kind, key string) error {
 		return nil
 	}
 
-	var mailed []string
+	var mailed, skipped []string
 	for _, issue := range cl.NeedMailIssue {
-		err := postIssueComment(ctxt, issue, "CL https://codereview.appspot.com/"+cl.CL+" mentions this issue.")
+		reason, err := badIssueRef(ctxt, issue)
+		if err != nil {
+			continue // try again next time
+		}
+		if reason != "" {
+			ctxt.Warningf("CL %s mentions issue %s, which is %s; not mailing", cl.CL, issue, reason)
+			skipped = append(skipped, issue)
+			continue
+		}
+		msg := "CL https://codereview.appspot.com/" + cl.CL + " mentions this issue."
+		err = app.PostOnce(ctxt, "issue/"+issue, "mailissue", msg, func() error {
+			return postIssueComment(ctxt, issue, msg)
+		})
 		if err != nil {
 			ctxt.Criticalf("posting to issue %v: %v", issue, err)
 			continue
@@ -438,16 +729,47 @@ func mailissue(ctxt appengine.Context, kind, key string) error {
 			return err
 		}
 		old.MailedIssue = append(old.MailedIssue, mailed...)
+		old.SkippedIssue = append(old.SkippedIssue, skipped...)
 		return app.WriteData(ctxt, "CL", key, &old)
 	})
 
 	return err
 }
 
+// badIssueRef checks a CL's reference to the issue with the given number
+// against the issue mirror, so that a typo in a CL description does not
+// post a comment on an unrelated or dead issue. It returns a description
+// of what is wrong with the issue, or "" if the issue exists and is open.
+func badIssueRef(ctxt appengine.Context, id string) (string, error) {
+	var bug issue.Issue
+	err := app.ReadData(ctxt, "Issue", id, &bug)
+	if err == datastore.ErrNoSuchEntity {
+		return "missing", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if bug.Status == "Moved" {
+		return "moved", nil
+	}
+	for _, label := range bug.Label {
+		if label == "IssueMoved" {
+			return "moved", nil
+		}
+	}
+	if bug.State == "closed" {
+		return "closed (" + bug.Status + ")", nil
+	}
+	return "", nil
+}
+
 func fetchJSON(ctxt appengine.Context, target interface{}, url string) error {
-	http := urlfetch.Client(ctxt)
+	http := app.Client(ctxt, "codereview")
 
 	res, err := http.Get(url)
+	if app.IsHostDown(err) {
+		return err // already logged
+	}
 	if err != nil {
 		ctxt.Errorf("fetch URL <%s>: %v", url, err)
 		return err
@@ -458,11 +780,17 @@ func fetchJSON(ctxt appengine.Context, target interface{}, url string) error {
 		return fmt.Errorf("http %v", res.Status)
 	}
 
-	err = json.NewDecoder(res.Body).Decode(target)
+	payload, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		ctxt.Errorf("fetch URL <%s>: %v", url, err)
+		return err
+	}
+	err = json.Unmarshal(payload, target)
 	if err != nil {
 		ctxt.Errorf("decoding JSON from URL <%s>: %v", url, err)
 		return err
 	}
+	mirrorRaw(ctxt, url, res.Header.Get("ETag"), payload)
 	return nil
 }
 
@@ -493,6 +821,11 @@ func urlWithParams(urlTempl string, m map[string]string) string {
 
 func init() {
 	app.RegisterStatus("codereview", status)
+	app.RegisterQuota("codereview", "CL", "Patch", "Diff", "DirOwner", "Conflict", "RawFetch", "Away")
+
+	app.RegisterCounter("codereview.count", datastore.NewQuery("CL"), false)
+	app.RegisterCounter("codereview.count.active", datastore.NewQuery("CL").Filter("Active =", true), true)
+	app.RegisterCounter("codereview.count.skippedissue", datastore.NewQuery("CL").Filter("SkippedIssue >", ""), true)
 }
 
 func status(ctxt appengine.Context) string {
@@ -508,6 +841,12 @@ func status(ctxt appengine.Context) string {
 	}
 	app.ReadMeta(ctxt, "codereview.count", &count)
 	fmt.Fprintf(w, "%d CLs total\n", count)
+	count = 0
+	app.ReadMeta(ctxt, "codereview.count.active", &count)
+	fmt.Fprintf(w, "%d CLs active (as of last recount)\n", count)
+	count = 0
+	app.ReadMeta(ctxt, "codereview.count.skippedissue", &count)
+	fmt.Fprintf(w, "%d CLs mention missing, closed, or moved issues (as of last recount)\n", count)
 
 	var chunk = 20000
 	if appengine.IsDevAppServer() {
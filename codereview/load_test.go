@@ -0,0 +1,447 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codereview
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"app"
+	"app/apptest"
+	"issue"
+)
+
+// The responses in testdata follow the JSON served by codereview.appspot.com.
+// Run the tests with -record to replace them with fresh recordings.
+
+func TestLoadCL(t *testing.T) {
+	ctxt := apptest.NewContext(t)
+	defer app.SetStore(app.SetStore(apptest.NewStore()))
+	defer app.SetTransport(app.SetTransport(apptest.NewReplay("testdata")))
+
+	var jcl jsonCL
+	if err := fetchJSON(ctxt, &jcl, urlWithParams(issueTmpl, map[string]string{"CL": "6454085"})); err != nil {
+		t.Fatal(err)
+	}
+	cl, err := jcl.toCL(ctxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updateCL(cl)
+
+	if cl.CL != "6454085" || cl.Owner != "gopher" || cl.OwnerEmail != "gopher@example.com" {
+		t.Errorf("CL %s owner %s <%s>, want 6454085 owner gopher <gopher@example.com>", cl.CL, cl.Owner, cl.OwnerEmail)
+	}
+	if want := "net/http: close response body on redirect"; cl.Summary != want {
+		t.Errorf("Summary = %q, want %q", cl.Summary, want)
+	}
+	if want := "2012-08-06 23:58:41"; cl.Created.Format(timeFormat) != want {
+		t.Errorf("Created = %v, want %s", cl.Created, want)
+	}
+	if len(cl.Messages) != 3 {
+		t.Fatalf("%d messages, want 3", len(cl.Messages))
+	}
+	if want := []string{"1", "2001"}; !reflect.DeepEqual(cl.PatchSets, want) {
+		t.Errorf("PatchSets = %v, want %v", cl.PatchSets, want)
+	}
+	if want := []string{"3795"}; !reflect.DeepEqual(cl.DescIssue, want) {
+		t.Errorf("DescIssue = %v, want %v", cl.DescIssue, want)
+	}
+
+	// Derived by parseMessages.
+	if !cl.Mailed || !cl.Submitted {
+		t.Errorf("Mailed=%v Submitted=%v, want both true", cl.Mailed, cl.Submitted)
+	}
+	if want := []string{"r@golang.org"}; !reflect.DeepEqual(cl.LGTM, want) {
+		t.Errorf("LGTM = %v, want %v", cl.LGTM, want)
+	}
+	if cl.PrimaryReviewer != "r@golang.org" {
+		t.Errorf("PrimaryReviewer = %q, want r@golang.org", cl.PrimaryReviewer)
+	}
+	if cl.Repo != "go" {
+		t.Errorf("Repo = %q, want go", cl.Repo)
+	}
+	if cl.NeedsReview || cl.Active {
+		t.Errorf("NeedsReview=%v Active=%v, want both false", cl.NeedsReview, cl.Active)
+	}
+}
+
+func TestLoadPatch(t *testing.T) {
+	ctxt := apptest.NewContext(t)
+	defer app.SetStore(app.SetStore(apptest.NewStore()))
+	defer app.SetTransport(app.SetTransport(apptest.NewReplay("testdata")))
+
+	var jp jsonPatch
+	if err := fetchJSON(ctxt, &jp, "https://codereview.appspot.com/api/6454085/2001"); err != nil {
+		t.Fatal(err)
+	}
+	p := jp.toPatch(ctxt)
+	if p.CL != "6454085" || p.PatchSet != "2001" || p.NumComments != 1 {
+		t.Errorf("patch %s/%s with %d comments, want 6454085/2001 with 1", p.CL, p.PatchSet, p.NumComments)
+	}
+	want := []File{
+		{Name: "src/pkg/net/http/client.go", Status: "M", NumChunks: 1, NumAdded: 3, NumRemoved: 1, ID: "2003"},
+		{Name: "src/pkg/net/http/client_test.go", Status: "M", NumChunks: 2, NumAdded: 24, ID: "2002"},
+	}
+	if !reflect.DeepEqual(p.Files, want) {
+		t.Errorf("Files = %+v\nwant %+v", p.Files, want)
+	}
+}
+
+func TestReparse(t *testing.T) {
+	ctxt := apptest.NewContext(t)
+	defer app.SetStore(app.SetStore(apptest.NewStore()))
+	defer app.SetTransport(app.SetTransport(apptest.NewReplay("testdata")))
+
+	url := "https://codereview.appspot.com/api/6454085/2001"
+	res, err := app.Client(ctxt, "codereview").Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	io.Copy(zw, res.Body)
+	res.Body.Close()
+	zw.Close()
+
+	r := &RawFetch{URL: url, Latest: true, Data: buf.Bytes()}
+	if err := reparseRaw(ctxt, r); err != nil {
+		t.Fatal(err)
+	}
+	var p Patch
+	if err := app.ReadData(ctxt, "Patch", "6454085/2001", &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.CL != "6454085" || p.PatchSet != "2001" || len(p.Files) != 2 {
+		t.Errorf("reparsed patch %s/%s with %d files, want 6454085/2001 with 2", p.CL, p.PatchSet, len(p.Files))
+	}
+
+	r.URL = "https://codereview.appspot.com/search?format=json"
+	if err := reparseRaw(ctxt, r); err == nil {
+		t.Errorf("reparse of search results succeeded")
+	}
+}
+
+func TestBadModified(t *testing.T) {
+	ctxt := apptest.NewContext(t)
+	defer app.SetStore(app.SetStore(apptest.NewStore()))
+
+	jcl := &jsonCL{Issue: 1, Created: "junk", Modified: "2012-08-06 23:58:41.123"}
+	cl, err := jcl.toCL(ctxt)
+	if err != nil {
+		t.Fatalf("toCL with bad created time: %v", err)
+	}
+	if !cl.Created.IsZero() {
+		t.Errorf("Created = %v, want zero time", cl.Created)
+	}
+
+	jcl.Modified = "junk"
+	if _, err := jcl.toCL(ctxt); err == nil {
+		t.Errorf("toCL with bad modified time succeeded")
+	}
+}
+
+func TestModifiedConflict(t *testing.T) {
+	ctxt := apptest.NewContext(t)
+	defer app.SetStore(app.SetStore(apptest.NewStore()))
+	defer app.SetTransport(app.SetTransport(apptest.NewReplay("testdata")))
+
+	// The fixture's CL was modified at 16:40:03.
+	sent := time.Date(2012, 8, 7, 16, 30, 0, 0, time.UTC)
+	store := func(have time.Time) {
+		if err := app.WriteData(ctxt, "CL", "6454085", &CL{CL: "6454085", Modified: have}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Within clock skew: Rietveld's copy wins.
+	store(time.Date(2012, 8, 7, 16, 42, 0, 0, time.UTC))
+	if err := writeCL(ctxt, &CL{CL: "6454085", Modified: sent}, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	var cl CL
+	if err := app.ReadData(ctxt, "CL", "6454085", &cl); err != nil {
+		t.Fatal(err)
+	}
+	if want := "2012-08-07 16:40:03"; cl.Modified.Format(timeFormat) != want {
+		t.Errorf("after skew, Modified = %v, want %v", cl.Modified, want)
+	}
+
+	// Genuine regression: recorded as a conflict, stored CL kept.
+	have := time.Date(2012, 8, 8, 0, 0, 0, 0, time.UTC)
+	store(have)
+	if err := writeCL(ctxt, &CL{CL: "6454085", Modified: sent}, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	var c Conflict
+	if err := app.ReadData(ctxt, "Conflict", "6454085", &c); err != nil {
+		t.Fatalf("no conflict recorded: %v", err)
+	}
+	if !c.Have.Equal(have) {
+		t.Errorf("conflict Have = %v, want %v", c.Have, have)
+	}
+	if err := app.ReadData(ctxt, "CL", "6454085", &cl); err != nil {
+		t.Fatal(err)
+	}
+	if !cl.Modified.Equal(have) {
+		t.Errorf("after conflict, Modified = %v, want %v", cl.Modified, have)
+	}
+}
+
+func TestWriteCLs(t *testing.T) {
+	ctxt := apptest.NewContext(t)
+	defer app.SetStore(app.SetStore(apptest.NewStore()))
+	defer app.SetTransport(app.SetTransport(apptest.NewReplay("testdata")))
+
+	// CL 6454085 is stored as modified at 16:42, within clock skew of
+	// the fixture's 16:40:03, so the batch finds it stale and refetches it.
+	if err := app.WriteData(ctxt, "CL", "6454085", &CL{CL: "6454085", Modified: time.Date(2012, 8, 7, 16, 42, 0, 0, time.UTC)}); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 2*maxBatchCLs + 5
+	base := time.Date(2012, 8, 7, 16, 30, 0, 0, time.UTC)
+	var cls []*CL
+	var modified []string
+	for i := 0; i < n; i++ {
+		key := fmt.Sprint(1000 + i)
+		if i == maxBatchCLs+3 {
+			key = "6454085"
+		}
+		mtime := base.Add(time.Duration(i) * time.Second)
+		cls = append(cls, &CL{CL: key, Modified: mtime})
+		modified = append(modified, mtime.Format(timeFormat))
+	}
+	if err := writeCLs(ctxt, cls, "codereview.test.mtime", modified); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range cls {
+		var cl CL
+		if err := app.ReadData(ctxt, "CL", want.CL, &cl); err != nil {
+			t.Fatalf("CL %s not stored: %v", want.CL, err)
+		}
+		if want.CL == "6454085" {
+			if got := "2012-08-07 16:40:03"; cl.Modified.Format(timeFormat) != got {
+				t.Errorf("CL %s Modified = %v, want %v", want.CL, cl.Modified, got)
+			}
+			continue
+		}
+		if !cl.Modified.Equal(want.Modified) {
+			t.Errorf("CL %s Modified = %v, want %v", want.CL, cl.Modified, want.Modified)
+		}
+	}
+	var count int64
+	if err := app.ReadMeta(ctxt, "codereview.count", &count); err != nil || count != n-1 {
+		t.Errorf("codereview.count = %d, %v, want %d", count, err, n-1)
+	}
+	var mtime string
+	if err := app.ReadMeta(ctxt, "codereview.test.mtime", &mtime); err != nil || mtime != modified[n-1] {
+		t.Errorf("mtime = %q, %v, want %q", mtime, err, modified[n-1])
+	}
+}
+
+func TestFairness(t *testing.T) {
+	cl := func(owner, reviewer, file string) *CL {
+		return &CL{OwnerEmail: owner, PrimaryReviewer: reviewer, Files: []string{file}}
+	}
+	var cls []*CL
+	for i := 0; i < 6; i++ {
+		cls = append(cls, cl("o@x", "a@x", "src/pkg/net/http/server.go"))
+	}
+	cls = append(cls,
+		cl("o@x", "b@x", "src/pkg/net/http/client.go"),
+		cl("o@x", "stranger@x", "src/pkg/net/http/client.go"), // not in roster
+		cl("a@x", "a@x", "src/pkg/net/http/client.go"),        // self-review
+		cl("o@x", "a@x", "src/pkg/fmt/print.go"),
+		cl("o@x", "b@x", "src/pkg/fmt/print.go"),
+	)
+	roster := map[string]bool{"a@x": true, "b@x": true, "c@x": true}
+	owners := Owners{"net": {Dir: "net", Owners: []string{"c@x", "nobody@x"}}}
+
+	r := computeFairness(cls, roster, owners, 2)
+	if len(r.Dirs) != 2 {
+		t.Fatalf("got %d directories, want 2", len(r.Dirs))
+	}
+	d := r.Dirs[0]
+	want := []ReviewerCount{{"a@x", 6}, {"b@x", 1}, {"c@x", 0}}
+	if d.Dir != "net/http" || d.Reviews != 7 || !reflect.DeepEqual(d.Reviewers, want) {
+		t.Errorf("Dirs[0] = %s %d %v, want net/http 7 %v", d.Dir, d.Reviews, d.Reviewers, want)
+	}
+	// Sorted counts 0, 1, 6: (-2*0 + 0*1 + 2*6) / (3*7).
+	if want := 12.0 / 21; d.Gini < want-1e-9 || d.Gini > want+1e-9 {
+		t.Errorf("net/http Gini = %v, want %v", d.Gini, want)
+	}
+	if d := r.Dirs[1]; d.Dir != "fmt" || d.Gini != 0 {
+		t.Errorf("Dirs[1] = %s Gini %v, want fmt 0", d.Dir, d.Gini)
+	}
+
+	if r := computeFairness(cls, roster, owners, 3); len(r.Dirs) != 1 {
+		t.Errorf("with MinReviews 3, got %d directories, want 1", len(r.Dirs))
+	}
+}
+
+func TestSuggestAvailable(t *testing.T) {
+	a, err := ParseAway("A@x", "2014-03-01", "2014-03-10", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseAway("a@x", "2014-03-10", "2014-03-01", ""); err == nil {
+		t.Errorf("ParseAway accepted until before from")
+	}
+	list := []*Away{a, {Email: "b@x", From: a.Until, Until: a.Until.Add(24 * time.Hour)}}
+	for _, tt := range []struct {
+		date string
+		away bool
+	}{
+		{"2014-02-28", false},
+		{"2014-03-01", true},
+		{"2014-03-10", true},
+		{"2014-03-11", false},
+	} {
+		tm, _ := time.Parse("2006-01-02", tt.date)
+		if away := absencesAt(list, tm.Add(12*time.Hour)).IsAway("a@x"); away != tt.away {
+			t.Errorf("a@x away on %s = %v, want %v", tt.date, away, tt.away)
+		}
+	}
+
+	away := absencesAt(list, a.From)
+	owners := Owners{
+		"net":      {Dir: "net", Owners: []string{"c@x"}},
+		"net/http": {Dir: "net/http", Owners: []string{"a@x"}},
+		"fmt":      {Dir: "fmt", Owners: []string{"a@x", "b@x"}},
+	}
+	cl := &CL{OwnerEmail: "o@x", Files: []string{"src/pkg/net/http/server.go", "src/pkg/fmt/print.go"}}
+	if got, want := owners.SuggestReviewers(cl), []string{"a@x", "b@x"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SuggestReviewers = %v, want %v", got, want)
+	}
+	if got, want := owners.SuggestAvailable(cl, away), []string{"b@x", "c@x"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SuggestAvailable = %v, want %v", got, want)
+	}
+	if got, want := owners.SuggestAvailable(cl, nil), owners.SuggestReviewers(cl); !reflect.DeepEqual(got, want) {
+		t.Errorf("SuggestAvailable with nobody away = %v, want %v", got, want)
+	}
+}
+
+func TestBadIssueRef(t *testing.T) {
+	ctxt := apptest.NewContext(t)
+	defer app.SetStore(app.SetStore(apptest.NewStore()))
+
+	for _, bug := range []*issue.Issue{
+		{ID: 1, State: "open", Status: "Accepted"},
+		{ID: 2, State: "closed", Status: "Fixed"},
+		{ID: 3, State: "closed", Status: "Moved"},
+		{ID: 4, State: "open", Label: []string{"IssueMoved"}},
+	} {
+		if err := app.WriteData(ctxt, "Issue", fmt.Sprint(bug.ID), bug); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id, want := range map[string]string{
+		"1": "",
+		"2": "closed (Fixed)",
+		"3": "moved",
+		"4": "moved",
+		"5": "missing",
+	} {
+		reason, err := badIssueRef(ctxt, id)
+		if err != nil || reason != want {
+			t.Errorf("badIssueRef(%s) = %q, %v, want %q", id, reason, err, want)
+		}
+	}
+}
+
+func TestDelegatedLGTM(t *testing.T) {
+	owner := "gopher@example.com"
+	lgtm := Message{Sender: botEmail(), Text: "LGTM\n\n(sent by adg@golang.org via the Go dashboard)"}
+	for _, first := range []Message{
+		{Sender: owner, Text: "Hello adg@golang.org,\n\nI'd like you to review this change to\nhttps://code.google.com/p/go"},
+		{Sender: owner, Text: "PTAL"},
+	} {
+		cl := &CL{OwnerEmail: owner, Messages: []Message{first, lgtm}}
+		cl.parseMessages()
+		if cl.PrimaryReviewer != "adg@golang.org" || cl.NeedsReview || !reflect.DeepEqual(cl.LGTM, []string{"adg@golang.org"}) {
+			t.Errorf("after %q and delegated LGTM: reviewer %q, NeedsReview %v, LGTM %v, want adg@golang.org, false, [adg@golang.org]",
+				first.Text, cl.PrimaryReviewer, cl.NeedsReview, cl.LGTM)
+		}
+	}
+}
+
+var lintTests = []struct {
+	desc string
+	want []string
+}{
+	{"net/http: fix typo\n\nFixes issue 123.", nil},
+	{"undo CL 12345 / 1b2c3d\n\nBroke the build.", nil},
+	{"fix typo", []string{"first line has no package prefix"}},
+	{"cmd/go: " + strings.Repeat("x", 80), []string{"first line longer than 76 characters"}},
+	{"runtime: fix crash\n\nSee issue 42.", []string{`mentions an issue but has no "Fixes issue N" line`}},
+	{"runtime: fix crash\n\nUpdates #42.", nil},
+	{"", nil},
+}
+
+func TestLintDesc(t *testing.T) {
+	for _, tt := range lintTests {
+		if got := lintDesc(tt.desc); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("lintDesc(%q) = %q, want %q", tt.desc, got, tt.want)
+		}
+	}
+}
+
+const testDiff = `Index: src/pkg/x/x.go
+===================================================================
+--- a/src/pkg/x/x.go
++++ b/src/pkg/x/x.go
+@@ -1,4 +1,4 @@
+ package x
+ 
+-func F() {}
++func F()  {}
+ 
+Index: src/pkg/x/y.go
+===================================================================
+--- /dev/null
++++ b/src/pkg/x/y.go
+@@ -0,0 +1,2 @@
++package x
++var Y = 1
+`
+
+func TestApplyDiff(t *testing.T) {
+	files := parseDiff(testDiff)
+	if len(files) != 2 {
+		t.Fatalf("parseDiff found %d files, want 2", len(files))
+	}
+	x, y := files[0], files[1]
+	if x.name != "src/pkg/x/x.go" || x.created || y.name != "src/pkg/x/y.go" || !y.created {
+		t.Fatalf("parseDiff = %+v, %+v", x, y)
+	}
+	src, err := x.apply([]byte("package x\n\nfunc F() {}\n\n// end\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "package x\n\nfunc F()  {}\n\n// end\n"; string(src) != want {
+		t.Errorf("apply = %q, want %q", src, want)
+	}
+	if s := gofmtProblem(src); s != "needs gofmt (first difference at line 3)" {
+		t.Errorf("gofmtProblem = %q", s)
+	}
+	src, err = y.apply(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := gofmtProblem(src); s != "needs gofmt (first difference at line 2)" {
+		t.Errorf("gofmtProblem(new file) = %q", s)
+	}
+	if _, err := x.apply([]byte("package y\n")); err == nil {
+		t.Errorf("apply to wrong base succeeded")
+	}
+}
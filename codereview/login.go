@@ -15,15 +15,14 @@ import (
 	"app"
 
 	"code.google.com/p/goauth2/oauth"
-	"github.com/rsc/appstats"
 
 	"appengine"
 	"appengine/urlfetch"
 )
 
 func init() {
-	http.Handle("/admin/codelogin", appstats.NewHandler(codelogin))
-	http.Handle("/codetoken", appstats.NewHandler(codetoken))
+	app.Handle("/admin/codelogin", codelogin)
+	app.Handle("/codetoken", codetoken)
 }
 
 func oauthConfig(ctxt appengine.Context) (*oauth.Config, error) {
@@ -103,7 +102,7 @@ func codetoken(ctxt appengine.Context, w http.ResponseWriter, req *http.Request)
 
 	tr := &oauth.Transport{
 		Config:    cfg,
-		Transport: urlfetch.Client(ctxt).Transport,
+		Transport: app.SecureTransport(ctxt, "codereview", urlfetch.Client(ctxt).Transport),
 	}
 
 	_, err = tr.Exchange(code)
@@ -132,7 +131,7 @@ func randomID() (string, error) {
 }
 
 func init() {
-	http.Handle("/admin/testissue", appstats.NewHandler(testIssue))
+	app.Handle("/admin/testissue", testIssue)
 }
 
 func testIssue(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
@@ -158,7 +157,7 @@ func postIssueComment(ctxt appengine.Context, id, comment string) error {
 	tr := &oauth.Transport{
 		Config:    cfg,
 		Token:     &tok,
-		Transport: urlfetch.Client(ctxt).Transport,
+		Transport: app.SecureTransport(ctxt, "codereview", urlfetch.Client(ctxt).Transport),
 	}
 	client := tr.Client()
 
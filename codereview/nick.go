@@ -0,0 +1,95 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codereview
+
+import (
+	"fmt"
+	"time"
+
+	"app"
+
+	"appengine"
+)
+
+// The CLs record nicknames only for their owners, so many people in the
+// roster have no known nickname. The codereview.nicks cron job looks up a
+// few of them in Rietveld on each run and saves the results in the
+// codereview.nicks metadata, which loadRoster merges into the roster.
+
+// nicksPerRun limits the Rietveld lookups done by a single run of lookupNicks.
+const nicksPerRun = 20
+
+// nickRetry is how long lookupNicks waits before retrying a failed lookup.
+const nickRetry = 7 * 24 * time.Hour
+
+type nickCache struct {
+	Nicks  map[string]string    // nickname by email address
+	Failed map[string]time.Time // time of the last failed lookup, by email address
+}
+
+func init() {
+	app.Cron("codereview.nicks", 1*time.Hour, lookupNicks)
+	app.RegisterOp("codereview.whoami", "Report which Rietveld account the bot is logged in as.", nil, func(ctxt appengine.Context, args map[string]string) (string, error) {
+		r, err := login(ctxt)
+		if err != nil {
+			return "", err
+		}
+		me, err := r.Me()
+		if err != nil {
+			return "", err
+		}
+		msg := fmt.Sprintf("logged in as %s (%s); mail notifications %v, chat notifications %v", me.Email, me.Nickname, me.NotifyByEmail, me.NotifyByChat)
+		if bot := loadBot(ctxt); me.Email != bot {
+			msg += "; expected " + bot
+		}
+		return msg, nil
+	})
+}
+
+func readNicks(ctxt appengine.Context) *nickCache {
+	var c nickCache
+	app.ReadMetaCached(ctxt, "codereview.nicks", &c)
+	if c.Nicks == nil {
+		c.Nicks = make(map[string]string)
+	}
+	if c.Failed == nil {
+		c.Failed = make(map[string]time.Time)
+	}
+	return &c
+}
+
+// lookupNicks looks up the nicknames of people in the roster without one.
+func lookupNicks(ctxt appengine.Context) error {
+	c := readNicks(ctxt)
+	var todo []string
+	for _, p := range loadRoster(ctxt) {
+		if p.Nick != "" || time.Since(c.Failed[p.Email]) < nickRetry {
+			continue
+		}
+		todo = append(todo, p.Email)
+		if len(todo) == nicksPerRun {
+			break
+		}
+	}
+	if len(todo) == 0 {
+		return nil
+	}
+
+	r, err := login(ctxt)
+	if err != nil {
+		return err
+	}
+	for _, email := range todo {
+		a, err := r.UserInfo(email)
+		if err != nil || a.Nickname == "" {
+			ctxt.Infof("looking up nickname of %s: %v", email, err)
+			c.Failed[email] = time.Now()
+			continue
+		}
+		c.Nicks[email] = a.Nickname
+		delete(c.Failed, email)
+	}
+	return app.WriteMeta(ctxt, "codereview.nicks", c)
+}
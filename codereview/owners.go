@@ -0,0 +1,204 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codereview
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+
+	"app"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"appengine/user"
+)
+
+// A DirOwner records the people responsible for a directory and its subdirectories.
+// Owners review CLs in the directory; watchers just want to know about them.
+// DirOwners are stored in the datastore under the directory name, using the
+// same names as CL.Dirs.
+type DirOwner struct {
+	Dir      string
+	Owners   []string
+	Watchers []string
+}
+
+// Owners maps directory names to their DirOwner records.
+type Owners map[string]*DirOwner
+
+// Lookup returns the DirOwner for dir, which is the record
+// for dir itself or else for its closest parent that has one.
+// It returns nil if there is no such record.
+func (o Owners) Lookup(dir string) *DirOwner {
+	for {
+		if d := o[dir]; d != nil {
+			return d
+		}
+		i := strings.LastIndex(dir, "/")
+		if i < 0 {
+			return nil
+		}
+		dir = dir[:i]
+	}
+}
+
+// LoadOwners returns all the DirOwner records.
+func LoadOwners(ctxt appengine.Context) (Owners, error) {
+	var list []*DirOwner
+	if _, err := memcache.JSON.Get(ctxt, "codereview.owners", &list); err != nil {
+		_, err := datastore.NewQuery("DirOwner").GetAll(ctxt, &list)
+		if err != nil {
+			ctxt.Errorf("loading owners: %v", err)
+			return nil, fmt.Errorf("loading owners failed")
+		}
+		memcache.JSON.Set(ctxt, &memcache.Item{Key: "codereview.owners", Object: list})
+	}
+	o := make(Owners)
+	for _, d := range list {
+		o[d.Dir] = d
+	}
+	return o, nil
+}
+
+// SuggestReviewers returns the owners of the directories the CL modifies,
+// most relevant first, omitting the CL's owner.
+func (o Owners) SuggestReviewers(cl *CL) []string {
+	var out []string
+	seen := map[string]bool{cl.OwnerEmail: true}
+	for _, dir := range cl.Dirs() {
+		d := o.Lookup(dir)
+		if d == nil {
+			continue
+		}
+		for _, who := range d.Owners {
+			if !seen[who] {
+				seen[who] = true
+				out = append(out, who)
+			}
+		}
+	}
+	return out
+}
+
+func init() {
+	app.HandleRole("/admin/codereview/owners", app.ReviewerAdmin, editOwners)
+}
+
+var ownersTemplate = template.Must(template.New("owners").Parse(`<html>
+<h1>directory owners</h1>
+{{if .Error}}<p><b>{{.Error}}</b></p>{{end}}
+<table>
+<tr><th>directory<th>owners<th>watchers
+{{range .List}}
+<tr><td><a href="?dir={{.Dir}}">{{.Dir}}</a><td>{{range .Owners}}{{.}} {{end}}<td>{{range .Watchers}}{{.}} {{end}}
+{{end}}
+</table>
+
+<h2>edit</h2>
+<form method="post">
+<input type="hidden" name="xsrf" value="{{.XSRF}}">
+Directory: <input type="text" name="dir" value="{{.Edit.Dir}}"><br>
+Owners: <input type="text" name="owners" size=80 value="{{range .Edit.Owners}}{{.}} {{end}}"><br>
+Watchers: <input type="text" name="watchers" size=80 value="{{range .Edit.Watchers}}{{.}} {{end}}"><br>
+<input type="submit" name="op" value="Write">
+<input type="submit" name="op" value="Delete">
+</form>
+<p>Owners and watchers are space-separated committer names or email addresses.
+Delete removes the record for the directory; its subdirectories then
+fall back to the record for the closest parent.</p>
+</html>
+`))
+
+// expandOwners parses a space- or comma-separated list of committers.
+func expandOwners(s string) ([]string, error) {
+	var out []string
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool { return r == ' ' || r == ',' }) {
+		who := expandReviewer(f)
+		if who == "" {
+			return nil, fmt.Errorf("unknown committer %q", f)
+		}
+		out = append(out, who)
+	}
+	return out, nil
+}
+
+func editOwners(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	var data struct {
+		Error string
+		XSRF  string
+		List  []*DirOwner
+		Edit  DirOwner
+	}
+	email := ""
+	if u := user.Current(ctxt); u != nil {
+		email = u.Email
+	}
+	data.XSRF = app.XSRFToken(ctxt, email, "codereview.owners")
+
+	dir := strings.Trim(req.FormValue("dir"), "/")
+	if req.Method == "POST" {
+		if !app.ValidXSRFToken(ctxt, req.FormValue("xsrf"), email, "codereview.owners") {
+			http.Error(w, "invalid XSRF token; reload the page", 403)
+			return
+		}
+		if err := updateOwners(ctxt, req, dir); err != nil {
+			data.Error = err.Error()
+		}
+	}
+
+	owners, err := LoadOwners(ctxt)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	for _, d := range owners {
+		data.List = append(data.List, d)
+	}
+	sort.Sort(ownersByDir(data.List))
+	if d := owners[dir]; d != nil {
+		data.Edit = *d
+	} else {
+		data.Edit.Dir = dir
+	}
+
+	var buf bytes.Buffer
+	if err := ownersTemplate.Execute(&buf, &data); err != nil {
+		ctxt.Errorf("execute: %v", err)
+		http.Error(w, "error executing template", 500)
+		return
+	}
+	w.Write(buf.Bytes())
+}
+
+// updateOwners applies the edit form in req to the record for dir.
+func updateOwners(ctxt appengine.Context, req *http.Request, dir string) error {
+	if dir == "" {
+		return fmt.Errorf("missing directory")
+	}
+	defer memcache.Delete(ctxt, "codereview.owners")
+	if req.FormValue("op") == "Delete" {
+		return app.DeleteData(ctxt, "DirOwner", dir)
+	}
+	d := &DirOwner{Dir: dir}
+	var err error
+	if d.Owners, err = expandOwners(req.FormValue("owners")); err != nil {
+		return err
+	}
+	if d.Watchers, err = expandOwners(req.FormValue("watchers")); err != nil {
+		return err
+	}
+	return app.WriteData(ctxt, "DirOwner", dir, d)
+}
+
+type ownersByDir []*DirOwner
+
+func (x ownersByDir) Len() int           { return len(x) }
+func (x ownersByDir) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+func (x ownersByDir) Less(i, j int) bool { return x[i].Dir < x[j].Dir }
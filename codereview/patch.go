@@ -0,0 +1,90 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codereview
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"app"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// A Diff is the unified diff of a single patch set,
+// stored in the datastore under "CL/patchset" like the Patch.
+// Patch sets do not change once uploaded, so a Diff never goes stale.
+type Diff struct {
+	Text      []byte `datastore:",noindex"`
+	Truncated bool   // Text is only the first maxDiff bytes
+}
+
+// maxDiff limits the size of a stored Diff, to stay under
+// the datastore's entity size limit.
+const maxDiff = 900 << 10
+
+const diffTmpl = "https://codereview.appspot.com/download/issue%s_%s.diff"
+
+// LatestPatch returns the stored metadata for the CL's latest patch set.
+func LatestPatch(ctxt appengine.Context, clnumber string) (*CL, *Patch, error) {
+	var cl CL
+	if err := app.ReadData(ctxt, "CL", clnumber, &cl); err != nil {
+		return nil, nil, err
+	}
+	if len(cl.PatchSets) == 0 {
+		return &cl, nil, fmt.Errorf("CL %s has no patch sets", clnumber)
+	}
+	ps := cl.PatchSets[len(cl.PatchSets)-1]
+	var p Patch
+	if err := app.ReadData(ctxt, "Patch", clnumber+"/"+ps, &p); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return &cl, nil, fmt.Errorf("patch set %s of CL %s not loaded yet", ps, clnumber)
+		}
+		return &cl, nil, err
+	}
+	return &cl, &p, nil
+}
+
+// LoadDiff returns the unified diff of the given patch set,
+// fetching it from Rietveld the first time it is requested.
+func LoadDiff(ctxt appengine.Context, clnumber, patchset string) (*Diff, error) {
+	key := clnumber + "/" + patchset
+	var d Diff
+	err := app.ReadData(ctxt, "Diff", key, &d)
+	if err == nil {
+		return &d, nil
+	}
+	if err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+
+	url := fmt.Sprintf(diffTmpl, clnumber, patchset)
+	res, err := app.Client(ctxt, "codereview").Get(url)
+	if err != nil {
+		ctxt.Errorf("fetch URL <%s>: %v", url, err)
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		ctxt.Errorf("fetch URL <%s>: %v", url, res.Status)
+		return nil, fmt.Errorf("http %v", res.Status)
+	}
+	text, err := ioutil.ReadAll(io.LimitReader(res.Body, maxDiff+1))
+	if err != nil {
+		ctxt.Errorf("reading URL <%s>: %v", url, err)
+		return nil, err
+	}
+	if len(text) > maxDiff {
+		text = text[:maxDiff]
+		d.Truncated = true
+	}
+	d.Text = text
+	if err := app.WriteData(ctxt, "Diff", key, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codereview
+
+import (
+	"fmt"
+	"time"
+
+	"app"
+	"issue"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Priority inheritance.
+//
+// A CL fixing an urgent issue is more urgent than a drive-by cleanup,
+// but only the issue says so. The codereview.priority scan copies the
+// priority of the most urgent open issue mentioned in each active CL's
+// description (see issue.Issue.Priority) into the CL's InheritedPriority,
+// which the dashboard uses to order the CLs in each group.
+
+func init() {
+	app.ScanData("codereview.priority", 15*time.Minute,
+		datastore.NewQuery("CL").Filter("Active =", true),
+		inheritPriority)
+}
+
+func inheritPriority(ctxt appengine.Context, kind, key string) error {
+	var cl CL
+	if err := app.ReadData(ctxt, "CL", key, &cl); err != nil {
+		return nil // error already logged
+	}
+	p := issue.PriorityNone
+	for _, id := range cl.DescIssue {
+		var bug issue.Issue
+		if err := app.ReadData(ctxt, "Issue", id, &bug); err != nil {
+			continue // not an issue we know; already logged
+		}
+		if bug.State == "open" && bug.Priority() > p {
+			p = bug.Priority()
+		}
+	}
+	if p == cl.InheritedPriority {
+		return nil
+	}
+	return app.Transaction(ctxt, func(ctxt appengine.Context) error {
+		var old CL
+		if err := app.ReadData(ctxt, "CL", key, &old); err != nil {
+			return fmt.Errorf("reading CL %s: %v", key, err)
+		}
+		old.InheritedPriority = p
+		old.Updated = time.Now()
+		return app.WriteData(ctxt, "CL", key, &old)
+	})
+}
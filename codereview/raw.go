@@ -0,0 +1,166 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codereview
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"time"
+
+	"app"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Raw payload mirror.
+//
+// When the codereview.rawfetch flag is on, fetchJSON keeps a compressed
+// copy of the JSON it fetches for each CL and patch set in a RawFetch
+// record, so that the conversion from Rietveld's JSON to CL and Patch
+// can be rerun over stored payloads without fetching them again.
+// The codereview.reparse scan reconverts the most recent payload for
+// each URL whenever rawParseVersion is newer than the version that
+// last converted it.
+
+// rawParseVersion is the version of the conversion from Rietveld's JSON
+// (jsonCL.toCL, jsonPatch.toPatch). Increment it after changing the
+// conversion to reprocess the stored payloads.
+const rawParseVersion = 1
+
+var rawFetchFlag = app.Flag("codereview.rawfetch", false)
+
+var (
+	rawCLRE    = regexp.MustCompile(`^https://codereview\.appspot\.com/api/([0-9]+)\?messages=true$`)
+	rawPatchRE = regexp.MustCompile(`^https://codereview\.appspot\.com/api/([0-9]+)/([0-9]+)$`)
+)
+
+// A RawFetch is a JSON payload fetched from Rietveld.
+// It is stored under the URL and the payload's ETag, separated by an @.
+// Responses without an ETag use a hash of the payload instead.
+type RawFetch struct {
+	URL    string
+	ETag   string `datastore:",noindex"`
+	Time   time.Time
+	Latest bool   // most recent payload fetched from URL
+	Parsed int    // rawParseVersion of the last conversion
+	Data   []byte `datastore:",noindex"` // gzip-compressed payload
+}
+
+func init() {
+	app.ScanData("codereview.reparse", 15*time.Minute,
+		datastore.NewQuery("RawFetch").Filter("Latest =", true).Filter("Parsed <", rawParseVersion),
+		reparse)
+}
+
+// mirrorRaw stores the payload fetched from url, if the flag is on
+// and url is a CL or patch set.
+// Errors are logged but otherwise ignored: the mirror is best effort.
+func mirrorRaw(ctxt appengine.Context, url, etag string, payload []byte) {
+	if !rawCLRE.MatchString(url) && !rawPatchRE.MatchString(url) || !rawFetchFlag.On(ctxt) {
+		return
+	}
+	if etag == "" {
+		etag = fmt.Sprintf("%x", sha1.Sum(payload))
+	}
+	key := url + "@" + etag
+	var old RawFetch
+	if err := app.ReadData(ctxt, "RawFetch", key, &old); err == nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(payload)
+	if err := zw.Close(); err != nil {
+		ctxt.Errorf("compressing %s: %v", url, err)
+		return
+	}
+
+	// Demote the previous payloads; only the latest is reparsed.
+	var prev []*RawFetch
+	keys, err := datastore.NewQuery("RawFetch").
+		Filter("URL =", url).
+		Filter("Latest =", true).
+		GetAll(ctxt, &prev)
+	if err != nil {
+		ctxt.Errorf("loading raw payloads for %s: %v", url, err)
+		return
+	}
+	for i, r := range prev {
+		r.Latest = false
+		if err := app.WriteData(ctxt, "RawFetch", keys[i].StringID(), r); err != nil {
+			return
+		}
+	}
+
+	r := &RawFetch{
+		URL:    url,
+		ETag:   etag,
+		Time:   time.Now(),
+		Latest: true,
+		Parsed: rawParseVersion,
+		Data:   buf.Bytes(),
+	}
+	app.WriteData(ctxt, "RawFetch", key, r)
+}
+
+// reparse converts the stored payload with the given key again
+// and stores the resulting CL or Patch.
+func reparse(ctxt appengine.Context, kind, key string) error {
+	var r RawFetch
+	if err := app.ReadData(ctxt, "RawFetch", key, &r); err != nil {
+		return nil // already logged
+	}
+	if err := reparseRaw(ctxt, &r); err != nil {
+		ctxt.Errorf("reparse %s: %v", key, err)
+	}
+	// Mark even failed payloads parsed, so that a bad payload
+	// is not retried forever; the next version will try it again.
+	r.Parsed = rawParseVersion
+	return app.WriteData(ctxt, "RawFetch", key, &r)
+}
+
+func reparseRaw(ctxt appengine.Context, r *RawFetch) error {
+	zr, err := gzip.NewReader(bytes.NewReader(r.Data))
+	if err != nil {
+		return err
+	}
+	payload, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return err
+	}
+
+	if m := rawPatchRE.FindStringSubmatch(r.URL); m != nil {
+		var jp jsonPatch
+		if err := json.Unmarshal(payload, &jp); err != nil {
+			return err
+		}
+		return app.WriteData(ctxt, "Patch", m[1]+"/"+m[2], jp.toPatch(ctxt))
+	}
+	if rawCLRE.MatchString(r.URL) {
+		var jcl jsonCL
+		if err := json.Unmarshal(payload, &jcl); err != nil {
+			return err
+		}
+		cl, err := jcl.toCL(ctxt)
+		if err != nil {
+			return err
+		}
+		cl.MessagesLoaded = true
+		err = storeCL(ctxt, cl, "", "", false)
+		if _, ok := err.(*staleError); ok {
+			// A newer copy was loaded without being mirrored. Keep it.
+			return nil
+		}
+		return err
+	}
+	return fmt.Errorf("unexpected URL %s", r.URL)
+}
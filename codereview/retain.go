@@ -0,0 +1,194 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codereview
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"time"
+
+	"app"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Patch retention.
+//
+// Every patch set of a CL is loaded into a Patch record (and, if someone
+// looks at it, a Diff record), and CLs that are updated often accumulate
+// many of them. Only the latest patch set is used, so the codereview.patchgc
+// cron job deletes the records for all but the latest few patch sets of
+// each CL, keeping counts of what it deleted on the CL.
+//
+// The number of patch sets to keep is set by the "codereview.patches" config:
+//
+//	{"Keep": 10}
+
+type retainConfig struct {
+	Keep int // patch sets to keep per CL; at least 1
+}
+
+var defaultRetainConfig = retainConfig{
+	Keep: 10,
+}
+
+// livePatchSets returns the CL's patch sets that have not been pruned.
+func (cl *CL) livePatchSets() []string {
+	if cl.PatchSetsPruned >= len(cl.PatchSets) {
+		return nil
+	}
+	return cl.PatchSets[cl.PatchSetsPruned:]
+}
+
+// patchGC records the progress of the codereview.patchgc cron job.
+// It is stored as the meta value "codereview.patchgc".
+type patchGC struct {
+	Cursor string    // where to continue the pass in progress, if any
+	Start  time.Time // start of the pass in progress
+	Pruned int64     // patch sets deleted so far by the pass in progress
+
+	Time       time.Time // when the last pass finished
+	LastPruned int64     // patch sets deleted by the last pass
+}
+
+// patchGCChunk is the number of CLs to consider in a single cron run.
+const patchGCChunk = 200
+
+func init() {
+	app.Cron("codereview.patchgc", 24*time.Hour, prunePatches)
+	app.RegisterStatus("codereview patch retention", patchGCStatus)
+}
+
+// prunePatches deletes old patch sets of the loaded CLs, a chunk of CLs at a time.
+// It returns app.ErrMoreCron until it has made a complete pass.
+func prunePatches(ctxt appengine.Context) error {
+	cfg := defaultRetainConfig
+	app.ReadConfig(ctxt, "codereview.patches", &cfg)
+	if cfg.Keep < 1 {
+		cfg.Keep = 1
+	}
+
+	var st patchGC
+	if err := app.ReadMeta(ctxt, "codereview.patchgc", &st); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	if st.Cursor == "" {
+		st.Start = time.Now()
+		st.Pruned = 0
+	}
+
+	q := datastore.NewQuery("CL").Filter("PatchSetsLoaded =", true).KeysOnly().Limit(patchGCChunk)
+	if st.Cursor != "" {
+		c, err := datastore.DecodeCursor(st.Cursor)
+		if err != nil {
+			ctxt.Errorf("patchgc: bad cursor: %v", err)
+			st.Cursor = ""
+			return app.WriteMeta(ctxt, "codereview.patchgc", &st)
+		}
+		q = q.Start(c)
+	}
+	n := 0
+	it := q.Run(ctxt)
+	for {
+		k, err := it.Next(nil)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("patchgc: %v", err)
+		}
+		n++
+		pruned, err := pruneCL(ctxt, k.StringID(), cfg.Keep)
+		if err != nil {
+			return fmt.Errorf("patchgc: CL %s: %v", k.StringID(), err)
+		}
+		st.Pruned += int64(pruned)
+	}
+
+	if n == patchGCChunk {
+		c, err := it.Cursor()
+		if err != nil {
+			return fmt.Errorf("patchgc: %v", err)
+		}
+		st.Cursor = c.String()
+		if err := app.WriteMeta(ctxt, "codereview.patchgc", &st); err != nil {
+			return err
+		}
+		return app.ErrMoreCron
+	}
+	st.Cursor = ""
+	st.Time = time.Now()
+	st.LastPruned = st.Pruned
+	return app.WriteMeta(ctxt, "codereview.patchgc", &st)
+}
+
+// pruneCL deletes the Patch and Diff records for all but the latest keep
+// patch sets of the CL with the given number, and returns how many
+// patch sets it pruned.
+func pruneCL(ctxt appengine.Context, key string, keep int) (int, error) {
+	var cl CL
+	if err := app.ReadData(ctxt, "CL", key, &cl); err != nil {
+		return 0, err
+	}
+	n := len(cl.PatchSets) - keep
+	if n <= cl.PatchSetsPruned {
+		return 0, nil
+	}
+
+	comments := 0
+	for _, ps := range cl.PatchSets[cl.PatchSetsPruned:n] {
+		pkey := cl.CL + "/" + ps
+		var p Patch
+		if err := app.ReadData(ctxt, "Patch", pkey, &p); err == nil {
+			comments += p.NumComments
+		}
+		if err := app.DeleteData(ctxt, "Patch", pkey); err != nil && err != datastore.ErrNoSuchEntity {
+			return 0, err
+		}
+		if err := app.DeleteData(ctxt, "Diff", pkey); err != nil && err != datastore.ErrNoSuchEntity {
+			return 0, err
+		}
+	}
+
+	pruned := n - cl.PatchSetsPruned
+	err := app.Transaction(ctxt, func(ctxt appengine.Context) error {
+		var old CL
+		if err := app.ReadData(ctxt, "CL", key, &old); err != nil {
+			return err
+		}
+		if old.PatchSetsPruned >= n {
+			return nil
+		}
+		old.PatchSetsPruned = n
+		old.PrunedComments += comments
+		return app.WriteData(ctxt, "CL", key, &old)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return pruned, nil
+}
+
+func patchGCStatus(ctxt appengine.Context) string {
+	cfg := defaultRetainConfig
+	app.ReadConfig(ctxt, "codereview.patches", &cfg)
+
+	w := new(bytes.Buffer)
+	fmt.Fprintf(w, "keeping the latest %d patch sets of each CL\n", cfg.Keep)
+	var st patchGC
+	if err := app.ReadMeta(ctxt, "codereview.patchgc", &st); err != nil {
+		fmt.Fprintf(w, "not yet run\n")
+	} else {
+		if !st.Time.IsZero() {
+			fmt.Fprintf(w, "last pass finished %v: pruned %d patch sets\n", st.Time, st.LastPruned)
+		}
+		if st.Cursor != "" {
+			fmt.Fprintf(w, "pass in progress since %v: pruned %d patch sets so far\n", st.Start, st.Pruned)
+		}
+	}
+	return "<pre>" + html.EscapeString(w.String()) + "</pre>"
+}
@@ -0,0 +1,124 @@
+package rietveld
+
+import (
+	"bufio"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Account holds the details of a Rietveld user account.
+type Account struct {
+	Email    string
+	Nickname string
+
+	// The notification settings are only known for the
+	// client's own account, as returned by Me.
+	NotifyByEmail bool
+	NotifyByChat  bool
+}
+
+// Me returns the account the client is acting as,
+// from the server's settings page.
+func (r *Rietveld) Me() (*Account, error) {
+	h := &settingsLoadHandler{}
+	if err := r.do(h); err != nil {
+		return nil, err
+	}
+	a := &Account{
+		Nickname:      h.form["nickname"],
+		NotifyByEmail: h.form["notify_by_email"] != "",
+		NotifyByChat:  h.form["notify_by_chat"] != "",
+	}
+	if a.Nickname == "" {
+		return nil, fmt.Errorf("settings page has no nickname")
+	}
+	who, err := r.UserInfo(a.Nickname)
+	if err != nil {
+		return nil, err
+	}
+	a.Email = who.Email
+	return a, nil
+}
+
+// UserInfo returns the account with the given email address or nickname,
+// which must match exactly (ignoring case).
+func (r *Rietveld) UserInfo(emailOrNick string) (*Account, error) {
+	h := &accountHandler{query: emailOrNick}
+	if err := r.do(h); err != nil {
+		return nil, err
+	}
+	for _, a := range h.accounts {
+		if strings.EqualFold(a.Email, emailOrNick) || strings.EqualFold(a.Nickname, emailOrNick) {
+			return a, nil
+		}
+	}
+	return nil, fmt.Errorf("no Rietveld account %q", emailOrNick)
+}
+
+type settingsLoadHandler struct {
+	form map[string]string
+}
+
+func (h *settingsLoadHandler) action() (method, path string) {
+	return "GET", "/settings"
+}
+
+func (h *settingsLoadHandler) write(mpw *multipart.Writer) error {
+	logf("Requesting account settings...")
+	return nil
+}
+
+func (h *settingsLoadHandler) process(resp *http.Response) error {
+	debugf("Response from server: %s", resp.Status)
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("server returned %q", resp.Status)
+	}
+	form, err := parseForm("/settings", resp.Body)
+	if err != nil {
+		return err
+	}
+	h.form = form
+	return nil
+}
+
+// accountHandler queries the /account endpoint Rietveld uses to
+// complete reviewer names. It responds with one account per line,
+// formatted as "email (nickname)".
+type accountHandler struct {
+	query    string
+	accounts []*Account
+}
+
+func (h *accountHandler) action() (method, path string) {
+	return "GET", "/account?" + url.Values{"q": {h.query}, "limit": {"10"}}.Encode()
+}
+
+func (h *accountHandler) write(mpw *multipart.Writer) error {
+	logf("Looking up account %s...", h.query)
+	return nil
+}
+
+func (h *accountHandler) process(resp *http.Response) error {
+	debugf("Response from server: %s", resp.Status)
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("server returned %q", resp.Status)
+	}
+	h.accounts = nil
+	s := bufio.NewScanner(resp.Body)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		a := &Account{Email: line}
+		if i := strings.Index(line, " ("); i >= 0 && strings.HasSuffix(line, ")") {
+			a.Email = line[:i]
+			a.Nickname = line[i+2 : len(line)-1]
+		}
+		h.accounts = append(h.accounts, a)
+	}
+	return s.Err()
+}
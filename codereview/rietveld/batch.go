@@ -0,0 +1,92 @@
+package rietveld
+
+import (
+	"sync"
+)
+
+// Op is a single operation on an issue, to be run by Batch.
+//
+// Batch loads the issue and then calls Edit and Comment, if set,
+// in that order. Either may look at and change the loaded issue.
+type Op struct {
+	Id int // id of the issue to operate on
+
+	// Edit changes the fields of the loaded issue and reports whether
+	// it did; if so, the issue is saved as with UpdateIssue.
+	Edit func(issue *Issue) bool
+
+	// Comment returns the comment to add to the issue's thread, as with
+	// AddComment, or nil to add none.
+	Comment func(issue *Issue) *Comment
+}
+
+// Result holds the outcome of an Op run by Batch.
+type Result struct {
+	Op      *Op
+	Issue   *Issue // the loaded issue, or nil if loading failed
+	Changed bool   // whether the issue was edited or commented on
+	Err     error
+}
+
+// BatchParallelism is the maximum number of operations Batch runs at once.
+var BatchParallelism = 4
+
+// Batch runs ops, at most BatchParallelism of them at a time,
+// and returns their results in the same order.
+//
+// All the operations share r's authentication, so that a batch over
+// many issues logs in at most once (more if the session expires
+// midway) instead of once per issue. A failing operation does not
+// stop the others; its error is reported in its Result.
+func (r *Rietveld) Batch(ops []Op) []Result {
+	results := make([]Result, len(ops))
+	n := BatchParallelism
+	if n < 1 {
+		n = 1
+	}
+	sem := make(chan bool, n)
+	var wg sync.WaitGroup
+	for i := range ops {
+		wg.Add(1)
+		sem <- true
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = r.runOp(&ops[i])
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+func (r *Rietveld) runOp(op *Op) Result {
+	res := Result{Op: op}
+	issue, err := r.Issue(op.Id)
+	if err != nil {
+		logf("Batch: loading issue %d: %v", op.Id, err)
+		res.Err = err
+		return res
+	}
+	res.Issue = issue
+	if op.Edit != nil && op.Edit(issue) {
+		if err := r.UpdateIssue(issue); err != nil {
+			logf("Batch: updating issue %d: %v", op.Id, err)
+			res.Err = err
+			return res
+		}
+		res.Changed = true
+	}
+	if op.Comment != nil {
+		if c := op.Comment(issue); c != nil {
+			if err := r.AddComment(issue, c); err != nil {
+				logf("Batch: commenting on issue %d: %v", op.Id, err)
+				res.Err = err
+				return res
+			}
+			res.Changed = true
+		}
+	}
+	return res
+}
@@ -0,0 +1,57 @@
+package rietveld
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// PatchDownload is the raw diff of a patch set, as returned by DownloadPatchSet.
+// The caller must close it when done reading.
+type PatchDownload struct {
+	io.ReadCloser
+	Size int64 // length of the diff in bytes, or -1 if unknown
+}
+
+// DownloadPatchSet returns the complete diff of the given patch set
+// of the issue, with the changes to all files concatenated, as served
+// by Rietveld's /download/issueNNN_PS.diff endpoint.
+func (r *Rietveld) DownloadPatchSet(issueId, psId int) (*PatchDownload, error) {
+	h := &downloadHandler{issueId: issueId, psId: psId}
+	if err := r.do(h); err != nil {
+		return nil, err
+	}
+	return h.patch, nil
+}
+
+type downloadHandler struct {
+	issueId int
+	psId    int
+	patch   *PatchDownload
+}
+
+func (h *downloadHandler) action() (method, path string) {
+	return "GET", fmt.Sprintf("/download/issue%d_%d.diff", h.issueId, h.psId)
+}
+
+func (h *downloadHandler) write(mpw *multipart.Writer) error {
+	logf("Downloading patch set %d of issue %d...", h.psId, h.issueId)
+	return nil
+}
+
+func (h *downloadHandler) process(resp *http.Response) error {
+	debugf("Response from server: %s", resp.Status)
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("server returned %q", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); strings.HasPrefix(ct, "text/html") {
+		return fmt.Errorf("server returned HTML instead of patch set %d of issue %d", h.psId, h.issueId)
+	}
+	// Hand the body to the caller; do closes only the replacement.
+	h.patch = &PatchDownload{resp.Body, resp.ContentLength}
+	resp.Body = ioutil.NopCloser(strings.NewReader(""))
+	return nil
+}
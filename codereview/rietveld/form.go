@@ -10,6 +10,7 @@ import (
 	"mime/multipart"
 	"net/http"
 	"reflect"
+	"strconv"
 	"strings"
 )
 
@@ -32,8 +33,22 @@ func (r *Rietveld) Issue(id int) (*Issue, error) {
 // UpdateIssue changes the server representation of the provided
 // issue to match all of its field values.
 // The issue must necessarily have been loaded with the Issue method
+//
+// If the server provides an XSRF token endpoint, UpdateIssue posts
+// the change directly; otherwise it first loads the issue's edit form.
 func (r *Rietveld) UpdateIssue(issue *Issue) error {
 	op := &opInfo{r: r, issue: issue}
+	if token := r.xsrfToken(); token != "" {
+		form := make(chan map[string]string, 1)
+		form <- map[string]string{"xsrf_token": token}
+		close(form)
+		err := r.do(&editHandler{op: op, form: form})
+		if err != errXSRFRejected {
+			return err
+		}
+		logf("XSRF token rejected; using edit form.")
+		r.dropXSRFToken()
+	}
 	// Two requests concurrently, even though the second depends on
 	// the result of the first. How about that?
 	errs := make(chan error)
@@ -61,6 +76,20 @@ func firstError(n int, errors chan error) error {
 // and update it according to the provided settings.
 func (r *Rietveld) AddComment(issue *Issue, comment *Comment) error {
 	op := &opInfo{r: r, issue: issue}
+	if comment.DraftOnly {
+		return r.saveDraft(op, comment)
+	}
+	if !commentNeedsForm(comment) {
+		if token := r.xsrfToken(); token != "" {
+			publish := &publishHandler{op, map[string]string{"xsrf_token": token}, comment}
+			err := r.do(publish)
+			if err != errXSRFRejected {
+				return err
+			}
+			logf("XSRF token rejected; using publish form.")
+			r.dropXSRFToken()
+		}
+	}
 	load := &publishLoadHandler{op: op}
 	if err := r.do(load); err != nil {
 		return err
@@ -69,6 +98,37 @@ func (r *Rietveld) AddComment(issue *Issue, comment *Comment) error {
 	return r.do(publish)
 }
 
+// saveDraft saves the comment's message as the draft message on op's issue.
+func (r *Rietveld) saveDraft(op *opInfo, c *Comment) error {
+	if c.Subject != "" || c.Reviewers != nil || c.Cc != nil || c.PublishDrafts || c.InReplyTo != 0 {
+		return fmt.Errorf("draft comment on issue %d can only have a message", op.issue.Id)
+	}
+	token := r.xsrfToken()
+	if token == "" {
+		load := &publishLoadHandler{op: op}
+		if err := r.do(load); err != nil {
+			return err
+		}
+		token = load.form["xsrf_token"]
+	}
+	return r.do(&draftHandler{op, token, c.Message})
+}
+
+// commentNeedsForm reports whether posting comment requires
+// the current values of the issue's publish form: to check that the
+// subject may be changed, or to post back the reviewer or CC list
+// that the comment leaves alone while publishing drafts or changing
+// the other list.
+func commentNeedsForm(c *Comment) bool {
+	if c.Subject != "" {
+		return true
+	}
+	if c.Reviewers == nil && c.Cc == nil {
+		return c.PublishDrafts
+	}
+	return c.Reviewers == nil || c.Cc == nil
+}
+
 type issueLoadHandler struct {
 	op *opInfo
 }
@@ -107,6 +167,7 @@ func (h *issueLoadHandler) process(resp *http.Response) error {
 	issue.origCcMails = append([]string(nil), issue.CcMails...)
 	issue.Private = jsonBool(fields["private"])
 	issue.Closed = jsonBool(fields["closed"])
+	issue.BaseURL = jsonString(fields["base_url"])
 	return nil
 }
 
@@ -137,8 +198,9 @@ func (h *editLoadHandler) process(resp *http.Response) error {
 }
 
 type editHandler struct {
-	op   *opInfo
-	form <-chan map[string]string
+	op     *opInfo
+	form   <-chan map[string]string
+	fields map[string]string // form received from form, kept for retries
 }
 
 func (h *editHandler) action() (method, path string) {
@@ -169,10 +231,14 @@ func newAddresses(oldMails, newMails, oldNicks, newNicks []string) (addrs []stri
 func (h *editHandler) write(mpw *multipart.Writer) error {
 	logf("Updating details of issue %d...", h.op.issue.Id)
 	issue := h.op.issue
-	form, ok := <-h.form
-	if !ok {
-		return fmt.Errorf("updating of issue was aborted")
+	if h.fields == nil {
+		form, ok := <-h.form
+		if !ok {
+			return fmt.Errorf("updating of issue was aborted")
+		}
+		h.fields = form
 	}
+	form := h.fields
 
 	rv := newAddresses(issue.origReviewerMails, issue.ReviewerMails, issue.origReviewerNicks, issue.ReviewerNicks)
 	cc := newAddresses(issue.origCcMails, issue.CcMails, issue.origCcNicks, issue.CcNicks)
@@ -183,11 +249,17 @@ func (h *editHandler) write(mpw *multipart.Writer) error {
 	form["cc"] = strings.Join(cc, ", ")
 	form["private"] = checked(issue.Private)
 	form["closed"] = checked(issue.Closed)
+	if _, ok := form["base"]; !ok && issue.BaseURL != "" {
+		form["base"] = issue.BaseURL
+	}
 	return writeFields(mpw, form)
 }
 
 func (h *editHandler) process(resp *http.Response) error {
 	debugf("Response from server: %s", resp.Status)
+	if resp.StatusCode == 403 {
+		return errXSRFRejected
+	}
 	if resp.StatusCode != 200 && resp.StatusCode != 302 {
 		return fmt.Errorf("server returned %q", resp.Status)
 	}
@@ -271,6 +343,9 @@ func (h *publishHandler) write(mpw *multipart.Writer) error {
 		form["cc"] = strings.Join(c.Cc, ", ")
 		form["message_only"] = ""
 	}
+	if c.InReplyTo != 0 {
+		form["in_reply_to"] = strconv.Itoa(c.InReplyTo)
+	}
 	form["send_mail"] = checked(!c.NoMail)
 	form["no_redirect"] = "true"
 	return writeFields(mpw, form)
@@ -278,6 +353,9 @@ func (h *publishHandler) write(mpw *multipart.Writer) error {
 
 func (h *publishHandler) process(resp *http.Response) error {
 	debugf("Response from server: %s", resp.Status)
+	if resp.StatusCode == 403 {
+		return errXSRFRejected
+	}
 	if resp.StatusCode != 200 {
 		return fmt.Errorf("server returned %q", resp.Status)
 	}
@@ -292,6 +370,32 @@ func (h *publishHandler) process(resp *http.Response) error {
 	return nil
 }
 
+type draftHandler struct {
+	op      *opInfo
+	token   string
+	message string
+}
+
+func (h *draftHandler) action() (method, path string) {
+	return "POST", fmt.Sprintf("/%d/draft_message", h.op.issue.Id)
+}
+
+func (h *draftHandler) write(mpw *multipart.Writer) error {
+	logf("Saving draft message on issue %d...", h.op.issue.Id)
+	return writeFields(mpw, map[string]string{
+		"reviewmsg":  h.message,
+		"xsrf_token": h.token,
+	})
+}
+
+func (h *draftHandler) process(resp *http.Response) error {
+	debugf("Response from server: %s", resp.Status)
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("server returned %q", resp.Status)
+	}
+	return nil
+}
+
 var (
 	formBytes     = []byte("form")
 	actionBytes   = []byte("action")
@@ -300,14 +404,44 @@ var (
 	inputBytes    = []byte("input")
 	checkedBytes  = []byte("checked")
 	textareaBytes = []byte("textarea")
+	selectBytes   = []byte("select")
+	optionBytes   = []byte("option")
+	selectedBytes = []byte("selected")
 )
 
+// matchAction reports whether the form action names the given path suffix,
+// ignoring any query or fragment in the action.
+func matchAction(action, suffix []byte) bool {
+	if i := bytes.IndexAny(action, "?#"); i >= 0 {
+		action = action[:i]
+	}
+	return bytes.HasSuffix(action, suffix)
+}
+
+// parseForm returns the fields of the first form on the page whose action
+// ends in actionSuffix, as a browser would submit them unchanged: the values
+// of its inputs and text areas, and the selected option of each select
+// (or the first option, if none is marked selected). Fields of other forms
+// on the page are ignored.
 func parseForm(actionSuffix string, r io.Reader) (form map[string]string, err error) {
 	form = make(map[string]string)
 	z := html.NewTokenizer(r)
 	inForm := false
 	inTextArea := ""
+	inSelect := ""
+	inOption := false     // collecting the text of an option without a value
+	haveSelected := false // the current select has an explicitly selected option
+	optionText := ""
 	actionSuffixBytes := []byte(actionSuffix)
+
+	// endOption records the text of an option that has no value attribute.
+	endOption := func() {
+		if inOption {
+			form[inSelect] = strings.TrimSpace(optionText)
+			inOption = false
+		}
+	}
+
 loop:
 	for {
 		tt := z.Next()
@@ -324,11 +458,17 @@ loop:
 			if bytes.Equal(tag, formBytes) && tt == html.StartTagToken {
 				for attr {
 					key, val, attr = z.TagAttr()
-					if bytes.Equal(key, actionBytes) && bytes.HasSuffix(val, actionSuffixBytes) {
+					if bytes.Equal(key, actionBytes) && matchAction(val, actionSuffixBytes) {
 						inForm = true
 					}
 				}
-			} else if bytes.Equal(tag, inputBytes) || bytes.Equal(tag, textareaBytes) {
+				continue
+			}
+			if !inForm {
+				continue
+			}
+			switch {
+			case bytes.Equal(tag, inputBytes) || bytes.Equal(tag, textareaBytes):
 				var name, value string
 				for attr {
 					key, val, attr = z.TagAttr()
@@ -345,11 +485,50 @@ loop:
 				} else if name != "" {
 					form[name] = value
 				}
+			case bytes.Equal(tag, selectBytes) && tt == html.StartTagToken:
+				inSelect = ""
+				for attr {
+					key, val, attr = z.TagAttr()
+					if bytes.Equal(key, nameBytes) {
+						inSelect = string(val)
+					}
+				}
+				haveSelected = false
+			case bytes.Equal(tag, optionBytes) && inSelect != "":
+				endOption()
+				var value string
+				hasValue, selected := false, false
+				for attr {
+					key, val, attr = z.TagAttr()
+					if bytes.Equal(key, valueBytes) {
+						value, hasValue = string(val), true
+					} else if bytes.Equal(key, selectedBytes) {
+						selected = true
+					}
+				}
+				_, seen := form[inSelect]
+				if selected || !seen && !haveSelected {
+					if selected {
+						haveSelected = true
+					}
+					if hasValue {
+						form[inSelect] = value
+					} else if tt == html.StartTagToken {
+						inOption = true
+						optionText = ""
+					}
+				}
 			}
 		case html.TextToken:
+			if !inForm {
+				continue
+			}
 			if inTextArea != "" {
 				form[inTextArea] = form[inTextArea] + string(z.Text())
 			}
+			if inOption {
+				optionText += string(z.Text())
+			}
 		case html.EndTagToken:
 			tag, _ := z.TagName()
 			if bytes.Equal(tag, formBytes) && inForm {
@@ -358,6 +537,13 @@ loop:
 			if inTextArea != "" && bytes.Equal(tag, textareaBytes) {
 				inTextArea = ""
 			}
+			if bytes.Equal(tag, optionBytes) {
+				endOption()
+			}
+			if bytes.Equal(tag, selectBytes) {
+				endOption()
+				inSelect = ""
+			}
 		}
 	}
 	if len(form) == 0 {
@@ -32,12 +32,13 @@ type Rietveld struct {
 	url    string
 	auth   Auth
 	client *http.Client
+	xsrf   xsrfCache
 }
 
 // New returns a new *Rietveld capable of communicating with the
 // server at rietveldURL, and authenticating requests using auth.
 func New(rietveldURL string, auth Auth, t http.RoundTripper) *Rietveld {
-	return &Rietveld{rietveldURL, auth, &http.Client{Transport: t}}
+	return &Rietveld{url: rietveldURL, auth: auth, client: &http.Client{Transport: t}}
 }
 
 // CodeReview is a *Rietveld that can communicate with the standard
@@ -92,6 +93,16 @@ type Comment struct {
 	// If PublishDrafts is true, inline comments made in the code
 	// and not yet published will be delivered.
 	PublishDrafts bool
+
+	// If InReplyTo is not zero, the comment is threaded as a reply
+	// to the message with that sequence number in the issue's thread,
+	// counting from 1 for the issue's first message.
+	InReplyTo int
+
+	// If DraftOnly is true, Message is saved as the account's draft
+	// message on the issue instead of being published, and nobody is
+	// mailed. The other fields must not be set.
+	DraftOnly bool
 }
 
 // IssueURL returns the URL for the given issue.
@@ -186,6 +197,9 @@ func (r *Rietveld) do(handler requestHandler) (err error) {
 		}
 
 		req.Header.Set("Content-Type", mpw.FormDataContentType())
+		if hh, ok := handler.(headerHandler); ok {
+			hh.header(req.Header)
+		}
 		go func() {
 			if err := handler.write(mpw); err != nil {
 				logf("Failed to prepare request: %v", err)
@@ -232,6 +246,11 @@ type requestHandler interface {
 	process(resp *http.Response) error
 }
 
+// A headerHandler is a requestHandler that sets extra request headers.
+type headerHandler interface {
+	header(h http.Header)
+}
+
 type uploadHandler struct {
 	op       *opInfo
 	sendMail bool
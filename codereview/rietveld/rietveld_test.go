@@ -487,6 +487,42 @@ func (s *RietS) TestUpdateIssue2(c *C) {
 	c.Assert(post.Form["closed"], DeepEquals, []string{""})
 }
 
+// Newer edit pages have a search form before the edit form
+// and select fields that must be posted back unchanged.
+var editSelectHTML = `<html><body>
+<form action="/search"><input name="query" value="ignored"></form>
+<form action="/5372097/edit?x=1" method="post">
+<input type="hidden" name="xsrf_token" value="515c6d74d6c8ffd1d4a1cb980e54ff84">
+<select name="base_repo"><option value="1">one</option><option value="2" selected>two</option></select>
+<select name="lang"><option>en</option><option>fr</option></select>
+<input type="text" name="subject" value="Old subject">
+</form>
+<form action="/settings/edit"><input name="nickname" value="ignored"></form>
+</body></html>`
+
+func (s *RietS) TestUpdateIssueSelect(c *C) {
+	testServer.Response(200, nil, editSelectHTML)
+	testServer.Response(200, nil, "")
+
+	issue := &rietveld.Issue{Id: 5372097, Subject: "Test subject"}
+	err := s.riet.UpdateIssue(issue)
+	c.Assert(err, IsNil)
+
+	get := testServer.WaitRequest()
+	post := testServer.WaitRequest()
+	if get.Method == "POST" {
+		get, post = post, get
+	}
+
+	c.Assert(post.Method, Equals, "POST")
+	c.Assert(post.Form["xsrf_token"], DeepEquals, []string{"515c6d74d6c8ffd1d4a1cb980e54ff84"})
+	c.Assert(post.Form["subject"], DeepEquals, []string{"Test subject"})
+	c.Assert(post.Form["base_repo"], DeepEquals, []string{"2"})
+	c.Assert(post.Form["lang"], DeepEquals, []string{"en"})
+	c.Assert(post.Form["query"], IsNil)
+	c.Assert(post.Form["nickname"], IsNil)
+}
+
 func (s *RietS) TestUpdateIssueReviewers(c *C) {
 
 	for testn := 0; testn < 2; testn++ {
@@ -638,3 +674,78 @@ func (s *RietS) TestAddComment3(c *C) {
 	c.Assert(req.Form["send_mail"], DeepEquals, []string{"checked"})
 	c.Assert(req.Form["no_redirect"], DeepEquals, []string{"true"})
 }
+
+func (s *RietS) TestAddCommentXSRFToken(c *C) {
+	testServer.Response(200, nil, "fetched-token\n")
+	testServer.Response(200, nil, "")
+
+	issue := &rietveld.Issue{Id: 5418043}
+	comment := &rietveld.Comment{Message: "Test message.", NoMail: true}
+
+	err := s.riet.AddComment(issue, comment)
+	c.Assert(err, IsNil)
+
+	req := testServer.WaitRequest()
+	c.Assert(req.Method, Equals, "GET")
+	c.Assert(req.URL.Path, Equals, "/xsrf_token")
+	c.Assert(req.Header.Get("X-Requesting-XSRF-Token"), Equals, "1")
+
+	req = testServer.WaitRequest()
+	c.Assert(req.Method, Equals, "POST")
+	c.Assert(req.URL.Path, Equals, "/5418043/publish")
+	c.Assert(req.Form["xsrf_token"], DeepEquals, []string{"fetched-token"})
+	c.Assert(req.Form["message"], DeepEquals, []string{"Test message."})
+	c.Assert(req.Form["message_only"], DeepEquals, []string{"true"})
+
+	// The token is reused for the next comment.
+	testServer.Response(200, nil, "")
+	err = s.riet.AddComment(issue, comment)
+	c.Assert(err, IsNil)
+
+	req = testServer.WaitRequest()
+	c.Assert(req.URL.Path, Equals, "/5418043/publish")
+	c.Assert(req.Form["xsrf_token"], DeepEquals, []string{"fetched-token"})
+}
+
+func (s *RietS) TestDownloadPatchSet(c *C) {
+	diff := "Index: file1\n--- file1\n+++ file1\n@@ -1 +1 @@\n-a\n+b\n"
+	testServer.Response(200, map[string]string{"Content-Type": "text/plain"}, diff)
+
+	patch, err := s.riet.DownloadPatchSet(5372097, 2001)
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(patch)
+	c.Assert(err, IsNil)
+	c.Assert(patch.Close(), IsNil)
+	c.Assert(string(data), Equals, diff)
+	c.Assert(patch.Size, Equals, int64(len(diff)))
+
+	req := testServer.WaitRequest()
+	c.Assert(req.Method, Equals, "GET")
+	c.Assert(req.URL.Path, Equals, "/download/issue5372097_2001.diff")
+}
+
+func (s *RietS) TestAddCommentReplyAndDraft(c *C) {
+	testServer.Response(200, nil, "fetched-token\n")
+	testServer.Response(200, nil, "")
+	testServer.Response(200, nil, "")
+
+	issue := &rietveld.Issue{Id: 5418043}
+	err := s.riet.AddComment(issue, &rietveld.Comment{Message: "Reply.", InReplyTo: 3})
+	c.Assert(err, IsNil)
+	err = s.riet.AddComment(issue, &rietveld.Comment{Message: "Draft.", DraftOnly: true})
+	c.Assert(err, IsNil)
+
+	testServer.WaitRequest()
+	req := testServer.WaitRequest()
+	c.Assert(req.URL.Path, Equals, "/5418043/publish")
+	c.Assert(req.Form["in_reply_to"], DeepEquals, []string{"3"})
+
+	req = testServer.WaitRequest()
+	c.Assert(req.Method, Equals, "POST")
+	c.Assert(req.URL.Path, Equals, "/5418043/draft_message")
+	c.Assert(req.Form["reviewmsg"], DeepEquals, []string{"Draft."})
+	c.Assert(req.Form["xsrf_token"], DeepEquals, []string{"fetched-token"})
+
+	err = s.riet.AddComment(issue, &rietveld.Comment{Message: "Draft.", DraftOnly: true, NoMail: false, Cc: []string{"x"}})
+	c.Assert(err, ErrorMatches, "draft comment on issue 5418043 can only have a message")
+}
@@ -0,0 +1,101 @@
+package rietveld
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// xsrfLifetime is how long a token fetched from /xsrf_token is reused.
+// Rietveld accepts tokens for several hours.
+const xsrfLifetime = 30 * time.Minute
+
+// errXSRFRejected is returned by the edit and publish handlers when the
+// server refuses the posted form, as it does for a stale XSRF token.
+var errXSRFRejected = errors.New("server rejected XSRF token")
+
+// xsrfCache holds the XSRF token last fetched by a Rietveld client.
+type xsrfCache struct {
+	sync.Mutex
+	token   string
+	expires time.Time
+	missing bool // the server has no /xsrf_token endpoint
+}
+
+// xsrfToken returns an XSRF token for posting forms to the server,
+// fetched from its /xsrf_token endpoint or reused from an earlier fetch.
+// It returns "" if the token cannot be fetched that way, in which case
+// the caller must scrape the token from the form it is about to post.
+func (r *Rietveld) xsrfToken() string {
+	r.xsrf.Lock()
+	defer r.xsrf.Unlock()
+	if r.xsrf.missing {
+		return ""
+	}
+	if r.xsrf.token != "" && time.Now().Before(r.xsrf.expires) {
+		return r.xsrf.token
+	}
+	h := &xsrfHandler{}
+	if err := r.do(h); err != nil {
+		logf("Can't fetch XSRF token: %v", err)
+		return ""
+	}
+	if h.token == "" {
+		logf("Server has no XSRF token endpoint; using forms.")
+		r.xsrf.missing = true
+		return ""
+	}
+	r.xsrf.token = h.token
+	r.xsrf.expires = time.Now().Add(xsrfLifetime)
+	return h.token
+}
+
+// dropXSRFToken forgets the cached XSRF token, after the server rejected it.
+func (r *Rietveld) dropXSRFToken() {
+	r.xsrf.Lock()
+	r.xsrf.token = ""
+	r.xsrf.Unlock()
+}
+
+type xsrfHandler struct {
+	token string
+}
+
+func (h *xsrfHandler) action() (method, path string) {
+	return "GET", "/xsrf_token"
+}
+
+func (h *xsrfHandler) header(hdr http.Header) {
+	hdr.Set("X-Requesting-XSRF-Token", "1")
+}
+
+func (h *xsrfHandler) write(mpw *multipart.Writer) error {
+	debugf("Requesting XSRF token...")
+	return nil
+}
+
+func (h *xsrfHandler) process(resp *http.Response) error {
+	debugf("Response from server: %s", resp.Status)
+	if resp.StatusCode == 404 {
+		h.token = ""
+		return nil
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("server returned %q", resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("can't read server response: %v", err)
+	}
+	h.token = strings.TrimSpace(string(data))
+	if h.token == "" || strings.ContainsAny(h.token, "<> \n") {
+		// An HTML page rather than a token: treat as unsupported.
+		h.token = ""
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codereview
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"app"
+	"identity"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// The roster lists the people active on recent CLs, as owners or reviewers,
+// with their Rietveld nicknames. It lets the dashboard assign CLs to
+// contributors who are not committers, by nickname or email address.
+// It is rebuilt periodically from the stored CLs and kept in the
+// codereview.roster metadata.
+
+// rosterPeriod is how far back rebuildRoster looks for activity.
+const rosterPeriod = 180 * 24 * time.Hour
+
+// maxCandidates limits the completions ResolveReviewer returns.
+const maxCandidates = 10
+
+// A Person is a single entry in the roster.
+type Person struct {
+	Nick       string // Rietveld nickname, if known
+	Email      string
+	LastActive time.Time
+}
+
+type roster struct {
+	People []Person
+}
+
+func init() {
+	app.Cron("codereview.roster", 6*time.Hour, rebuildRoster)
+	app.RegisterWarmup("codereview", func(ctxt appengine.Context) error {
+		loadRoster(ctxt)
+		loadBot(ctxt)
+		return nil
+	})
+}
+
+// rosterChunk is the number of CLs rebuildRoster reads in a single cron run.
+// Larger rebuilds continue in later runs, from a saved cursor.
+const rosterChunk = 200
+
+// A rosterBuild records the progress of a roster rebuild spanning several cron runs.
+// It is stored as the meta value "codereview.roster.build".
+type rosterBuild struct {
+	Cursor string    // where to continue, if the rebuild is still running
+	Start  time.Time // when the rebuild started
+	People []Person  // people found so far
+}
+
+// rebuildRoster rebuilds the roster from the CLs modified recently,
+// a chunk at a time. It returns app.ErrMoreCron until all the CLs have been read.
+func rebuildRoster(ctxt appengine.Context) error {
+	var b rosterBuild
+	if err := app.ReadMeta(ctxt, "codereview.roster.build", &b); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	if b.Cursor == "" {
+		b = rosterBuild{Start: time.Now()}
+	}
+
+	botEmail := loadBot(ctxt)
+	people := make(map[string]*Person)
+	for i := range b.People {
+		people[b.People[i].Email] = &b.People[i]
+	}
+	add := func(email, nick string, t time.Time) {
+		if !strings.Contains(email, "@") || strings.HasPrefix(email, "golang-") || email == botEmail {
+			return
+		}
+		p := people[email]
+		if p == nil {
+			p = &Person{Email: email}
+			people[email] = p
+		}
+		if nick != "" {
+			p.Nick = nick
+		}
+		if t.After(p.LastActive) {
+			p.LastActive = t
+		}
+	}
+
+	q := datastore.NewQuery("CL").
+		Filter("Modified >", b.Start.Add(-rosterPeriod)).
+		KeysOnly().
+		Limit(rosterChunk)
+	if b.Cursor != "" {
+		c, err := datastore.DecodeCursor(b.Cursor)
+		if err != nil {
+			ctxt.Errorf("roster: bad cursor: %v", err)
+			return app.DeleteMeta(ctxt, "codereview.roster.build")
+		}
+		q = q.Start(c)
+	}
+	it := q.Run(ctxt)
+	var names []string
+	for {
+		k, err := it.Next(nil)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			ctxt.Errorf("loading CLs for roster: %v", err)
+			return err
+		}
+		names = append(names, k.StringID())
+	}
+
+	cls := make([]*CL, len(names))
+	for i := range cls {
+		cls[i] = new(CL)
+	}
+	if len(names) > 0 {
+		if err := app.ReadDataMulti(ctxt, "CL", names, cls); err != nil {
+			me, ok := err.(appengine.MultiError)
+			if !ok {
+				return err
+			}
+			for i, err := range me {
+				if err != nil && err != datastore.ErrNoSuchEntity {
+					return err
+				}
+				if err != nil {
+					// Deleted since the query.
+					cls[i] = nil
+				}
+			}
+		}
+	}
+	for _, cl := range cls {
+		if cl == nil {
+			continue
+		}
+		add(cl.OwnerEmail, cl.Owner, cl.Modified)
+		for _, m := range cl.Messages {
+			add(m.Sender, "", m.Time)
+		}
+		for _, r := range cl.Reviewers {
+			add(r, "", cl.Modified)
+		}
+	}
+
+	var list []Person
+	for _, p := range people {
+		list = append(list, *p)
+	}
+	sort.Sort(peopleByEmail(list))
+
+	if len(names) == rosterChunk {
+		c, err := it.Cursor()
+		if err != nil {
+			return err
+		}
+		b.Cursor = c.String()
+		b.People = list
+		if err := app.WriteMeta(ctxt, "codereview.roster.build", &b); err != nil {
+			return err
+		}
+		return app.ErrMoreCron
+	}
+
+	if err := app.WriteMeta(ctxt, "codereview.roster", &roster{People: list}); err != nil {
+		return err
+	}
+	return app.DeleteMeta(ctxt, "codereview.roster.build")
+}
+
+type peopleByEmail []Person
+
+func (x peopleByEmail) Len() int           { return len(x) }
+func (x peopleByEmail) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+func (x peopleByEmail) Less(i, j int) bool { return x[i].Email < x[j].Email }
+
+// loadRoster returns the roster, with the committers added
+// and the nicknames looked up by lookupNicks filled in.
+func loadRoster(ctxt appengine.Context) []Person {
+	var r roster
+	app.ReadMetaCached(ctxt, "codereview.roster", &r)
+	seen := make(map[string]bool)
+	for _, p := range r.People {
+		seen[p.Email] = true
+	}
+	for _, c := range identity.Load(ctxt).Committers() {
+		if !seen[c] {
+			r.People = append(r.People, Person{Email: c})
+		}
+	}
+	nicks := readNicks(ctxt)
+	for i := range r.People {
+		if p := &r.People[i]; p.Nick == "" {
+			p.Nick = nicks.Nicks[p.Email]
+		}
+	}
+	return r.People
+}
+
+// ResolveReviewer resolves the name of a would-be reviewer,
+// which may be a committer shorthand (as accepted by ExpandReviewer),
+// a Rietveld nickname, an email address, or the user name part of an
+// email address of anyone in the roster.
+// If name resolves to a single person, ResolveReviewer returns that person's
+// email address. Otherwise it returns the empty string and up to ten
+// candidate email addresses that name is a prefix of, if any.
+func ResolveReviewer(ctxt appengine.Context, name string) (email string, candidates []string) {
+	if x := expandReviewer(name); x != "" {
+		return x, nil
+	}
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return "", nil
+	}
+	var exact, prefix []string
+	for _, p := range loadRoster(ctxt) {
+		user := p.Email
+		if i := strings.Index(user, "@"); i >= 0 {
+			user = user[:i]
+		}
+		nick := strings.ToLower(p.Nick)
+		email := strings.ToLower(p.Email)
+		switch {
+		case name == email || name == nick || name == user:
+			exact = append(exact, p.Email)
+		case strings.HasPrefix(email, name) || nick != "" && strings.HasPrefix(nick, name):
+			prefix = append(prefix, p.Email)
+		}
+	}
+	if len(exact) == 1 {
+		return exact[0], nil
+	}
+	candidates = append(exact, prefix...)
+	sort.Strings(candidates)
+	if len(candidates) > maxCandidates {
+		candidates = candidates[:maxCandidates]
+	}
+	return "", candidates
+}
@@ -0,0 +1,100 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codereview
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"app"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/search"
+)
+
+// CLs are added to the "CL" search index by the codereview.index scan,
+// which picks up every CL written with Indexed == false.
+
+// clDoc is the search document for a CL.
+type clDoc struct {
+	CL        search.Atom
+	Summary   string
+	Desc      string
+	Owner     string
+	Reviewers string
+	Files     string
+	Modified  time.Time
+}
+
+func init() {
+	app.ScanData("codereview.index", 5*time.Minute,
+		datastore.NewQuery("CL").Filter("Indexed =", false),
+		indexCL)
+}
+
+func indexCL(ctxt appengine.Context, kind, key string) error {
+	var cl CL
+	if err := app.ReadData(ctxt, "CL", key, &cl); err != nil {
+		return err
+	}
+	index, err := search.Open("CL")
+	if err != nil {
+		return err
+	}
+	doc := &clDoc{
+		CL:        search.Atom(cl.CL),
+		Summary:   cl.Summary,
+		Desc:      cl.Desc,
+		Owner:     cl.OwnerEmail,
+		Reviewers: strings.Join(cl.Reviewers, " "),
+		Files:     strings.Join(cl.Files, " "),
+		Modified:  cl.Modified,
+	}
+	if _, err := index.Put(ctxt, cl.CL, doc); err != nil {
+		return fmt.Errorf("indexing CL %s: %v", cl.CL, err)
+	}
+	indexed := cl.Updated
+	return app.Transaction(ctxt, func(ctxt appengine.Context) error {
+		var cl CL
+		if err := app.ReadData(ctxt, "CL", key, &cl); err != nil {
+			return err
+		}
+		if !cl.Updated.Equal(indexed) {
+			// Changed since we read it; the next scan indexes the new copy.
+			return nil
+		}
+		cl.Indexed = true
+		return app.WriteData(ctxt, "CL", key, &cl)
+	})
+}
+
+// Search returns up to limit CLs matching the query,
+// which uses the App Engine search query syntax.
+func Search(ctxt appengine.Context, query string, limit int) ([]*CL, error) {
+	index, err := search.Open("CL")
+	if err != nil {
+		return nil, err
+	}
+	var cls []*CL
+	it := index.Search(ctxt, query, &search.SearchOptions{Limit: limit, IDsOnly: true})
+	for {
+		id, err := it.Next(nil)
+		if err == search.Done {
+			break
+		}
+		if err != nil {
+			ctxt.Errorf("searching CLs for %q: %v", query, err)
+			return nil, fmt.Errorf("searching CLs failed")
+		}
+		cl := new(CL)
+		if err := app.ReadData(ctxt, "CL", id, cl); err != nil {
+			continue
+		}
+		cls = append(cls, cl)
+	}
+	return cls, nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codereview
+
+import (
+	"fmt"
+	"time"
+
+	"identity"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// ReviewStats summarizes the current review load of a single committer.
+type ReviewStats struct {
+	Reviewer      string
+	Assigned      int       // active CLs with Reviewer as primary reviewer
+	Waiting       int       // assigned CLs waiting for Reviewer
+	OldestWaiting time.Time // last modification of the oldest waiting CL
+	LGTMs         int       // LGTMs sent since the start time
+}
+
+// LoadReviewStats returns statistics for every committer,
+// counting the LGTMs sent since the given time.
+func LoadReviewStats(ctxt appengine.Context, since time.Time) ([]*ReviewStats, error) {
+	loadBot(ctxt)
+	stats := make(map[string]*ReviewStats)
+	var list []*ReviewStats
+	for _, c := range identity.Load(ctxt).Committers() {
+		s := &ReviewStats{Reviewer: c}
+		stats[c] = s
+		list = append(list, s)
+	}
+
+	var active []*CL
+	_, err := datastore.NewQuery("CL").
+		Filter("Active =", true).
+		Limit(2000).
+		GetAll(ctxt, &active)
+	if err != nil {
+		ctxt.Errorf("loading active CLs: %v", err)
+		return nil, fmt.Errorf("loading CLs failed")
+	}
+	for _, cl := range active {
+		s := stats[cl.PrimaryReviewer]
+		if s == nil {
+			continue
+		}
+		s.Assigned++
+		if cl.NeedsReview {
+			s.Waiting++
+			if s.OldestWaiting.IsZero() || cl.Modified.Before(s.OldestWaiting) {
+				s.OldestWaiting = cl.Modified
+			}
+		}
+	}
+
+	var recent []*CL
+	_, err = datastore.NewQuery("CL").
+		Filter("Modified >=", since).
+		Limit(2000).
+		GetAll(ctxt, &recent)
+	if err != nil {
+		ctxt.Errorf("loading recent CLs: %v", err)
+		return nil, fmt.Errorf("loading CLs failed")
+	}
+	for _, cl := range recent {
+		for _, m := range cl.Messages {
+			if m.Time.Before(since) || notlgtmRE.MatchString(m.Text) || !lgtmRE.MatchString(m.Text) {
+				continue
+			}
+			if s := stats[isReviewer(lgtmSender(m))]; s != nil {
+				s.LGTMs++
+			}
+		}
+	}
+
+	return list, nil
+}
+
+// FirstResponse returns the time the CL was first mailed for review
+// and the time a reviewer other than its owner first replied.
+// Either is the zero time if it has not happened.
+func (cl *CL) FirstResponse() (mailed, replied time.Time) {
+	mailed = cl.firstMailed()
+	if mailed.IsZero() {
+		return
+	}
+	for _, m := range cl.Messages {
+		who := isReviewer(lgtmSender(m))
+		if m.Time.After(mailed) && who != "" && who != isReviewer(cl.OwnerEmail) {
+			return mailed, m.Time
+		}
+	}
+	return mailed, time.Time{}
+}
@@ -0,0 +1,63 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codereview
+
+import (
+	"reflect"
+
+	"app"
+
+	"appengine"
+)
+
+func init() {
+	app.RegisterVerifier("codereview", "CL", verifyCL)
+}
+
+// verifyCL compares the stored CL with the given number
+// against a fresh copy from Rietveld.
+func verifyCL(ctxt appengine.Context, key string) ([]string, error) {
+	var old CL
+	if err := app.ReadData(ctxt, "CL", key, &old); err != nil {
+		return nil, err
+	}
+	if old.Dead {
+		return nil, app.ErrStale
+	}
+	cur, err := fetchCL(ctxt, key)
+	if err != nil {
+		return nil, err
+	}
+	if !cur.Modified.Equal(old.Modified) {
+		return nil, app.ErrStale
+	}
+
+	var diffs []string
+	diff := func(field string, same bool) {
+		if !same {
+			diffs = append(diffs, field)
+		}
+	}
+	diff("Desc", cur.Desc == old.Desc)
+	diff("Owner", cur.Owner == old.Owner)
+	diff("OwnerEmail", cur.OwnerEmail == old.OwnerEmail)
+	diff("Created", cur.Created.Equal(old.Created))
+	diff("Reviewers", sameStrings(cur.Reviewers, old.Reviewers))
+	diff("CC", sameStrings(cur.CC, old.CC))
+	diff("Closed", cur.Closed == old.Closed)
+	if old.MessagesLoaded {
+		diff("Messages", len(cur.Messages) == len(old.Messages))
+	}
+	if old.PatchSetsLoaded {
+		diff("PatchSets", sameStrings(cur.PatchSets, old.PatchSets))
+	}
+	return diffs, nil
+}
+
+// sameStrings reports whether a and b hold the same strings,
+// treating nil and empty lists as equal.
+func sameStrings(a, b []string) bool {
+	return len(a) == 0 && len(b) == 0 || reflect.DeepEqual(a, b)
+}
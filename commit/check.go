@@ -0,0 +1,62 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commit
+
+import (
+	"fmt"
+	"strings"
+
+	"appengine"
+	"appengine/datastore"
+
+	"app"
+)
+
+func init() {
+	app.RegisterCheck("commit.links", datastore.NewQuery("Rev"), checkLinks)
+}
+
+// checkLinks checks that the Prev and Next hashes of a Rev
+// name stored Revs in the same repository.
+// The parents of the initial roots were never loaded and are not reported.
+func checkLinks(ctxt appengine.Context, kind, key string) (string, error) {
+	var rev Rev
+	if err := app.ReadData(ctxt, "Rev", key, &rev); err != nil {
+		return "", err
+	}
+	repo := key[:strings.LastIndex(key, ".")+1]
+	root := false
+	for _, hash := range initialRoots {
+		if hash == rev.Hash {
+			root = true
+		}
+	}
+
+	var names, keys []string
+	for _, hash := range rev.Next {
+		names = append(names, "next "+hash)
+		keys = append(keys, repo+hash)
+	}
+	if !root {
+		for _, hash := range rev.Prev {
+			names = append(names, "prev "+hash)
+			keys = append(keys, repo+hash)
+		}
+	}
+	ok, err := app.DataExistsMulti(ctxt, "Rev", keys)
+	if err != nil {
+		return "", err
+	}
+	var dangling []string
+	for i, name := range names {
+		if !ok[i] {
+			dangling = append(dangling, name)
+		}
+	}
+	if len(dangling) > 0 {
+		return fmt.Sprintf("dangling %s", strings.Join(dangling, ", ")), nil
+	}
+	return "", nil
+}
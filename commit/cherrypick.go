@@ -0,0 +1,246 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commit
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"app"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Release branches.
+//
+// Commits on release branches (release-branch.go1.2 and so on) are
+// loaded like any others; the commit.track op starts loading a branch
+// whose commits are not reachable from the roots already loaded.
+// Most of them are cherry-picks of commits made on the default branch.
+// The commit.cherrypick scan picks up every release-branch Rev with
+// PickPending set and records the default-branch commit it was
+// cherry-picked from in CherryPickOf, matching, in order:
+//
+//	the hash in the «««-quoted original log hg transplant leaves,
+//	the code review CL the two logs link to, or
+//	the patch identity (see patchID).
+//
+// /api/commit/unpicked lists the default-branch commits made since
+// a release branch was created that have not been cherry-picked to it.
+
+var (
+	releaseBranchRE = regexp.MustCompile(`^release-branch\.go[0-9.]+$`)
+	pickedHashRE    = regexp.MustCompile(`(?m)^««« (?:CL [0-9]+ / )?([0-9a-f]{12,40})`)
+	branchPrefixRE  = regexp.MustCompile(`^\[[^\]]+\] `)
+)
+
+// IsReleaseBranch reports whether branch is a release branch.
+func IsReleaseBranch(branch string) bool {
+	return releaseBranchRE.MatchString(branch)
+}
+
+// patchID returns an identifier for the change made by rev:
+// a hash of its summary line, without any [release-branch.goX.Y] prefix,
+// and the names of the files it changes. The loader does not store diffs,
+// so this stands in for hg's patch identity; it is good enough to match
+// a cherry-pick that kept the original's summary.
+func patchID(rev *Rev) string {
+	summary := strings.TrimSpace(rev.Log)
+	if i := strings.Index(summary, "\n"); i >= 0 {
+		summary = summary[:i]
+	}
+	summary = branchPrefixRE.ReplaceAllString(summary, "")
+	var files []string
+	for _, f := range rev.Files {
+		files = append(files, f.Name)
+	}
+	sort.Strings(files)
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\n%s\n", summary, strings.Join(files, "\n"))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// updatePick sets the cherry-pick fields of rev derived from its log.
+// It is called from the Rev updater.
+func updatePick(rev *Rev) {
+	rev.CL = ""
+	if m := clLinkRE.FindStringSubmatch(rev.Log); m != nil {
+		rev.CL = m[1]
+	}
+	rev.PatchID = patchID(rev)
+	rev.PickPending = IsReleaseBranch(rev.Branch) && !rev.PickChecked
+}
+
+func init() {
+	app.ScanData("commit.cherrypick", 15*time.Minute,
+		datastore.NewQuery("Rev").Filter("PickPending =", true),
+		findPick)
+	app.Handle("/api/commit/unpicked", apiUnpicked)
+	app.RegisterAPI("/api/commit/unpicked", "Commits on the default branch of repo= not yet cherry-picked to the release branch=.",
+		[]string{"repo", "branch"}, []*ReleaseChange(nil))
+
+	app.RegisterOp("commit.track", "Start loading the given branch of repo (\"main\", \"go.net\", ...) at the given commit hash.", []string{"repo", "branch", "hash"}, func(ctxt appengine.Context, args map[string]string) (string, error) {
+		if args["repo"] == "" || args["branch"] == "" || len(args["hash"]) != 40 {
+			return "", fmt.Errorf("need repo, branch, and full commit hash")
+		}
+		if err := addTodo(ctxt, args["repo"], args["branch"], args["hash"]); err != nil && err != errDone {
+			return "", err
+		}
+		laterLoad.Call(ctxt)
+		return "tracking " + args["repo"] + " " + args["branch"], nil
+	})
+}
+
+// findPick records the commit the release-branch Rev with the given key
+// was cherry-picked from, if it can be found.
+func findPick(ctxt appengine.Context, kind, key string) error {
+	var rev Rev
+	if err := app.ReadData(ctxt, "Rev", key, &rev); err != nil {
+		return err
+	}
+	orig, err := pickSource(ctxt, &rev)
+	if err != nil {
+		return err
+	}
+	return app.Transaction(ctxt, func(ctxt appengine.Context) error {
+		var rev Rev
+		if err := app.ReadData(ctxt, "Rev", key, &rev); err != nil {
+			return err
+		}
+		rev.CherryPickOf = orig
+		rev.PickChecked = true
+		return app.WriteData(ctxt, "Rev", key, &rev)
+	})
+}
+
+// pickSource returns the hash of the default-branch commit rev was
+// cherry-picked from, or "" if there is none.
+func pickSource(ctxt appengine.Context, rev *Rev) (string, error) {
+	try := func(field, value string) (string, error) {
+		var revs []*Rev
+		_, err := datastore.NewQuery("Rev").
+			Filter("Repo =", rev.Repo).
+			Filter(field+" =", value).
+			Limit(10).
+			GetAll(ctxt, &revs)
+		if err != nil {
+			ctxt.Errorf("finding cherry-pick source of %s: %v", rev.ShortHash, err)
+			return "", err
+		}
+		for _, r := range revs {
+			if r.Branch == "default" {
+				return r.Hash, nil
+			}
+		}
+		return "", nil
+	}
+
+	if m := pickedHashRE.FindStringSubmatch(rev.Log); m != nil {
+		h, err := try("ShortHash", m[1][:12])
+		if h != "" || err != nil {
+			return h, err
+		}
+	}
+	if rev.CL != "" {
+		h, err := try("CL", rev.CL)
+		if h != "" || err != nil {
+			return h, err
+		}
+	}
+	return try("PatchID", rev.PatchID)
+}
+
+// Unpicked returns the default-branch commits in repo made since the
+// release branch was created that have not been cherry-picked to it,
+// oldest first.
+func Unpicked(ctxt appengine.Context, repo, branch string) ([]*ReleaseChange, error) {
+	var first []*Rev
+	_, err := datastore.NewQuery("Rev").
+		Filter("Repo =", repo).
+		Filter("Branch =", branch).
+		Order("Time").
+		Limit(1).
+		GetAll(ctxt, &first)
+	if err != nil {
+		ctxt.Errorf("loading %s %s: %v", repo, branch, err)
+		return nil, err
+	}
+	if len(first) == 0 {
+		return nil, fmt.Errorf("no commits on %s branch %s", repo, branch)
+	}
+
+	var picks []*Rev
+	_, err = datastore.NewQuery("Rev").
+		Filter("Repo =", repo).
+		Filter("Branch =", branch).
+		Limit(maxReleaseRevs).
+		GetAll(ctxt, &picks)
+	if err != nil {
+		ctxt.Errorf("loading %s %s: %v", repo, branch, err)
+		return nil, err
+	}
+	picked := make(map[string]bool)
+	for _, r := range picks {
+		if r.CherryPickOf != "" {
+			picked[r.CherryPickOf] = true
+		}
+	}
+
+	var tip []*Rev
+	_, err = datastore.NewQuery("Rev").
+		Filter("Repo =", repo).
+		Filter("Branch =", "default").
+		Filter("Time >", first[0].Time).
+		Order("Time").
+		Limit(maxReleaseRevs).
+		GetAll(ctxt, &tip)
+	if err != nil {
+		ctxt.Errorf("loading %s default: %v", repo, err)
+		return nil, err
+	}
+	var out []*ReleaseChange
+	for _, r := range tip {
+		if !picked[r.Hash] && !tagRE.MatchString(r.Log) {
+			out = append(out, releaseChange(r))
+		}
+	}
+	return out, nil
+}
+
+// apiUnpicked serves /api/commit/unpicked?repo=main&branch=release-branch.go1.2,
+// the JSON list of commits not yet cherry-picked to the branch.
+func apiUnpicked(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	repo := req.FormValue("repo")
+	if repo == "" {
+		repo = "main"
+	}
+	branch := req.FormValue("branch")
+	if !IsReleaseBranch(branch) {
+		http.Error(w, "branch= must name a release branch", 400)
+		return
+	}
+	list, err := Unpicked(ctxt, repo, branch)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	js, err := json.Marshal(list)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	var buf bytes.Buffer
+	json.Indent(&buf, js, "", "\t")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(buf.Bytes())
+}
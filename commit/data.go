@@ -4,10 +4,14 @@
 
 package commit
 
-import "time"
+import (
+	"sort"
+	"strings"
+	"time"
+)
 
 type Rev struct {
-	DV int `dataversion:"1"`
+	DV int `dataversion:"4"`
 
 	Repo   string
 	Branch string
@@ -25,6 +29,19 @@ type Rev struct {
 	Log string `datastore:",noindex"`
 
 	Files []File
+
+	FixesIssues   []string // issues the log says the commit fixes (see trailer.go)
+	UpdatesIssues []string // other issues the log mentions
+	IssuesLinked  bool     // fixed issues marked as such (see trailer.go)
+
+	Indexed bool // up to date in the search index (see search.go)
+
+	// Cherry-pick tracking (see cherrypick.go).
+	CL           string // code review number from the log
+	PatchID      string // identifies the change, across branches
+	CherryPickOf string // hash of the default-branch commit this was cherry-picked from
+	PickChecked  bool   // CherryPickOf has been looked for
+	PickPending  bool   // release-branch commit not yet PickChecked
 }
 
 type File struct {
@@ -38,3 +55,22 @@ var initialRoots = map[string]string{
 	"go.crypto/default": "b50a7fb49394c272db51587d86e14c73e9b901f5",
 	"go.net/default":    "b50a7fb49394c272db51587d86e14c73e9b901f5",
 }
+
+// Repos returns the names of the repositories whose commits are loaded,
+// as the code review site names them: "go" for the main repository
+// and "go.net" and so on for the others.
+func Repos() []string {
+	var repos []string
+	for repoBranch := range initialRoots {
+		repo := repoBranch
+		if i := strings.Index(repo, "/"); i >= 0 {
+			repo = repo[:i]
+		}
+		if repo == "main" {
+			repo = "go"
+		}
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	return repos
+}
@@ -24,9 +24,6 @@ import (
 	"appengine"
 	"appengine/datastore"
 	"appengine/delay"
-	"appengine/urlfetch"
-
-	"github.com/rsc/appstats"
 )
 
 // code.google.com sends times in Mountain View time zone.
@@ -46,13 +43,23 @@ func init() {
 var laterLoad, laterLoadRev *delay.Function
 
 func init() {
-	http.Handle("/admin/commit/load", appstats.NewHandler(startLoad))
-	http.Handle("/admin/commit/kickoff", appstats.NewHandler(initialLoad))
-	http.Handle("/admin/commit/status", appstats.NewHandler(status))
-	http.Handle("/admin/commit/show/", appstats.NewHandler(show))
+	app.Handle("/admin/commit/load", startLoad)
+	app.Handle("/admin/commit/kickoff", initialLoad)
+	app.Handle("/admin/commit/status", status)
+	app.Handle("/admin/commit/show/", show)
 
 	laterLoad = delay.Func("commit.load", load)
 	laterLoadRev = delay.Func("commit.loadrev", loadRev)
+	app.RegisterQuota("commit", "Rev", "RevTodo")
+
+	app.RegisterOp("commit.kickoff", "Queue the initial roots of every repository for loading.", nil, func(ctxt appengine.Context, args map[string]string) (string, error) {
+		initialLoad(ctxt, nil, nil)
+		return "queued initial roots", nil
+	})
+	app.RegisterOp("commit.load", "Start loading queued commits now.", nil, func(ctxt appengine.Context, args map[string]string) (string, error) {
+		laterLoad.Call(ctxt)
+		return "started", nil
+	})
 }
 
 func status(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
@@ -134,9 +141,21 @@ func load(ctxt appengine.Context) {
 	ctxt.Infof("load found %d todo", n)
 }
 
+var backfill = app.RegisterBackfill("commit.load", true)
+
+// loadRev loads up to 100 revisions, starting at hash.
+// If it stops early, the todo for the next revision is picked up by a later load.
 func loadRev(ctxt appengine.Context, repo, branch, hash string) {
+	if !backfill.Start(ctxt) {
+		return
+	}
+	defer backfill.Done(ctxt)
+
 	n := 0
 	for hash != "" {
+		if !backfill.Allow(ctxt, 1) {
+			break
+		}
 		hash = loadRevOnce(ctxt, repo, branch, hash)
 		if n++; n >= 100 {
 			laterLoadRev.Call(ctxt, repo, branch, hash)
@@ -241,6 +260,9 @@ func loadRevOnce(ctxt appengine.Context, repo, branch, hash string) (nextHash st
 		old.Time = r.Time
 		old.Log = r.Log
 		old.Files = r.Files
+		old.IssuesLinked = false
+		old.Indexed = false
+		old.PickChecked = false
 
 		if err := app.WriteData(ctxt, "Rev", repo+"."+hash, &old); err != nil {
 			return err
@@ -340,14 +362,9 @@ func writeTodo(ctxt appengine.Context, repo, branch, hash string, force bool) er
 }
 
 func fetchRev(ctxt appengine.Context, repo, hash string) (*Rev, error) {
-	http := urlfetch.Client(ctxt)
-
-	url := "https://code.google.com/p/go/source/detail?r=" + hash
-	if repo != "main" {
-		url += "&repo=" + strings.TrimPrefix(repo, "go.")
-	}
+	http := app.Client(ctxt, "commit")
 
-	res, err := http.Get(url)
+	res, err := http.Get(URL(repo, hash))
 	if err != nil {
 		return nil, err
 	}
@@ -359,6 +376,17 @@ func fetchRev(ctxt appengine.Context, repo, hash string) (*Rev, error) {
 	if err != nil {
 		return nil, err
 	}
+	r, err := parseRev(ctxt, repo, hash, data)
+	if err != nil {
+		return nil, err
+	}
+	r.Author, r.AuthorEmail = app.CanonicalAuthor(ctxt, r.Author, r.AuthorEmail)
+	return r, nil
+}
+
+// parseRev parses data, the source browser page for the given revision.
+// The author is returned as the page gives it, not canonicalized.
+func parseRev(ctxt appengine.Context, repo, hash string, data []byte) (*Rev, error) {
 	doc, err := html.Parse(bytes.NewReader(data))
 	if err != nil {
 		return nil, err
@@ -465,10 +493,8 @@ func process(ctxt appengine.Context, rev *Rev, n *html.Node) {
 			}
 			if strings.HasPrefix(thstr, "Date:") {
 				date := attr(findChildElem(td, "span"), "title")
-				t, err := time.ParseInLocation(time.ANSIC, date, mtv)
-				if err != nil {
-					ctxt.Infof("parsing time %q: %v", date, err)
-				} else {
+				// On error, app.ParseTime reports the bad date; leave the time unset.
+				if t, err := app.ParseTime(ctxt, "commit.date", time.ANSIC, date, mtv); err == nil {
 					rev.Time = t.UTC()
 				}
 			}
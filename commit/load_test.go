@@ -0,0 +1,109 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commit
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"app"
+	"app/apptest"
+)
+
+// The pages in testdata follow the source browser pages served by code.google.com.
+// Run the tests with -record to replace them with fresh recordings.
+
+func TestFetchRev(t *testing.T) {
+	ctxt := apptest.NewContext(t)
+	defer app.SetStore(app.SetStore(apptest.NewStore()))
+	defer app.SetTransport(app.SetTransport(apptest.NewReplay("testdata")))
+
+	rev, err := fetchRev(ctxt, "main", "4c2b1f8a9d3e7b6c5a4f3e2d1c0b9a8f7e6d5c4b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Rev{
+		Repo:        "main",
+		Branch:      "default",
+		Hash:        "4c2b1f8a9d3e7b6c5a4f3e2d1c0b9a8f7e6d5c4b",
+		ShortHash:   "4c2b1f8a9d3e",
+		Prev:        []string{"3b1a0e7f8c2d6a5b4e3f2d1c0b9a8e7f6d5c4b3a"},
+		Next:        []string{"5d3c2a9b0e4f8c7d6b5a4f3e2d1c0b9a8f7e6d5c"},
+		Author:      "Russ Cox",
+		AuthorEmail: "rsc@golang.org",
+		Time:        time.Date(2014, 3, 4, 10, 5, 13, 0, mtv).UTC(),
+		Log:         "runtime: fix race in select\n\nLGTM=iant\nR=golang-codereviews, iant\nCC=golang-codereviews\nhttps://codereview.appspot.com/69840043",
+		Files: []File{
+			{"M", "/src/pkg/runtime/chan.goc"},
+			{"A", "/test/fixedbugs/issue7455.go"},
+		},
+	}
+	if !reflect.DeepEqual(rev, want) {
+		t.Errorf("fetchRev:\nhave %+v\nwant %+v", rev, want)
+	}
+}
+
+var trailerTests = []struct {
+	log     string
+	fixes   []string
+	updates []string
+}{
+	{"runtime: fix race in select\n\nLGTM=iant\nR=golang-codereviews", nil, nil},
+	{"net/http: close idle connections\n\nFixes issue 1234.\n", []string{"1234"}, nil},
+	{"cmd/gc: two fixes\n\nFixes #12.\nfixes issue 34\nUpdates issue 56.\nUpdates #12.\n", []string{"12", "34"}, []string{"56"}},
+	{"os: mention issue 78 in a comment\n\nSee issue 78; this prefixes #90.\n", nil, nil},
+}
+
+func TestParseTrailers(t *testing.T) {
+	for _, tt := range trailerTests {
+		fixes, updates := parseTrailers(tt.log)
+		if !reflect.DeepEqual(fixes, tt.fixes) || !reflect.DeepEqual(updates, tt.updates) {
+			t.Errorf("parseTrailers(%q) = %q, %q, want %q, %q", tt.log, fixes, updates, tt.fixes, tt.updates)
+		}
+	}
+}
+
+func TestPatchID(t *testing.T) {
+	files := []File{{"M", "/src/pkg/net/http/transport.go"}, {"M", "/src/pkg/net/http/transport_test.go"}}
+	tip := &Rev{Branch: "default", Log: "net/http: fix leak\n\nFixes issue 7000.\n", Files: files}
+	pick := &Rev{
+		Branch: "release-branch.go1.2",
+		Log:    "[release-branch.go1.2] net/http: fix leak\n\n««« CL 51234567 / 0123456789ab\nnet/http: fix leak\n»»»\n",
+		Files:  []File{files[1], files[0]},
+	}
+	if patchID(tip) != patchID(pick) {
+		t.Errorf("patchID differs for cherry-pick")
+	}
+	other := &Rev{Branch: "default", Log: "net/http: fix other leak\n", Files: files}
+	if patchID(tip) == patchID(other) {
+		t.Errorf("patchID same for different change")
+	}
+	if m := pickedHashRE.FindStringSubmatch(pick.Log); m == nil || m[1] != "0123456789ab" {
+		t.Errorf("pickedHashRE = %q, want 0123456789ab", m)
+	}
+
+	updatePick(pick)
+	if !pick.PickPending {
+		t.Errorf("release-branch commit not PickPending")
+	}
+	updatePick(tip)
+	if tip.PickPending {
+		t.Errorf("default-branch commit PickPending")
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	ctxt := apptest.NewContext(t)
+	results, err := selfTest(ctxt, "selftest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			t.Errorf("%s", r)
+		}
+	}
+}
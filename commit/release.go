@@ -0,0 +1,271 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"app"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// A Release summarizes the changes made between two points in a repository,
+// grouped by directory, to help draft release notes.
+type Release struct {
+	Repo     string
+	From     string // tag name
+	FromHash string // changeset named by tag
+	To       string
+	ToHash   string
+	Groups   []*ReleaseGroup
+}
+
+// A ReleaseGroup is the list of changes affecting a single directory.
+type ReleaseGroup struct {
+	Dir     string
+	Changes []*ReleaseChange
+}
+
+// A ReleaseChange is a single commit in a release report.
+type ReleaseChange struct {
+	Hash    string
+	Author  string
+	Time    time.Time
+	Summary string
+	CL      string   // code review number, if known
+	Issues  []string // issues fixed
+}
+
+var (
+	tagRE    = regexp.MustCompile(`(?m)^Added tag (\S+) for changeset ([0-9a-f]+)`)
+	clLinkRE = regexp.MustCompile(`https?://codereview\.appspot\.com/([0-9]+)`)
+)
+
+// maxReleaseRevs limits the number of revisions ReleaseReport will examine.
+const maxReleaseRevs = 10000
+
+// ReleaseReport assembles a report of the changes in repo made after the
+// changeset tagged fromTag, up to and including toTip.
+// If toTip is empty, the report runs to the most recent revision.
+// Otherwise toTip is a (possibly abbreviated) changeset hash.
+// Only changes on the same branch as toTip are included.
+func ReleaseReport(ctxt appengine.Context, repo, fromTag, toTip string) (*Release, error) {
+	report := &Release{
+		Repo: repo,
+		From: fromTag,
+		To:   toTip,
+	}
+
+	var (
+		revs    []*Rev
+		started = toTip == ""
+		branch  string
+		fromPre string
+		n       int
+	)
+	it := datastore.NewQuery("Rev").
+		Filter("Repo =", repo).
+		Order("-Time").
+		Limit(maxReleaseRevs).
+		Run(ctxt)
+	for {
+		var rev Rev
+		_, err := it.Next(&rev)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			ctxt.Errorf("release report %s: %v", repo, err)
+			return nil, err
+		}
+		n++
+		if !started {
+			if !strings.HasPrefix(rev.Hash, toTip) {
+				continue
+			}
+			started = true
+		}
+		if report.ToHash == "" {
+			report.ToHash = rev.Hash
+			branch = rev.Branch
+		}
+		if fromPre != "" && strings.HasPrefix(rev.Hash, fromPre) {
+			report.FromHash = rev.Hash
+			break
+		}
+		if fromPre == "" {
+			for _, m := range tagRE.FindAllStringSubmatch(rev.Log, -1) {
+				if m[1] == fromTag {
+					fromPre = m[2]
+				}
+			}
+		}
+		if rev.Branch == branch {
+			r := rev
+			revs = append(revs, &r)
+		}
+	}
+
+	switch {
+	case !started:
+		return nil, fmt.Errorf("cannot find %s revision %s", repo, toTip)
+	case fromPre == "":
+		return nil, fmt.Errorf("cannot find tag %s in last %d %s revisions", fromTag, n, repo)
+	case report.FromHash == "":
+		return nil, fmt.Errorf("cannot find changeset %s tagged %s in last %d %s revisions", fromPre, fromTag, n, repo)
+	}
+
+	groups := make(map[string]*ReleaseGroup)
+	for _, rev := range revs {
+		if tagRE.MatchString(rev.Log) {
+			continue
+		}
+		dir := revDir(rev)
+		g := groups[dir]
+		if g == nil {
+			g = &ReleaseGroup{Dir: dir}
+			groups[dir] = g
+			report.Groups = append(report.Groups, g)
+		}
+		g.Changes = append(g.Changes, releaseChange(rev))
+	}
+	sort.Sort(releaseGroupsByDir(report.Groups))
+	for _, g := range report.Groups {
+		sort.Sort(releaseChangesByTime(g.Changes))
+	}
+	return report, nil
+}
+
+func releaseChange(rev *Rev) *ReleaseChange {
+	c := &ReleaseChange{
+		Hash:   rev.Hash,
+		Author: rev.Author,
+		Time:   rev.Time,
+	}
+	s := strings.TrimSpace(rev.Log)
+	if i := strings.Index(s, "\n"); i >= 0 {
+		s = s[:i]
+	}
+	c.Summary = s
+	if m := clLinkRE.FindStringSubmatch(rev.Log); m != nil {
+		c.CL = m[1]
+	}
+	c.Issues, _ = parseTrailers(rev.Log)
+	return c
+}
+
+// revDir returns the directory most of rev's files are in,
+// using the same naming as the code review dashboard.
+func revDir(rev *Rev) string {
+	counts := make(map[string]int)
+	best := ""
+	for _, f := range rev.Files {
+		name := strings.TrimPrefix(f.Name, "/")
+		if i := strings.LastIndex(name, "/"); i >= 0 {
+			name = name[:i]
+		} else {
+			name = ""
+		}
+		name = strings.TrimPrefix(name, "src/pkg/")
+		name = strings.TrimPrefix(name, "src/")
+		if name == "src" || name == "" {
+			name = "build"
+		}
+		counts[name]++
+		if c := counts[name]; c > counts[best] || c == counts[best] && name < best {
+			best = name
+		}
+	}
+	if best == "" {
+		return "?"
+	}
+	return best
+}
+
+type releaseGroupsByDir []*ReleaseGroup
+
+func (x releaseGroupsByDir) Len() int           { return len(x) }
+func (x releaseGroupsByDir) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+func (x releaseGroupsByDir) Less(i, j int) bool { return x[i].Dir < x[j].Dir }
+
+type releaseChangesByTime []*ReleaseChange
+
+func (x releaseChangesByTime) Len() int           { return len(x) }
+func (x releaseChangesByTime) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+func (x releaseChangesByTime) Less(i, j int) bool { return x[i].Time.Before(x[j].Time) }
+
+func init() {
+	app.Handle("/admin/commit/release", showRelease)
+}
+
+var releaseTemplate = template.Must(template.New("release").Parse(`<html>
+<head>
+<title>{{.Repo}} changes since {{.From}}</title>
+</head>
+<body>
+<h1>{{.Repo}} changes since {{.From}}</h1>
+<p>{{.FromHash}} .. {{.ToHash}}</p>
+{{range .Groups}}
+<h2>{{.Dir}}</h2>
+<ul>
+{{range .Changes}}
+<li>{{.Summary}}
+	{{if .CL}}(<a href="https://codereview.appspot.com/{{.CL}}">CL {{.CL}}</a>){{end}}
+	{{range .Issues}}(<a href="https://golang.org/issue/{{.}}">issue {{.}}</a>){{end}}
+	<br><small>{{.Author}}, {{.Time.Format "2006-01-02"}}</small>
+{{end}}
+</ul>
+{{end}}
+</body>
+</html>
+`))
+
+func showRelease(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	repo := req.FormValue("repo")
+	if repo == "" {
+		repo = "main"
+	}
+	from := req.FormValue("from")
+	if from == "" {
+		http.Error(w, "missing from= tag", 400)
+		return
+	}
+	report, err := ReleaseReport(ctxt, repo, from, req.FormValue("to"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	if req.FormValue("format") == "json" {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		js, err := json.Marshal(report)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		var buf bytes.Buffer
+		json.Indent(&buf, js, "", "\t")
+		w.Write(buf.Bytes())
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := releaseTemplate.Execute(&buf, report); err != nil {
+		ctxt.Errorf("execute: %v", err)
+		http.Error(w, "error executing template", 500)
+		return
+	}
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,107 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commit
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"app"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/search"
+)
+
+// Revs are added to the "Rev" search index by the commit.index scan,
+// which picks up every Rev written with Indexed == false.
+
+// revDoc is the search document for a Rev.
+type revDoc struct {
+	Repo   search.Atom
+	Hash   search.Atom
+	Author string
+	Log    string
+	Files  string
+	Time   time.Time
+}
+
+func init() {
+	app.ScanData("commit.index", 5*time.Minute,
+		datastore.NewQuery("Rev").Filter("Indexed =", false),
+		indexRev)
+}
+
+// newRevDoc returns the search document for rev.
+func newRevDoc(rev *Rev) *revDoc {
+	var files []string
+	for _, f := range rev.Files {
+		files = append(files, f.Name)
+	}
+	return &revDoc{
+		Repo:   search.Atom(rev.Repo),
+		Hash:   search.Atom(rev.Hash),
+		Author: rev.Author + " " + rev.AuthorEmail,
+		Log:    rev.Log,
+		Files:  strings.Join(files, " "),
+		Time:   rev.Time,
+	}
+}
+
+func indexRev(ctxt appengine.Context, kind, key string) error {
+	var rev Rev
+	if err := app.ReadData(ctxt, "Rev", key, &rev); err != nil {
+		return err
+	}
+	index, err := search.Open("Rev")
+	if err != nil {
+		return err
+	}
+	doc := newRevDoc(&rev)
+	if _, err := index.Put(ctxt, key, doc); err != nil {
+		return fmt.Errorf("indexing rev %s: %v", key, err)
+	}
+	return app.Transaction(ctxt, func(ctxt appengine.Context) error {
+		var rev Rev
+		if err := app.ReadData(ctxt, "Rev", key, &rev); err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(newRevDoc(&rev), doc) {
+			// Changed since we read it; the next scan indexes the new copy.
+			return nil
+		}
+		rev.Indexed = true
+		return app.WriteData(ctxt, "Rev", key, &rev)
+	})
+}
+
+// Search returns up to limit Revs matching the query,
+// which uses the App Engine search query syntax.
+func Search(ctxt appengine.Context, query string, limit int) ([]*Rev, error) {
+	index, err := search.Open("Rev")
+	if err != nil {
+		return nil, err
+	}
+	var revs []*Rev
+	it := index.Search(ctxt, query, &search.SearchOptions{Limit: limit, IDsOnly: true})
+	for {
+		id, err := it.Next(nil)
+		if err == search.Done {
+			break
+		}
+		if err != nil {
+			ctxt.Errorf("searching revs for %q: %v", query, err)
+			return nil, fmt.Errorf("searching commits failed")
+		}
+		rev := new(Rev)
+		if err := app.ReadData(ctxt, "Rev", id, rev); err != nil {
+			continue
+		}
+		revs = append(revs, rev)
+	}
+	return revs, nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"app"
+
+	"appengine"
+)
+
+// Parser self-test.
+//
+// The source browser pages the loader parses change without notice.
+// The directory commit/selftest holds saved pages for a few kinds of
+// revision (an ordinary commit, a merge, a branch point, and a commit
+// renaming files), each name.html next to a name.json holding the Rev
+// the parser should produce. The self-test, served at
+// /admin/commit/selftest and run by the commit.selftest op, parses each
+// page and reports whether the result matches, so that after a change
+// to the pages operators can check the parser without trusting live data.
+// Refresh the saved pages by hand from the live site when it changes.
+
+// selfTestDir is the directory holding the self-test pages,
+// relative to the app's root directory.
+const selfTestDir = "commit/selftest"
+
+func init() {
+	app.Handle("/admin/commit/selftest", showSelfTest)
+	app.RegisterOp("commit.selftest", "Run the commit page parser over the saved test pages.", nil, func(ctxt appengine.Context, args map[string]string) (string, error) {
+		results, err := selfTest(ctxt, selfTestDir)
+		if err != nil {
+			return "", err
+		}
+		var buf bytes.Buffer
+		for _, r := range results {
+			buf.WriteString(r.String())
+		}
+		return buf.String(), nil
+	})
+}
+
+// A selfTestResult is the outcome of parsing one saved page.
+type selfTestResult struct {
+	Name string
+	Err  error // nil if the page parsed as expected
+}
+
+func (r *selfTestResult) String() string {
+	if r.Err != nil {
+		return fmt.Sprintf("FAIL %s: %v\n", r.Name, r.Err)
+	}
+	return fmt.Sprintf("PASS %s\n", r.Name)
+}
+
+// selfTest parses the pages in dir and compares the results
+// with the expected Revs.
+func selfTest(ctxt appengine.Context, dir string) ([]*selfTestResult, error) {
+	pages, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("no test pages in %s", dir)
+	}
+	sort.Strings(pages)
+	var results []*selfTestResult
+	for _, page := range pages {
+		name := strings.TrimSuffix(filepath.Base(page), ".html")
+		results = append(results, &selfTestResult{name, selfTestPage(ctxt, page)})
+	}
+	return results, nil
+}
+
+func selfTestPage(ctxt appengine.Context, page string) error {
+	js, err := ioutil.ReadFile(strings.TrimSuffix(page, ".html") + ".json")
+	if err != nil {
+		return err
+	}
+	want := new(Rev)
+	if err := json.Unmarshal(js, want); err != nil {
+		return fmt.Errorf("reading expected result: %v", err)
+	}
+	data, err := ioutil.ReadFile(page)
+	if err != nil {
+		return err
+	}
+	have, err := parseRev(ctxt, want.Repo, want.Hash, data)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(have, want) {
+		return fmt.Errorf("have %+v, want %+v", have, want)
+	}
+	return nil
+}
+
+func showSelfTest(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	results, err := selfTest(ctxt, selfTestDir)
+	if err != nil {
+		fmt.Fprintf(w, "self-test: %v\n", err)
+		return
+	}
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+		}
+		fmt.Fprint(w, r)
+	}
+	fmt.Fprintf(w, "%d pages, %d failed\n", len(results), failed)
+}
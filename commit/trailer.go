@@ -0,0 +1,61 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commit
+
+import (
+	"regexp"
+	"strings"
+
+	"app"
+)
+
+// Commit messages refer to the issues they address with lines like
+// "Fixes issue 1234", "Fixes #1234", or "Updates issue 1234".
+// The Rev updater records the issue numbers in FixesIssues and UpdatesIssues,
+// and the issue.fixlanded scan in package issue marks the fixed issues,
+// picking up every Rev written with IssuesLinked == false.
+
+var trailerRE = regexp.MustCompile(`(?i)\b(fixes|updates)\s+(?:issue\s+|#)([0-9]+)\b`)
+
+func init() {
+	app.RegisterDataUpdater("Rev", updateRev)
+}
+
+func updateRev(rev *Rev) {
+	rev.FixesIssues, rev.UpdatesIssues = parseTrailers(rev.Log)
+	if len(rev.FixesIssues) == 0 {
+		rev.IssuesLinked = true
+	}
+	updatePick(rev)
+}
+
+// parseTrailers returns the issues the commit message log says it fixes
+// and the other issues it says it updates, each in order of first mention.
+func parseTrailers(log string) (fixes, updates []string) {
+	seen := make(map[string]bool)
+	for _, m := range trailerRE.FindAllStringSubmatch(log, -1) {
+		if strings.EqualFold(m[1], "fixes") && !seen[m[2]] {
+			fixes = append(fixes, m[2])
+			seen[m[2]] = true
+		}
+	}
+	for _, m := range trailerRE.FindAllStringSubmatch(log, -1) {
+		if strings.EqualFold(m[1], "updates") && !seen[m[2]] {
+			updates = append(updates, m[2])
+			seen[m[2]] = true
+		}
+	}
+	return fixes, updates
+}
+
+// URL returns the URL of the source browser page for the commit with
+// the given hash in repo ("main", "go.net", and so on).
+func URL(repo, hash string) string {
+	url := "https://code.google.com/p/go/source/detail?r=" + hash
+	if repo != "main" {
+		url += "&repo=" + strings.TrimPrefix(repo, "go.")
+	}
+	return url
+}
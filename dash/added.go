@@ -0,0 +1,131 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"app"
+	"codereview"
+	"identity"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/mail"
+)
+
+// An Added records that a user was added as a reviewer or CC on a CL.
+// It is stored under the user's email and the CL number, separated by a slash.
+// For a few days afterward, the CL is highlighted on the user's /mine page.
+type Added struct {
+	Email string
+	CL    string
+	CC    bool // added as CC, not reviewer
+	Time  time.Time
+}
+
+// addedDays is how long a CL stays highlighted after the user is added to it.
+const addedDays = 3
+
+// addedMailFlag gates mail to newly added reviewers. Rietveld only mails
+// the reviewers when the CL is mailed, so this catches additions made later.
+var addedMailFlag = app.Flag("dash.addedmail", false)
+
+func init() {
+	app.Subscribe("codereview.reviewers", "dash.added", noteAdded)
+}
+
+// noteAdded records the people in a codereview.ReviewersEvent as added,
+// mailing the reviewers if addedMailFlag is on.
+// People already recorded as added by this event or a later one are skipped,
+// so that a retried delivery does not mail twice.
+func noteAdded(ctxt appengine.Context, e *app.Event) error {
+	var ev codereview.ReviewersEvent
+	if err := e.Decode(&ev); err != nil {
+		ctxt.Errorf("bad event %s %s: %v", e.Topic, e.Key, err)
+		return nil
+	}
+	add := func(who string, cc bool) error {
+		email := identity.Load(ctxt).Canonical(who)
+		key := email + "/" + ev.CL
+		var a Added
+		if err := app.ReadData(ctxt, "Added", key, &a); err == nil && !a.Time.Before(e.Time) {
+			return nil
+		}
+		a = Added{Email: email, CL: ev.CL, CC: cc, Time: e.Time}
+		if err := app.WriteData(ctxt, "Added", key, &a); err != nil {
+			return err
+		}
+		if !cc && addedMailFlag.On(ctxt) {
+			mailAdded(ctxt, who, &ev)
+		}
+		return nil
+	}
+	for _, who := range ev.Reviewers {
+		if err := add(who, false); err != nil {
+			return err
+		}
+	}
+	for _, who := range ev.CC {
+		if err := add(who, true); err != nil {
+			return err
+		}
+	}
+	app.BumpDataVersion(ctxt)
+	return nil
+}
+
+func mailAdded(ctxt appengine.Context, to string, ev *codereview.ReviewersEvent) {
+	msg := &mail.Message{
+		Sender:  fmt.Sprintf("Go dashboard <noreply@%s.appspotmail.com>", appengine.AppID(ctxt)),
+		To:      []string{to},
+		Subject: fmt.Sprintf("review request: CL %s: %s", ev.CL, ev.Summary),
+		Body: fmt.Sprintf("%s added you as a reviewer of CL %s.\n\n"+
+			"https://codereview.appspot.com/%s\n"+
+			"https://%s/mine\n",
+			ev.OwnerEmail, ev.CL, ev.CL, appengine.DefaultVersionHostname(ctxt)),
+	}
+	if err := mail.Send(ctxt, msg); err != nil {
+		ctxt.Errorf("mailing %s about CL %s: %v", to, ev.CL, err)
+	}
+}
+
+// loadAdded loads the CLs the user d.email was recently added to into d.added.
+func (d *display) loadAdded(ctxt appengine.Context) {
+	if d.email == "" {
+		return
+	}
+	var list []*Added
+	_, err := datastore.NewQuery("Added").
+		Filter("Email =", d.email).
+		Filter("Time >", time.Now().Add(-days(addedDays))).
+		GetAll(ctxt, &list)
+	if err != nil {
+		ctxt.Errorf("loading added CLs for %s: %v", d.email, err)
+		return
+	}
+	d.added = make(map[string]bool)
+	for _, a := range list {
+		d.added[a.CL] = true
+	}
+}
+
+// isAdded returns css class "added" if the user was recently added to the CL
+// (see loadAdded).
+func (d *display) isAdded(cl string) string {
+	return d.css("added", d.added[cl])
+}
+
+// addedCLs returns the CLs in d.added, sorted.
+func (d *display) addedCLs() []string {
+	var list []string
+	for cl := range d.added {
+		list = append(list, cl)
+	}
+	sort.Strings(list)
+	return list
+}
@@ -0,0 +1,281 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"app"
+	"codereview"
+	"dash/model"
+	"issue"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+)
+
+func init() {
+	app.Handle("/api/dash", apiDash)
+	app.Handle("/api/dash/changes", apiChanges)
+	app.Handle("/api/dash/fixed", apiFixed)
+
+	app.RegisterAPI("/api/dash", "The dashboard groups, filtered and grouped as on the HTML dashboard.",
+		[]string{"user", "view", "repo", "dir", "reviewer", "size", "label", "needsreview", "kind", "groupby"}, []*model.Group(nil))
+	app.RegisterAPI("/api/dash/changes", "The CLs and issues changed since the data version since=.",
+		[]string{"since"}, (*changesResult)(nil))
+	app.RegisterAPI("/api/dash/fixed", "Issues a commit says it fixes that have not been verified, most recently fixed first.",
+		[]string{"user"}, []*issue.Issue(nil))
+}
+
+// apiCacheTime is how long /api/dash responses are cached in memcache.
+const apiCacheTime = 1 * time.Minute
+
+// apiDash serves the dashboard groups as JSON.
+// The optional user= parameter restricts the result to items involving
+// the given user (as CL owner or reviewer, or issue reporter or owner).
+// The result can also be filtered by the same parameters as the HTML
+// dashboard, including view= to select one of the logged-in user's saved views,
+// and regrouped by groupby= (dir, reviewer, owner, size, or repo).
+// With kind=issues or kind=cls, only issues or only CLs are loaded.
+// Whatever the grouping, the group name is returned in the Dir field.
+// Items the logged-in user has snoozed are omitted.
+// Times are RFC 3339 timestamps in UTC, regardless of the user's
+// time display preferences.
+func apiDash(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	who := req.FormValue("user")
+
+	var d display
+	d.email, _ = requestEmail(ctxt, req)
+	if notModified(ctxt, w, req, d.email) {
+		return
+	}
+	if d.email != "" {
+		app.ReadData(ctxt, "UserPref", d.email, &d.pref)
+	}
+	view, err := viewFromForm(req, &d.pref)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	groupBy := req.FormValue("groupby")
+	by, err := groupingFor(groupBy, view.kind())
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	cacheKey := fmt.Sprintf("dash.api.%d.%d.%q.%q.%q.%q", pageVersion(ctxt), app.DataVersion(ctxt), d.email, who, view.Query(), groupBy)
+	if it, err := memcache.Get(ctxt, cacheKey); err == nil {
+		writeJSON(w, it.Value)
+		return
+	}
+
+	groups, err := loadGroups(ctxt, view.kind())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	model.FilterForUser(groups, model.UserFilter{Snoozed: d.pref.Snoozed, Now: time.Now()})
+	view.filter(groups)
+	if groupBy != "" && groupBy != "dir" {
+		groups = model.Regroup(groups, by)
+	}
+
+	var out []*model.Group
+	for _, g := range groups {
+		g = apiGroup(g, who)
+		if len(g.Items) > 0 {
+			out = append(out, g)
+		}
+	}
+	sort.Sort(groupsByDir(out))
+
+	js, err := json.Marshal(out)
+	if err != nil {
+		ctxt.Errorf("encoding dash JSON: %v", err)
+		http.Error(w, "error encoding JSON", 500)
+		return
+	}
+	memcache.Set(ctxt, &memcache.Item{Key: cacheKey, Value: js, Expiration: apiCacheTime})
+	writeJSON(w, js)
+}
+
+func writeJSON(w http.ResponseWriter, js []byte) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(js)
+}
+
+// apiGroup returns a copy of g containing only the items involving who
+// (or all items, if who is empty). The CLs and issues in the copy omit
+// the message and comment text, which the dashboard does not display.
+func apiGroup(g *model.Group, who string) *model.Group {
+	ng := &model.Group{Dir: g.Dir}
+	for _, item := range g.Items {
+		if who != "" && !itemInvolves(item, who) {
+			continue
+		}
+		ng.Items = append(ng.Items, apiItem(item))
+	}
+	return ng
+}
+
+// apiItem returns a copy of item without the CL message
+// and issue comment text.
+func apiItem(item *model.Item) *model.Item {
+	nitem := &model.Item{Overdue: item.Overdue, OverdueCLs: item.OverdueCLs}
+	if item.Bug != nil {
+		bug := *item.Bug
+		if len(bug.Comment) > 1 {
+			bug.Comment = bug.Comment[:1]
+		}
+		nitem.Bug = &bug
+	}
+	for _, cl := range item.CLs {
+		ncl := *cl
+		ncl.Messages = nil
+		nitem.CLs = append(nitem.CLs, &ncl)
+	}
+	return nitem
+}
+
+// itemInvolves reports whether the item involves the user who,
+// given as either a full email address or the part before the @.
+func itemInvolves(item *model.Item, who string) bool {
+	match := func(email string) bool { return matchUser(email, who) }
+	if bug := item.Bug; bug != nil {
+		if match(bug.Owner) || len(bug.Comment) > 0 && match(bug.Comment[0].Author) {
+			return true
+		}
+	}
+	for _, cl := range item.CLs {
+		if match(cl.OwnerEmail) || match(cl.PrimaryReviewer) {
+			return true
+		}
+	}
+	return false
+}
+
+// changesSlack is how far before the requested version apiChanges looks.
+// It covers writes that were still being committed when the client's
+// copy of the data was produced. Reporting an item twice is harmless.
+const changesSlack = 1 * time.Minute
+
+// maxChanges limits the number of CLs and issues returned by apiChanges.
+// A client seeing that many should reload everything.
+const maxChanges = 100
+
+// A changesResult is the result of apiChanges.
+type changesResult struct {
+	Version int64
+	More    bool // too many changes; reload everything
+	CLs     []*codereview.CL
+	Issues  []*issue.Issue
+}
+
+// apiChanges serves the CLs and issues that have changed since
+// the data version given by the since= parameter, along with the
+// current data version, to use as since= in the next request.
+// Changed CLs and issues are reported even if they are no longer
+// on the dashboard, so that clients can remove them.
+func apiChanges(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	since, err := strconv.ParseInt(req.FormValue("since"), 10, 64)
+	if err != nil {
+		http.Error(w, "missing or invalid since=", 400)
+		return
+	}
+	t := app.DataVersionTime(since).Add(-changesSlack)
+
+	var out changesResult
+	out.Version = app.DataVersion(ctxt)
+
+	if since < out.Version {
+		_, err := datastore.NewQuery("CL").
+			Filter("Updated >=", t).
+			Limit(maxChanges+1).
+			GetAll(ctxt, &out.CLs)
+		if err != nil {
+			ctxt.Errorf("loading changed CLs: %v", err)
+			http.Error(w, "loading CLs failed", 500)
+			return
+		}
+		_, err = datastore.NewQuery("Issue").
+			Filter("Updated >=", t).
+			Limit(maxChanges+1).
+			GetAll(ctxt, &out.Issues)
+		if err != nil {
+			ctxt.Errorf("loading changed issues: %v", err)
+			http.Error(w, "loading issues failed", 500)
+			return
+		}
+		if len(out.CLs) > maxChanges || len(out.Issues) > maxChanges {
+			out.More = true
+			out.CLs = nil
+			out.Issues = nil
+		}
+		item := apiItem(&model.Item{CLs: out.CLs})
+		out.CLs = item.CLs
+		var bugs []*issue.Issue
+		for _, bug := range out.Issues {
+			if !bug.Restricted {
+				bugs = append(bugs, apiItem(&model.Item{Bug: bug}).Bug)
+			}
+		}
+		out.Issues = bugs
+	}
+
+	js, err := json.Marshal(&out)
+	if err != nil {
+		ctxt.Errorf("encoding changes JSON: %v", err)
+		http.Error(w, "error encoding JSON", 500)
+		return
+	}
+	writeJSON(w, js)
+}
+
+// maxFixed limits the number of issues returned by apiFixed.
+const maxFixed = 500
+
+// apiFixed serves as JSON the issues that a commit says it fixes
+// but that have not been marked Verified, most recently fixed first.
+// The optional user= parameter restricts the result to issues
+// reported or owned by the given user.
+func apiFixed(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	who := req.FormValue("user")
+	bugs, err := issue.FixedUnverified(ctxt, maxFixed)
+	if err != nil {
+		ctxt.Errorf("loading fixed issues: %v", err)
+		http.Error(w, "loading issues failed", 500)
+		return
+	}
+	out := []*issue.Issue{}
+	for _, bug := range bugs {
+		item := &model.Item{Bug: bug}
+		if bug.Restricted || who != "" && !itemInvolves(item, who) {
+			continue
+		}
+		out = append(out, apiItem(item).Bug)
+	}
+
+	js, err := json.Marshal(out)
+	if err != nil {
+		ctxt.Errorf("encoding fixed issues JSON: %v", err)
+		http.Error(w, "error encoding JSON", 500)
+		return
+	}
+	writeJSON(w, js)
+}
+
+type groupsByDir []*model.Group
+
+func (x groupsByDir) Len() int           { return len(x) }
+func (x groupsByDir) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+func (x groupsByDir) Less(i, j int) bool { return model.DirKey(x[i].Dir) < model.DirKey(x[j].Dir) }
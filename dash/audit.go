@@ -0,0 +1,131 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"net/url"
+	"time"
+
+	"app"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// An AdminAction records a single uiop request, so that changes made
+// on a user's behalf (many of them posted by the bot account) can be
+// traced back to the user who asked for them.
+type AdminAction struct {
+	Time    time.Time
+	Who     string
+	ByToken bool // request used an API token
+	Op      string
+	Target  string `datastore:",noindex"` // other form values, in URL query form
+	Status  int    // HTTP status of the response
+	Result  string `datastore:",noindex"` // start of the response body
+}
+
+// maxActionResult limits the response text saved in an AdminAction.
+const maxActionResult = 500
+
+// auditWriter is an http.ResponseWriter that remembers
+// the status and the start of the body of the response.
+type auditWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *auditWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditWriter) Write(b []byte) (int, error) {
+	if n := maxActionResult - w.body.Len(); n > 0 {
+		if n > len(b) {
+			n = len(b)
+		}
+		w.body.Write(b[:n])
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// recordAction stores the AdminAction for the uiop request req by who,
+// which got the response recorded in w.
+func recordAction(ctxt appengine.Context, who string, byToken bool, req *http.Request, w *auditWriter) {
+	target := make(url.Values)
+	for k, v := range req.Form {
+		if k != "op" && k != "xsrf" {
+			target[k] = v
+		}
+	}
+	a := &AdminAction{
+		Time:    time.Now(),
+		Who:     who,
+		ByToken: byToken,
+		Op:      req.FormValue("op"),
+		Target:  target.Encode(),
+		Status:  w.status,
+		Result:  w.body.String(),
+	}
+	if _, err := datastore.Put(ctxt, datastore.NewIncompleteKey(ctxt, "AdminAction", nil), a); err != nil {
+		ctxt.Errorf("recording uiop action: %v", err)
+	}
+}
+
+func init() {
+	app.HandleRole("/admin/dash/actions", app.ReviewerAdmin, showActions)
+}
+
+var actionsTemplate = template.Must(template.New("actions").Parse(`<html>
+<h1>uiop actions</h1>
+<form>
+User: <input type="text" name="who" value="{{.Who}}">
+<input type="submit" value="Show">
+</form>
+<table>
+<tr><th>time<th>user<th>op<th>target<th>status<th>result
+{{range .List}}
+<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}
+<td><a href="?who={{.Who}}">{{.Who}}</a>{{if .ByToken}} (token){{end}}
+<td>{{.Op}}<td>{{.Target}}<td>{{.Status}}<td>{{.Result}}
+{{end}}
+</table>
+</html>
+`))
+
+// maxActions is the number of actions shown by /admin/dash/actions.
+const maxActions = 200
+
+// showActions serves /admin/dash/actions, which shows the most recent
+// uiop requests, optionally only those by the user given as who=.
+func showActions(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	var data struct {
+		Who  string
+		List []*AdminAction
+	}
+	data.Who = req.FormValue("who")
+	q := datastore.NewQuery("AdminAction").Order("-Time").Limit(maxActions)
+	if data.Who != "" {
+		q = q.Filter("Who =", data.Who)
+	}
+	if _, err := q.GetAll(ctxt, &data.List); err != nil {
+		ctxt.Errorf("loading actions: %v", err)
+		http.Error(w, "loading actions failed", 500)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := actionsTemplate.Execute(&buf, &data); err != nil {
+		ctxt.Errorf("execute: %v", err)
+		http.Error(w, "error executing template", 500)
+		return
+	}
+	w.Write(buf.Bytes())
+}
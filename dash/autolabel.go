@@ -0,0 +1,188 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"app"
+	"codereview"
+	"issue"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Labels from linked CLs.
+//
+// When a CL starts mentioning an issue, the directories it changes
+// say which packages the issue is about. noteLinked turns those into
+// package labels for the issue and, depending on the "dash.autolabel"
+// config, either posts them to the tracker or records them as a
+// LabelSuggestion, which the triage page offers to apply.
+
+// autolabelConfig is read from the "dash.autolabel" config, for example
+//
+//	{"Apply": true, "Labels": {"cmd/gc": "Compiler", "doc": ""}}
+type autolabelConfig struct {
+	Apply bool // post labels to the tracker instead of suggesting them
+
+	// Labels maps a directory (and its subdirectories) to its label.
+	// An empty label means the directory gets none.
+	// Directories not listed get "Pkg-" and the directory name.
+	Labels map[string]string
+}
+
+// maxAutoLabels is the most labels derived from a single CL.
+const maxAutoLabels = 2
+
+// A LabelSuggestion records labels suggested for an issue by the CLs
+// linked to it. It is stored under the issue number.
+type LabelSuggestion struct {
+	Issue int
+	CL    []string // CLs the labels came from
+	Label []string
+	Time  time.Time
+}
+
+func init() {
+	app.Subscribe("codereview.issues", "dash.autolabel", noteLinked)
+}
+
+// dirLabel returns the label for dir, or "" if it has none.
+func (c *autolabelConfig) dirLabel(dir string) string {
+	for d := dir; ; {
+		if l, ok := c.Labels[d]; ok {
+			return l
+		}
+		i := strings.LastIndex(d, "/")
+		if i < 0 {
+			break
+		}
+		d = d[:i]
+	}
+	return "Pkg-" + strings.Replace(dir, "/", "-", -1)
+}
+
+// labelsFor returns the labels for the CL directories dirs,
+// omitting those already in have.
+func (c *autolabelConfig) labelsFor(dirs []string, have []string) []string {
+	seen := make(map[string]bool)
+	for _, l := range have {
+		seen[strings.ToLower(l)] = true
+	}
+	var list []string
+	for _, dir := range dirs {
+		if len(list) >= maxAutoLabels {
+			break
+		}
+		l := c.dirLabel(dir)
+		if l == "" || seen[strings.ToLower(l)] {
+			continue
+		}
+		seen[strings.ToLower(l)] = true
+		list = append(list, l)
+	}
+	return list
+}
+
+// noteLinked labels, or suggests labels for, the open issues
+// in a codereview.IssuesEvent.
+func noteLinked(ctxt appengine.Context, e *app.Event) error {
+	var ev codereview.IssuesEvent
+	if err := e.Decode(&ev); err != nil {
+		ctxt.Errorf("bad event %s %s: %v", e.Topic, e.Key, err)
+		return nil
+	}
+	var c autolabelConfig
+	app.ReadConfig(ctxt, "dash.autolabel", &c)
+
+	for _, key := range ev.Issues {
+		var bug issue.Issue
+		if err := app.ReadData(ctxt, "Issue", key, &bug); err != nil {
+			continue // not an issue we know; already logged
+		}
+		if bug.State != "open" {
+			continue
+		}
+		labels := c.labelsFor(ev.Dirs, bug.Label)
+		if len(labels) == 0 {
+			continue
+		}
+		if c.Apply {
+			u := &issue.Update{
+				Label:   labels,
+				Comment: fmt.Sprintf("(labels from CL %s via the Go dashboard)", ev.CL),
+			}
+			if err := issue.Post(ctxt, bug.ID, u); err != nil {
+				ctxt.Errorf("autolabel issue %d: %v", bug.ID, err)
+				return err
+			}
+			continue
+		}
+		if err := suggestLabels(ctxt, bug.ID, ev.CL, labels); err != nil {
+			return err
+		}
+	}
+	bumpPageVersion(ctxt)
+	return nil
+}
+
+// suggestLabels adds labels, derived from the given CL, to the issue's LabelSuggestion.
+func suggestLabels(ctxt appengine.Context, id int, cl string, labels []string) error {
+	key := strconv.Itoa(id)
+	return app.Transaction(ctxt, func(ctxt appengine.Context) error {
+		var s LabelSuggestion
+		if err := app.ReadData(ctxt, "LabelSuggestion", key, &s); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		s.Issue = id
+		s.CL = toggleString(s.CL, cl, true)
+		for _, l := range labels {
+			s.Label = toggleString(s.Label, l, true)
+		}
+		s.Time = time.Now()
+		return app.WriteData(ctxt, "LabelSuggestion", key, &s)
+	})
+}
+
+// loadSuggestions returns the label suggestions for the given issues,
+// by issue number, dropping labels the issues already have.
+func loadSuggestions(ctxt appengine.Context, bugs []*issue.Issue) map[int]*LabelSuggestion {
+	m := make(map[int]*LabelSuggestion)
+	var list []*LabelSuggestion
+	if _, err := datastore.NewQuery("LabelSuggestion").GetAll(ctxt, &list); err != nil {
+		ctxt.Errorf("loading label suggestions: %v", err)
+		return m
+	}
+	byID := make(map[int]*LabelSuggestion)
+	for _, s := range list {
+		byID[s.Issue] = s
+	}
+	for _, bug := range bugs {
+		s := byID[bug.ID]
+		if s == nil {
+			continue
+		}
+		have := make(map[string]bool)
+		for _, l := range bug.Label {
+			have[strings.ToLower(l)] = true
+		}
+		var labels []string
+		for _, l := range s.Label {
+			if !have[strings.ToLower(l)] {
+				labels = append(labels, l)
+			}
+		}
+		if len(labels) > 0 {
+			s.Label = labels
+			m[bug.ID] = s
+		}
+	}
+	return m
+}
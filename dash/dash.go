@@ -5,63 +5,25 @@
 package dash
 
 import (
+	"bytes"
 	"fmt"
-	"html/template"
-	"io/ioutil"
 	"net/http"
-	"regexp"
 	"sort"
-	"strconv"
 	"strings"
 	"time"
 
 	"app"
 	"codereview"
-	"issue"
+	"dash/model"
+	"identity"
 
 	"appengine"
-	"appengine/datastore"
+	"appengine/memcache"
 	"appengine/user"
-
-	"github.com/rsc/appstats"
 )
 
 func init() {
-	http.Handle("/", appstats.NewHandler(showDash))
-	http.Handle("/uiop", appstats.NewHandler(uiOperation))
-}
-
-type Group struct {
-	Dir   string
-	Items []*Item
-}
-
-type Item struct {
-	Bug *issue.Issue
-	CLs []*codereview.CL
-}
-
-type itemsBySummary []*Item
-
-func (x itemsBySummary) Len() int           { return len(x) }
-func (x itemsBySummary) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
-func (x itemsBySummary) Less(i, j int) bool { return itemSummary(x[i]) < itemSummary(x[j]) }
-
-func itemSummary(it *Item) string {
-	if it.Bug != nil {
-		return it.Bug.Summary
-	}
-	for _, cl := range it.CLs {
-		return cl.Summary
-	}
-	return ""
-}
-
-func dirKey(s string) string {
-	if strings.Contains(s, ".") {
-		return "\x7F" + s
-	}
-	return s
+	app.Handle("/", showDash)
 }
 
 // display holds state needed to compute the displayed HTML.
@@ -69,13 +31,62 @@ func dirKey(s string) string {
 // Not all methods need the display state; being methods just keeps
 // them all in one place.
 type display struct {
-	email string
-	pref  UserPref
+	email     string
+	pref      UserPref
+	owners    codereview.Owners
+	profiles  *profiles
+	sla       slaConfig
+	added     map[string]bool     // CLs the user was recently added to (see added.go)
+	watched   map[string]bool     // watched items recently changed (see watch.go)
+	newcomers map[string]bool     // first items by newcomers (see newcomer.go)
+	role      app.Role            // the user's role; set only by uiop (see userRole)
+	loc       *time.Location      // the user's time zone (see timefmt.go)
+	sparks    *sparkStats         // group activity (see sparkline.go)
+	security  bool                // show restricted issues (see canSeeRestricted)
+	away      codereview.Absences // reviewers away now (see codereview.Away)
 }
 
 // UserPref holds user preferences; stored in the datastore under email address.
+// Users manage them on /settings (see settings.go).
 type UserPref struct {
-	Muted []string
+	DV int `dataversion:"1" json:"-"`
+
+	Muted       []string       // muted directories
+	MutedCLs    []string       // muted CL numbers
+	MutedIssues []int          // muted issue numbers
+	Views       []View         // saved views
+	Snoozed     []model.Snooze // snoozed CLs and issues
+
+	// Summary mail (see summary.go).
+	Summary     bool      // send a periodic summary
+	SummaryDays int       // days between summaries
+	SummarySent time.Time `datastore:",noindex"`
+
+	// Watch lists (see watch.go).
+	WatchCLs    []string // watched CL numbers
+	WatchIssues []int    // watched issue numbers
+	WatchDirs   []string // watched directories, including subdirectories
+	WatchMail   bool     // mail changes to watched items
+	WatchHook   string   `datastore:",noindex"` // https URL to POST changes to
+	WatchUrgent bool     // mail and POST only changes to urgent items
+
+	// Time display (see timefmt.go).
+	TimeZone   string // IANA time zone name; empty means UTC
+	TimeFormat string // timeDays, timeRelative, or timeAbsolute
+}
+
+func init() {
+	app.RegisterDataUpdater("UserPref", updateUserPref)
+	app.RegisterQuota("dash", "UserPref", "Escalation", "APIToken", "Added", "LabelSuggestion", "Report", "Watched", "ReviewEscalation", "Activity", "DeletionRequest")
+}
+
+func updateUserPref(pref *UserPref) {
+	if pref.SummaryDays == 0 {
+		pref.SummaryDays = defaultSummaryDays
+	}
+	if pref.TimeFormat == "" {
+		pref.TimeFormat = timeDays
+	}
 }
 
 // short returns a shortened email address by removing @domain.
@@ -99,6 +110,21 @@ func (d *display) short(s interface{}) interface{} {
 	return s
 }
 
+// profile returns the profile for the person with the given email address,
+// or nil if email is empty.
+func (d *display) profile(email string) *Profile {
+	if d.profiles == nil {
+		return nil
+	}
+	return d.profiles.lookup(email)
+}
+
+// awayRecord returns the Away record for the reviewer with the given
+// email address, or nil if they are not away.
+func (d *display) awayRecord(email string) *codereview.Away {
+	return d.away.Lookup(email)
+}
+
 // css returns name if cond is true; otherwise it returns the empty string.
 // It is intended for use in generating css class names (or not).
 func (d *display) css(name string, cond bool) string {
@@ -108,9 +134,20 @@ func (d *display) css(name string, cond bool) string {
 	return ""
 }
 
-// old returns css class "old" t is too long ago.
+// old returns css class "old" if t is longer ago than
+// the threshold for CLs waiting for review.
 func (d *display) old(t time.Time) string {
-	return d.css("old", time.Since(t) > 7*24*time.Hour)
+	return d.css("old", time.Since(t) > days(d.sla.NeedsReview))
+}
+
+// overdue returns css class "old" if the CL is one of the item's overdue CLs.
+func (d *display) overdue(item *model.Item, cl string) string {
+	for _, x := range item.OverdueCLs {
+		if x == cl {
+			return "old"
+		}
+	}
+	return ""
 }
 
 // join is like strings.Join but takes arguments in the reverse order,
@@ -119,16 +156,6 @@ func (d *display) join(sep string, list []string) string {
 	return strings.Join(list, sep)
 }
 
-// since returns the elapsed time since t as a number of days.
-func (d *display) since(t time.Time) string {
-	// NOTE: Considered changing the unit (hours, days, weeks)
-	// but that made it harder to scan through the table.
-	// If it's always days, that's one less thing you have to read.
-	// Otherwise 1 week might be misread as worse than 6 hours.
-	dt := time.Since(t)
-	return fmt.Sprintf("%.1f days ago", float64(dt)/float64(24*time.Hour))
-}
-
 // reviewer returns the reviewer for a CL:
 // the actual reviewer if there is one, or else "golang-dev".
 func (d *display) reviewer(cl *codereview.CL) string {
@@ -138,17 +165,83 @@ func (d *display) reviewer(cl *codereview.CL) string {
 	return cl.PrimaryReviewer
 }
 
+// build returns the css class summarizing the build results
+// for the CL's latest patch set: "buildok", "buildfail", or,
+// if there are no results, the empty string.
+func (d *display) build(cl *codereview.CL) string {
+	switch {
+	case cl.BuildOK:
+		return "buildok"
+	case len(cl.LatestBuildResults()) > 0:
+		return "buildfail"
+	}
+	return ""
+}
+
+// dirOwners returns the short names of the owners of dir.
+func (d *display) dirOwners(dir string) []string {
+	if o := d.owners.Lookup(dir); o != nil {
+		return d.short(o.Owners).([]string)
+	}
+	return nil
+}
+
+// suggest returns the short names of the suggested reviewers
+// for an unassigned CL, or the suggested second reviewers for
+// a CL waiting for a second reviewer, omitting reviewers who are away.
+func (d *display) suggest(cl *codereview.CL) []string {
+	if cl.WantsSecond() {
+		var list []string
+		for _, who := range d.owners.SuggestAvailable(cl, d.away) {
+			if who != cl.PrimaryReviewer && who != cl.NeedsSecond {
+				list = append(list, who)
+			}
+		}
+		return d.short(list).([]string)
+	}
+	if cl.PrimaryReviewer != "" {
+		return nil
+	}
+	return d.short(d.owners.SuggestAvailable(cl, d.away)).([]string)
+}
+
+// secondCLs returns the CLs in groups that are waiting
+// for a second reviewer, least recently updated first.
+func secondCLs(groups map[string]*model.Group) []*codereview.CL {
+	var list []*codereview.CL
+	seen := make(map[string]bool)
+	for _, g := range groups {
+		for _, item := range g.Items {
+			for _, cl := range item.CLs {
+				if cl.WantsSecond() && !seen[cl.CL] {
+					seen[cl.CL] = true
+					list = append(list, cl)
+				}
+			}
+		}
+	}
+	sort.Sort(clsByModified(list))
+	return list
+}
+
+type clsByModified []*codereview.CL
+
+func (x clsByModified) Len() int           { return len(x) }
+func (x clsByModified) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+func (x clsByModified) Less(i, j int) bool { return x[i].Modified.Before(x[j].Modified) }
+
 // second returns the css class "second" if the index is non-zero
 // (so really "second" here means "not first").
 func (d *display) second(index int) string {
 	return d.css("second", index > 0)
 }
 
-// mine returns the css class "mine" if the email address is the logged-in user.
+// mine returns the css class "mine" if the email address or tracker name
+// identifies the logged-in user (see package identity).
 // It also returns "unassigned" for the unassigned reviewer "golang-dev"
 // (see reviewer above).
 func (d *display) mine(email string) string {
-	if email == d.email {
+	if identity.Current().Same(email, d.email) {
 		return "mine"
 	}
 	if email == "golang-dev" {
@@ -171,10 +264,7 @@ func findEmail(ctxt appengine.Context) string {
 	self := ""
 	u := user.Current(ctxt)
 	if u != nil {
-		self = codereview.IsReviewer(u.Email)
-		if self == "" {
-			self = u.Email
-		}
+		self = identity.Load(ctxt).Canonical(app.CanonicalEmail(ctxt, u.Email))
 	}
 	return self
 }
@@ -185,299 +275,199 @@ func showDash(ctxt appengine.Context, w http.ResponseWriter, req *http.Request)
 		return
 	}
 	if req.URL.Path != "/" {
-		http.ServeFile(w, req, "static/"+req.URL.Path)
+		serveStatic(w, req)
 		return
 	}
-	const chunk = 1000
 	ctxt.Errorf("DASH")
 	req.ParseForm()
 
-	var cls []*codereview.CL
-	_, err := datastore.NewQuery("CL").
-		Filter("Active =", true).
-		Limit(chunk).
-		GetAll(ctxt, &cls)
-	if err != nil {
-		ctxt.Errorf("loading CLs: %v", err)
-		fmt.Fprintf(w, "loading CLs failed\n")
+	// Load information about logged-in user.
+	var d display
+	d.email = findEmail(ctxt)
+
+	if notModified(ctxt, w, req, d.email) {
 		return
 	}
 
-	var bugs []*issue.Issue
-	_, err = datastore.NewQuery("Issue").
-		Filter("State =", "open").
-		Filter("Label =", "Release-Go1.3").
-		Limit(chunk).
-		GetAll(ctxt, &bugs)
-	if err != nil {
-		ctxt.Errorf("loading issues: %v", err)
-		fmt.Fprintf(w, "loading issues failed\n")
+	cacheKey := pageCacheKey(ctxt, d.email, req.URL.Path, req.URL.RawQuery)
+	if it, err := memcache.Get(ctxt, cacheKey); err == nil {
+		w.Write(it.Value)
 		return
 	}
 
-	groups := make(map[string]*Group)
-	itemsByBug := make(map[int]*Item)
-
-	addGroup := func(item *Item) {
-		dir := itemDir(item)
-		g := groups[dirKey(dir)]
-		if g == nil {
-			g = &Group{Dir: dir}
-			groups[dirKey(dir)] = g
-		}
-		g.Items = append(g.Items, item)
+	d.loadPref(ctxt)
+	view, err := viewFromForm(req, &d.pref)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
 	}
 
-	for _, bug := range bugs {
-		item := &Item{Bug: bug}
-		addGroup(item)
-		itemsByBug[bug.ID] = item
+	if exportFormat(req) == 0 {
+		d.security = canSeeRestricted(ctxt, req)
 	}
-
-	for _, cl := range cls {
-		found := false
-		for _, id := range clBugs(cl) {
-			item := itemsByBug[id]
-			if item != nil {
-				found = true
-				item.CLs = append(item.CLs, cl)
-			}
-		}
-		if !found {
-			item := &Item{CLs: []*codereview.CL{cl}}
-			addGroup(item)
+	dm, err := loadModel(ctxt, &d, view.kind())
+	if err != nil {
+		if !serveStale(ctxt, w, req, d.email, err) {
+			fmt.Fprintf(w, "%v\n", err)
 		}
+		return
 	}
+	groups := dm.Groups
+	repos := groupRepos(groups)
+	d.loadWatched(ctxt)
+	d.loadNewcomers(ctxt)
+	d.loadSparklines(ctxt)
+	view.filter(groups)
 
-	for _, g := range groups {
-		sort.Sort(itemsBySummary(g.Items))
+	groupBy := req.FormValue("groupby")
+	by, err := groupingFor(groupBy, view.kind())
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
 	}
-
-	// Load information about logged-in user.
-	var d display
-	d.email = findEmail(ctxt)
-	if d.email != "" {
-		app.ReadData(ctxt, "UserPref", d.email, &d.pref)
+	if groupBy != "" && groupBy != "dir" {
+		groups = model.Regroup(groups, by)
 	}
 
-	/*
-
-		nrow := 0
-		self := findEmail(ctxt)
-		isme := func(s string) bool { return s == self || s == "golang-dev" }
-
-		muted := func(dir string) string {
-			for _, targ := range pref.Muted {
-				if dir == targ {
-					return "muted"
-				}
-			}
-			return ""
-		}
-		todo := func(cl *codereview.CL) bool {
-			if cl.NeedsReview {
-				return isme(defaultReviewer(cl))
-			} else {
-				return isme(cl.OwnerEmail)
-			}
-		}
-		todoItem := func(item *Item) bool {
-			for _, cl := range item.CLs {
-				if todo(cl) {
-					return true
-				}
-			}
-			return false
-		}
-		todoGroup := func(g *Group) bool {
-			for _, item := range g.Items {
-				if todoItem(item) {
-					return true
-				}
-			}
-			return false
-		}
-	*/
-
-	tmpl, err := ioutil.ReadFile("template/dash.html")
-	if err != nil {
-		ctxt.Errorf("reading template: %v", err)
+	if sep := exportFormat(req); sep != 0 {
+		writeExport(w, sep, sortedGroups(groups))
 		return
 	}
-	t, err := template.New("main").Funcs(template.FuncMap{
-		"css":      d.css,
-		"join":     d.join,
-		"mine":     d.mine,
-		"muted":    d.muted,
-		"old":      d.old,
-		"replace":  strings.Replace,
-		"reviewer": d.reviewer,
-		"second":   d.second,
-		"short":    d.short,
-		"since":    d.since,
-	}).Parse(string(tmpl))
+
+	t, err := loadTemplate(ctxt, "dash.html", &d)
 	if err != nil {
-		ctxt.Errorf("parsing template: %v", err)
+		fmt.Fprintf(w, "error loading template\n")
 		return
 	}
 
 	data := struct {
-		User string
-		Dirs map[string]*Group
+		User     string
+		XSRF     string
+		View     *View
+		Views    []View
+		Repos    []string
+		Releases []string
+		GroupBy  string
+		Version  int64
+		Warnings []string
+		Second   []*codereview.CL
+		Dirs     map[string]*model.Group
 	}{
 		d.email,
+		"",
+		view,
+		d.pref.Views,
+		repos,
+		releaseLabels(ctxt),
+		groupBy,
+		app.DataVersion(ctxt),
+		dm.Warnings,
+		secondCLs(groups),
 		groups,
 	}
+	if d.email != "" {
+		data.XSRF = app.XSRFToken(ctxt, d.email, "uiop")
+	}
 
-	if err := t.Execute(w, data); err != nil {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
 		ctxt.Errorf("execute: %v", err)
 		fmt.Fprintf(w, "error executing template\n")
 		return
 	}
-}
-
-func descDir(desc string) string {
-	desc = strings.TrimSpace(desc)
-	i := strings.Index(desc, ":")
-	if i < 0 {
-		return ""
-	}
-	desc = desc[:i]
-	if i := strings.Index(desc, ","); i >= 0 {
-		desc = strings.TrimSpace(desc[:i])
-	}
-	if strings.Contains(desc, " ") {
-		return ""
+	if len(dm.Warnings) > 0 {
+		// Don't cache an incomplete page.
+		uncacheable(w)
+	} else {
+		memcache.Set(ctxt, &memcache.Item{Key: cacheKey, Value: buf.Bytes(), Expiration: pageCacheTime})
+		saveStale(ctxt, d.email, req, buf.Bytes())
 	}
-	return desc
+	w.Write(buf.Bytes())
 }
 
-var okDesc = map[string]bool{
-	"all":   true,
-	"build": true,
+// releaseConfig lists the active release labels, the issue tracker labels
+// marking issues that must be resolved for upcoming releases.
+// It is read from the "dash.release" config (see app.ReadConfig),
+// for example {"Labels": ["Release-Go1.3", "Release-Go1.3Maybe"]}.
+// The first label is the current release.
+type releaseConfig struct {
+	Labels []string
 }
 
-func itemDir(item *Item) string {
-	for _, cl := range item.CLs {
-		dirs := cl.Dirs()
-		desc := descDir(cl.Summary)
+var defaultRelease = releaseConfig{
+	Labels: []string{"Release-Go1.3"},
+}
 
-		// Accept description if it is a global prefix like "all".
-		if okDesc[desc] {
-			return desc
-		}
+// releaseLabels returns the active release labels.
+func releaseLabels(ctxt appengine.Context) []string {
+	// Decode into an empty config, not a copy of defaultRelease:
+	// that would share, and overwrite, the default's Labels array.
+	var c releaseConfig
+	app.ReadConfig(ctxt, "dash.release", &c)
+	if len(c.Labels) == 0 {
+		return append([]string(nil), defaultRelease.Labels...)
+	}
+	return c.Labels
+}
 
-		// Accept description if it matches one of the directories.
-		for _, dir := range dirs {
-			if dir == desc {
-				return dir
-			}
-		}
+// loadGroups loads the active CLs and the open issues with any of the
+// active release labels, joins CLs with the issues they fix, and groups
+// the resulting items by directory. The map is keyed by model.DirKey(dir).
+// If kind is model.IssuesOnly or model.CLsOnly, only issues or CLs are loaded.
+//
+// Restricted issues are always omitted, even for users who may see them
+// (see canSeeRestricted), so loadGroups and loadLabelGroups are only for
+// the API, exports, and other views that never show them. Pages that show
+// restricted issues to the security team must use loadModel, the one path
+// that applies model.UserFilter's ShowRestricted.
+func loadGroups(ctxt appengine.Context, kind model.Kind) (map[string]*model.Group, error) {
+	return publicGroups(strictGroups(loadLabelGroupsPartial(ctxt, releaseLabels(ctxt), kind)))
+}
 
-		// Otherwise use most common directory.
-		if len(dirs) > 0 {
-			return dirs[0]
-		}
+// loadLabelGroups is like loadGroups but loads the open issues
+// with the given labels instead of the active release labels,
+// and always loads both CLs and issues.
+func loadLabelGroups(ctxt appengine.Context, labels ...string) (map[string]*model.Group, error) {
+	return publicGroups(strictGroups(loadLabelGroupsPartial(ctxt, labels, model.AllItems)))
+}
 
-		// Otherwise accept description.
-		return desc
-	}
-	if item.Bug != nil {
-		if dir := descDir(item.Bug.Summary); dir != "" {
-			return dir
-		}
-		return "?"
+// publicGroups removes the restricted issues from groups.
+func publicGroups(groups map[string]*model.Group, err error) (map[string]*model.Group, error) {
+	if err == nil {
+		model.FilterForUser(groups, model.UserFilter{})
 	}
-	return "?"
+	return groups, err
 }
 
-var bugRE = regexp.MustCompile(`Fixes issue (\d+)`)
+// canSeeRestricted reports whether the user making the request
+// may see restricted security issues (see issue.Issue.Restricted).
+// Only HTML pages for the logged-in user show them: the JSON API,
+// exports, and mail never do.
+func canSeeRestricted(ctxt appengine.Context, req *http.Request) bool {
+	return app.RequestRole(ctxt, req) >= app.Security
+}
 
-func clBugs(cl *codereview.CL) []int {
-	var out []int
-	for _, m := range bugRE.FindAllStringSubmatch(cl.Desc, -1) {
-		n, _ := strconv.Atoi(m[1])
-		if n > 0 {
-			out = append(out, n)
-		}
+// strictGroups turns the warnings from loadLabelGroupsPartial into an error.
+func strictGroups(groups map[string]*model.Group, warnings []string, err error) (map[string]*model.Group, error) {
+	if err == nil && len(warnings) > 0 {
+		return nil, fmt.Errorf("%s", warnings[0])
 	}
-	return out
+	return groups, err
 }
 
-func uiOperation(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
-	email := findEmail(ctxt)
-	d := display{email: email}
-	if d.email == "" {
-		w.WriteHeader(501)
-		fmt.Fprintf(w, "must be logged in")
-		return
+// loadLabelGroupsPartial is like loadLabelGroups, but if only the CL
+// or only the issue queries fail, it returns the groups made from
+// the results of the others, along with a warning about the failure.
+// It returns an error only if both fail.
+func loadLabelGroupsPartial(ctxt appengine.Context, labels []string, kind model.Kind) (groups map[string]*model.Group, warnings []string, err error) {
+	items, warns, err := model.LoadActiveItems(ctxt, labels, kind)
+	for _, w := range warns {
+		countError(ctxt, w.Query+" query")
+		warnings = append(warnings, w.Text)
 	}
-	if req.Method != "POST" {
-		w.WriteHeader(501)
-		fmt.Fprintf(w, "must POST")
-		return
-	}
-	// TODO: XSRF protection
-	switch op := req.FormValue("op"); op {
-	default:
-		w.WriteHeader(501)
-		fmt.Fprintf(w, "invalid verb")
-		return
-	case "mute", "unmute":
-		targ := req.FormValue("dir")
-		if targ == "" {
-			w.WriteHeader(501)
-			fmt.Fprintf(w, "missing dir")
-			return
-		}
-		err := app.Transaction(ctxt, func(ctxt appengine.Context) error {
-			var pref UserPref
-			app.ReadData(ctxt, "UserPref", d.email, &pref)
-			for i, dir := range pref.Muted {
-				if dir == targ {
-					if op == "unmute" {
-						pref.Muted = append(pref.Muted[:i], pref.Muted[i+1:]...)
-						break
-					}
-					return nil
-				}
-			}
-			if op == "mute" {
-				pref.Muted = append(pref.Muted, targ)
-				sort.Strings(pref.Muted)
-			}
-			return app.WriteData(ctxt, "UserPref", d.email, &pref)
-		})
-		if err != nil {
-			w.WriteHeader(501)
-			fmt.Fprintf(w, "unable to update")
-			return
-		}
-
-	case "reviewer":
-		clnum := req.FormValue("cl")
-		who := req.FormValue("reviewer")
-		switch who {
-		case "close", "golang-dev":
-			// ok
-		default:
-			who = codereview.ExpandReviewer(who)
-		}
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		if who == "" {
-			fmt.Fprintf(w, "ERROR: unknown reviewer")
-			return
-		}
-		if err := codereview.SetReviewer(ctxt, clnum, who); err != nil {
-			fmt.Fprintf(w, "ERROR: setting reviewer: %v", err)
-			return
-		}
-		var cl codereview.CL
-		if err := app.ReadData(ctxt, "CL", clnum, &cl); err != nil {
-			fmt.Fprintf(w, "ERROR: refreshing CL: %v", err)
-			return
-		}
-		fmt.Fprintf(w, "%s", d.short(d.reviewer(&cl)))
-		return
+	if err != nil {
+		return nil, nil, err
 	}
+	markOverdue(ctxt, items)
+	return model.GroupBy(items, model.ItemDir), warnings, nil
 }
@@ -0,0 +1,87 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"html"
+	"net/http"
+	"time"
+
+	"app"
+
+	"appengine"
+	"appengine/memcache"
+)
+
+// When the datastore is having trouble, the dashboard pages show
+// whatever they can load, with a warning, instead of failing outright.
+// If nothing can be loaded, they fall back to the last good copy of the page,
+// which is kept in memcache for staleCacheTime.
+
+// staleCacheTime is how long the last good copy of a page is kept.
+const staleCacheTime = 24 * time.Hour
+
+// errorCounters are the names of the error counts shown on the status page.
+var errorCounters = []string{"cl query", "issue query", "stale page", "no page"}
+
+func init() {
+	app.RegisterStatus("dash errors", errorStatus)
+}
+
+// countError increments the error counter with the given name.
+func countError(ctxt appengine.Context, name string) {
+	memcache.Increment(ctxt, "dash.errors."+name, 1, 0)
+}
+
+func errorStatus(ctxt appengine.Context) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<pre>\n")
+	for _, name := range errorCounters {
+		n, _ := memcache.Increment(ctxt, "dash.errors."+name, 0, 0)
+		fmt.Fprintf(&buf, "%s: %d\n", html.EscapeString(name), n)
+	}
+	fmt.Fprintf(&buf, "</pre>\n")
+	return buf.String()
+}
+
+// staleKey returns the memcache key for the last good copy of a page.
+// Unlike pageCacheKey, it does not depend on the page or data version.
+func staleKey(email, path, query string) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\x00%s?%s", email, path, query)
+	return fmt.Sprintf("dash.stale.%x", h.Sum(nil))
+}
+
+// saveStale saves page as the last good copy of the page.
+func saveStale(ctxt appengine.Context, email string, req *http.Request, page []byte) {
+	memcache.Set(ctxt, &memcache.Item{Key: staleKey(email, req.URL.Path, req.URL.RawQuery), Value: page, Expiration: staleCacheTime})
+}
+
+// serveStale serves the last good copy of the page, with a warning
+// that it is out of date. It reports whether there was a copy to serve.
+func serveStale(ctxt appengine.Context, w http.ResponseWriter, req *http.Request, email string, loadErr error) bool {
+	it, err := memcache.Get(ctxt, staleKey(email, req.URL.Path, req.URL.RawQuery))
+	if err != nil {
+		countError(ctxt, "no page")
+		return false
+	}
+	countError(ctxt, "stale page")
+	uncacheable(w)
+	banner := fmt.Sprintf("<body>\n<div class=\"warning\">%s; showing an older copy of this page</div>\n", html.EscapeString(loadErr.Error()))
+	w.Write(bytes.Replace(it.Value, []byte("<body>"), []byte(banner), 1))
+	return true
+}
+
+// uncacheable marks the response as not to be cached by the client,
+// undoing notModified, for pages showing incomplete or stale data.
+func uncacheable(w http.ResponseWriter) {
+	h := w.Header()
+	h.Del("ETag")
+	h.Del("Last-Modified")
+	h.Set("Cache-Control", "private, no-cache")
+}
@@ -0,0 +1,87 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"dash/model"
+)
+
+// exportHeader is the first line of a CSV or TSV export.
+var exportHeader = []string{"dir", "type", "id", "summary", "owner", "reviewer", "age", "state"}
+
+// exportFormat returns the field separator for the export format
+// named by the request's format= parameter, or 0 if the request
+// is not for an export.
+func exportFormat(req *http.Request) rune {
+	switch req.FormValue("format") {
+	case "csv":
+		return ','
+	case "tsv":
+		return '\t'
+	}
+	return 0
+}
+
+// writeExport writes the items in groups to w as CSV (or TSV, if sep is a tab),
+// one line per issue or CL. The dir column is the group name.
+// The owner of an issue is the person it is assigned to; issues have no reviewer.
+func writeExport(w http.ResponseWriter, sep rune, groups []*model.Group) {
+	name, ctype := "dash.csv", "text/csv"
+	if sep == '\t' {
+		name, ctype = "dash.tsv", "text/tab-separated-values"
+	}
+	w.Header().Set("Content-Type", ctype+"; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename="+name)
+
+	cw := csv.NewWriter(w)
+	cw.Comma = sep
+	cw.Write(exportHeader)
+	for _, g := range groups {
+		for _, item := range g.Items {
+			if bug := item.Bug; bug != nil {
+				cw.Write([]string{g.Dir, "issue", fmt.Sprint(bug.ID), bug.Summary, bug.Owner, "", exportAge(bug.Modified), bug.Status})
+			}
+			for _, cl := range item.CLs {
+				state := "waiting for author"
+				if cl.NeedsReview {
+					state = "waiting for reviewer"
+				}
+				cw.Write([]string{g.Dir, "cl", cl.CL, cl.Summary, cl.OwnerEmail, cl.PrimaryReviewer, exportAge(cl.Modified), state})
+			}
+		}
+	}
+	cw.Flush()
+}
+
+// exportAge returns the time since t in days, as the dashboard displays it.
+func exportAge(t time.Time) string {
+	return fmt.Sprintf("%.1f", float64(time.Since(t))/float64(24*time.Hour))
+}
+
+// sortedGroups returns the groups in the order the dashboard shows them.
+func sortedGroups(groups map[string]*model.Group) []*model.Group {
+	var list []*model.Group
+	for _, g := range groups {
+		list = append(list, g)
+	}
+	sort.Sort(groupsByDir(list))
+	return list
+}
+
+// itemGroups returns a list of single-item groups, one for each item,
+// named by the item's directory.
+func itemGroups(items []*model.Item) []*model.Group {
+	var list []*model.Group
+	for _, item := range items {
+		list = append(list, &model.Group{Dir: model.ItemDir(item), Items: []*model.Item{item}})
+	}
+	return list
+}
@@ -0,0 +1,61 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"encoding/csv"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"codereview"
+	"dash/model"
+	"issue"
+)
+
+func TestWriteExport(t *testing.T) {
+	now := time.Now()
+	bug := &issue.Issue{
+		ID:       100,
+		Summary:  "net/http: Transport leaks connections",
+		Status:   "Accepted",
+		Owner:    "owner@golang.org",
+		Modified: now,
+		Comment:  []issue.Comment{{Author: "reporter@example.com"}},
+	}
+	cl := &codereview.CL{
+		CL:              "1001",
+		Summary:         "net/http: close idle connections",
+		OwnerEmail:      "author@example.com",
+		PrimaryReviewer: "reviewer@golang.org",
+		NeedsReview:     true,
+		Modified:        now,
+	}
+	groups := []*model.Group{{Dir: "net/http", Items: []*model.Item{{Bug: bug, CLs: []*codereview.CL{cl}}}}}
+
+	w := httptest.NewRecorder()
+	writeExport(w, ',', groups)
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []map[string]string{
+		{"dir": "net/http", "type": "issue", "id": "100", "summary": bug.Summary, "owner": "owner@golang.org", "reviewer": "", "age": "0.0", "state": "Accepted"},
+		{"dir": "net/http", "type": "cl", "id": "1001", "summary": cl.Summary, "owner": "author@example.com", "reviewer": "reviewer@golang.org", "age": "0.0", "state": "waiting for reviewer"},
+	}
+	if len(rows) != 1+len(want) || !reflect.DeepEqual(rows[0], exportHeader) {
+		t.Fatalf("export = %q, want header and %d rows", rows, len(want))
+	}
+	for i, row := range rows[1:] {
+		got := make(map[string]string)
+		for j, col := range exportHeader {
+			got[col] = row[j]
+		}
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("row %d = %v, want %v", i+1, got, want[i])
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"fmt"
+	"sort"
+
+	"codereview"
+	"commit"
+	"dash/model"
+)
+
+// groupings lists the groupings offered by the groupby= parameter.
+// The dashboard groups by directory by default.
+var groupings = map[string]model.Grouping{
+	"dir":      model.ItemDir,
+	"reviewer": itemReviewer,
+	"owner":    itemOwner,
+	"size":     itemSize,
+	"repo":     itemRepo,
+}
+
+// groupingFor returns the grouping with the given name.
+// The empty name means the default grouping, by directory.
+// Grouping issues by CL size is meaningless, so groupingFor rejects
+// the size grouping when kind is model.IssuesOnly.
+func groupingFor(name string, kind model.Kind) (model.Grouping, error) {
+	if name == "" {
+		name = "dir"
+	}
+	if name == "size" && kind == model.IssuesOnly {
+		return nil, fmt.Errorf("cannot group issues by size")
+	}
+	g := groupings[name]
+	if g == nil {
+		return nil, fmt.Errorf("unknown groupby %q", name)
+	}
+	return g, nil
+}
+
+// itemReviewer groups by the primary reviewer of the item's first CL,
+// or by the issue owner for items without CLs.
+func itemReviewer(item *model.Item) string {
+	for _, cl := range item.CLs {
+		if cl.PrimaryReviewer == "" {
+			return "golang-dev"
+		}
+		return cl.PrimaryReviewer
+	}
+	return itemIssueOwner(item)
+}
+
+// itemOwner groups by the owner of the item's first CL,
+// or by the issue owner for items without CLs.
+func itemOwner(item *model.Item) string {
+	for _, cl := range item.CLs {
+		return cl.OwnerEmail
+	}
+	return itemIssueOwner(item)
+}
+
+func itemIssueOwner(item *model.Item) string {
+	if item.Bug != nil && item.Bug.Owner != "" {
+		return item.Bug.Owner
+	}
+	return "unassigned"
+}
+
+// itemSize groups by the size class of the item's largest CL.
+func itemSize(item *model.Item) string {
+	var max *codereview.CL
+	for _, cl := range item.CLs {
+		if max == nil || cl.Delta > max.Delta {
+			max = cl
+		}
+	}
+	if max == nil {
+		return "no CL"
+	}
+	return sizeClass(max.Delta)
+}
+
+// itemRepo groups by the repository of the item's first CL.
+// Issues without CLs are assumed to be in the main repository.
+func itemRepo(item *model.Item) string {
+	for _, cl := range item.CLs {
+		if cl.Repo != "" {
+			return cl.Repo
+		}
+	}
+	return "go"
+}
+
+// groupRepos returns the repositories to offer in the dashboard's
+// repository selector: those with items in groups, along with those
+// whose commits are loaded.
+func groupRepos(groups map[string]*model.Group) []string {
+	seen := make(map[string]bool)
+	var repos []string
+	add := func(repo string) {
+		if !seen[repo] {
+			seen[repo] = true
+			repos = append(repos, repo)
+		}
+	}
+	for _, repo := range commit.Repos() {
+		add(repo)
+	}
+	for _, g := range groups {
+		for _, item := range g.Items {
+			add(itemRepo(item))
+		}
+	}
+	sort.Strings(repos)
+	return repos
+}
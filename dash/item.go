@@ -0,0 +1,225 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"app"
+	"codereview"
+	"commit"
+	"issue"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+)
+
+func init() {
+	app.Handle("/item/", showItem)
+}
+
+// An Event is a single entry in an item's timeline.
+type Event struct {
+	Time time.Time
+	Kind string // "created", "message", "comment", "cl", "commit", "build", "escalated"
+	Who  string
+	Text string
+	URL  string
+	OK   bool // for builds
+}
+
+type eventsByTime []*Event
+
+func (x eventsByTime) Len() int           { return len(x) }
+func (x eventsByTime) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+func (x eventsByTime) Less(i, j int) bool { return x[i].Time.Before(x[j].Time) }
+
+var (
+	submittedRE = regexp.MustCompile(`\*\*\* Submitted as \S*[?&]r=([0-9a-f]+)`)
+	revisionRE  = regexp.MustCompile(`(?i)\bclosed by revision ([0-9a-f]{12,40})\b`)
+)
+
+// clEvents returns the timeline events for the CL:
+// its creation, messages, build results, reviewer escalations,
+// and the commit it was submitted as.
+func clEvents(ctxt appengine.Context, cl *codereview.CL) []*Event {
+	url := "https://codereview.appspot.com/" + cl.CL
+	events := []*Event{{Time: cl.Created, Kind: "created", Who: cl.OwnerEmail, Text: cl.Summary, URL: url}}
+	var hashes []string
+	for _, m := range cl.Messages {
+		events = append(events, &Event{Time: m.Time, Kind: "message", Who: m.Sender, Text: m.Text, URL: url})
+		for _, x := range submittedRE.FindAllStringSubmatch(m.Text, -1) {
+			hashes = append(hashes, x[1])
+		}
+	}
+	for _, r := range cl.BuildResults {
+		events = append(events, &Event{Time: r.Time, Kind: "build", Who: r.Builder, Text: "patch set " + r.PatchSet, URL: r.URL, OK: r.OK})
+	}
+	events = append(events, escalationEvents(ctxt, cl)...)
+	return append(events, commitEvents(ctxt, hashes)...)
+}
+
+// issueEvents returns the timeline events for the issue:
+// its comments, the CLs mentioning it, and the commits that closed it.
+func issueEvents(ctxt appengine.Context, bug *issue.Issue) []*Event {
+	url := fmt.Sprintf("https://code.google.com/p/go/issues/detail?id=%d", bug.ID)
+	var events []*Event
+	var hashes []string
+	for i, c := range bug.Comment {
+		kind := "comment"
+		if i == 0 {
+			kind = "created"
+		}
+		text := c.Text
+		var changes []string
+		for _, x := range []struct{ name, val string }{{"status", c.Status}, {"owner", c.Owner}, {"cc", c.CC}, {"labels", c.Label}} {
+			if x.val != "" {
+				changes = append(changes, x.name+": "+x.val)
+			}
+		}
+		if len(changes) > 0 {
+			text = "[" + strings.Join(changes, "; ") + "]\n" + text
+		}
+		events = append(events, &Event{Time: c.Time, Kind: kind, Who: c.Author, Text: text, URL: url})
+		for _, x := range revisionRE.FindAllStringSubmatch(c.Text, -1) {
+			hashes = append(hashes, x[1])
+		}
+	}
+
+	var cls []*codereview.CL
+	_, err := datastore.NewQuery("CL").
+		Filter("DescIssue =", strconv.Itoa(bug.ID)).
+		Limit(100).
+		GetAll(ctxt, &cls)
+	if err != nil {
+		ctxt.Errorf("loading CLs for issue %d: %v", bug.ID, err)
+	}
+	for _, cl := range cls {
+		events = append(events, &Event{Time: cl.Created, Kind: "cl", Who: cl.OwnerEmail, Text: "CL " + cl.CL + ": " + cl.Summary, URL: "/item/cl/" + cl.CL})
+	}
+	return append(events, commitEvents(ctxt, hashes)...)
+}
+
+// commitEvents returns timeline events for the commits with the given hashes,
+// which may be abbreviated as in codereview and issue tracker messages.
+func commitEvents(ctxt appengine.Context, hashes []string) []*Event {
+	var events []*Event
+	seen := make(map[string]bool)
+	for _, h := range hashes {
+		if len(h) > 12 {
+			h = h[:12]
+		}
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+		var revs []*commit.Rev
+		_, err := datastore.NewQuery("Rev").
+			Filter("ShortHash =", h).
+			Limit(1).
+			GetAll(ctxt, &revs)
+		if err != nil {
+			ctxt.Errorf("loading commit %s: %v", h, err)
+			continue
+		}
+		for _, rev := range revs {
+			text := rev.Log
+			if i := strings.Index(text, "\n"); i >= 0 {
+				text = text[:i]
+			}
+			events = append(events, &Event{
+				Time: rev.Time,
+				Kind: "commit",
+				Who:  rev.AuthorEmail,
+				Text: rev.ShortHash + " " + text,
+				URL:  "https://code.google.com/p/go/source/detail?r=" + rev.ShortHash,
+			})
+		}
+	}
+	return events
+}
+
+// showItem serves /item/cl/<n> and /item/issue/<n>, which show
+// everything the dashboard knows about a CL or issue as a single timeline.
+func showItem(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	var d display
+	d.email = findEmail(ctxt)
+
+	cacheKey := pageCacheKey(ctxt, d.email, req.URL.Path, "")
+	if it, err := memcache.Get(ctxt, cacheKey); err == nil {
+		w.Write(it.Value)
+		return
+	}
+
+	var data struct {
+		User   string
+		Title  string
+		URL    string
+		CL     *codereview.CL
+		Issue  *issue.Issue
+		Events []*Event
+	}
+	data.User = d.email
+
+	f := strings.Split(strings.TrimPrefix(req.URL.Path, "/item/"), "/")
+	if len(f) != 2 {
+		http.NotFound(w, req)
+		return
+	}
+	n, err := strconv.Atoi(f[1])
+	if err != nil || n <= 0 {
+		http.NotFound(w, req)
+		return
+	}
+	key := strconv.Itoa(n)
+	switch f[0] {
+	case "cl":
+		var cl codereview.CL
+		if err := app.ReadData(ctxt, "CL", key, &cl); err != nil {
+			http.NotFound(w, req)
+			return
+		}
+		data.CL = &cl
+		data.Title = fmt.Sprintf("CL %s: %s", cl.CL, cl.Summary)
+		data.URL = "https://codereview.appspot.com/" + cl.CL
+		data.Events = clEvents(ctxt, &cl)
+	case "issue":
+		var bug issue.Issue
+		if err := app.ReadData(ctxt, "Issue", key, &bug); err != nil || bug.Restricted && !canSeeRestricted(ctxt, req) {
+			http.NotFound(w, req)
+			return
+		}
+		data.Issue = &bug
+		data.Title = fmt.Sprintf("issue %d: %s", bug.ID, bug.Summary)
+		data.URL = fmt.Sprintf("https://code.google.com/p/go/issues/detail?id=%d", bug.ID)
+		data.Events = issueEvents(ctxt, &bug)
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	sort.Stable(eventsByTime(data.Events))
+
+	t, err := loadTemplate(ctxt, "item.html", &d)
+	if err != nil {
+		fmt.Fprintf(w, "error loading template\n")
+		return
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		ctxt.Errorf("execute: %v", err)
+		fmt.Fprintf(w, "error executing template\n")
+		return
+	}
+	memcache.Set(ctxt, &memcache.Item{Key: cacheKey, Value: buf.Bytes(), Expiration: pageCacheTime})
+	w.Write(buf.Bytes())
+}
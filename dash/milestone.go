@@ -0,0 +1,157 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"app"
+	"issue"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+func init() {
+	app.Handle("/api/milestone/", apiMilestoneChanges)
+	app.RegisterAPI("/api/milestone/", "/api/milestone/<label>/changes: issues that gained or lost the label between since= and until= (RFC 3339).",
+		[]string{"since", "until"}, (*milestoneChanges)(nil))
+}
+
+var milestonePathRE = regexp.MustCompile(`^/api/milestone/([^/]+)/changes$`)
+
+// maxMilestoneIssues limits the number of modified issues
+// apiMilestoneChanges examines. If there are more, the result
+// sets More, and the client should ask for a shorter window.
+const maxMilestoneIssues = 2000
+
+// A milestoneChange records an issue gaining or losing a label.
+type milestoneChange struct {
+	ID      int
+	Summary string
+	Time    time.Time
+	Who     string
+	Change  string // "added" or "removed"
+	Open    bool   // whether the issue is open now
+}
+
+// milestoneChanges is the result of apiMilestoneChanges.
+type milestoneChanges struct {
+	Label   string
+	Since   time.Time
+	Until   time.Time
+	More    bool // too many modified issues; ask for a shorter window
+	Changes []*milestoneChange
+}
+
+type changesByTime []*milestoneChange
+
+func (x changesByTime) Len() int           { return len(x) }
+func (x changesByTime) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+func (x changesByTime) Less(i, j int) bool { return x[i].Time.Before(x[j].Time) }
+
+// apiMilestoneChanges serves /api/milestone/<label>/changes, the issues
+// that gained or lost the label between the RFC 3339 times given by
+// the since= and optional until= parameters, oldest change first.
+// The tracker records label changes in the comments that made them;
+// an issue created with the label has no such comment, so it is
+// reported as added by its reporter when it was created.
+func apiMilestoneChanges(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	m := milestonePathRE.FindStringSubmatch(req.URL.Path)
+	if m == nil {
+		http.NotFound(w, req)
+		return
+	}
+	label := m[1]
+
+	since, err := time.Parse(time.RFC3339, req.FormValue("since"))
+	if err != nil {
+		http.Error(w, "missing or invalid since= (want RFC 3339 time)", 400)
+		return
+	}
+	until := time.Now()
+	if s := req.FormValue("until"); s != "" {
+		until, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			http.Error(w, "invalid until= (want RFC 3339 time)", 400)
+			return
+		}
+	}
+	in := func(t time.Time) bool {
+		return !t.Before(since) && t.Before(until)
+	}
+
+	var bugs []*issue.Issue
+	_, err = datastore.NewQuery("Issue").
+		Filter("Modified >=", since).
+		Limit(maxMilestoneIssues+1).
+		GetAll(ctxt, &bugs)
+	if err != nil {
+		ctxt.Errorf("loading issues: %v", err)
+		http.Error(w, "loading issues failed", 500)
+		return
+	}
+
+	out := milestoneChanges{
+		Label:   label,
+		Since:   since.UTC(),
+		Until:   until.UTC(),
+		Changes: []*milestoneChange{},
+	}
+	if len(bugs) > maxMilestoneIssues {
+		out.More = true
+		bugs = bugs[:maxMilestoneIssues]
+	}
+
+	for _, bug := range bugs {
+		if bug.Restricted {
+			continue
+		}
+		change := func(t time.Time, who, what string) {
+			out.Changes = append(out.Changes, &milestoneChange{
+				ID:      bug.ID,
+				Summary: bug.Summary,
+				Time:    t.UTC(),
+				Who:     who,
+				Change:  what,
+				Open:    bug.State != "closed",
+			})
+		}
+		mentioned := false
+		for _, c := range bug.Comment {
+			for _, l := range strings.Split(c.Label, ",") {
+				l = strings.TrimSpace(l)
+				what := "added"
+				if strings.HasPrefix(l, "-") {
+					what, l = "removed", l[1:]
+				}
+				if l != label {
+					continue
+				}
+				mentioned = true
+				if in(c.Time) {
+					change(c.Time, c.Author, what)
+				}
+			}
+		}
+		if !mentioned && in(bug.Created) && hasAnyLabel(bug, []string{label}) && len(bug.Comment) > 0 {
+			change(bug.Created, bug.Comment[0].Author, "added")
+		}
+	}
+	sort.Stable(changesByTime(out.Changes))
+
+	js, err := json.Marshal(&out)
+	if err != nil {
+		ctxt.Errorf("encoding milestone changes JSON: %v", err)
+		http.Error(w, "error encoding JSON", 500)
+		return
+	}
+	writeJSON(w, js)
+}
@@ -0,0 +1,239 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"app"
+	"codereview"
+	"dash/model"
+	"identity"
+
+	"appengine"
+	"appengine/memcache"
+	"appengine/user"
+)
+
+func init() {
+	app.Handle("/mine", showMine)
+	app.Handle("/api/mine", apiMine)
+	app.RegisterAPI("/api/mine", "The logged-in user's work list, or, for triagers, user='s.", []string{"user"}, (*Work)(nil))
+}
+
+// A Work is the list of items involving a single user,
+// split into those waiting on the user and those waiting on others.
+type Work struct {
+	NeedsAction []*model.Item
+	Waiting     []*model.Item
+	Added       []string `json:",omitempty"` // CLs the user was recently added to
+	Warnings    []string `json:",omitempty"` // problems loading the dashboard
+}
+
+// myWork returns the items in groups involving the user with the given email:
+// issues the user owns or is CC'd on, and CLs the user owns, is the primary
+// reviewer of, or has been asked to review but has not yet LGTMed.
+// Unassigned CLs in directories the user owns are also included.
+func myWork(groups map[string]*model.Group, owners codereview.Owners, email string) *Work {
+	w := new(Work)
+	for _, g := range groups {
+		for _, item := range g.Items {
+			involved, action := itemWork(item, owners, email)
+			switch {
+			case action:
+				w.NeedsAction = append(w.NeedsAction, item)
+			case involved:
+				w.Waiting = append(w.Waiting, item)
+			}
+		}
+	}
+	model.SortBySummary(w.NeedsAction)
+	model.SortBySummary(w.Waiting)
+	return w
+}
+
+// itemWork reports whether item involves the user with the given email,
+// and if so, whether it is waiting on that user.
+func itemWork(item *model.Item, owners codereview.Owners, email string) (involved, action bool) {
+	dir := identity.Current()
+	if bug := item.Bug; bug != nil && matchUser(bug.Owner, email) {
+		involved, action = true, true
+	}
+	if bug := item.Bug; bug != nil && !involved {
+		for _, cc := range bug.CC {
+			if matchUser(email, cc) {
+				// Following the issue, but not responsible for it.
+				involved = true
+				break
+			}
+		}
+	}
+	for _, cl := range item.CLs {
+		pending := contains(dir, cl.Reviewers, email) && !contains(dir, cl.LGTM, email)
+		if cl.PrimaryReviewer == "" && contains(dir, owners.SuggestReviewers(cl), email) {
+			// Unassigned CL in a directory the user owns.
+			pending = true
+		}
+		if !dir.Same(cl.OwnerEmail, email) && !dir.Same(cl.PrimaryReviewer, email) && !pending {
+			continue
+		}
+		involved = true
+		switch who := cl.WaitingOn(); {
+		case dir.Same(who, email):
+			action = true
+		case who == "" && pending:
+			// Unassigned CL that the user has been asked to look at.
+			action = true
+		}
+	}
+	return
+}
+
+// contains reports whether list contains an address of the user with address s.
+func contains(dir *identity.Directory, list []string, s string) bool {
+	for _, x := range list {
+		if dir.Same(x, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadWork loads the dashboard items involving the logged-in user,
+// omitting any the user has muted or snoozed.
+func loadWork(ctxt appengine.Context, d *display) (*Work, error) {
+	d.loadPref(ctxt)
+	dm, err := loadModel(ctxt, d, model.AllItems)
+	if err != nil {
+		return nil, err
+	}
+	work := dm.work(d)
+	work.Warnings = dm.Warnings
+	d.loadAdded(ctxt)
+	d.loadWatched(ctxt)
+	d.loadNewcomers(ctxt)
+	work.Added = d.addedCLs()
+	return work, nil
+}
+
+func showMine(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	var d display
+	d.email = findEmail(ctxt)
+	if d.email == "" {
+		url, err := user.LoginURL(ctxt, "/mine")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		http.Redirect(w, req, url, 302)
+		return
+	}
+
+	cacheKey := pageCacheKey(ctxt, d.email, req.URL.Path, "")
+	if exportFormat(req) == 0 {
+		if it, err := memcache.Get(ctxt, cacheKey); err == nil {
+			w.Write(it.Value)
+			return
+		}
+		d.security = canSeeRestricted(ctxt, req)
+	}
+
+	work, err := loadWork(ctxt, &d)
+	if err != nil {
+		if !serveStale(ctxt, w, req, d.email, err) {
+			fmt.Fprintf(w, "%v\n", err)
+		}
+		return
+	}
+
+	if sep := exportFormat(req); sep != 0 {
+		writeExport(w, sep, append(itemGroups(work.NeedsAction), itemGroups(work.Waiting)...))
+		return
+	}
+
+	t, err := loadTemplate(ctxt, "mine.html", &d)
+	if err != nil {
+		fmt.Fprintf(w, "error loading template\n")
+		return
+	}
+
+	data := struct {
+		User    string
+		XSRF    string
+		Summary bool
+		*Work
+	}{
+		d.email,
+		app.XSRFToken(ctxt, d.email, "uiop"),
+		d.pref.Summary,
+		work,
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		ctxt.Errorf("execute: %v", err)
+		fmt.Fprintf(w, "error executing template\n")
+		return
+	}
+	if len(work.Warnings) == 0 {
+		memcache.Set(ctxt, &memcache.Item{Key: cacheKey, Value: buf.Bytes(), Expiration: pageCacheTime})
+		saveStale(ctxt, d.email, req, buf.Bytes())
+	}
+	w.Write(buf.Bytes())
+}
+
+// apiMine serves the logged-in user's work list as JSON.
+// The user= parameter selects a different user, given as a full email address.
+// Since the list is filtered through that user's mutes and snoozes,
+// only triagers and above may ask for someone else's.
+// As in /api/dash, times are RFC 3339 timestamps in UTC.
+func apiMine(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	var d display
+	email, byToken := requestEmail(ctxt, req)
+	if email == "" {
+		http.Error(w, "must be logged in", 403)
+		return
+	}
+	d.email = email
+	if who := req.FormValue("user"); who != "" {
+		ids := identity.Load(ctxt)
+		d.email = ids.Canonical(who)
+		if d.email != ids.Canonical(email) && userRole(ctxt, req, email, byToken) < app.Triager {
+			http.Error(w, "only triagers may see another user's work", 403)
+			return
+		}
+	}
+
+	cacheKey := fmt.Sprintf("dash.api.mine.%d.%q", pageVersion(ctxt), d.email)
+	if it, err := memcache.Get(ctxt, cacheKey); err == nil {
+		writeJSON(w, it.Value)
+		return
+	}
+
+	work, err := loadWork(ctxt, &d)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	for _, list := range []*[]*model.Item{&work.NeedsAction, &work.Waiting} {
+		for i, item := range *list {
+			(*list)[i] = apiItem(item)
+		}
+	}
+
+	js, err := json.Marshal(work)
+	if err != nil {
+		ctxt.Errorf("encoding mine JSON: %v", err)
+		http.Error(w, "error encoding JSON", 500)
+		return
+	}
+	if len(work.Warnings) == 0 {
+		memcache.Set(ctxt, &memcache.Item{Key: cacheKey, Value: js, Expiration: apiCacheTime})
+	}
+	writeJSON(w, js)
+}
@@ -0,0 +1,194 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"app"
+	"dash/model"
+
+	"appengine"
+	"appengine/memcache"
+	"appengine/user"
+)
+
+// Mobile view.
+//
+// /m is a lightweight page for phones, meant for checking during a standup
+// what needs attention: the logged-in user's top actionable items, most
+// urgent first, one line each, with no grouping, scripts, or controls.
+// /api/m serves the same payload as JSON. Both are computed from the same
+// work list as /mine but cached longer, since a few minutes of staleness
+// does not matter for a glance at a phone; changes made through the
+// dashboard still invalidate them by bumping the page version.
+
+func init() {
+	app.Handle("/m", showMobile)
+	app.Handle("/api/m", apiMobile)
+	app.RegisterAPI("/api/m", "The logged-in user's top n= actionable items, most urgent first.", []string{"n"}, (*mobileWork)(nil))
+}
+
+const (
+	mobileItems     = 10 // default number of items
+	maxMobileItems  = 50
+	mobileCacheTime = 5 * time.Minute
+)
+
+// A mobileItem is a one-line summary of an item needing the user's action.
+type mobileItem struct {
+	Kind     string // "issue" or "cl"
+	ID       string
+	Summary  string
+	Modified time.Time // most recent change to the issue or any of its CLs
+	Priority int       // see model.Priority
+	Overdue  bool
+	Urgent   string // see model.Urgent
+}
+
+// A mobileWork is the payload of /m and /api/m.
+type mobileWork struct {
+	User     string
+	Items    []*mobileItem
+	More     int      // number of further actionable items not listed
+	Warnings []string `json:",omitempty"` // problems loading the dashboard
+}
+
+// mobileCount returns the number of items requested by req's n= parameter.
+func mobileCount(req *http.Request) int {
+	n, err := strconv.Atoi(req.FormValue("n"))
+	if err != nil || n <= 0 {
+		return mobileItems
+	}
+	if n > maxMobileItems {
+		n = maxMobileItems
+	}
+	return n
+}
+
+// loadMobile returns the top n items waiting on the logged-in user.
+func loadMobile(ctxt appengine.Context, d *display, n int) (*mobileWork, error) {
+	work, err := loadWork(ctxt, d)
+	if err != nil {
+		return nil, err
+	}
+	model.SortByPriority(work.NeedsAction)
+	m := &mobileWork{User: d.email, Items: []*mobileItem{}, Warnings: work.Warnings}
+	for i, item := range work.NeedsAction {
+		if i >= n {
+			m.More = len(work.NeedsAction) - n
+			break
+		}
+		m.Items = append(m.Items, newMobileItem(item))
+	}
+	return m, nil
+}
+
+func newMobileItem(item *model.Item) *mobileItem {
+	mi := &mobileItem{Priority: model.Priority(item), Overdue: item.Overdue, Urgent: model.Urgent(item)}
+	if bug := item.Bug; bug != nil {
+		mi.Kind, mi.ID, mi.Summary, mi.Modified = "issue", fmt.Sprint(bug.ID), bug.Summary, bug.Modified
+	}
+	for _, cl := range item.CLs {
+		if mi.Kind == "" {
+			mi.Kind, mi.ID, mi.Summary = "cl", cl.CL, cl.Summary
+		}
+		if mi.Modified.Before(cl.Modified) {
+			mi.Modified = cl.Modified
+		}
+	}
+	mi.Modified = mi.Modified.UTC()
+	return mi
+}
+
+func mobileCacheKey(ctxt appengine.Context, kind, email string, n int) string {
+	return fmt.Sprintf("dash.mobile.%s.%d.%d.%q.%d", kind, pageVersion(ctxt), app.DataVersion(ctxt), email, n)
+}
+
+func showMobile(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	var d display
+	d.email = findEmail(ctxt)
+	if d.email == "" {
+		url, err := user.LoginURL(ctxt, "/m")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		http.Redirect(w, req, url, 302)
+		return
+	}
+
+	n := mobileCount(req)
+	cacheKey := mobileCacheKey(ctxt, "page", d.email, n)
+	if it, err := memcache.Get(ctxt, cacheKey); err == nil {
+		w.Write(it.Value)
+		return
+	}
+
+	d.security = canSeeRestricted(ctxt, req)
+	m, err := loadMobile(ctxt, &d, n)
+	if err != nil {
+		if !serveStale(ctxt, w, req, d.email, err) {
+			fmt.Fprintf(w, "%v\n", err)
+		}
+		return
+	}
+
+	t, err := loadTemplate(ctxt, "m.html", &d)
+	if err != nil {
+		fmt.Fprintf(w, "error loading template\n")
+		return
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, m); err != nil {
+		ctxt.Errorf("execute: %v", err)
+		fmt.Fprintf(w, "error executing template\n")
+		return
+	}
+	if len(m.Warnings) == 0 {
+		memcache.Set(ctxt, &memcache.Item{Key: cacheKey, Value: buf.Bytes(), Expiration: mobileCacheTime})
+		saveStale(ctxt, d.email, req, buf.Bytes())
+	}
+	w.Write(buf.Bytes())
+}
+
+// apiMobile serves the payload of /m as JSON.
+// Times are RFC 3339 timestamps in UTC.
+func apiMobile(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	var d display
+	d.email, _ = requestEmail(ctxt, req)
+	if d.email == "" {
+		http.Error(w, "not logged in", 403)
+		return
+	}
+
+	n := mobileCount(req)
+	cacheKey := mobileCacheKey(ctxt, "api", d.email, n)
+	if it, err := memcache.Get(ctxt, cacheKey); err == nil {
+		writeJSON(w, it.Value)
+		return
+	}
+
+	m, err := loadMobile(ctxt, &d, n)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	js, err := json.Marshal(m)
+	if err != nil {
+		ctxt.Errorf("encoding mobile JSON: %v", err)
+		http.Error(w, "error encoding JSON", 500)
+		return
+	}
+	if len(m.Warnings) == 0 {
+		memcache.Set(ctxt, &memcache.Item{Key: cacheKey, Value: js, Expiration: mobileCacheTime})
+	}
+	writeJSON(w, js)
+}
@@ -0,0 +1,76 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"time"
+
+	"app"
+	"codereview"
+	"dash/model"
+
+	"appengine"
+)
+
+// A dashModel is the dashboard as seen by one user: the dashboard items
+// grouped by directory, without the CLs and issues the user has muted or snoozed.
+// It is shared by the HTML and JSON views and by the summary mail.
+type dashModel struct {
+	Groups   map[string]*model.Group
+	Warnings []string // problems loading the groups (see loadLabelGroupsPartial)
+}
+
+// loadPref loads the preferences of the user d.email, if any, into d.pref.
+func (d *display) loadPref(ctxt appengine.Context) {
+	if d.email != "" {
+		app.ReadData(ctxt, "UserPref", d.email, &d.pref)
+	}
+}
+
+// loadModel loads the dashboard for the user d.email, who may be empty
+// for an anonymous view, using the preferences already loaded into d.pref
+// (see loadPref) and the model cache (see warm.go).
+// It also loads the directory owners into d.owners.
+// The kind selects whether to load issues, CLs, or both.
+// If only some of the dashboard could be loaded, loadModel returns
+// what it has, with the problems listed in the model's Warnings.
+func loadModel(ctxt appengine.Context, d *display, kind model.Kind) (*dashModel, error) {
+	groups, warnings, err := loadLabelGroupsCached(ctxt, releaseLabels(ctxt), kind)
+	if err != nil {
+		return nil, err
+	}
+	d.owners, _ = codereview.LoadOwners(ctxt)
+	model.FilterForUser(groups, model.UserFilter{
+		MutedCLs:    d.pref.MutedCLs,
+		MutedIssues: d.pref.MutedIssues,
+		Snoozed:     d.pref.Snoozed,
+		Now:         time.Now(),
+
+		ShowRestricted: d.security,
+	})
+	return &dashModel{Groups: groups, Warnings: warnings}, nil
+}
+
+// work returns the items in the model involving the user d.email.
+func (m *dashModel) work(d *display) *Work {
+	return myWork(m.Groups, d.owners, d.email)
+}
+
+// mutedDirItems returns the items in the user's muted directories
+// (which the dashboard hides, but does not drop) that satisfy keep.
+func (m *dashModel) mutedDirItems(d *display, keep func(*model.Item) bool) []*model.Item {
+	var items []*model.Item
+	for dir, g := range m.Groups {
+		if d.muted(dir) == "" {
+			continue
+		}
+		for _, item := range g.Items {
+			if keep(item) {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
@@ -0,0 +1,102 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package model
+
+import (
+	"time"
+
+	"codereview"
+)
+
+// A Snooze hides a single CL or issue from a user's dashboard until
+// a given time, or until the CL or issue changes, whichever comes first.
+// Exactly one of CL and Issue is set.
+type Snooze struct {
+	CL       string
+	Issue    int
+	Until    time.Time
+	Modified time.Time // modification time of CL or issue when snoozed
+}
+
+// Active reports whether the snooze still hides an item last modified at the given time.
+func (s *Snooze) Active(now, modified time.Time) bool {
+	return now.Before(s.Until) && !modified.After(s.Modified)
+}
+
+// A UserFilter lists the CLs and issues a user has hidden.
+type UserFilter struct {
+	MutedCLs    []string
+	MutedIssues []int
+	Snoozed     []Snooze
+	Now         time.Time // time to check snoozes against
+
+	// ShowRestricted keeps restricted security issues
+	// (see issue.Issue.Restricted), which are otherwise removed.
+	ShowRestricted bool
+}
+
+// FilterForUser removes the CLs and issues hidden by f from groups.
+// An item whose issue is hidden is removed along with its CLs,
+// but an item whose issue is restricted keeps its CLs, which are public.
+// Groups left with no items are removed.
+func FilterForUser(groups map[string]*Group, f UserFilter) {
+	if len(f.MutedCLs) == 0 && len(f.MutedIssues) == 0 && len(f.Snoozed) == 0 && f.ShowRestricted {
+		return
+	}
+	hideCL := make(map[string]bool)
+	for _, cl := range f.MutedCLs {
+		hideCL[cl] = true
+	}
+	hideIssue := make(map[int]bool)
+	for _, id := range f.MutedIssues {
+		hideIssue[id] = true
+	}
+	snoozedCL := make(map[string]*Snooze)
+	snoozedIssue := make(map[int]*Snooze)
+	for i := range f.Snoozed {
+		s := &f.Snoozed[i]
+		if s.CL != "" {
+			snoozedCL[s.CL] = s
+		} else {
+			snoozedIssue[s.Issue] = s
+		}
+	}
+
+	for key, g := range groups {
+		var items []*Item
+		for _, item := range g.Items {
+			if bug := item.Bug; bug != nil && bug.Restricted && !f.ShowRestricted {
+				item = &Item{CLs: item.CLs, Overdue: item.Overdue, OverdueCLs: item.OverdueCLs}
+			}
+			if bug := item.Bug; bug != nil {
+				if hideIssue[bug.ID] {
+					continue
+				}
+				if s := snoozedIssue[bug.ID]; s != nil && s.Active(f.Now, bug.Modified) {
+					continue
+				}
+			}
+			var cls []*codereview.CL
+			for _, cl := range item.CLs {
+				if hideCL[cl.CL] {
+					continue
+				}
+				if s := snoozedCL[cl.CL]; s != nil && s.Active(f.Now, cl.Modified) {
+					continue
+				}
+				cls = append(cls, cl)
+			}
+			item.CLs = cls
+			if item.Bug == nil && len(item.CLs) == 0 {
+				continue
+			}
+			items = append(items, item)
+		}
+		g.Items = items
+		if len(items) == 0 {
+			delete(groups, key)
+		}
+	}
+}
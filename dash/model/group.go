@@ -0,0 +1,38 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package model
+
+// A Grouping maps an item to the name of the group it belongs in.
+type Grouping func(item *Item) string
+
+// GroupBy groups items using the grouping by, sorting each group
+// by Priority and then Summary, so that release-blocking work comes
+// first. The result is keyed by DirKey(name), so that repositories
+// other than the main one sort last in directory groupings.
+func GroupBy(items []*Item, by Grouping) map[string]*Group {
+	groups := make(map[string]*Group)
+	for _, item := range items {
+		name := by(item)
+		g := groups[DirKey(name)]
+		if g == nil {
+			g = &Group{Dir: name}
+			groups[DirKey(name)] = g
+		}
+		g.Items = append(g.Items, item)
+	}
+	for _, g := range groups {
+		SortByPriority(g.Items)
+	}
+	return groups
+}
+
+// Regroup returns the items in groups regrouped using by.
+func Regroup(groups map[string]*Group, by Grouping) map[string]*Group {
+	var items []*Item
+	for _, g := range groups {
+		items = append(items, g.Items...)
+	}
+	return GroupBy(items, by)
+}
@@ -0,0 +1,296 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package model loads the dashboard's CLs and issues and arranges them
+// into groups. It is shared by the dashboard's HTML and JSON views and
+// its mail, so that they all show the same items.
+package model
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"codereview"
+	"issue"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// A Group is a named list of items, such as the items for one directory.
+type Group struct {
+	Dir   string
+	Items []*Item
+}
+
+// An Item is an issue with the CLs that fix it,
+// or a single CL not associated with any loaded issue.
+type Item struct {
+	Bug *issue.Issue
+	CLs []*codereview.CL
+
+	// Overdue is set if any of the CLs has been waiting longer
+	// than the configured threshold for its state (see dash's slaConfig).
+	// OverdueCLs lists those CLs.
+	Overdue    bool
+	OverdueCLs []string
+}
+
+// A Warning describes part of the dashboard that could not be loaded.
+type Warning struct {
+	Query string // the failed query: "cl" or "issue"
+	Text  string // explanation for the user
+}
+
+// A Kind restricts the items LoadActiveItems loads.
+type Kind int
+
+const (
+	AllItems   Kind = iota // CLs and issues
+	IssuesOnly             // issues, without their CLs
+	CLsOnly                // CLs, each in its own item
+)
+
+// queryChunk limits the number of CLs or issues loaded by a single query.
+const queryChunk = 1000
+
+// LoadActiveItems loads the active CLs and the open issues with any of
+// the given labels and joins them into items (see Join).
+// If kind is IssuesOnly or CLsOnly, it skips the query for the other kind.
+// If only the CL or only the issue queries fail, it returns the items made
+// from the results of the others, along with a warning about the failure.
+// It returns an error if all the queries it runs fail, still listing the warnings.
+func LoadActiveItems(ctxt appengine.Context, labels []string, kind Kind) (items []*Item, warnings []Warning, err error) {
+	var cls []*codereview.CL
+	if kind != IssuesOnly {
+		cls, err = codereview.LoadActive(ctxt, queryChunk)
+		if err != nil {
+			ctxt.Errorf("loading CLs: %v", err)
+			if kind == CLsOnly {
+				return nil, []Warning{{"cl", "loading CLs failed"}}, fmt.Errorf("loading CLs failed")
+			}
+			warnings = append(warnings, Warning{"cl", "loading CLs failed; showing issues only"})
+			cls = nil
+		}
+	}
+	if kind == CLsOnly {
+		labels = nil
+	}
+
+	var bugs []*issue.Issue
+	seen := make(map[int]bool)
+	err = nil
+	for _, label := range labels {
+		var list []*issue.Issue
+		_, err = datastore.NewQuery("Issue").
+			Filter("State =", "open").
+			Filter("Label =", label).
+			Limit(queryChunk).
+			GetAll(ctxt, &list)
+		if err != nil {
+			break
+		}
+		for _, bug := range list {
+			if !seen[bug.ID] {
+				seen[bug.ID] = true
+				bugs = append(bugs, bug)
+			}
+		}
+	}
+	if err != nil {
+		ctxt.Errorf("loading issues: %v", err)
+		if kind == IssuesOnly {
+			return nil, []Warning{{"issue", "loading issues failed"}}, fmt.Errorf("loading issues failed")
+		}
+		warnings = append(warnings, Warning{"issue", "loading issues failed; showing CLs only"})
+		if len(warnings) > 1 {
+			return nil, warnings, fmt.Errorf("loading CLs and issues failed")
+		}
+		bugs = nil
+	}
+
+	return Join(cls, bugs), warnings, nil
+}
+
+// Join returns one item for each issue, holding the CLs that fix it,
+// followed by one item for each CL that does not fix any of the issues.
+func Join(cls []*codereview.CL, bugs []*issue.Issue) []*Item {
+	var items []*Item
+	itemsByBug := make(map[int]*Item)
+	for _, bug := range bugs {
+		item := &Item{Bug: bug}
+		items = append(items, item)
+		itemsByBug[bug.ID] = item
+	}
+
+	for _, cl := range cls {
+		found := false
+		for _, id := range CLBugs(cl) {
+			item := itemsByBug[id]
+			if item != nil {
+				found = true
+				item.CLs = append(item.CLs, cl)
+			}
+		}
+		if !found {
+			items = append(items, &Item{CLs: []*codereview.CL{cl}})
+		}
+	}
+	return items
+}
+
+var bugRE = regexp.MustCompile(`Fixes issue (\d+)`)
+
+// CLBugs returns the issues the CL's description says it fixes.
+func CLBugs(cl *codereview.CL) []int {
+	var out []int
+	for _, m := range bugRE.FindAllStringSubmatch(cl.Desc, -1) {
+		n, _ := strconv.Atoi(m[1])
+		if n > 0 {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// Summary returns the summary line of the item's issue,
+// or of its first CL if there is no issue.
+func Summary(it *Item) string {
+	if it.Bug != nil {
+		return it.Bug.Summary
+	}
+	for _, cl := range it.CLs {
+		return cl.Summary
+	}
+	return ""
+}
+
+// SortBySummary sorts items by Summary.
+func SortBySummary(items []*Item) {
+	sort.Sort(itemsBySummary(items))
+}
+
+type itemsBySummary []*Item
+
+func (x itemsBySummary) Len() int           { return len(x) }
+func (x itemsBySummary) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+func (x itemsBySummary) Less(i, j int) bool { return Summary(x[i]) < Summary(x[j]) }
+
+// Priority returns the item's priority: that of its issue, if open,
+// or else the highest inherited by its CLs (see codereview.CL.InheritedPriority).
+func Priority(it *Item) int {
+	p := issue.PriorityNone
+	if it.Bug != nil && it.Bug.State == "open" {
+		p = it.Bug.Priority()
+	}
+	for _, cl := range it.CLs {
+		if p < cl.InheritedPriority {
+			p = cl.InheritedPriority
+		}
+	}
+	return p
+}
+
+// Urgent returns the urgency phrase of the item's issue, if open,
+// or else of the first of its CLs mentioning one (see issue.Urgency).
+func Urgent(it *Item) string {
+	if it.Bug != nil && it.Bug.State == "open" && it.Bug.Urgent != "" {
+		return it.Bug.Urgent
+	}
+	for _, cl := range it.CLs {
+		if cl.Urgent != "" {
+			return cl.Urgent
+		}
+	}
+	return ""
+}
+
+// SortByPriority sorts items by decreasing Priority
+// and then by Summary.
+func SortByPriority(items []*Item) {
+	sort.Sort(itemsByPriority(items))
+}
+
+type itemsByPriority []*Item
+
+func (x itemsByPriority) Len() int      { return len(x) }
+func (x itemsByPriority) Swap(i, j int) { x[i], x[j] = x[j], x[i] }
+func (x itemsByPriority) Less(i, j int) bool {
+	if pi, pj := Priority(x[i]), Priority(x[j]); pi != pj {
+		return pi > pj
+	}
+	return Summary(x[i]) < Summary(x[j])
+}
+
+// DirKey returns the map key for a group named s.
+// Names containing dots (repositories other than the main one)
+// get keys that sort after the others.
+func DirKey(s string) string {
+	if strings.Contains(s, ".") {
+		return "\x7F" + s
+	}
+	return s
+}
+
+func descDir(desc string) string {
+	desc = strings.TrimSpace(desc)
+	i := strings.Index(desc, ":")
+	if i < 0 {
+		return ""
+	}
+	desc = desc[:i]
+	if i := strings.Index(desc, ","); i >= 0 {
+		desc = strings.TrimSpace(desc[:i])
+	}
+	if strings.Contains(desc, " ") {
+		return ""
+	}
+	return desc
+}
+
+var okDesc = map[string]bool{
+	"all":   true,
+	"build": true,
+}
+
+// ItemDir returns the directory the item is about, judging by the
+// prefix of its first CL's description and the files the CL modifies,
+// or by the prefix of the issue summary for items without CLs.
+// It returns "?" if there is no clear answer.
+func ItemDir(item *Item) string {
+	for _, cl := range item.CLs {
+		dirs := cl.Dirs()
+		desc := descDir(cl.Summary)
+
+		// Accept description if it is a global prefix like "all".
+		if okDesc[desc] {
+			return desc
+		}
+
+		// Accept description if it matches one of the directories.
+		for _, dir := range dirs {
+			if dir == desc {
+				return dir
+			}
+		}
+
+		// Otherwise use most common directory.
+		if len(dirs) > 0 {
+			return dirs[0]
+		}
+
+		// Otherwise accept description.
+		return desc
+	}
+	if item.Bug != nil {
+		if dir := descDir(item.Bug.Summary); dir != "" {
+			return dir
+		}
+		return "?"
+	}
+	return "?"
+}
@@ -0,0 +1,273 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package model
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"codereview"
+	"issue"
+)
+
+// The fake datastore contents: two release issues and four active CLs,
+// one of which fixes both issues and one of which fixes an issue
+// that is not loaded.
+var (
+	t0 = time.Date(2014, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	testBugs = []*issue.Issue{
+		{ID: 100, Summary: "net/http: Transport leaks connections", Modified: t0},
+		{ID: 200, Summary: "cmd/gc: internal compiler error", Modified: t0},
+	}
+
+	testCLs = []*codereview.CL{
+		{
+			CL:       "1001",
+			Summary:  "net/http: close idle connections",
+			Desc:     "net/http: close idle connections\n\nFixes issue 100.\nFixes issue 200.\n",
+			Files:    []string{"src/pkg/net/http/transport.go"},
+			Modified: t0,
+		},
+		{
+			CL:       "1002",
+			Summary:  "strings: add IndexFunc example",
+			Desc:     "strings: add IndexFunc example\n\nFixes issue 999.\n",
+			Files:    []string{"src/pkg/strings/example_test.go"},
+			Modified: t0,
+		},
+		{
+			CL:       "1003",
+			Summary:  "all: fix typos",
+			Desc:     "all: fix typos\n",
+			Files:    []string{"src/pkg/fmt/doc.go", "src/pkg/os/file.go"},
+			Modified: t0,
+		},
+		{
+			CL:       "1004",
+			Summary:  "go.tools/go/types: fix shift checking",
+			Desc:     "go.tools/go/types: fix shift checking\n",
+			Repo:     "go.tools",
+			Files:    []string{"go/types/expr.go"},
+			Modified: t0,
+		},
+	}
+)
+
+// itemIDs returns a description of the items, for comparing in tests.
+func itemIDs(items []*Item) []string {
+	var ids []string
+	for _, item := range items {
+		id := ""
+		if item.Bug != nil {
+			id = "issue " + strconv.Itoa(item.Bug.ID)
+		}
+		for _, cl := range item.CLs {
+			if id != "" {
+				id += " "
+			}
+			id += "CL " + cl.CL
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestJoin(t *testing.T) {
+	items := Join(testCLs, testBugs)
+	want := []string{
+		"issue 100 CL 1001",
+		"issue 200 CL 1001",
+		"CL 1002",
+		"CL 1003",
+		"CL 1004",
+	}
+	if got := itemIDs(items); !reflect.DeepEqual(got, want) {
+		t.Errorf("Join = %q, want %q", got, want)
+	}
+}
+
+func TestCLBugs(t *testing.T) {
+	if got, want := CLBugs(testCLs[0]), []int{100, 200}; !reflect.DeepEqual(got, want) {
+		t.Errorf("CLBugs(%s) = %v, want %v", testCLs[0].CL, got, want)
+	}
+	if got := CLBugs(testCLs[2]); got != nil {
+		t.Errorf("CLBugs(%s) = %v, want none", testCLs[2].CL, got)
+	}
+}
+
+var itemDirTests = []struct {
+	item *Item
+	dir  string
+}{
+	{&Item{CLs: testCLs[0:1]}, "net/http"},
+	{&Item{CLs: testCLs[1:2]}, "strings"},
+	{&Item{CLs: testCLs[2:3]}, "all"},
+	{&Item{CLs: testCLs[3:4]}, "go.tools/go/types"},
+	{&Item{Bug: testBugs[1]}, "cmd/gc"},
+	{&Item{Bug: &issue.Issue{Summary: "spec is unclear"}}, "?"},
+	{&Item{}, "?"},
+}
+
+func TestItemDir(t *testing.T) {
+	for _, tt := range itemDirTests {
+		if dir := ItemDir(tt.item); dir != tt.dir {
+			t.Errorf("ItemDir(%q) = %q, want %q", itemIDs([]*Item{tt.item}), dir, tt.dir)
+		}
+	}
+}
+
+func TestGroupBy(t *testing.T) {
+	groups := GroupBy(Join(testCLs, testBugs), ItemDir)
+	var keys []string
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	want := []string{"all", "net/http", "strings", "\x7Fgo.tools/go/types"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Fatalf("GroupBy keys = %q, want %q", keys, want)
+	}
+	if g := groups["\x7Fgo.tools/go/types"]; g.Dir != "go.tools/go/types" {
+		t.Errorf("go.tools group has Dir %q", g.Dir)
+	}
+	// Issue 200 is grouped with the CL that fixes it, not by its own summary.
+	want = []string{"issue 200 CL 1001", "issue 100 CL 1001"}
+	if got := itemIDs(groups["net/http"].Items); !reflect.DeepEqual(got, want) {
+		t.Errorf("net/http group = %q, want %q", got, want)
+	}
+}
+
+func TestSortByPriority(t *testing.T) {
+	items := []*Item{
+		{CLs: []*codereview.CL{{CL: "2001", Summary: "a: cleanup"}}},
+		{CLs: []*codereview.CL{{CL: "2002", Summary: "b: fix leak", InheritedPriority: issue.PriorityHigh}}},
+		{Bug: &issue.Issue{ID: 300, Summary: "c: crash", State: "open", Label: []string{"Priority-Low", "Release-Go1.3"}}},
+		{Bug: &issue.Issue{ID: 400, Summary: "d: wrong answer", State: "open", Label: []string{"Priority-Critical", "Release-Go1.3Maybe"}}},
+		{Bug: &issue.Issue{ID: 500, Summary: "e: closed", State: "closed", Label: []string{"Priority-Critical"}}},
+	}
+	SortByPriority(items)
+	want := []string{"issue 300", "issue 400", "CL 2002", "CL 2001", "issue 500"}
+	if got := itemIDs(items); !reflect.DeepEqual(got, want) {
+		t.Errorf("SortByPriority = %q, want %q", got, want)
+	}
+}
+
+func TestRegroup(t *testing.T) {
+	groups := GroupBy(Join(testCLs, testBugs), ItemDir)
+	one := Regroup(groups, func(*Item) string { return "everything" })
+	if len(one) != 1 {
+		t.Fatalf("Regroup made %d groups, want 1", len(one))
+	}
+	got := itemIDs(one["everything"].Items)
+	want := []string{
+		"CL 1003",           // all: fix typos
+		"issue 200 CL 1001", // cmd/gc: internal compiler error
+		"CL 1004",           // go.tools/go/types: fix shift checking
+		"issue 100 CL 1001", // net/http: Transport leaks connections
+		"CL 1002",           // strings: add IndexFunc example
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Regroup items = %q, want %q (sorted by summary)", got, want)
+	}
+}
+
+var filterTests = []struct {
+	name   string
+	filter UserFilter
+	want   []string
+}{
+	{
+		"none",
+		UserFilter{},
+		[]string{"CL 1003", "issue 200 CL 1001", "CL 1004", "issue 100 CL 1001", "CL 1002"},
+	},
+	{
+		"muted CL",
+		UserFilter{MutedCLs: []string{"1001", "1004"}},
+		[]string{"CL 1003", "issue 200", "issue 100", "CL 1002"},
+	},
+	{
+		"muted issue",
+		UserFilter{MutedIssues: []int{200}},
+		[]string{"CL 1003", "CL 1004", "issue 100 CL 1001", "CL 1002"},
+	},
+	{
+		"snoozed",
+		UserFilter{
+			Snoozed: []Snooze{
+				{CL: "1002", Until: t0.Add(48 * time.Hour), Modified: t0},
+				{Issue: 100, Until: t0.Add(48 * time.Hour), Modified: t0},
+			},
+			Now: t0.Add(24 * time.Hour),
+		},
+		[]string{"CL 1003", "issue 200 CL 1001", "CL 1004"},
+	},
+	{
+		"snooze expired",
+		UserFilter{
+			Snoozed: []Snooze{{CL: "1002", Until: t0.Add(48 * time.Hour), Modified: t0}},
+			Now:     t0.Add(72 * time.Hour),
+		},
+		[]string{"CL 1003", "issue 200 CL 1001", "CL 1004", "issue 100 CL 1001", "CL 1002"},
+	},
+	{
+		"snoozed item changed",
+		UserFilter{
+			Snoozed: []Snooze{{CL: "1002", Until: t0.Add(48 * time.Hour), Modified: t0.Add(-time.Hour)}},
+			Now:     t0.Add(24 * time.Hour),
+		},
+		[]string{"CL 1003", "issue 200 CL 1001", "CL 1004", "issue 100 CL 1001", "CL 1002"},
+	},
+}
+
+func TestFilterForUser(t *testing.T) {
+	for _, tt := range filterTests {
+		// Filtering edits the groups and items, so start fresh each time.
+		groups := GroupBy(Join(testCLs, testBugs), ItemDir)
+		FilterForUser(groups, tt.filter)
+		all := Regroup(groups, func(*Item) string { return "" })
+		var got []string
+		if g := all[""]; g != nil {
+			got = itemIDs(g.Items)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: FilterForUser left %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFilterForUserRemovesEmptyGroups(t *testing.T) {
+	groups := GroupBy(Join(testCLs, testBugs), ItemDir)
+	FilterForUser(groups, UserFilter{MutedCLs: []string{"1002"}})
+	if g, ok := groups["strings"]; ok {
+		t.Errorf("strings group not removed: %q", itemIDs(g.Items))
+	}
+}
+
+func TestFilterForUserRestricted(t *testing.T) {
+	restricted := *testBugs[1]
+	restricted.Restricted = true
+	bugs := []*issue.Issue{testBugs[0], &restricted}
+
+	groups := GroupBy(Join(testCLs, bugs), ItemDir)
+	FilterForUser(groups, UserFilter{})
+	got := itemIDs(Regroup(groups, func(*Item) string { return "" })[""].Items)
+	want := []string{"CL 1003", "CL 1004", "issue 100 CL 1001", "CL 1001", "CL 1002"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FilterForUser left %q, want %q", got, want)
+	}
+
+	groups = GroupBy(Join(testCLs, bugs), ItemDir)
+	FilterForUser(groups, UserFilter{ShowRestricted: true})
+	got = itemIDs(Regroup(groups, func(*Item) string { return "" })[""].Items)
+	want = []string{"CL 1003", "issue 200 CL 1001", "CL 1004", "issue 100 CL 1001", "CL 1002"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FilterForUser with ShowRestricted left %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"app"
+	"codereview"
+	"identity"
+	"issue"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// First-time participants.
+//
+// The dash.activity cron job counts the mirrored activity of each person,
+// the CLs they own and the issues they reported, in an Activity record
+// under their canonical email address (see identity.Directory.Canonical),
+// and remembers the first of those items. For newcomerDays after it was
+// created, a person's first item is marked as a newcomer's on the
+// dashboard, so that reviewers can make a point of a welcoming response.
+
+// An Activity counts a person's mirrored CLs and issues.
+// It is stored under the person's canonical email address.
+type Activity struct {
+	Email     string
+	CLs       int
+	Issues    int
+	First     time.Time // creation time of the first item
+	FirstItem string    // "cl/1234" or "issue/5678"
+}
+
+// newcomerDays is how long a newcomer's first item is marked.
+const newcomerDays = 30
+
+// activityChunk is the number of items of each kind counted per cron run.
+const activityChunk = 500
+
+func init() {
+	app.Cron("dash.activity", 15*time.Minute, countActivity)
+}
+
+// countActivity counts the CLs and issues created since the last run.
+// The meta values dash.activity.cl and dash.activity.issue hold the
+// creation time of the last item counted of each kind.
+func countActivity(ctxt appengine.Context) error {
+	dir := identity.Load(ctxt)
+	more := false
+
+	var mark time.Time
+	app.ReadMeta(ctxt, "dash.activity.cl", &mark)
+	var cls []*codereview.CL
+	_, err := datastore.NewQuery("CL").
+		Filter("Created >", mark).
+		Order("Created").
+		Limit(activityChunk).
+		GetAll(ctxt, &cls)
+	if err != nil {
+		ctxt.Errorf("loading CLs: %v", err)
+		return fmt.Errorf("loading CLs failed")
+	}
+	for _, cl := range cls {
+		if err := noteActivity(ctxt, dir.Canonical(cl.OwnerEmail), "cl/"+cl.CL, cl.Created); err != nil {
+			return err
+		}
+		mark = cl.Created
+	}
+	if len(cls) > 0 {
+		app.WriteMeta(ctxt, "dash.activity.cl", mark)
+	}
+	more = more || len(cls) == activityChunk
+
+	mark = time.Time{}
+	app.ReadMeta(ctxt, "dash.activity.issue", &mark)
+	var bugs []*issue.Issue
+	_, err = datastore.NewQuery("Issue").
+		Filter("Created >", mark).
+		Order("Created").
+		Limit(activityChunk).
+		GetAll(ctxt, &bugs)
+	if err != nil {
+		ctxt.Errorf("loading issues: %v", err)
+		return fmt.Errorf("loading issues failed")
+	}
+	for _, bug := range bugs {
+		if len(bug.Comment) > 0 {
+			if err := noteActivity(ctxt, dir.Canonical(bug.Comment[0].Author), fmt.Sprintf("issue/%d", bug.ID), bug.Created); err != nil {
+				return err
+			}
+		}
+		mark = bug.Created
+	}
+	if len(bugs) > 0 {
+		app.WriteMeta(ctxt, "dash.activity.issue", mark)
+	}
+	more = more || len(bugs) == activityChunk
+
+	if more {
+		return app.ErrMoreCron
+	}
+	return nil
+}
+
+// noteActivity counts the item, created at the given time, for the person with the given email.
+func noteActivity(ctxt appengine.Context, email, item string, created time.Time) error {
+	if email == "" {
+		return nil
+	}
+	return app.Transaction(ctxt, func(ctxt appengine.Context) error {
+		var a Activity
+		if err := app.ReadData(ctxt, "Activity", email, &a); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		a.Email = email
+		if strings.HasPrefix(item, "cl/") {
+			a.CLs++
+		} else {
+			a.Issues++
+		}
+		if a.FirstItem == "" || created.Before(a.First) {
+			a.First = created
+			a.FirstItem = item
+		}
+		return app.WriteData(ctxt, "Activity", email, &a)
+	})
+}
+
+// loadNewcomers loads the recent first items of newcomers into d.newcomers.
+func (d *display) loadNewcomers(ctxt appengine.Context) {
+	var list []*Activity
+	_, err := datastore.NewQuery("Activity").
+		Filter("First >", time.Now().Add(-days(newcomerDays))).
+		GetAll(ctxt, &list)
+	if err != nil {
+		ctxt.Errorf("loading newcomers: %v", err)
+		return
+	}
+	d.newcomers = make(map[string]bool)
+	for _, a := range list {
+		d.newcomers[a.FirstItem] = true
+	}
+}
+
+// isNewcomer reports whether the item of the given kind ("cl" or "issue")
+// is the first by its author (see loadNewcomers).
+func (d *display) isNewcomer(kind string, key interface{}) bool {
+	return d.newcomers[kind+"/"+fmt.Sprint(key)]
+}
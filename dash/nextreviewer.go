@@ -0,0 +1,185 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"fmt"
+	"time"
+
+	"app"
+	"codereview"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/mail"
+)
+
+// Next-reviewer escalation.
+//
+// When a CL has been waiting on its primary reviewer for longer than
+// the NeedsReview limit in the "dash.sla" config, the dash.nextreviewer
+// cron job picks a secondary reviewer: the owner of a directory the CL
+// modifies (see codereview.Owners) with the fewest CLs waiting on them,
+// skipping owners who are away (see codereview.Away). A CL whose primary
+// reviewer is away is escalated without waiting for the limit.
+// It mails the primary and secondary reviewers and records a
+// ReviewEscalation, which shows up on the CL's /item page.
+// If the dash.nextreviewer.assign flag is set, it also assigns the CL
+// to the secondary reviewer.
+//
+// Each CL is escalated at most once per primary reviewer.
+
+var (
+	nextReviewerFlag = app.Flag("dash.nextreviewer", true)
+	assignNextFlag   = app.Flag("dash.nextreviewer.assign", false)
+)
+
+// A ReviewEscalation records that a CL stalled on its primary reviewer
+// and who was suggested (or assigned) in that reviewer's place.
+// It is stored under the CL number and the primary reviewer, separated by a slash.
+type ReviewEscalation struct {
+	CL       string
+	From     string // primary reviewer
+	To       string // secondary reviewer
+	Assigned bool   // To was assigned, not just suggested
+	Time     time.Time
+}
+
+func init() {
+	app.Cron("dash.nextreviewer", 1*time.Hour, escalateReviewers)
+}
+
+// escalateReviewers finds the CLs overdue for review and escalates them.
+func escalateReviewers(ctxt appengine.Context) error {
+	if !nextReviewerFlag.On(ctxt) {
+		return nil
+	}
+	var cls []*codereview.CL
+	_, err := datastore.NewQuery("CL").
+		Filter("Active =", true).
+		Limit(1000).
+		GetAll(ctxt, &cls)
+	if err != nil {
+		ctxt.Errorf("loading CLs: %v", err)
+		return fmt.Errorf("loading CLs failed")
+	}
+	owners, err := codereview.LoadOwners(ctxt)
+	if err != nil {
+		return err
+	}
+	sla := loadSLA(ctxt)
+	now := time.Now()
+	away, err := codereview.LoadAway(ctxt, now)
+	if err != nil {
+		return err
+	}
+
+	var load map[string]int // CLs waiting on each committer; loaded on first use
+	for _, cl := range cls {
+		if !cl.NeedsReview || unassigned(cl) || !(sla.overdue(cl, now) || away.IsAway(cl.PrimaryReviewer)) {
+			continue
+		}
+		key := cl.CL + "/" + cl.PrimaryReviewer
+		var e ReviewEscalation
+		if err := app.ReadData(ctxt, "ReviewEscalation", key, &e); err == nil {
+			continue
+		}
+		if load == nil {
+			stats, err := codereview.LoadReviewStats(ctxt, now)
+			if err != nil {
+				return err
+			}
+			load = make(map[string]int)
+			for _, s := range stats {
+				load[s.Reviewer] = s.Waiting
+			}
+		}
+		who := nextReviewer(cl, owners, away, load)
+		if who == "" {
+			continue
+		}
+		e = ReviewEscalation{CL: cl.CL, From: cl.PrimaryReviewer, To: who, Time: now}
+		if assignNextFlag.On(ctxt) {
+			if err := codereview.SetReviewerBy(ctxt, cl.CL, who, "the Go dashboard"); err != nil {
+				ctxt.Errorf("assigning CL %s to %s: %v", cl.CL, who, err)
+				continue
+			}
+			e.Assigned = true
+			load[who]++
+		}
+		mailEscalation(ctxt, cl, &e, sla.NeedsReview)
+		if err := app.WriteData(ctxt, "ReviewEscalation", key, &e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nextReviewer returns the secondary reviewer for the CL: the owner of
+// one of its directories with the fewest CLs waiting on them, or ""
+// if there is nobody available other than the CL's owner and primary reviewer.
+func nextReviewer(cl *codereview.CL, owners codereview.Owners, away codereview.Absences, load map[string]int) string {
+	best := ""
+	for _, who := range owners.SuggestAvailable(cl, away) {
+		if who == cl.PrimaryReviewer {
+			continue
+		}
+		if best == "" || load[who] < load[best] {
+			best = who
+		}
+	}
+	return best
+}
+
+func mailEscalation(ctxt appengine.Context, cl *codereview.CL, e *ReviewEscalation, limit float64) {
+	what := "Please take a look, or reassign it"
+	if e.Assigned {
+		what = "It has been assigned to " + e.To
+	}
+	msg := &mail.Message{
+		Sender:  fmt.Sprintf("Go dashboard <noreply@%s.appspotmail.com>", appengine.AppID(ctxt)),
+		To:      []string{e.From, e.To},
+		Subject: fmt.Sprintf("overdue CL %s: %s", cl.CL, cl.Summary),
+		Body: fmt.Sprintf("CL %s by %s has been waiting %s for its reviewer, %s,\n"+
+			"longer than the %g days the dashboard allows.\n"+
+			"%s is an owner of a directory it modifies and has been suggested as a second reviewer.\n"+
+			"%s.\n\n"+
+			"https://codereview.appspot.com/%s\n"+
+			"https://%s/item/cl/%s\n",
+			cl.CL, cl.OwnerEmail, new(display).since(cl.Modified), e.From,
+			limit, e.To, what,
+			cl.CL, appengine.DefaultVersionHostname(ctxt), cl.CL),
+	}
+	if err := mail.Send(ctxt, msg); err != nil {
+		ctxt.Errorf("mailing escalation of CL %s: %v", cl.CL, err)
+	}
+}
+
+// escalationEvents returns the timeline events for the CL's escalations.
+func escalationEvents(ctxt appengine.Context, cl *codereview.CL) []*Event {
+	var list []*ReviewEscalation
+	_, err := datastore.NewQuery("ReviewEscalation").
+		Filter("CL =", cl.CL).
+		GetAll(ctxt, &list)
+	if err != nil {
+		ctxt.Errorf("loading escalations for CL %s: %v", cl.CL, err)
+		return nil
+	}
+	var events []*Event
+	for _, e := range list {
+		verb := "suggested"
+		if e.Assigned {
+			verb = "assigned"
+		}
+		events = append(events, &Event{
+			Time: e.Time,
+			Kind: "escalated",
+			Who:  e.To,
+			Text: fmt.Sprintf("overdue for review by %s; %s %s", e.From, verb, e.To),
+			URL:  "https://codereview.appspot.com/" + cl.CL,
+		})
+	}
+	return events
+}
@@ -0,0 +1,83 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"time"
+
+	"app"
+	"codereview"
+
+	"appengine"
+)
+
+func init() {
+	app.Handle("/api/cl/", apiPatch)
+	app.RegisterAPI("/api/cl/", "/api/cl/<n>/patch: the latest patch set of CL n; diff=1 includes the diff.", []string{"diff"}, (*apiPatchResult)(nil))
+}
+
+var patchPathRE = regexp.MustCompile(`^/api/cl/(\d+)/patch$`)
+
+// An apiPatchResult describes the latest patch set of a CL.
+type apiPatchResult struct {
+	CL            string
+	PatchSet      string
+	Created       time.Time
+	Modified      time.Time
+	Message       string
+	Files         []codereview.File
+	Diff          string `json:",omitempty"`
+	DiffTruncated bool   `json:",omitempty"`
+}
+
+// apiPatch serves /api/cl/<n>/patch, the stored metadata for the latest
+// patch set of CL n. With diff=1, the result also includes the unified diff,
+// which is fetched from Rietveld once and then served from the datastore,
+// so that previews on the dashboard do not each hit Rietveld.
+func apiPatch(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	m := patchPathRE.FindStringSubmatch(req.URL.Path)
+	if m == nil {
+		http.NotFound(w, req)
+		return
+	}
+	cl, p, err := codereview.LatestPatch(ctxt, m[1])
+	if err != nil {
+		if cl == nil {
+			http.NotFound(w, req)
+			return
+		}
+		http.Error(w, err.Error(), 503)
+		return
+	}
+
+	out := &apiPatchResult{
+		CL:       p.CL,
+		PatchSet: p.PatchSet,
+		Created:  p.Created,
+		Modified: p.Modified,
+		Message:  p.Message,
+		Files:    p.Files,
+	}
+	if req.FormValue("diff") == "1" {
+		diff, err := codereview.LoadDiff(ctxt, p.CL, p.PatchSet)
+		if err != nil {
+			http.Error(w, "loading diff failed", 502)
+			return
+		}
+		out.Diff = string(diff.Text)
+		out.DiffTruncated = diff.Truncated
+	}
+
+	js, err := json.Marshal(out)
+	if err != nil {
+		ctxt.Errorf("encoding patch JSON: %v", err)
+		http.Error(w, "error encoding JSON", 500)
+		return
+	}
+	writeJSON(w, js)
+}
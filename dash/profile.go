@@ -0,0 +1,85 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"crypto/md5"
+	"fmt"
+	"strings"
+
+	"app"
+
+	"appengine"
+)
+
+// A Profile gives the display name and avatar image for a person.
+type Profile struct {
+	Email  string
+	Name   string
+	Avatar string // URL of avatar image
+}
+
+// profileConfig is the profile configuration, read from the
+// "dash.profiles" config (see app.ReadConfig).
+// People without a configured profile get their name from the mailmap
+// and, if NoGravatar is not set, an avatar from gravatar.com.
+type profileConfig struct {
+	NoGravatar bool
+	Profiles   []*Profile
+}
+
+// profiles holds the profile information used by a single page.
+type profiles struct {
+	config  profileConfig
+	byEmail map[string]*Profile
+	mailmap *app.Mailmap
+}
+
+// loadProfiles loads the profile configuration.
+func loadProfiles(ctxt appengine.Context) *profiles {
+	p := &profiles{
+		byEmail: make(map[string]*Profile),
+		mailmap: app.ReadMailmap(ctxt),
+	}
+	app.ReadConfig(ctxt, "dash.profiles", &p.config)
+	for _, pr := range p.config.Profiles {
+		p.byEmail[strings.ToLower(pr.Email)] = pr
+	}
+	return p
+}
+
+// lookup returns the profile for email.
+func (p *profiles) lookup(email string) *Profile {
+	if email == "" {
+		return nil
+	}
+	key := strings.ToLower(email)
+	if pr := p.byEmail[key]; pr != nil {
+		return pr
+	}
+	name, canon := p.mailmap.Lookup("", email)
+	if pr := p.byEmail[strings.ToLower(canon)]; pr != nil {
+		p.byEmail[key] = pr
+		return pr
+	}
+	pr := &Profile{Email: canon, Name: name}
+	if pr.Name == "" {
+		pr.Name = canon
+		if i := strings.Index(canon, "@"); i >= 0 {
+			pr.Name = canon[:i]
+		}
+	}
+	if !p.config.NoGravatar {
+		pr.Avatar = gravatar(canon)
+	}
+	p.byEmail[key] = pr
+	return pr
+}
+
+// gravatar returns the gravatar.com avatar URL for email.
+func gravatar(email string) string {
+	h := md5.Sum([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return fmt.Sprintf("https://www.gravatar.com/avatar/%x?s=32&d=identicon", h)
+}
@@ -0,0 +1,146 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"app"
+	"dash/model"
+
+	"appengine"
+	"appengine/memcache"
+)
+
+func init() {
+	app.Handle("/release/", showRelease)
+}
+
+// A burndownChart holds the precomputed coordinates for
+// the inline SVG chart on the release page.
+type burndownChart struct {
+	Width, Height int
+	Max           int // y value at top of chart
+	Start, End    time.Time
+	Issues        string // polyline points for open issues
+	CLs           string // polyline points for pending CLs
+}
+
+const (
+	chartWidth  = 600
+	chartHeight = 200
+)
+
+// newBurndownChart returns a chart for the snapshots, which must be sorted by time.
+// It returns nil if there are fewer than two snapshots.
+func newBurndownChart(snaps []*Snapshot) *burndownChart {
+	if len(snaps) < 2 {
+		return nil
+	}
+	c := &burndownChart{
+		Width:  chartWidth,
+		Height: chartHeight,
+		Start:  snaps[0].Time,
+		End:    snaps[len(snaps)-1].Time,
+	}
+	for _, s := range snaps {
+		if c.Max < s.Issues {
+			c.Max = s.Issues
+		}
+		if c.Max < s.PendingCLs {
+			c.Max = s.PendingCLs
+		}
+	}
+	if c.Max == 0 {
+		c.Max = 1
+	}
+	span := c.End.Sub(c.Start)
+	if span <= 0 {
+		span = 1
+	}
+	var issues, cls []string
+	for _, s := range snaps {
+		x := float64(s.Time.Sub(c.Start)) / float64(span) * chartWidth
+		y := func(n int) float64 { return chartHeight - float64(n)/float64(c.Max)*chartHeight }
+		issues = append(issues, fmt.Sprintf("%.1f,%.1f", x, y(s.Issues)))
+		cls = append(cls, fmt.Sprintf("%.1f,%.1f", x, y(s.PendingCLs)))
+	}
+	c.Issues = strings.Join(issues, " ")
+	c.CLs = strings.Join(cls, " ")
+	return c
+}
+
+// showRelease serves /release/<label>, the burndown page for the given label.
+func showRelease(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	label := strings.TrimPrefix(req.URL.Path, "/release/")
+	if label == "" {
+		http.Redirect(w, req, "/release/"+releaseLabels(ctxt)[0], 302)
+		return
+	}
+
+	var d display
+	d.email = findEmail(ctxt)
+
+	cacheKey := pageCacheKey(ctxt, d.email, req.URL.Path, "")
+	if it, err := memcache.Get(ctxt, cacheKey); err == nil {
+		w.Write(it.Value)
+		return
+	}
+
+	snaps, err := loadSnapshots(ctxt, label)
+	if err != nil {
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+	groups, err := loadLabelGroups(ctxt, label)
+	if err != nil {
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+	var items []*model.Item
+	for _, g := range groups {
+		for _, item := range g.Items {
+			if item.Bug != nil {
+				items = append(items, item)
+			}
+		}
+	}
+	model.SortBySummary(items)
+
+	t, err := loadTemplate(ctxt, "release.html", &d)
+	if err != nil {
+		fmt.Fprintf(w, "error loading template\n")
+		return
+	}
+
+	data := struct {
+		User   string
+		Label  string
+		Chart  *burndownChart
+		Latest *Snapshot
+		Items  []*model.Item
+	}{
+		User:  d.email,
+		Label: label,
+		Chart: newBurndownChart(snaps),
+		Items: items,
+	}
+	if len(snaps) > 0 {
+		data.Latest = snaps[len(snaps)-1]
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		ctxt.Errorf("execute: %v", err)
+		fmt.Fprintf(w, "error executing template\n")
+		return
+	}
+	memcache.Set(ctxt, &memcache.Item{Key: cacheKey, Value: buf.Bytes(), Expiration: pageCacheTime})
+	w.Write(buf.Bytes())
+}
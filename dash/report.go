@@ -0,0 +1,335 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/http"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"app"
+	"codereview"
+	"issue"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/mail"
+)
+
+// Weekly reports.
+//
+// Every Monday, the dash.report cron job writes a report on the previous
+// week (Monday to Monday, UTC): CLs opened and closed, how long mailed CLs
+// waited for a first reply from a reviewer, new issues with release labels,
+// CLs with failing builds, and how the release snapshots moved.
+// Reports are stored as Report records, served at /reports/,
+// and mailed to the addresses in the "dash.report" config, if any:
+//
+//	{"To": ["golang-dev@googlegroups.com"]}
+
+type reportConfig struct {
+	To []string
+}
+
+// A Report is a weekly report, stored under the date of the
+// Monday starting the week, formatted as 2006-01-02.
+type Report struct {
+	Week   string
+	Start  time.Time
+	End    time.Time
+	HTML   []byte `datastore:",noindex"`
+	Text   []byte `datastore:",noindex"`
+	Mailed bool
+}
+
+// reportData is the data a report is generated from.
+type reportData struct {
+	Week       string
+	Start, End time.Time
+	Host       string
+
+	Opened    int
+	Closed    int
+	Mailed    int     // CLs first mailed during the week
+	Replied   int     // of those, CLs with a reply from a reviewer
+	Latency50 float64 // median hours to first reply
+	Latency90 float64 // 90th percentile hours to first reply
+
+	Blockers []*issue.Issue       // new issues with release labels
+	Broken   []*codereview.CL     // CLs with failed builds during the week
+	Releases []*reportReleaseData // snapshot movement per release label
+}
+
+type reportReleaseData struct {
+	Label                  string
+	IssuesStart, IssuesEnd int
+	CLsStart, CLsEnd       int
+}
+
+func init() {
+	app.Cron("dash.report", 6*time.Hour, weeklyReport)
+	app.Handle("/reports/", showReport)
+
+	app.RegisterOp("dash.report", "Regenerate the report for the week starting on the given Monday (2006-01-02), without mailing it.", []string{"week"}, func(ctxt appengine.Context, args map[string]string) (string, error) {
+		start, err := time.Parse("2006-01-02", args["week"])
+		if err != nil || start.Weekday() != time.Monday {
+			return "", fmt.Errorf("week must be a Monday, formatted as 2006-01-02")
+		}
+		r, err := makeReport(ctxt, start)
+		if err != nil {
+			return "", err
+		}
+		r.Mailed = true
+		if err := app.WriteData(ctxt, "Report", r.Week, r); err != nil {
+			return "", err
+		}
+		return "wrote report for week of " + r.Week, nil
+	})
+}
+
+// reportWeek returns the start of the last complete week before t.
+func reportWeek(t time.Time) time.Time {
+	t = t.UTC()
+	end := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	for end.Weekday() != time.Monday {
+		end = end.AddDate(0, 0, -1)
+	}
+	return end.AddDate(0, 0, -7)
+}
+
+// weeklyReport writes and mails the report for the last complete week,
+// unless that has already been done.
+func weeklyReport(ctxt appengine.Context) error {
+	start := reportWeek(time.Now())
+	week := start.Format("2006-01-02")
+	var r Report
+	if err := app.ReadData(ctxt, "Report", week, &r); err == nil && r.Mailed {
+		return nil
+	}
+	rp, err := makeReport(ctxt, start)
+	if err != nil {
+		return err
+	}
+	if err := app.WriteData(ctxt, "Report", week, rp); err != nil {
+		return err
+	}
+
+	var c reportConfig
+	app.ReadConfig(ctxt, "dash.report", &c)
+	if len(c.To) > 0 {
+		msg := &mail.Message{
+			Sender:   fmt.Sprintf("Go dashboard <noreply@%s.appspotmail.com>", appengine.AppID(ctxt)),
+			To:       c.To,
+			Subject:  "Go development report for the week of " + week,
+			Body:     string(rp.Text),
+			HTMLBody: string(rp.HTML),
+		}
+		if err := mail.Send(ctxt, msg); err != nil {
+			ctxt.Errorf("mailing report for %s: %v", week, err)
+			return err
+		}
+	}
+	rp.Mailed = true
+	return app.WriteData(ctxt, "Report", week, rp)
+}
+
+// makeReport generates the report for the week starting at start.
+func makeReport(ctxt appengine.Context, start time.Time) (*Report, error) {
+	data, err := loadReportData(ctxt, start)
+	if err != nil {
+		return nil, err
+	}
+	var d display
+	t, err := loadTemplate(ctxt, "report.html", &d)
+	if err != nil {
+		return nil, err
+	}
+	var page, text bytes.Buffer
+	if err := t.Execute(&page, data); err != nil {
+		return nil, fmt.Errorf("executing template: %v", err)
+	}
+	if err := reportText.Execute(&text, data); err != nil {
+		return nil, fmt.Errorf("executing text template: %v", err)
+	}
+	return &Report{
+		Week:  data.Week,
+		Start: data.Start,
+		End:   data.End,
+		HTML:  page.Bytes(),
+		Text:  text.Bytes(),
+	}, nil
+}
+
+// loadReportData collects the numbers for the week starting at start.
+func loadReportData(ctxt appengine.Context, start time.Time) (*reportData, error) {
+	end := start.AddDate(0, 0, 7)
+	data := &reportData{
+		Week:  start.Format("2006-01-02"),
+		Start: start,
+		End:   end,
+		Host:  appengine.DefaultVersionHostname(ctxt),
+	}
+	in := func(t time.Time) bool {
+		return !t.Before(start) && t.Before(end)
+	}
+
+	var cls []*codereview.CL
+	_, err := datastore.NewQuery("CL").
+		Filter("Modified >=", start).
+		Limit(5000).
+		GetAll(ctxt, &cls)
+	if err != nil {
+		ctxt.Errorf("loading CLs: %v", err)
+		return nil, fmt.Errorf("loading CLs failed")
+	}
+	var waits []float64
+	for _, cl := range cls {
+		if in(cl.Created) {
+			data.Opened++
+		}
+		if (cl.Closed || cl.Submitted) && in(cl.Modified) {
+			data.Closed++
+		}
+		if mailed, replied := cl.FirstResponse(); in(mailed) {
+			data.Mailed++
+			if !replied.IsZero() {
+				data.Replied++
+				waits = append(waits, replied.Sub(mailed).Hours())
+			}
+		}
+		for _, r := range cl.BuildResults {
+			if !r.OK && in(r.Time) {
+				data.Broken = append(data.Broken, cl)
+				break
+			}
+		}
+	}
+	sort.Float64s(waits)
+	data.Latency50 = percentile(waits, 0.5)
+	data.Latency90 = percentile(waits, 0.9)
+
+	labels := releaseLabels(ctxt)
+	var bugs []*issue.Issue
+	_, err = datastore.NewQuery("Issue").
+		Filter("Created >=", start).
+		Limit(1000).
+		GetAll(ctxt, &bugs)
+	if err != nil {
+		ctxt.Errorf("loading issues: %v", err)
+		return nil, fmt.Errorf("loading issues failed")
+	}
+	for _, bug := range bugs {
+		if in(bug.Created) && hasAnyLabel(bug, labels) && !bug.Restricted {
+			data.Blockers = append(data.Blockers, bug)
+		}
+	}
+	sort.Sort(issue.ByID(data.Blockers))
+
+	for _, label := range labels {
+		snaps, err := loadSnapshots(ctxt, label)
+		if err != nil {
+			return nil, err
+		}
+		rd := &reportReleaseData{Label: label}
+		for _, s := range snaps {
+			if !s.Time.After(start) {
+				rd.IssuesStart, rd.CLsStart = s.Issues, s.PendingCLs
+			}
+			if !s.Time.After(end) {
+				rd.IssuesEnd, rd.CLsEnd = s.Issues, s.PendingCLs
+			}
+		}
+		data.Releases = append(data.Releases, rd)
+	}
+	return data, nil
+}
+
+// percentile returns the p'th percentile of the sorted list, or 0 if it is empty.
+func percentile(list []float64, p float64) float64 {
+	if len(list) == 0 {
+		return 0
+	}
+	i := int(p * float64(len(list)))
+	if i >= len(list) {
+		i = len(list) - 1
+	}
+	return list[i]
+}
+
+// hasAnyLabel reports whether the issue has any of the labels.
+func hasAnyLabel(bug *issue.Issue, labels []string) bool {
+	for _, l := range bug.Label {
+		for _, x := range labels {
+			if l == x {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var reportText = template.Must(template.New("report").Parse(`Go development report for the week of {{.Week}}
+
+CLs opened: {{.Opened}}
+CLs closed: {{.Closed}}
+CLs mailed: {{.Mailed}} ({{.Replied}} with a reviewer reply)
+Hours to first reply: median {{printf "%.1f" .Latency50}}, 90th percentile {{printf "%.1f" .Latency90}}
+{{range .Releases}}
+{{.Label}}: {{.IssuesStart}} -> {{.IssuesEnd}} open issues, {{.CLsStart}} -> {{.CLsEnd}} pending CLs{{end}}
+{{if .Blockers}}
+New release issues:
+{{range .Blockers}}	issue {{.ID}}: {{.Summary}}
+{{end}}{{end}}{{if .Broken}}
+CLs with failing builds:
+{{range .Broken}}	CL {{.CL}}: {{.Summary}}
+{{end}}{{end}}
+https://{{.Host}}/reports/{{.Week}}
+`))
+
+// showReport serves /reports/, the list of reports,
+// and /reports/WEEK, a single report (or, with a .txt suffix, its text).
+func showReport(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	week := strings.TrimPrefix(req.URL.Path, "/reports/")
+	if week == "" {
+		keys, err := datastore.NewQuery("Report").
+			Order("-__key__").
+			KeysOnly().
+			Limit(200).
+			GetAll(ctxt, nil)
+		if err != nil {
+			ctxt.Errorf("loading reports: %v", err)
+			http.Error(w, "loading reports failed", 500)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, "<html><title>Weekly reports - Go development dashboard</title>\n<h1>Weekly reports</h1>\n<ul>\n")
+		for _, k := range keys {
+			week := html.EscapeString(k.StringID())
+			fmt.Fprintf(w, "<li><a href=\"/reports/%s\">week of %s</a> (<a href=\"/reports/%s.txt\">text</a>)\n", week, week, week)
+		}
+		fmt.Fprintf(w, "</ul>\n</html>\n")
+		return
+	}
+
+	txt := strings.HasSuffix(week, ".txt")
+	week = strings.TrimSuffix(week, ".txt")
+	var r Report
+	if err := app.ReadData(ctxt, "Report", week, &r); err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	if txt {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(r.Text)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(r.HTML)
+}
@@ -0,0 +1,114 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"app"
+	"codereview"
+
+	"appengine"
+	"appengine/memcache"
+)
+
+func init() {
+	app.Handle("/reviewers", showReviewers)
+}
+
+// reviewerSorts maps the sort= parameter on /reviewers to
+// the corresponding ordering. Each ordering breaks ties by name.
+var reviewerSorts = map[string]func(x, y *codereview.ReviewStats) bool{
+	"name": func(x, y *codereview.ReviewStats) bool {
+		return false
+	},
+	"assigned": func(x, y *codereview.ReviewStats) bool {
+		return x.Assigned > y.Assigned
+	},
+	"waiting": func(x, y *codereview.ReviewStats) bool {
+		return x.Waiting > y.Waiting
+	},
+	"oldest": func(x, y *codereview.ReviewStats) bool {
+		if x.OldestWaiting.IsZero() || y.OldestWaiting.IsZero() {
+			return !x.OldestWaiting.IsZero() && y.OldestWaiting.IsZero()
+		}
+		return x.OldestWaiting.Before(y.OldestWaiting)
+	},
+	"lgtms": func(x, y *codereview.ReviewStats) bool {
+		return x.LGTMs > y.LGTMs
+	},
+}
+
+type statsSorter struct {
+	list []*codereview.ReviewStats
+	less func(x, y *codereview.ReviewStats) bool
+}
+
+func (x *statsSorter) Len() int      { return len(x.list) }
+func (x *statsSorter) Swap(i, j int) { x.list[i], x.list[j] = x.list[j], x.list[i] }
+func (x *statsSorter) Less(i, j int) bool {
+	a, b := x.list[i], x.list[j]
+	if x.less(a, b) {
+		return true
+	}
+	if x.less(b, a) {
+		return false
+	}
+	return a.Reviewer < b.Reviewer
+}
+
+func showReviewers(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	var d display
+	d.email = findEmail(ctxt)
+
+	by := req.FormValue("sort")
+	less := reviewerSorts[by]
+	if less == nil {
+		by = "waiting"
+		less = reviewerSorts[by]
+	}
+
+	cacheKey := pageCacheKey(ctxt, d.email, req.URL.Path, by)
+	if it, err := memcache.Get(ctxt, cacheKey); err == nil {
+		w.Write(it.Value)
+		return
+	}
+
+	stats, err := codereview.LoadReviewStats(ctxt, time.Now().Add(-7*24*time.Hour))
+	if err != nil {
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+	sort.Sort(&statsSorter{stats, less})
+
+	t, err := loadTemplate(ctxt, "reviewers.html", &d)
+	if err != nil {
+		fmt.Fprintf(w, "error loading template\n")
+		return
+	}
+
+	data := struct {
+		User  string
+		Sort  string
+		Stats []*codereview.ReviewStats
+	}{
+		d.email,
+		by,
+		stats,
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		ctxt.Errorf("execute: %v", err)
+		fmt.Fprintf(w, "error executing template\n")
+		return
+	}
+	memcache.Set(ctxt, &memcache.Item{Key: cacheKey, Value: buf.Bytes(), Expiration: pageCacheTime})
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,187 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"app"
+	"codereview"
+	"commit"
+	"issue"
+
+	"appengine"
+)
+
+func init() {
+	app.Handle("/search", showSearch)
+}
+
+// maxSearch is the number of results requested from each index.
+const maxSearch = 50
+
+// A SearchResult is a single CL, issue, or commit matching a search.
+type SearchResult struct {
+	Kind  string // "cl", "issue", or "commit"
+	ID    string
+	Title string
+	Who   string
+	URL   string
+	Time  time.Time
+	Score float64
+}
+
+type resultsByScore []*SearchResult
+
+func (x resultsByScore) Len() int      { return len(x) }
+func (x resultsByScore) Swap(i, j int) { x[i], x[j] = x[j], x[i] }
+func (x resultsByScore) Less(i, j int) bool {
+	if x[i].Score != x[j].Score {
+		return x[i].Score > x[j].Score
+	}
+	return x[i].Time.After(x[j].Time)
+}
+
+// score ranks a result found at position i in its index's results.
+// Each index returns its best matches first, so earlier results score higher,
+// and results mentioning every query word in the title score higher still.
+func score(i int, title, query string) float64 {
+	s := 1 / float64(1+i)
+	title = strings.ToLower(title)
+	all := true
+	for _, w := range strings.Fields(strings.ToLower(query)) {
+		if !strings.Contains(title, w) {
+			all = false
+		}
+	}
+	if all {
+		s++
+	}
+	return s
+}
+
+// search runs the query against the CL, issue, and commit indexes
+// and returns the merged results, best first.
+func search(ctxt appengine.Context, query string) ([]*SearchResult, error) {
+	var (
+		out  []*SearchResult
+		errs []string
+	)
+	cls, err := codereview.Search(ctxt, query, maxSearch)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	for i, cl := range cls {
+		out = append(out, &SearchResult{
+			Kind:  "cl",
+			ID:    cl.CL,
+			Title: cl.Summary,
+			Who:   cl.OwnerEmail,
+			URL:   "/item/cl/" + cl.CL,
+			Time:  cl.Modified,
+			Score: score(i, cl.Summary, query),
+		})
+	}
+	bugs, err := issue.Search(ctxt, query, maxSearch)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	for i, bug := range bugs {
+		author := ""
+		if len(bug.Comment) > 0 {
+			author = bug.Comment[0].Author
+		}
+		out = append(out, &SearchResult{
+			Kind:  "issue",
+			ID:    fmt.Sprint(bug.ID),
+			Title: bug.Summary,
+			Who:   author,
+			URL:   fmt.Sprintf("/item/issue/%d", bug.ID),
+			Time:  bug.Modified,
+			Score: score(i, bug.Summary, query),
+		})
+	}
+	revs, err := commit.Search(ctxt, query, maxSearch)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	for i, rev := range revs {
+		title := rev.Log
+		if j := strings.Index(title, "\n"); j >= 0 {
+			title = title[:j]
+		}
+		out = append(out, &SearchResult{
+			Kind:  "commit",
+			ID:    rev.ShortHash,
+			Title: title,
+			Who:   rev.AuthorEmail,
+			URL:   "https://code.google.com/p/go/source/detail?r=" + rev.ShortHash,
+			Time:  rev.Time,
+			Score: score(i, title, query),
+		})
+	}
+	sort.Sort(resultsByScore(out))
+	if len(out) == 0 && len(errs) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return out, nil
+}
+
+// showSearch serves /search?q=, which searches the CLs, issues, and commits.
+// With format=json, the results are returned as JSON.
+func showSearch(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	var d display
+	d.email = findEmail(ctxt)
+
+	query := strings.TrimSpace(req.FormValue("q"))
+	var results []*SearchResult
+	if query != "" {
+		var err error
+		results, err = search(ctxt, query)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+
+	if req.FormValue("format") == "json" {
+		js, err := json.Marshal(results)
+		if err != nil {
+			ctxt.Errorf("encoding search JSON: %v", err)
+			http.Error(w, "error encoding JSON", 500)
+			return
+		}
+		writeJSON(w, js)
+		return
+	}
+
+	t, err := loadTemplate(ctxt, "search.html", &d)
+	if err != nil {
+		fmt.Fprintf(w, "error loading template\n")
+		return
+	}
+	data := struct {
+		User    string
+		Query   string
+		Results []*SearchResult
+	}{
+		d.email,
+		query,
+		results,
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		ctxt.Errorf("execute: %v", err)
+		fmt.Fprintf(w, "error executing template\n")
+		return
+	}
+	w.Write(buf.Bytes())
+}
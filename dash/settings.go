@@ -0,0 +1,176 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"app"
+	"codereview"
+
+	"appengine"
+	"appengine/user"
+)
+
+func init() {
+	app.Handle("/settings", showSettings)
+	app.Handle("/api/prefs", apiPrefs)
+	app.RegisterAPI("/api/prefs", "The user's preferences. A POST with op= changes them first.", []string{"op", "xsrf"}, (*UserPref)(nil))
+}
+
+// showSettings serves /settings, where logged-in users manage all their
+// preferences in one place: muted directories, CLs, and issues, saved views,
+// snoozes, summary mail, time display, reviewer availability, API tokens,
+// and their stored data. Changes are POSTed back to /settings with an op=
+// naming one of the preference operations also accepted by /uiop (see prefOps),
+// or away, notaway (see codereview.Away), createtoken, revoketoken,
+// or deletedata (see userdata.go).
+func showSettings(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	var d display
+	d.email = findEmail(ctxt)
+	if d.email == "" {
+		url, err := user.LoginURL(ctxt, "/settings")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		http.Redirect(w, req, url, 302)
+		return
+	}
+
+	var data struct {
+		User     string
+		XSRF     string
+		NewToken string
+		Error    string
+		Pref     UserPref
+		MaxDays  int
+		Tokens   []*APIToken
+		Hashes   []string
+		Deletion *DeletionRequest
+		Away     *codereview.Away
+	}
+	data.User = d.email
+	data.XSRF = app.XSRFToken(ctxt, d.email, "settings")
+	data.MaxDays = maxSummaryDays
+
+	if req.Method == "POST" {
+		if !app.ValidXSRFToken(ctxt, req.FormValue("xsrf"), d.email, "settings") {
+			http.Error(w, "invalid XSRF token; reload the page", 403)
+			return
+		}
+		var err error
+		switch op := req.FormValue("op"); {
+		case op == "createtoken":
+			data.NewToken, err = newToken(ctxt, d.email, req.FormValue("name"))
+		case op == "revoketoken":
+			err = revokeToken(ctxt, d.email, req.FormValue("hash"))
+		case op == "away":
+			var a *codereview.Away
+			a, err = codereview.ParseAway(d.email, req.FormValue("from"), req.FormValue("until"), req.FormValue("note"))
+			if err == nil {
+				err = codereview.SetAway(ctxt, a)
+			}
+		case op == "notaway":
+			err = codereview.ClearAway(ctxt, d.email)
+		case op == "deletedata":
+			err = requestDeletion(ctxt, d.email)
+		case prefOps[op] != nil:
+			var edit func(*UserPref)
+			edit, err = prefOps[op](ctxt, req, op)
+			if err == nil {
+				err = updatePref(ctxt, d.email, edit)
+			}
+		default:
+			err = fmt.Errorf("invalid op")
+		}
+		if err != nil {
+			data.Error = err.Error()
+		}
+	}
+
+	app.ReadData(ctxt, "UserPref", d.email, &data.Pref)
+	if data.Pref.SummaryDays == 0 {
+		data.Pref.SummaryDays = defaultSummaryDays
+	}
+	if data.Pref.TimeFormat == "" {
+		data.Pref.TimeFormat = timeDays
+	}
+	d.pref = data.Pref
+	var dr DeletionRequest
+	if err := app.ReadData(ctxt, "DeletionRequest", d.email, &dr); err == nil {
+		data.Deletion = &dr
+	}
+	if a := codereview.ReadAway(ctxt, d.email); a != nil && a.Until.After(time.Now()) {
+		data.Away = a
+	}
+
+	var err error
+	data.Tokens, data.Hashes, err = listTokens(ctxt, d.email)
+	if err != nil {
+		http.Error(w, "loading tokens failed", 500)
+		return
+	}
+
+	t, err := loadTemplate(ctxt, "settings.html", &d)
+	if err != nil {
+		fmt.Fprintf(w, "error loading template\n")
+		return
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		ctxt.Errorf("execute: %v", err)
+		fmt.Fprintf(w, "error executing template\n")
+		return
+	}
+	w.Write(buf.Bytes())
+}
+
+// apiPrefs serves /api/prefs, which returns the user's preferences as JSON.
+// A POST with an op= naming one of the preference operations accepted by /uiop
+// (see prefOps) applies that change first. As with /uiop, a POST must carry
+// an XSRF token unless the user is identified by an API token.
+func apiPrefs(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	email, byToken := requestEmail(ctxt, req)
+	if email == "" {
+		http.Error(w, "must be logged in", 403)
+		return
+	}
+
+	if req.Method == "POST" {
+		if !byToken && !app.ValidXSRFToken(ctxt, req.FormValue("xsrf"), email, "uiop") {
+			http.Error(w, "invalid XSRF token; reload the page", 403)
+			return
+		}
+		op := req.FormValue("op")
+		if prefOps[op] == nil {
+			http.Error(w, "invalid op", 400)
+			return
+		}
+		edit, err := prefOps[op](ctxt, req, op)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err := updatePref(ctxt, email, edit); err != nil {
+			http.Error(w, "unable to update", 500)
+			return
+		}
+	}
+
+	var pref UserPref
+	app.ReadData(ctxt, "UserPref", email, &pref)
+	js, err := json.Marshal(&pref)
+	if err != nil {
+		ctxt.Errorf("encoding prefs JSON: %v", err)
+		http.Error(w, "error encoding JSON", 500)
+		return
+	}
+	writeJSON(w, js)
+}
@@ -0,0 +1,64 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"time"
+
+	"app"
+	"codereview"
+	"dash/model"
+
+	"appengine"
+)
+
+// slaConfig holds the thresholds, in days, after which a CL waiting
+// in a given state is overdue. It is read from the "dash.sla" config
+// (see app.ReadConfig), for example {"NeedsReview": 2}.
+type slaConfig struct {
+	NeedsReview   float64 // waiting for the reviewer
+	WaitingAuthor float64 // waiting for the author
+}
+
+var defaultSLA = slaConfig{
+	NeedsReview:   3,
+	WaitingAuthor: 14,
+}
+
+func loadSLA(ctxt appengine.Context) slaConfig {
+	c := defaultSLA
+	app.ReadConfig(ctxt, "dash.sla", &c)
+	return c
+}
+
+func days(n float64) time.Duration {
+	return time.Duration(n * float64(24*time.Hour))
+}
+
+// overdue reports whether the CL has been waiting longer than
+// the threshold for its current state.
+func (c *slaConfig) overdue(cl *codereview.CL, now time.Time) bool {
+	limit := c.WaitingAuthor
+	if cl.NeedsReview {
+		limit = c.NeedsReview
+	}
+	return now.Sub(cl.Modified) > days(limit)
+}
+
+// markOverdue sets the Overdue and OverdueCLs fields of the items.
+func markOverdue(ctxt appengine.Context, items []*model.Item) {
+	c := loadSLA(ctxt)
+	now := time.Now()
+	for _, item := range items {
+		item.Overdue = false
+		item.OverdueCLs = nil
+		for _, cl := range item.CLs {
+			if c.overdue(cl, now) {
+				item.Overdue = true
+				item.OverdueCLs = append(item.OverdueCLs, cl.CL)
+			}
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"fmt"
+	"time"
+
+	"app"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// A Snapshot records the state of a release label at a particular time.
+// Snapshots are taken periodically by the dash.snapshot cron job
+// and are used to draw the release burndown charts.
+type Snapshot struct {
+	Label      string
+	Time       time.Time
+	Issues     int // open issues with the label
+	PendingCLs int // active CLs for those issues
+}
+
+// snapshotLabels returns the labels to snapshot.
+// The list can be changed by editing the "dash.snapshot.labels" metadata;
+// by default it is the active release labels.
+func snapshotLabels(ctxt appengine.Context) []string {
+	var labels []string
+	if err := app.ReadMetaCached(ctxt, "dash.snapshot.labels", &labels); err != nil || len(labels) == 0 {
+		labels = releaseLabels(ctxt)
+	}
+	return labels
+}
+
+func init() {
+	app.Cron("dash.snapshot", 1*time.Hour, snapshot)
+}
+
+func snapshot(ctxt appengine.Context) error {
+	now := time.Now()
+	for _, label := range snapshotLabels(ctxt) {
+		groups, err := loadLabelGroups(ctxt, label)
+		if err != nil {
+			return err
+		}
+		s := &Snapshot{Label: label, Time: now}
+		for _, g := range groups {
+			for _, item := range g.Items {
+				if item.Bug == nil {
+					continue
+				}
+				s.Issues++
+				s.PendingCLs += len(item.CLs)
+			}
+		}
+		key := datastore.NewKey(ctxt, "Snapshot", fmt.Sprintf("%s/%d", label, now.Unix()), 0, nil)
+		if _, err := datastore.Put(ctxt, key, s); err != nil {
+			ctxt.Errorf("storing snapshot for %s: %v", label, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// loadSnapshots returns the snapshots for label, oldest first.
+func loadSnapshots(ctxt appengine.Context, label string) ([]*Snapshot, error) {
+	var list []*Snapshot
+	_, err := datastore.NewQuery("Snapshot").
+		Filter("Label =", label).
+		Order("-Time").
+		Limit(5000).
+		GetAll(ctxt, &list)
+	if err != nil {
+		ctxt.Errorf("loading snapshots for %s: %v", label, err)
+		return nil, fmt.Errorf("loading snapshots failed")
+	}
+	// The query returns the newest snapshots first; the charts want oldest first.
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	return list, nil
+}
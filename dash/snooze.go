@@ -0,0 +1,75 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"app"
+	"codereview"
+	"dash/model"
+	"issue"
+
+	"appengine"
+)
+
+// snoozeFromForm returns the snooze described by the request's
+// cl= or issue= parameter and its until= parameter, a date in YYYY-MM-DD form.
+func snoozeFromForm(ctxt appengine.Context, req *http.Request) (*model.Snooze, error) {
+	until, err := time.Parse("2006-01-02", req.FormValue("until"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid until date")
+	}
+	s := &model.Snooze{Until: until}
+	if clnum := req.FormValue("cl"); clnum != "" {
+		var cl codereview.CL
+		if err := app.ReadData(ctxt, "CL", clnum, &cl); err != nil {
+			return nil, fmt.Errorf("unknown cl")
+		}
+		s.CL = cl.CL
+		s.Modified = cl.Modified
+		return s, nil
+	}
+	id, err := strconv.Atoi(req.FormValue("issue"))
+	if err != nil || id <= 0 {
+		return nil, fmt.Errorf("missing cl or issue")
+	}
+	var bug issue.Issue
+	if err := app.ReadData(ctxt, "Issue", fmt.Sprint(id), &bug); err != nil {
+		return nil, fmt.Errorf("unknown issue")
+	}
+	s.Issue = bug.ID
+	s.Modified = bug.Modified
+	return s, nil
+}
+
+// addSnooze returns list with s added, replacing any earlier snooze
+// for the same item. Expired snoozes are dropped.
+func addSnooze(list []model.Snooze, s *model.Snooze) []model.Snooze {
+	now := time.Now()
+	var out []model.Snooze
+	for _, x := range list {
+		if x.CL == s.CL && x.Issue == s.Issue || !now.Before(x.Until) {
+			continue
+		}
+		out = append(out, x)
+	}
+	return append(out, *s)
+}
+
+// removeSnooze returns list with any snooze for the given CL or issue removed.
+func removeSnooze(list []model.Snooze, clnum string, id int) []model.Snooze {
+	var out []model.Snooze
+	for _, x := range list {
+		if clnum != "" && x.CL == clnum || id > 0 && x.Issue == id {
+			continue
+		}
+		out = append(out, x)
+	}
+	return out
+}
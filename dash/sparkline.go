@@ -0,0 +1,157 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"app"
+	"codereview"
+	"dash/model"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Group activity sparklines.
+//
+// The dash.sparklines cron job counts the CLs opened and closed in each
+// directory in each of the last sparkWeeks weeks, including this one,
+// and stores the counts as the meta value "dash.sparklines".
+// The dashboard draws them as a tiny chart in each directory's group
+// header, so that users can see at a glance which muted directories
+// have become busy again.
+
+// sparkWeeks is the number of weeks of activity in a sparkline.
+const sparkWeeks = 12
+
+// sparkStats is the meta value "dash.sparklines".
+type sparkStats struct {
+	Time  time.Time               // when the counts were computed
+	Start time.Time               // start of the first week
+	Dirs  map[string]*dirActivity // keyed by group name (see model.ItemDir)
+}
+
+// A dirActivity counts a directory's CLs by week, oldest first.
+type dirActivity struct {
+	Opened [sparkWeeks]int
+	Closed [sparkWeeks]int
+}
+
+func init() {
+	app.Cron("dash.sparklines", 6*time.Hour, computeSparklines)
+}
+
+func computeSparklines(ctxt appengine.Context) error {
+	now := time.Now()
+	thisWeek := reportWeek(now).AddDate(0, 0, 7) // the week in progress
+	s := &sparkStats{
+		Time:  now,
+		Start: thisWeek.AddDate(0, 0, -7*(sparkWeeks-1)),
+		Dirs:  make(map[string]*dirActivity),
+	}
+	week := func(t time.Time) int {
+		if t.Before(s.Start) {
+			return -1
+		}
+		w := int(t.Sub(s.Start) / (7 * 24 * time.Hour))
+		if w >= sparkWeeks {
+			return -1
+		}
+		return w
+	}
+
+	it := datastore.NewQuery("CL").Filter("Modified >=", s.Start).Run(ctxt)
+	for {
+		var cl codereview.CL
+		_, err := it.Next(&cl)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			ctxt.Errorf("loading CLs: %v", err)
+			return fmt.Errorf("loading CLs failed")
+		}
+		dir := model.ItemDir(&model.Item{CLs: []*codereview.CL{&cl}})
+		a := s.Dirs[dir]
+		if a == nil {
+			a = new(dirActivity)
+			s.Dirs[dir] = a
+		}
+		if w := week(cl.Created); w >= 0 {
+			a.Opened[w]++
+		}
+		if w := week(cl.Modified); w >= 0 && (cl.Closed || cl.Submitted) {
+			a.Closed[w]++
+		}
+	}
+	return app.WriteMeta(ctxt, "dash.sparklines", s)
+}
+
+// loadSparklines loads the activity counts into d.sparks.
+func (d *display) loadSparklines(ctxt appengine.Context) {
+	var s sparkStats
+	if err := app.ReadMetaCached(ctxt, "dash.sparklines", &s); err != nil {
+		return
+	}
+	d.sparks = &s
+}
+
+// A sparkline holds the precomputed coordinates for
+// the inline SVG chart in a group header.
+type sparkline struct {
+	Width, Height  int
+	Opened, Closed string // polyline points
+	Title          string
+}
+
+const (
+	sparkWidth  = 60
+	sparkHeight = 14
+)
+
+// spark returns the sparkline for the named group,
+// or nil if there was no activity there in the last sparkWeeks weeks.
+func (d *display) spark(dir string) *sparkline {
+	if d.sparks == nil {
+		return nil
+	}
+	a := d.sparks.Dirs[dir]
+	if a == nil {
+		return nil
+	}
+	max, opened, closed := 0, 0, 0
+	for w := 0; w < sparkWeeks; w++ {
+		if max < a.Opened[w] {
+			max = a.Opened[w]
+		}
+		if max < a.Closed[w] {
+			max = a.Closed[w]
+		}
+		opened += a.Opened[w]
+		closed += a.Closed[w]
+	}
+	if max == 0 {
+		return nil
+	}
+	points := func(counts *[sparkWeeks]int) string {
+		var list []string
+		for w, n := range counts {
+			x := float64(w) / float64(sparkWeeks-1) * sparkWidth
+			y := sparkHeight - 1 - float64(n)/float64(max)*(sparkHeight-2)
+			list = append(list, fmt.Sprintf("%.1f,%.1f", x, y))
+		}
+		return strings.Join(list, " ")
+	}
+	return &sparkline{
+		Width:  sparkWidth,
+		Height: sparkHeight,
+		Opened: points(&a.Opened),
+		Closed: points(&a.Closed),
+		Title:  fmt.Sprintf("%d CLs opened, %d closed in the last %d weeks", opened, closed, sparkWeeks),
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"appengine"
+)
+
+// Files in the static directory are served at the top level: /dash.js
+// serves static/dash.js. Templates refer to them using the static
+// function, which adds a fingerprint of the file content (/dash.js?v=1a2b3c4d5e).
+// Fingerprinted URLs can be cached forever, since a new version of the
+// file gets a new URL; other URLs are cached only briefly.
+
+const (
+	staticDir       = "static"
+	staticCacheTime = 10 * time.Minute
+)
+
+type staticFile struct {
+	data []byte
+	hash string
+}
+
+// staticFiles caches the static files, which do not change
+// while an instance is running (except on the development server).
+var staticFiles struct {
+	sync.Mutex
+	m map[string]*staticFile
+}
+
+// loadStatic returns the named static file, which must be a clean
+// path relative to the static directory, or nil if there is no such file.
+func loadStatic(name string) *staticFile {
+	staticFiles.Lock()
+	defer staticFiles.Unlock()
+	if f := staticFiles.m[name]; f != nil && !appengine.IsDevAppServer() {
+		return f
+	}
+	data, err := ioutil.ReadFile(staticDir + "/" + name)
+	if err != nil {
+		return nil
+	}
+	f := &staticFile{
+		data: data,
+		hash: fmt.Sprintf("%x", sha1.Sum(data))[:10],
+	}
+	if staticFiles.m == nil {
+		staticFiles.m = make(map[string]*staticFile)
+	}
+	staticFiles.m[name] = f
+	return f
+}
+
+// staticName returns the name of the static file for the URL path p,
+// or "" if p cannot name a static file.
+func staticName(p string) string {
+	p = path.Clean("/" + p)
+	if strings.Contains(p, "..") || strings.HasPrefix(p, "/.") || strings.Contains(p, "/.") {
+		return ""
+	}
+	return strings.TrimPrefix(p, "/")
+}
+
+// serveStatic serves the static file named by the request URL.
+func serveStatic(w http.ResponseWriter, req *http.Request) {
+	name := staticName(req.URL.Path)
+	if name == "" || req.URL.Path != "/"+name {
+		http.NotFound(w, req)
+		return
+	}
+	f := loadStatic(name)
+	if f == nil {
+		http.NotFound(w, req)
+		return
+	}
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ctype)
+	if v := req.FormValue("v"); v != "" && v == f.hash {
+		w.Header().Set("Cache-Control", "public, max-age=31536000")
+	} else {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(staticCacheTime/time.Second)))
+	}
+	w.Header().Set("ETag", `"`+f.hash+`"`)
+	if req.Header.Get("If-None-Match") == `"`+f.hash+`"` {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write(f.data)
+}
+
+// static returns the fingerprinted URL for the named static file.
+func (d *display) static(name string) string {
+	f := loadStatic(staticName(name))
+	if f == nil {
+		return "/" + name
+	}
+	return "/" + name + "?v=" + f.hash
+}
@@ -0,0 +1,162 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"app"
+	"dash/model"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/mail"
+)
+
+// Users who set UserPref.Summary are mailed a summary of their
+// dashboard every UserPref.SummaryDays days (weekly by default):
+// the items waiting on them, the items waiting on others,
+// and any large CLs in directories they have muted.
+
+const (
+	defaultSummaryDays = 7
+	maxSummaryDays     = 28
+
+	// bigDelta is the number of lines changed that makes a CL
+	// in a muted directory worth mentioning in the summary.
+	bigDelta = 500
+
+	// maxSummaries is the number of summaries sent per cron run.
+	maxSummaries = 20
+)
+
+func init() {
+	app.Cron("dash.summary", 1*time.Hour, sendSummaries)
+}
+
+func summaryOp(ctxt appengine.Context, req *http.Request, op string) (func(*UserPref), error) {
+	return func(pref *UserPref) {
+		pref.Summary = op == "summary"
+	}, nil
+}
+
+func summaryDaysOp(ctxt appengine.Context, req *http.Request, op string) (func(*UserPref), error) {
+	n, err := strconv.Atoi(req.FormValue("days"))
+	if err != nil || n < 1 || n > maxSummaryDays {
+		return nil, fmt.Errorf("days must be between 1 and %d", maxSummaryDays)
+	}
+	return func(pref *UserPref) {
+		pref.SummaryDays = n
+	}, nil
+}
+
+// summaryPeriod returns the time between the user's summaries.
+func (pref *UserPref) summaryPeriod() time.Duration {
+	n := pref.SummaryDays
+	if n <= 0 {
+		n = defaultSummaryDays
+	}
+	return days(float64(n))
+}
+
+// summaryFlag gates the summary mail.
+var summaryFlag = app.Flag("dash.summary", true)
+
+// sendSummaries mails the summaries that are due.
+func sendSummaries(ctxt appengine.Context) error {
+	if !summaryFlag.On(ctxt) {
+		return nil
+	}
+	keys, err := datastore.NewQuery("UserPref").
+		Filter("Summary =", true).
+		KeysOnly().
+		GetAll(ctxt, nil)
+	if err != nil {
+		ctxt.Errorf("loading summary users: %v", err)
+		return err
+	}
+	n := 0
+	for _, key := range keys {
+		email := key.StringID()
+		var pref UserPref
+		if err := app.ReadData(ctxt, "UserPref", email, &pref); err != nil {
+			continue
+		}
+		if time.Since(pref.SummarySent) < pref.summaryPeriod() {
+			continue
+		}
+		if n >= maxSummaries {
+			return app.ErrMoreCron
+		}
+		n++
+		if err := sendSummary(ctxt, email); err != nil {
+			ctxt.Errorf("summary for %s: %v", email, err)
+			continue
+		}
+		updatePref(ctxt, email, func(pref *UserPref) {
+			pref.SummarySent = time.Now()
+		})
+	}
+	return nil
+}
+
+// sendSummary mails the summary to the user with the given email address.
+func sendSummary(ctxt appengine.Context, email string) error {
+	d := display{email: email}
+	d.loadPref(ctxt)
+	dm, err := loadModel(ctxt, &d, model.AllItems)
+	if err != nil {
+		return err
+	}
+	if len(dm.Warnings) > 0 {
+		// Try again next time rather than mail an incomplete summary.
+		return fmt.Errorf("%s", dm.Warnings[0])
+	}
+	work := dm.work(&d)
+	big := dm.mutedDirItems(&d, func(item *model.Item) bool {
+		for _, cl := range item.CLs {
+			if cl.Delta >= bigDelta {
+				return true
+			}
+		}
+		return false
+	})
+	model.SortBySummary(big)
+	if len(work.NeedsAction) == 0 && len(work.Waiting) == 0 && len(big) == 0 {
+		return nil
+	}
+
+	t, err := loadTemplate(ctxt, "summary.html", &d)
+	if err != nil {
+		return err
+	}
+	data := struct {
+		User string
+		Host string
+		Big  []*model.Item
+		*Work
+	}{
+		email,
+		appengine.DefaultVersionHostname(ctxt),
+		big,
+		work,
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return fmt.Errorf("executing template: %v", err)
+	}
+
+	msg := &mail.Message{
+		Sender:   fmt.Sprintf("Go dashboard <noreply@%s.appspotmail.com>", appengine.AppID(ctxt)),
+		To:       []string{email},
+		Subject:  fmt.Sprintf("Go dashboard: %d items need your action", len(work.NeedsAction)),
+		HTMLBody: buf.String(),
+	}
+	return mail.Send(ctxt, msg)
+}
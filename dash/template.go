@@ -0,0 +1,226 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"app"
+	"codereview"
+
+	"appengine"
+	"appengine/memcache"
+)
+
+// funcs returns the template functions bound to the display state d.
+func (d *display) funcs() template.FuncMap {
+	return template.FuncMap{
+		"added":    d.isAdded,
+		"away":     d.awayRecord,
+		"build":    d.build,
+		"css":      d.css,
+		"join":     d.join,
+		"mine":     d.mine,
+		"muted":    d.muted,
+		"newcomer": d.isNewcomer,
+		"old":      d.old,
+		"overdue":  d.overdue,
+		"owners":   d.dirOwners,
+		"profile":  d.profile,
+		"replace":  strings.Replace,
+		"reviewer": d.reviewer,
+		"second":   d.second,
+		"short":    d.short,
+		"since":    d.since,
+		"spark":    d.spark,
+		"static":   d.static,
+		"suggest":  d.suggest,
+		"watched":  d.isWatched,
+		"when":     d.when,
+	}
+}
+
+// Templates are parsed once per instance and then cloned for each request,
+// so that the display-specific functions can be bound to the clone.
+// On the development server, templates are reparsed on every request,
+// so that edits show up without restarting the server.
+var templates struct {
+	sync.Mutex
+	m map[string]*template.Template
+}
+
+// commonTemplate is the file holding the templates, such as "person",
+// shared by all the pages. It is parsed along with each page.
+const commonTemplate = "common.tmpl"
+
+// parseTemplate reads and parses the named file from the template directory,
+// along with the common templates.
+func parseTemplate(name string) (*template.Template, error) {
+	data, err := ioutil.ReadFile("template/" + name)
+	if err != nil {
+		return nil, fmt.Errorf("reading template: %v", err)
+	}
+	common, err := ioutil.ReadFile("template/" + commonTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("reading template: %v", err)
+	}
+	t, err := template.New("main").Funcs(new(display).funcs()).Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("parsing template: %v", err)
+	}
+	if _, err := t.New(commonTemplate).Parse(string(common)); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", commonTemplate, err)
+	}
+	return t, nil
+}
+
+// loadTemplate returns the named template, with its functions bound to d.
+// It also loads the profiles, away records, and configuration
+// used by the template functions.
+func loadTemplate(ctxt appengine.Context, name string, d *display) (*template.Template, error) {
+	if d.profiles == nil {
+		d.profiles = loadProfiles(ctxt)
+		d.sla = loadSLA(ctxt)
+		d.away, _ = codereview.LoadAway(ctxt, time.Now())
+	}
+	templates.Lock()
+	t := templates.m[name]
+	templates.Unlock()
+
+	if t == nil || appengine.IsDevAppServer() {
+		var err error
+		t, err = parseTemplate(name)
+		if err != nil {
+			ctxt.Errorf("%s: %v", name, err)
+			return nil, err
+		}
+		templates.Lock()
+		if templates.m == nil {
+			templates.m = make(map[string]*template.Template)
+		}
+		templates.m[name] = t
+		templates.Unlock()
+	}
+
+	t, err := t.Clone()
+	if err != nil {
+		ctxt.Errorf("%s: cloning template: %v", name, err)
+		return nil, err
+	}
+	return t.Funcs(d.funcs()), nil
+}
+
+func init() {
+	// Parse the main dashboard template at startup, both to
+	// save time during the first request and to catch errors early.
+	if t, err := parseTemplate("dash.html"); err == nil {
+		templates.m = map[string]*template.Template{"dash.html": t}
+	}
+
+	app.RegisterWarmup("dash", warmup)
+}
+
+// warmup parses the remaining templates and loads the configuration
+// used by the template functions into memcache.
+func warmup(ctxt appengine.Context) error {
+	files, err := ioutil.ReadDir("template")
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		name := fi.Name()
+		if !strings.HasSuffix(name, ".html") {
+			continue
+		}
+		templates.Lock()
+		t := templates.m[name]
+		templates.Unlock()
+		if t != nil {
+			continue
+		}
+		t, err := parseTemplate(name)
+		if err != nil {
+			ctxt.Errorf("%s: %v", name, err)
+			continue
+		}
+		templates.Lock()
+		if templates.m == nil {
+			templates.m = make(map[string]*template.Template)
+		}
+		templates.m[name] = t
+		templates.Unlock()
+	}
+	loadProfiles(ctxt)
+	loadSLA(ctxt)
+	return nil
+}
+
+// pageCacheTime is how long rendered pages are cached in memcache.
+// Pages are also invalidated by bumping the page version (see bumpPageVersion),
+// but changes made by the background loaders only show up after the cache
+// entry expires.
+const pageCacheTime = 1 * time.Minute
+
+// pageVersion returns the current page cache version.
+func pageVersion(ctxt appengine.Context) uint64 {
+	v, err := memcache.Increment(ctxt, "dash.pageversion", 0, 1)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// bumpPageVersion invalidates all cached pages.
+// It is called after any operation that changes what a page displays.
+// It also bumps the app's data version, so that clients holding
+// the old page in their HTTP caches refetch it.
+func bumpPageVersion(ctxt appengine.Context) {
+	memcache.Increment(ctxt, "dash.pageversion", 1, 1)
+	app.BumpDataVersion(ctxt)
+}
+
+// pageCacheKey returns the memcache key for the page with the
+// given path and query, as seen by the user with the given email address.
+func pageCacheKey(ctxt appengine.Context, email, path, query string) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\x00%s?%s", email, path, query)
+	return fmt.Sprintf("dash.page.%d.%d.%x", pageVersion(ctxt), app.DataVersion(ctxt), h.Sum(nil))
+}
+
+// notModified sets the ETag and Last-Modified headers for the response
+// to the given request made by the user with the given email address.
+// If the request's If-None-Match or If-Modified-Since header shows that
+// the client already has the current response, notModified replies
+// with a 304 and returns true.
+func notModified(ctxt appengine.Context, w http.ResponseWriter, req *http.Request, email string) bool {
+	v := app.DataVersion(ctxt)
+	h := sha1.New()
+	// Include the half-day in the hash so that pages are refetched,
+	// with fresh XSRF tokens, before the tokens expire.
+	fmt.Fprintf(h, "%s\x00%s\x00%d\x00%d", email, req.URL.RequestURI(), pageVersion(ctxt), time.Now().Unix()/(12*3600))
+	etag := fmt.Sprintf(`"%d-%x"`, v, h.Sum(nil)[:8])
+	mtime := app.DataVersionTime(v).UTC()
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", mtime.Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "private, no-cache")
+
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		if inm != etag {
+			return false
+		}
+	} else if ims, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err != nil || mtime.After(ims.Add(1*time.Second)) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
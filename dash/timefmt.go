@@ -0,0 +1,114 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"appengine"
+)
+
+// Time display.
+//
+// The dashboard shows times as the time elapsed since them, in days by
+// default. Users can choose (UserPref.TimeFormat) to see the elapsed time
+// in the largest sensible unit instead, or the time itself in their own
+// time zone (UserPref.TimeZone). Whatever the choice, the time itself is
+// also available as a tooltip (see when). The JSON API is unaffected:
+// it always uses RFC 3339 timestamps.
+
+// The values of UserPref.TimeFormat.
+const (
+	timeDays     = "days"     // "1.5 days ago"; the default
+	timeRelative = "relative" // "3 hours ago"
+	timeAbsolute = "absolute" // "2014-03-01 09:30 EST"
+)
+
+// location returns the user's time zone, or UTC if they have not set one.
+func (d *display) location() *time.Location {
+	if d.loc == nil {
+		d.loc = time.UTC
+		if d.pref.TimeZone != "" {
+			if loc, err := time.LoadLocation(d.pref.TimeZone); err == nil {
+				d.loc = loc
+			}
+		}
+	}
+	return d.loc
+}
+
+// since returns the time t in the user's preferred format,
+// by default the elapsed time since t as a number of days.
+func (d *display) since(t time.Time) string {
+	switch d.pref.TimeFormat {
+	case timeAbsolute:
+		return d.when(t)
+	case timeRelative:
+		return relative(time.Since(t)) + " ago"
+	}
+	// NOTE: Considered changing the unit (hours, days, weeks)
+	// but that made it harder to scan through the table.
+	// If it's always days, that's one less thing you have to read.
+	// Otherwise 1 week might be misread as worse than 6 hours.
+	// Users who prefer units can choose the relative format.
+	dt := time.Since(t)
+	return fmt.Sprintf("%.1f days ago", float64(dt)/float64(24*time.Hour))
+}
+
+// when returns the time t in the user's time zone.
+func (d *display) when(t time.Time) string {
+	return t.In(d.location()).Format("2006-01-02 15:04 MST")
+}
+
+// relative returns dt in the largest unit that leaves it at least 1,
+// such as "3 hours" or "2 weeks".
+func relative(dt time.Duration) string {
+	units := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"week", 7 * 24 * time.Hour},
+		{"day", 24 * time.Hour},
+		{"hour", time.Hour},
+		{"minute", time.Minute},
+	}
+	for _, u := range units {
+		if n := int(dt / u.d); n >= 1 {
+			if n == 1 {
+				return "1 " + u.name
+			}
+			return fmt.Sprintf("%d %ss", n, u.name)
+		}
+	}
+	return "less than a minute"
+}
+
+func timeZoneOp(ctxt appengine.Context, req *http.Request, op string) (func(*UserPref), error) {
+	tz := strings.TrimSpace(req.FormValue("tz"))
+	if tz != "" {
+		if _, err := time.LoadLocation(tz); err != nil {
+			return nil, fmt.Errorf("unknown time zone %q; use a name like America/New_York", tz)
+		}
+	}
+	return func(pref *UserPref) {
+		pref.TimeZone = tz
+	}, nil
+}
+
+func timeFormatOp(ctxt appengine.Context, req *http.Request, op string) (func(*UserPref), error) {
+	format := req.FormValue("format")
+	switch format {
+	case timeDays, timeRelative, timeAbsolute:
+		// ok
+	default:
+		return nil, fmt.Errorf("invalid time format %q", format)
+	}
+	return func(pref *UserPref) {
+		pref.TimeFormat = format
+	}, nil
+}
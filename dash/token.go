@@ -0,0 +1,188 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"app"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+)
+
+// An APIToken lets a program act as a user when calling the dashboard's
+// /api/ endpoints and /uiop, by sending "Authorization: Bearer <token>".
+// Tokens are stored in the datastore under the SHA-256 hash of the token,
+// so the token itself is only ever seen by the user, once, when it is created.
+type APIToken struct {
+	Email    string
+	Name     string
+	Created  time.Time
+	LastUsed time.Time `datastore:",noindex"`
+}
+
+func init() {
+	app.Handle("/tokens", showTokens)
+}
+
+func tokenHash(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
+// bearerToken returns the token in the request's Authorization header, if any.
+func bearerToken(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+}
+
+// tokenEmail returns the email address of the user owning the token,
+// or the empty string if the token is not valid.
+func tokenEmail(ctxt appengine.Context, token string) string {
+	var t APIToken
+	key := tokenHash(token)
+	if err := app.ReadData(ctxt, "APIToken", key, &t); err != nil {
+		return ""
+	}
+	if time.Since(t.LastUsed) > 1*time.Hour {
+		t.LastUsed = time.Now()
+		app.WriteData(ctxt, "APIToken", key, &t)
+	}
+	return t.Email
+}
+
+// requestEmail is like findEmail but also accepts API tokens.
+// It reports whether the user was identified by a token,
+// in which case XSRF checks are unnecessary.
+// A request presenting an invalid token is treated as anonymous,
+// even if it also carries a login cookie.
+func requestEmail(ctxt appengine.Context, req *http.Request) (email string, byToken bool) {
+	if token := bearerToken(req); token != "" {
+		return tokenEmail(ctxt, token), true
+	}
+	return findEmail(ctxt), false
+}
+
+// newToken creates and stores a new token for the user with the given email address.
+func newToken(ctxt appengine.Context, email, name string) (string, error) {
+	b := make([]byte, 24)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	token := fmt.Sprintf("%x", b)
+	t := &APIToken{Email: email, Name: name, Created: time.Now()}
+	if err := app.WriteData(ctxt, "APIToken", tokenHash(token), t); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// revokeToken deletes the user's token with the given hash.
+func revokeToken(ctxt appengine.Context, email, hash string) error {
+	return app.Transaction(ctxt, func(ctxt appengine.Context) error {
+		var t APIToken
+		if err := app.ReadData(ctxt, "APIToken", hash, &t); err != nil {
+			return err
+		}
+		if t.Email != email {
+			return fmt.Errorf("not your token")
+		}
+		return app.DeleteData(ctxt, "APIToken", hash)
+	})
+}
+
+// listTokens returns the tokens of the user with the given email address,
+// along with their hashes, which identify them to revokeToken.
+func listTokens(ctxt appengine.Context, email string) ([]*APIToken, []string, error) {
+	var tokens []*APIToken
+	keys, err := datastore.NewQuery("APIToken").
+		Filter("Email =", email).
+		GetAll(ctxt, &tokens)
+	if err != nil {
+		ctxt.Errorf("loading tokens: %v", err)
+		return nil, nil, err
+	}
+	var hashes []string
+	for _, k := range keys {
+		hashes = append(hashes, k.StringID())
+	}
+	return tokens, hashes, nil
+}
+
+// showTokens serves /tokens, where logged-in users manage their API tokens.
+func showTokens(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	var d display
+	d.email = findEmail(ctxt)
+	if d.email == "" {
+		url, err := user.LoginURL(ctxt, "/tokens")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		http.Redirect(w, req, url, 302)
+		return
+	}
+
+	var data struct {
+		User     string
+		XSRF     string
+		NewToken string
+		Error    string
+		Tokens   []*APIToken
+		Hashes   []string
+	}
+	data.User = d.email
+	data.XSRF = app.XSRFToken(ctxt, d.email, "tokens")
+
+	if req.Method == "POST" {
+		if !app.ValidXSRFToken(ctxt, req.FormValue("xsrf"), d.email, "tokens") {
+			http.Error(w, "invalid XSRF token; reload the page", 403)
+			return
+		}
+		var err error
+		switch req.FormValue("op") {
+		case "create":
+			data.NewToken, err = newToken(ctxt, d.email, req.FormValue("name"))
+		case "revoke":
+			err = revokeToken(ctxt, d.email, req.FormValue("hash"))
+		default:
+			err = fmt.Errorf("invalid op")
+		}
+		if err != nil {
+			data.Error = err.Error()
+		}
+	}
+
+	var err error
+	data.Tokens, data.Hashes, err = listTokens(ctxt, d.email)
+	if err != nil {
+		http.Error(w, "loading tokens failed", 500)
+		return
+	}
+
+	t, err := loadTemplate(ctxt, "tokens.html", &d)
+	if err != nil {
+		fmt.Fprintf(w, "error loading template\n")
+		return
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		ctxt.Errorf("execute: %v", err)
+		fmt.Fprintf(w, "error executing template\n")
+		return
+	}
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,169 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"app"
+	"codereview"
+	"issue"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+func init() {
+	app.Handle("/triage", showTriage)
+}
+
+// triagePriorities are the priorities offered on the triage page,
+// each corresponding to a Priority-X label.
+var triagePriorities = []string{"Critical", "High", "Medium", "Low", "Later"}
+
+// needsTriage reports whether the issue has no priority label,
+// which includes having no labels at all, unless it has already
+// been marked as needing a decision.
+func needsTriage(bug *issue.Issue) bool {
+	if bug.Status == "NeedsDecision" {
+		return false
+	}
+	for _, l := range bug.Label {
+		if strings.HasPrefix(l, "Priority-") {
+			return false
+		}
+	}
+	return true
+}
+
+func showTriage(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	var d display
+	d.email = findEmail(ctxt)
+
+	var bugs []*issue.Issue
+	_, err := datastore.NewQuery("Issue").
+		Filter("State =", "open").
+		Order("-Created").
+		Limit(1000).
+		GetAll(ctxt, &bugs)
+	if err != nil {
+		ctxt.Errorf("loading issues: %v", err)
+		fmt.Fprintf(w, "loading issues failed\n")
+		return
+	}
+	var list []*issue.Issue
+	security := canSeeRestricted(ctxt, req)
+	for _, bug := range bugs {
+		if bug.Restricted && !security {
+			continue
+		}
+		if needsTriage(bug) {
+			list = append(list, bug)
+		}
+	}
+
+	t, err := loadTemplate(ctxt, "triage.html", &d)
+	if err != nil {
+		fmt.Fprintf(w, "error loading template\n")
+		return
+	}
+
+	data := struct {
+		User       string
+		XSRF       string
+		Triager    bool
+		Priorities []string
+		Issues     []*issue.Issue
+		Suggested  map[int]*LabelSuggestion
+	}{
+		User:       d.email,
+		Triager:    userRole(ctxt, req, d.email, false) >= app.Triager,
+		Priorities: triagePriorities,
+		Issues:     list,
+		Suggested:  loadSuggestions(ctxt, list),
+	}
+	if data.Triager {
+		data.XSRF = app.XSRFToken(ctxt, d.email, "uiop")
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		ctxt.Errorf("execute: %v", err)
+		fmt.Fprintf(w, "error executing template\n")
+		return
+	}
+	w.Write(buf.Bytes())
+}
+
+// triageUpdate returns the issue update for the triage operation op
+// requested by the committer with the given email address.
+func triageUpdate(req *http.Request, op, email string) (*issue.Update, error) {
+	u := &issue.Update{
+		Comment: fmt.Sprintf("(triaged by %s via the Go dashboard)", email),
+	}
+	switch op {
+	case "setpriority":
+		p := req.FormValue("priority")
+		ok := false
+		for _, x := range triagePriorities {
+			if p == x {
+				ok = true
+			} else {
+				u.Label = append(u.Label, "-Priority-"+x)
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("invalid priority %q", p)
+		}
+		u.Label = append(u.Label, "Priority-"+p)
+	case "setowner":
+		who := codereview.ExpandReviewer(req.FormValue("owner"))
+		if who == "" {
+			return nil, fmt.Errorf("unknown owner")
+		}
+		u.Owner = who
+		u.Status = "Accepted"
+	case "needsdecision":
+		u.Status = "NeedsDecision"
+	case "addlabels":
+		u.Label = strings.Fields(req.FormValue("labels"))
+		if len(u.Label) == 0 {
+			return nil, fmt.Errorf("missing labels")
+		}
+		for _, l := range u.Label {
+			if strings.HasPrefix(l, "-") {
+				return nil, fmt.Errorf("invalid label %q", l)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("invalid triage operation")
+	}
+	return u, nil
+}
+
+// triage performs the triage uiop operations.
+func triage(ctxt appengine.Context, req *http.Request, op string, d *display) error {
+	if d.role < app.Triager {
+		return fmt.Errorf("only triagers can triage issues")
+	}
+	id, err := strconv.Atoi(req.FormValue("issue"))
+	if err != nil || id <= 0 {
+		return fmt.Errorf("missing issue")
+	}
+	u, err := triageUpdate(req, op, d.email)
+	if err != nil {
+		return err
+	}
+	if err := issue.Post(ctxt, id, u); err != nil {
+		ctxt.Errorf("triage issue %d: %v", id, err)
+		return fmt.Errorf("updating issue failed")
+	}
+	bumpPageVersion(ctxt)
+	return nil
+}
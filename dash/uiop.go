@@ -0,0 +1,486 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"app"
+	"codereview"
+	"identity"
+
+	"appengine"
+)
+
+func init() {
+	app.Handle("/uiop", uiOperation)
+}
+
+func uiOperation(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	email, byToken := requestEmail(ctxt, req)
+	d := display{email: email}
+	if d.email == "" {
+		w.WriteHeader(501)
+		fmt.Fprintf(w, "must be logged in")
+		return
+	}
+	d.role = userRole(ctxt, req, d.email, byToken)
+	if req.Method != "POST" {
+		w.WriteHeader(501)
+		fmt.Fprintf(w, "must POST")
+		return
+	}
+
+	// Record the request and its result (see audit.go).
+	aw := &auditWriter{ResponseWriter: w, status: 200}
+	defer recordAction(ctxt, d.email, byToken, req, aw)
+	w = aw
+
+	if !byToken && !app.ValidXSRFToken(ctxt, req.FormValue("xsrf"), d.email, "uiop") {
+		w.WriteHeader(403)
+		fmt.Fprintf(w, "invalid XSRF token; reload the page")
+		return
+	}
+	op := req.FormValue("op")
+	switch {
+	default:
+		w.WriteHeader(501)
+		fmt.Fprintf(w, "invalid verb")
+		return
+
+	case op == "batch":
+		batchOperation(ctxt, w, req, &d)
+		return
+
+	case prefOps[op] != nil:
+		edit, err := prefOps[op](ctxt, req, op)
+		if err != nil {
+			w.WriteHeader(501)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+		if err := updatePref(ctxt, d.email, edit); err != nil {
+			w.WriteHeader(501)
+			fmt.Fprintf(w, "unable to update")
+			return
+		}
+
+	case actionOps[op] != nil:
+		result, err := actionOps[op](ctxt, req, op, &d)
+		if err != nil {
+			w.WriteHeader(501)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+		if result != nil {
+			js, err := json.Marshal(result)
+			if err != nil {
+				w.WriteHeader(501)
+				fmt.Fprintf(w, "encoding response: %v", err)
+				return
+			}
+			writeJSON(w, js)
+		}
+
+	case op == "reviewer":
+		clnum := req.FormValue("cl")
+		who := req.FormValue("reviewer")
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		switch who {
+		case "close", "golang-dev":
+			// ok
+		default:
+			var candidates []string
+			who, candidates = codereview.ResolveReviewer(ctxt, who)
+			if who == "" && len(candidates) > 0 {
+				fmt.Fprintf(w, "ERROR: ambiguous reviewer; did you mean %s?", strings.Join(candidates, ", "))
+				return
+			}
+		}
+		if who == "" {
+			fmt.Fprintf(w, "ERROR: unknown reviewer")
+			return
+		}
+		if err := checkReassign(ctxt, &d, clnum); err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+			return
+		}
+		if err := codereview.SetReviewerBy(ctxt, clnum, who, d.email); err != nil {
+			fmt.Fprintf(w, "ERROR: setting reviewer: %v", err)
+			return
+		}
+		bumpPageVersion(ctxt)
+		var cl codereview.CL
+		if err := app.ReadData(ctxt, "CL", clnum, &cl); err != nil {
+			fmt.Fprintf(w, "ERROR: refreshing CL: %v", err)
+			return
+		}
+		fmt.Fprintf(w, "%s", d.short(d.reviewer(&cl)))
+		return
+	}
+}
+
+// A prefOp checks the arguments to a uiop operation that
+// changes only the user's preferences and returns the change to make.
+// Keeping the change separate from the check lets a batch apply the
+// changes for all its operations in a single transaction.
+type prefOp func(ctxt appengine.Context, req *http.Request, op string) (func(*UserPref), error)
+
+// An actionOp performs a uiop operation that acts on the outside world,
+// such as assigning a reviewer. If it returns a non-nil result,
+// the result is sent back to the client as JSON.
+type actionOp func(ctxt appengine.Context, req *http.Request, op string, d *display) (interface{}, error)
+
+var prefOps = map[string]prefOp{
+	"mute":         muteOp,
+	"unmute":       muteOp,
+	"mutecl":       muteCLOp,
+	"unmutecl":     muteCLOp,
+	"muteissue":    muteIssueOp,
+	"unmuteissue":  muteIssueOp,
+	"saveview":     saveViewOp,
+	"deleteview":   deleteViewOp,
+	"snooze":       snoozeOp,
+	"unsnooze":     unsnoozeOp,
+	"summary":      summaryOp,
+	"nosummary":    summaryOp,
+	"summarydays":  summaryDaysOp,
+	"watchcl":      watchCLOp,
+	"unwatchcl":    watchCLOp,
+	"watchissue":   watchIssueOp,
+	"unwatchissue": watchIssueOp,
+	"watchdir":     watchDirOp,
+	"unwatchdir":   watchDirOp,
+	"watchmail":    watchMailOp,
+	"nowatchmail":  watchMailOp,
+	"watchhook":    watchHookOp,
+	"watchurgent":  watchUrgentOp,
+	"watchall":     watchUrgentOp,
+	"timezone":     timeZoneOp,
+	"timeformat":   timeFormatOp,
+}
+
+var actionOps = map[string]actionOp{
+	"claim":         assignOp,
+	"assign":        assignOp,
+	"lgtm":          lgtmOp,
+	"notlgtm":       lgtmOp,
+	"needs-second":  secondOp,
+	"no-second":     secondOp,
+	"setpriority":   triageOp,
+	"setowner":      triageOp,
+	"needsdecision": triageOp,
+	"addlabels":     triageOp,
+}
+
+func muteOp(ctxt appengine.Context, req *http.Request, op string) (func(*UserPref), error) {
+	targ := req.FormValue("dir")
+	if targ == "" {
+		return nil, fmt.Errorf("missing dir")
+	}
+	return func(pref *UserPref) {
+		pref.Muted = toggleString(pref.Muted, targ, op == "mute")
+	}, nil
+}
+
+func muteCLOp(ctxt appengine.Context, req *http.Request, op string) (func(*UserPref), error) {
+	targ := req.FormValue("cl")
+	if _, err := strconv.Atoi(targ); err != nil {
+		return nil, fmt.Errorf("missing cl")
+	}
+	return func(pref *UserPref) {
+		pref.MutedCLs = toggleString(pref.MutedCLs, targ, op == "mutecl")
+	}, nil
+}
+
+func muteIssueOp(ctxt appengine.Context, req *http.Request, op string) (func(*UserPref), error) {
+	targ, err := strconv.Atoi(req.FormValue("issue"))
+	if err != nil || targ <= 0 {
+		return nil, fmt.Errorf("missing issue")
+	}
+	return func(pref *UserPref) {
+		pref.MutedIssues = toggleInt(pref.MutedIssues, targ, op == "muteissue")
+	}, nil
+}
+
+func saveViewOp(ctxt appengine.Context, req *http.Request, op string) (func(*UserPref), error) {
+	view, err := viewFromForm(req, nil)
+	if err != nil {
+		return nil, err
+	}
+	view.Name = req.FormValue("name")
+	if view.Name == "" {
+		return nil, fmt.Errorf("missing name")
+	}
+	return func(pref *UserPref) {
+		pref.Views = removeView(pref.Views, view.Name)
+		pref.Views = append(pref.Views, *view)
+		sort.Sort(viewsByName(pref.Views))
+	}, nil
+}
+
+func deleteViewOp(ctxt appengine.Context, req *http.Request, op string) (func(*UserPref), error) {
+	name := req.FormValue("name")
+	return func(pref *UserPref) {
+		pref.Views = removeView(pref.Views, name)
+	}, nil
+}
+
+func snoozeOp(ctxt appengine.Context, req *http.Request, op string) (func(*UserPref), error) {
+	snooze, err := snoozeFromForm(ctxt, req)
+	if err != nil {
+		return nil, err
+	}
+	return func(pref *UserPref) {
+		pref.Snoozed = addSnooze(pref.Snoozed, snooze)
+	}, nil
+}
+
+func unsnoozeOp(ctxt appengine.Context, req *http.Request, op string) (func(*UserPref), error) {
+	clnum := req.FormValue("cl")
+	id, _ := strconv.Atoi(req.FormValue("issue"))
+	if clnum == "" && id <= 0 {
+		return nil, fmt.Errorf("missing cl or issue")
+	}
+	return func(pref *UserPref) {
+		pref.Snoozed = removeSnooze(pref.Snoozed, clnum, id)
+	}, nil
+}
+
+func assignOp(ctxt appengine.Context, req *http.Request, op string, d *display) (interface{}, error) {
+	clnum := req.FormValue("cl")
+	who := d.email
+	if op == "assign" {
+		who = codereview.ExpandReviewer(req.FormValue("reviewer"))
+	}
+	if codereview.IsReviewer(who) == "" {
+		return nil, fmt.Errorf("unknown reviewer")
+	}
+	if err := checkReassign(ctxt, d, clnum); err != nil {
+		return nil, err
+	}
+	if err := codereview.SetReviewerBy(ctxt, clnum, who, d.email); err != nil {
+		return nil, fmt.Errorf("setting reviewer: %v", err)
+	}
+	bumpPageVersion(ctxt)
+	return map[string]string{
+		"CL":       clnum,
+		"Reviewer": who,
+		"Short":    d.short(who).(string),
+	}, nil
+}
+
+func lgtmOp(ctxt appengine.Context, req *http.Request, op string, d *display) (interface{}, error) {
+	if err := codereview.SendLGTM(ctxt, req.FormValue("cl"), d.email, op == "lgtm"); err != nil {
+		return nil, fmt.Errorf("sending %s: %v", op, err)
+	}
+	bumpPageVersion(ctxt)
+	return nil, nil
+}
+
+func secondOp(ctxt appengine.Context, req *http.Request, op string, d *display) (interface{}, error) {
+	if err := codereview.SetNeedsSecond(ctxt, req.FormValue("cl"), d.email, op == "needs-second"); err != nil {
+		return nil, fmt.Errorf("%s: %v", op, err)
+	}
+	bumpPageVersion(ctxt)
+	return nil, nil
+}
+
+func triageOp(ctxt appengine.Context, req *http.Request, op string, d *display) (interface{}, error) {
+	return nil, triage(ctxt, req, op, d)
+}
+
+// userRole returns the role of the user with the given email address
+// making the request (see app.RequestRole); byToken says whether the user
+// was identified by an API token, not by logging in. Committers are
+// triagers even without a stored role.
+func userRole(ctxt appengine.Context, req *http.Request, email string, byToken bool) app.Role {
+	r := app.RoleOf(ctxt, email)
+	if !byToken {
+		if rr := app.RequestRole(ctxt, req); rr > r {
+			r = rr
+		}
+	}
+	if r < app.Triager && codereview.IsReviewer(email) != "" {
+		r = app.Triager
+	}
+	return r
+}
+
+// checkReassign returns an error if the user d.email may not change the
+// reviewer of the CL. Triagers may reassign any CL; other users only
+// their own CLs and the CLs they are the primary reviewer of.
+func checkReassign(ctxt appengine.Context, d *display, clnum string) error {
+	if d.role >= app.Triager {
+		return nil
+	}
+	var cl codereview.CL
+	if err := app.ReadData(ctxt, "CL", clnum, &cl); err != nil {
+		return fmt.Errorf("unknown CL %s", clnum)
+	}
+	dir := identity.Load(ctxt)
+	if dir.Same(d.email, cl.OwnerEmail) || dir.Same(d.email, cl.PrimaryReviewer) {
+		return nil
+	}
+	return fmt.Errorf("only triagers can reassign other people's CLs")
+}
+
+// maxBatch limits the number of operations in a single batch.
+const maxBatch = 100
+
+// A batchResult is the result of a single operation in a batch.
+type batchResult struct {
+	OK     bool
+	Error  string      `json:",omitempty"`
+	Result interface{} `json:",omitempty"`
+}
+
+// batchOperation runs the operations given as a JSON array in the ops parameter.
+// Each operation is a JSON object holding the parameters that would be sent
+// for that operation alone, such as {"op": "mute", "dir": "net"}.
+// The changes to the user's preferences are applied in a single transaction,
+// after all other operations have run. The response is a JSON array
+// of results, one for each operation.
+func batchOperation(ctxt appengine.Context, w http.ResponseWriter, req *http.Request, d *display) {
+	var ops []map[string]string
+	if err := json.Unmarshal([]byte(req.FormValue("ops")), &ops); err != nil {
+		w.WriteHeader(501)
+		fmt.Fprintf(w, "invalid ops: %v", err)
+		return
+	}
+	if len(ops) > maxBatch {
+		w.WriteHeader(501)
+		fmt.Fprintf(w, "too many ops")
+		return
+	}
+
+	results := make([]batchResult, len(ops))
+	var (
+		edits   []func(*UserPref)
+		editIdx []int
+	)
+	for i, args := range ops {
+		form := make(url.Values)
+		for k, v := range args {
+			form.Set(k, v)
+		}
+		r := &http.Request{Method: "POST", URL: &url.URL{}, Form: form, PostForm: form}
+		op := form.Get("op")
+		var err error
+		switch {
+		default:
+			err = fmt.Errorf("invalid verb")
+		case prefOps[op] != nil:
+			var edit func(*UserPref)
+			edit, err = prefOps[op](ctxt, r, op)
+			if err == nil {
+				edits = append(edits, edit)
+				editIdx = append(editIdx, i)
+				continue
+			}
+		case actionOps[op] != nil:
+			results[i].Result, err = actionOps[op](ctxt, r, op, d)
+		}
+		if err != nil {
+			results[i].Error = err.Error()
+		} else {
+			results[i].OK = true
+		}
+	}
+
+	if len(edits) > 0 {
+		err := updatePref(ctxt, d.email, func(pref *UserPref) {
+			for _, edit := range edits {
+				edit(pref)
+			}
+		})
+		for _, i := range editIdx {
+			if err != nil {
+				results[i].Error = "unable to update"
+			} else {
+				results[i].OK = true
+			}
+		}
+	}
+
+	js, err := json.Marshal(results)
+	if err != nil {
+		w.WriteHeader(501)
+		fmt.Fprintf(w, "encoding response: %v", err)
+		return
+	}
+	writeJSON(w, js)
+}
+
+// updatePref applies f to the stored preferences for the user with the given email.
+func updatePref(ctxt appengine.Context, email string, f func(*UserPref)) error {
+	err := app.Transaction(ctxt, func(ctxt appengine.Context) error {
+		var pref UserPref
+		app.ReadData(ctxt, "UserPref", email, &pref)
+		f(&pref)
+		return app.WriteData(ctxt, "UserPref", email, &pref)
+	})
+	if err == nil {
+		bumpPageVersion(ctxt)
+	}
+	return err
+}
+
+// toggleString adds s to the sorted list if on is true,
+// or removes s from the list if on is false.
+func toggleString(list []string, s string, on bool) []string {
+	for i, x := range list {
+		if x == s {
+			if !on {
+				list = append(list[:i], list[i+1:]...)
+			}
+			return list
+		}
+	}
+	if on {
+		list = append(list, s)
+		sort.Strings(list)
+	}
+	return list
+}
+
+// toggleInt is like toggleString but for lists of ints.
+func toggleInt(list []int, n int, on bool) []int {
+	for i, x := range list {
+		if x == n {
+			if !on {
+				list = append(list[:i], list[i+1:]...)
+			}
+			return list
+		}
+	}
+	if on {
+		list = append(list, n)
+		sort.Ints(list)
+	}
+	return list
+}
+
+// removeView returns views with the view with the given name removed.
+func removeView(views []View, name string) []View {
+	for i := range views {
+		if views[i].Name == name {
+			return append(views[:i], views[i+1:]...)
+		}
+	}
+	return views
+}
+
+type viewsByName []View
+
+func (x viewsByName) Len() int           { return len(x) }
+func (x viewsByName) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+func (x viewsByName) Less(i, j int) bool { return x[i].Name < x[j].Name }
@@ -0,0 +1,182 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"app"
+	"codereview"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/mail"
+	"appengine/memcache"
+)
+
+func init() {
+	app.Handle("/unassigned", showUnassigned)
+	app.Cron("dash.escalate", 1*time.Hour, escalateUnassigned)
+}
+
+// unassignedConfig configures the escalation of unassigned CLs.
+// It is read from the "dash.unassigned" config (see app.ReadConfig).
+// If EscalateDays is positive, the owners of the directories an
+// unassigned CL modifies are mailed once it has been waiting that
+// many days without a reviewer.
+type unassignedConfig struct {
+	EscalateDays float64
+}
+
+// An Escalation records that the owners were mailed about an unassigned CL.
+// Escalations are stored in the datastore under the CL number.
+type Escalation struct {
+	Time   time.Time
+	Owners []string
+}
+
+func unassigned(cl *codereview.CL) bool {
+	return cl.PrimaryReviewer == "" || cl.PrimaryReviewer == "golang-dev"
+}
+
+type clsByCreated []*codereview.CL
+
+func (x clsByCreated) Len() int           { return len(x) }
+func (x clsByCreated) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+func (x clsByCreated) Less(i, j int) bool { return x[i].Created.Before(x[j].Created) }
+
+// loadUnassigned returns the active CLs without a reviewer, oldest first.
+func loadUnassigned(ctxt appengine.Context) ([]*codereview.CL, error) {
+	var cls []*codereview.CL
+	_, err := datastore.NewQuery("CL").
+		Filter("Active =", true).
+		Limit(1000).
+		GetAll(ctxt, &cls)
+	if err != nil {
+		ctxt.Errorf("loading CLs: %v", err)
+		return nil, fmt.Errorf("loading CLs failed")
+	}
+	var out []*codereview.CL
+	for _, cl := range cls {
+		if unassigned(cl) {
+			out = append(out, cl)
+		}
+	}
+	sort.Sort(clsByCreated(out))
+	return out, nil
+}
+
+// showUnassigned serves /unassigned, the queue of CLs waiting for someone
+// to take them on as reviewer.
+func showUnassigned(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	var d display
+	d.email = findEmail(ctxt)
+
+	cacheKey := pageCacheKey(ctxt, d.email, req.URL.Path, "")
+	if it, err := memcache.Get(ctxt, cacheKey); err == nil {
+		w.Write(it.Value)
+		return
+	}
+
+	cls, err := loadUnassigned(ctxt)
+	if err != nil {
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+	d.owners, _ = codereview.LoadOwners(ctxt)
+
+	t, err := loadTemplate(ctxt, "unassigned.html", &d)
+	if err != nil {
+		fmt.Fprintf(w, "error loading template\n")
+		return
+	}
+	data := struct {
+		User string
+		XSRF string
+		CLs  []*codereview.CL
+	}{
+		User: d.email,
+		CLs:  cls,
+	}
+	if d.email != "" {
+		data.XSRF = app.XSRFToken(ctxt, d.email, "uiop")
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		ctxt.Errorf("execute: %v", err)
+		fmt.Fprintf(w, "error executing template\n")
+		return
+	}
+	memcache.Set(ctxt, &memcache.Item{Key: cacheKey, Value: buf.Bytes(), Expiration: pageCacheTime})
+	w.Write(buf.Bytes())
+}
+
+// escalateFlag gates the escalation mail sent to directory owners.
+var escalateFlag = app.Flag("dash.escalate", true)
+
+// escalateUnassigned mails the directory owners about CLs that have
+// been unassigned for longer than the configured number of days,
+// skipping owners who are away unless they all are.
+// Each CL is escalated at most once.
+func escalateUnassigned(ctxt appengine.Context) error {
+	if !escalateFlag.On(ctxt) {
+		return nil
+	}
+	var c unassignedConfig
+	app.ReadConfig(ctxt, "dash.unassigned", &c)
+	if c.EscalateDays <= 0 {
+		return nil
+	}
+	cls, err := loadUnassigned(ctxt)
+	if err != nil {
+		return err
+	}
+	owners, err := codereview.LoadOwners(ctxt)
+	if err != nil {
+		return err
+	}
+	away, err := codereview.LoadAway(ctxt, time.Now())
+	if err != nil {
+		return err
+	}
+	for _, cl := range cls {
+		if time.Since(cl.Created) < days(c.EscalateDays) {
+			break // sorted oldest first
+		}
+		var e Escalation
+		if err := app.ReadData(ctxt, "Escalation", cl.CL, &e); err == nil {
+			continue
+		}
+		who := owners.SuggestAvailable(cl, away)
+		if len(who) == 0 {
+			who = owners.SuggestReviewers(cl) // everyone is away; mail waits for them
+		}
+		if len(who) == 0 {
+			continue
+		}
+		msg := &mail.Message{
+			Sender:  fmt.Sprintf("Go dashboard <noreply@%s.appspotmail.com>", appengine.AppID(ctxt)),
+			To:      who,
+			Subject: fmt.Sprintf("unassigned CL %s: %s", cl.CL, cl.Summary),
+			Body: fmt.Sprintf("CL %s by %s has been waiting %s for a reviewer.\n"+
+				"You are listed as an owner of a directory it modifies.\n\n"+
+				"https://codereview.appspot.com/%s\n"+
+				"https://%s/unassigned\n",
+				cl.CL, cl.OwnerEmail, new(display).since(cl.Created), cl.CL, appengine.DefaultVersionHostname(ctxt)),
+		}
+		if err := mail.Send(ctxt, msg); err != nil {
+			ctxt.Errorf("escalating CL %s: %v", cl.CL, err)
+			continue
+		}
+		e = Escalation{Time: time.Now(), Owners: who}
+		app.WriteData(ctxt, "Escalation", cl.CL, &e)
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+
+	"app"
+	"codereview"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+)
+
+// Personal data.
+//
+// /api/export/me returns everything the dashboard stores about the
+// logged-in user: preferences, role, the metadata of their API tokens
+// (the tokens themselves are never stored), the uiop actions they made,
+// the CLs they were added to, their pending watch notifications, their
+// away record (see codereview.Away), and their activity counts.
+// A POST with op=delete asks for all of it to be deleted, recording
+// a DeletionRequest; as with /uiop, it must carry an XSRF token unless
+// the user is identified by an API token. Pending requests are listed
+// on the status page, and an operator carries one out with the
+// dash.deleteuser op, which deletes the records and marks the request
+// done. The request itself is kept, as the record that the data was
+// deleted. Activity counts are derived from the public CLs and issues,
+// so the newcomer cron job (see newcomer.go) will recount them.
+
+// A UserExport is the result of /api/export/me.
+type UserExport struct {
+	Email    string
+	Time     time.Time
+	Pref     *UserPref `json:",omitempty"`
+	Role     string
+	Tokens   []*APIToken
+	Actions  []*AdminAction
+	Added    []*Added
+	Watched  []*Watched
+	Activity *Activity        `json:",omitempty"`
+	Away     *codereview.Away `json:",omitempty"`
+	Deletion *DeletionRequest `json:",omitempty"` // pending or completed deletion, if any
+}
+
+// A DeletionRequest records a user's request to delete their data.
+// It is stored under the user's email address.
+type DeletionRequest struct {
+	Email     string
+	Requested time.Time
+	Done      time.Time // zero until dash.deleteuser has run
+	By        string    `datastore:",noindex"` // operator who ran dash.deleteuser
+}
+
+// maxExportRecords limits the records of each kind in an export.
+const maxExportRecords = 1000
+
+// deleteChunk is the number of AdminAction records deleted per datastore call.
+const deleteChunk = 500
+
+func init() {
+	app.Handle("/api/export/me", apiExportMe)
+	app.RegisterAPI("/api/export/me", "Everything stored about the logged-in user. A POST with op=delete asks for it to be deleted.",
+		[]string{"op", "xsrf"}, (*UserExport)(nil))
+	app.RegisterStatus("dash user data deletion requests", deletionStatus)
+	app.RegisterOp("dash.deleteuser", "Delete everything stored about the user with the given email address, who must have asked for it at /api/export/me.",
+		[]string{"email"}, func(ctxt appengine.Context, args map[string]string) (string, error) {
+			by := ""
+			if u := user.Current(ctxt); u != nil {
+				by = u.Email
+			}
+			return deleteUserData(ctxt, strings.TrimSpace(args["email"]), by)
+		})
+}
+
+func apiExportMe(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	email, byToken := requestEmail(ctxt, req)
+	if email == "" {
+		http.Error(w, "must be logged in", 403)
+		return
+	}
+
+	if req.Method == "POST" {
+		if !byToken && !app.ValidXSRFToken(ctxt, req.FormValue("xsrf"), email, "uiop") {
+			http.Error(w, "invalid XSRF token; reload the page", 403)
+			return
+		}
+		if req.FormValue("op") != "delete" {
+			http.Error(w, "invalid op", 400)
+			return
+		}
+		if err := requestDeletion(ctxt, email); err != nil {
+			http.Error(w, "unable to record request", 500)
+			return
+		}
+	}
+
+	x, err := exportUser(ctxt, email)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	js, err := json.Marshal(x)
+	if err != nil {
+		ctxt.Errorf("encoding export JSON: %v", err)
+		http.Error(w, "error encoding JSON", 500)
+		return
+	}
+	writeJSON(w, js)
+}
+
+// exportUser collects the data stored about the user with the given email address.
+func exportUser(ctxt appengine.Context, email string) (*UserExport, error) {
+	x := &UserExport{
+		Email:   email,
+		Time:    time.Now(),
+		Role:    app.RoleOf(ctxt, email).String(),
+		Tokens:  []*APIToken{},
+		Actions: []*AdminAction{},
+		Added:   []*Added{},
+		Watched: []*Watched{},
+	}
+	var pref UserPref
+	if err := app.ReadData(ctxt, "UserPref", email, &pref); err == nil {
+		x.Pref = &pref
+	}
+	var a Activity
+	if err := app.ReadData(ctxt, "Activity", email, &a); err == nil {
+		x.Activity = &a
+	}
+	x.Away = codereview.ReadAway(ctxt, email)
+	var dr DeletionRequest
+	if err := app.ReadData(ctxt, "DeletionRequest", email, &dr); err == nil {
+		x.Deletion = &dr
+	}
+	for _, q := range []struct {
+		kind, field string
+		dst         interface{}
+	}{
+		{"APIToken", "Email", &x.Tokens},
+		{"AdminAction", "Who", &x.Actions},
+		{"Added", "Email", &x.Added},
+		{"Watched", "Email", &x.Watched},
+	} {
+		_, err := datastore.NewQuery(q.kind).
+			Filter(q.field+" =", email).
+			Limit(maxExportRecords).
+			GetAll(ctxt, q.dst)
+		if err != nil {
+			ctxt.Errorf("exporting %s for %s: %v", q.kind, email, err)
+			return nil, fmt.Errorf("loading %s records failed", q.kind)
+		}
+	}
+	return x, nil
+}
+
+// requestDeletion records that the user with the given email address
+// asked for their data to be deleted.
+func requestDeletion(ctxt appengine.Context, email string) error {
+	return app.Transaction(ctxt, func(ctxt appengine.Context) error {
+		var dr DeletionRequest
+		if err := app.ReadData(ctxt, "DeletionRequest", email, &dr); err == nil && dr.Done.IsZero() {
+			return nil // already pending
+		}
+		dr = DeletionRequest{Email: email, Requested: time.Now()}
+		return app.WriteData(ctxt, "DeletionRequest", email, &dr)
+	})
+}
+
+// deleteUserData deletes the data stored about the user with the given
+// email address, who must have a pending DeletionRequest, and marks
+// the request done.
+func deleteUserData(ctxt appengine.Context, email, by string) (string, error) {
+	var dr DeletionRequest
+	if err := app.ReadData(ctxt, "DeletionRequest", email, &dr); err != nil {
+		return "", fmt.Errorf("no deletion request for %s", email)
+	}
+	if !dr.Done.IsZero() {
+		return "", fmt.Errorf("data for %s already deleted at %v", email, dr.Done)
+	}
+
+	n := 0
+	for _, kind := range []string{"UserPref", "Activity"} {
+		err := app.DeleteData(ctxt, kind, email)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return "", err
+		}
+		if err == nil {
+			n++
+		}
+	}
+	if codereview.ReadAway(ctxt, email) != nil {
+		if err := codereview.ClearAway(ctxt, email); err != nil {
+			return "", err
+		}
+		n++
+	}
+	if app.RoleOf(ctxt, email) != app.Viewer {
+		if err := app.SetRole(ctxt, email, app.Viewer, by); err != nil {
+			return "", err
+		}
+		n++
+	}
+	for _, kind := range []string{"APIToken", "Added", "Watched"} {
+		keys, err := datastore.NewQuery(kind).
+			Filter("Email =", email).
+			KeysOnly().
+			GetAll(ctxt, nil)
+		if err != nil {
+			return "", fmt.Errorf("finding %s records: %v", kind, err)
+		}
+		for _, k := range keys {
+			err := app.DeleteData(ctxt, kind, k.StringID())
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return "", fmt.Errorf("deleting %s records: %v", kind, err)
+			}
+			n++
+		}
+	}
+
+	// The audit log is written with datastore.Put under numeric IDs
+	// (see audit.go), not with app.WriteData, so its records are neither
+	// cached nor counted against the quota, and can be deleted directly.
+	keys, err := datastore.NewQuery("AdminAction").
+		Filter("Who =", email).
+		KeysOnly().
+		GetAll(ctxt, nil)
+	if err != nil {
+		return "", fmt.Errorf("finding AdminAction records: %v", err)
+	}
+	for len(keys) > 0 {
+		chunk := keys
+		if len(chunk) > deleteChunk {
+			chunk = chunk[:deleteChunk]
+		}
+		if err := datastore.DeleteMulti(ctxt, chunk); err != nil {
+			return "", fmt.Errorf("deleting AdminAction records: %v", err)
+		}
+		n += len(chunk)
+		keys = keys[len(chunk):]
+	}
+
+	dr.Done = time.Now()
+	dr.By = by
+	if err := app.WriteData(ctxt, "DeletionRequest", email, &dr); err != nil {
+		return "", err
+	}
+	ctxt.Infof("deleted %d records about %s", n, email)
+	return fmt.Sprintf("deleted %d records about %s", n, email), nil
+}
+
+func deletionStatus(ctxt appengine.Context) string {
+	var list []*DeletionRequest
+	_, err := datastore.NewQuery("DeletionRequest").
+		Filter("Done =", time.Time{}).
+		GetAll(ctxt, &list)
+	w := new(bytes.Buffer)
+	if err != nil {
+		fmt.Fprintf(w, "error loading requests: %v\n", err)
+	}
+	if len(list) == 0 {
+		fmt.Fprintf(w, "no pending requests\n")
+	}
+	for _, dr := range list {
+		fmt.Fprintf(w, "%s requested %v; run dash.deleteuser\n", dr.Email, dr.Requested.Format(time.RFC3339))
+	}
+	return "<pre>" + html.EscapeString(w.String()) + "</pre>"
+}
@@ -0,0 +1,198 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"dash/model"
+	"identity"
+)
+
+// A View is a filter on the dashboard items.
+// Views can be given directly in the URL (as /?dir=net&needsreview=1)
+// or saved in the user preferences under a name and selected by /?view=name.
+// The zero View shows everything.
+type View struct {
+	Name        string
+	Repo        string // repository, as in CL.Repo ("go", "go.net", ...)
+	Dir         string // directory, including subdirectories
+	Reviewer    string // CL reviewer or issue owner, as email or short name
+	Size        string // CL size class: small, medium, or large
+	Label       string // issue label
+	NeedsReview bool   // only CLs waiting for the reviewer
+	Kind        string // "issues" or "cls" to show only issues or only CLs
+}
+
+// sizeClass returns the size class of a CL modifying delta lines.
+func sizeClass(delta int64) string {
+	switch {
+	case delta < 50:
+		return "small"
+	case delta < 500:
+		return "medium"
+	}
+	return "large"
+}
+
+// viewFromForm returns the view described by the request's form values.
+// If the request names a saved view (view=name), viewFromForm looks up
+// that name in pref; otherwise it uses the individual filter parameters.
+// If pref is nil, the view= parameter is ignored.
+func viewFromForm(req *http.Request, pref *UserPref) (*View, error) {
+	if name := req.FormValue("view"); name != "" && pref != nil {
+		for i := range pref.Views {
+			if pref.Views[i].Name == name {
+				v := pref.Views[i]
+				return &v, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown view %q", name)
+	}
+	v := &View{
+		Repo:        req.FormValue("repo"),
+		Dir:         req.FormValue("dir"),
+		Reviewer:    req.FormValue("reviewer"),
+		Size:        req.FormValue("size"),
+		Label:       req.FormValue("label"),
+		NeedsReview: req.FormValue("needsreview") == "1",
+		Kind:        req.FormValue("kind"),
+	}
+	switch v.Size {
+	case "", "small", "medium", "large":
+		// ok
+	default:
+		return nil, fmt.Errorf("invalid size %q", v.Size)
+	}
+	switch v.Kind {
+	case "", "issues", "cls":
+		// ok
+	default:
+		return nil, fmt.Errorf("invalid kind %q", v.Kind)
+	}
+	return v, nil
+}
+
+// kind returns the kind of items the view shows.
+// Loading only that kind skips the datastore query for the other.
+func (v *View) kind() model.Kind {
+	switch v.Kind {
+	case "issues":
+		return model.IssuesOnly
+	case "cls":
+		return model.CLsOnly
+	}
+	return model.AllItems
+}
+
+// Empty reports whether v shows everything.
+func (v *View) Empty() bool {
+	return v.Repo == "" && v.Dir == "" && v.Reviewer == "" && v.Size == "" && v.Label == "" && !v.NeedsReview && v.Kind == ""
+}
+
+// Query returns the URL query string selecting the view's filters.
+func (v *View) Query() string {
+	q := url.Values{}
+	if v.Repo != "" {
+		q.Set("repo", v.Repo)
+	}
+	if v.Dir != "" {
+		q.Set("dir", v.Dir)
+	}
+	if v.Reviewer != "" {
+		q.Set("reviewer", v.Reviewer)
+	}
+	if v.Size != "" {
+		q.Set("size", v.Size)
+	}
+	if v.Label != "" {
+		q.Set("label", v.Label)
+	}
+	if v.NeedsReview {
+		q.Set("needsreview", "1")
+	}
+	if v.Kind != "" {
+		q.Set("kind", v.Kind)
+	}
+	return q.Encode()
+}
+
+// filter removes from groups any items not shown by the view.
+// Groups left with no items are removed.
+func (v *View) filter(groups map[string]*model.Group) {
+	if v.Empty() {
+		return
+	}
+	for key, g := range groups {
+		if v.Dir != "" && g.Dir != v.Dir && !strings.HasPrefix(g.Dir, v.Dir+"/") {
+			delete(groups, key)
+			continue
+		}
+		var items []*model.Item
+		for _, item := range g.Items {
+			if v.match(item) {
+				items = append(items, item)
+			}
+		}
+		g.Items = items
+		if len(items) == 0 {
+			delete(groups, key)
+		}
+	}
+}
+
+// match reports whether the view shows item.
+func (v *View) match(item *model.Item) bool {
+	if v.Repo != "" && itemRepo(item) != v.Repo {
+		return false
+	}
+	if v.Label != "" {
+		if item.Bug == nil || !hasLabel(item.Bug.Label, v.Label) {
+			return false
+		}
+	}
+	if v.Reviewer == "" && v.Size == "" && !v.NeedsReview {
+		return true
+	}
+	if v.Reviewer != "" && item.Bug != nil && matchUser(item.Bug.Owner, v.Reviewer) && v.Size == "" && !v.NeedsReview {
+		return true
+	}
+	for _, cl := range item.CLs {
+		if (v.Reviewer == "" || matchUser(cl.PrimaryReviewer, v.Reviewer)) &&
+			(v.Size == "" || sizeClass(cl.Delta) == v.Size) &&
+			(!v.NeedsReview || cl.NeedsReview) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasLabel(labels []string, label string) bool {
+	for _, l := range labels {
+		if strings.EqualFold(l, label) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchUser reports whether email identifies the user who, given as an
+// email address or tracker name (see package identity) or as the part of
+// an email address before the @.
+func matchUser(email, who string) bool {
+	dir := identity.Current()
+	if dir.Lookup(who) == nil && !strings.Contains(who, "@") {
+		p := dir.Expand(who)
+		if p == nil {
+			// Not a committer: match the address itself.
+			return email != "" && strings.HasPrefix(email, who+"@")
+		}
+		who = p.Email
+	}
+	return dir.Same(email, who)
+}
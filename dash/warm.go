@@ -0,0 +1,164 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"app"
+	"dash/model"
+
+	"appengine"
+	"appengine/memcache"
+)
+
+// Model cache.
+//
+// Building the dashboard means querying up to a thousand CLs and a thousand
+// issues and grouping them, which dominates the time to serve a page.
+// The grouped items do not depend on the user (loadModel filters them
+// afterward), so loadLabelGroupsCached keeps them in memcache, keyed by
+// the page and data versions so that any change invalidates them.
+// The dash.warm cron job rebuilds the entries for the public dashboard
+// and for the views saved by the users in the "dash.warm" config,
+// so that most page loads find them already built:
+//
+//	{"Users": ["rsc@golang.org"]}
+//
+// The cached items omit CL messages and issue comments after the first,
+// which the dashboard pages do not show.
+
+type warmConfig struct {
+	Users []string
+}
+
+const (
+	modelCacheTime = 30 * time.Minute
+	maxModelCache  = 1000 << 10 // memcache item size limit, roughly
+)
+
+func init() {
+	app.Cron("dash.warm", 5*time.Minute, warmModels)
+	app.RegisterStatus("dash model cache", modelCacheStatus)
+}
+
+// modelCacheKey returns the memcache key for the groups of the given kind
+// made from the active CLs and the open issues with the given labels.
+func modelCacheKey(ctxt appengine.Context, labels []string, kind model.Kind) string {
+	return fmt.Sprintf("dash.model.%d.%d.%d.%q", pageVersion(ctxt), app.DataVersion(ctxt), kind, strings.Join(labels, ","))
+}
+
+// loadLabelGroupsCached is like loadLabelGroupsPartial but uses the model cache.
+func loadLabelGroupsCached(ctxt appengine.Context, labels []string, kind model.Kind) (map[string]*model.Group, []string, error) {
+	key := modelCacheKey(ctxt, labels, kind)
+	if groups, ok := getCachedGroups(ctxt, key); ok {
+		memcache.Increment(ctxt, "dash.model.hit", 1, 0)
+		return groups, nil, nil
+	}
+	memcache.Increment(ctxt, "dash.model.miss", 1, 0)
+	groups, warnings, err := loadLabelGroupsPartial(ctxt, labels, kind)
+	if err == nil && len(warnings) == 0 {
+		putCachedGroups(ctxt, key, groups)
+	}
+	return groups, warnings, err
+}
+
+func getCachedGroups(ctxt appengine.Context, key string) (map[string]*model.Group, bool) {
+	it, err := memcache.Get(ctxt, key)
+	if err != nil {
+		return nil, false
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(it.Value))
+	if err != nil {
+		ctxt.Errorf("model cache %s: %v", key, err)
+		return nil, false
+	}
+	var groups map[string]*model.Group
+	if err := gob.NewDecoder(zr).Decode(&groups); err != nil {
+		ctxt.Errorf("model cache %s: %v", key, err)
+		return nil, false
+	}
+	return groups, true
+}
+
+func putCachedGroups(ctxt appengine.Context, key string, groups map[string]*model.Group) {
+	trimmed := make(map[string]*model.Group)
+	for k, g := range groups {
+		ng := &model.Group{Dir: g.Dir}
+		for _, item := range g.Items {
+			ng.Items = append(ng.Items, apiItem(item))
+		}
+		trimmed[k] = ng
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := gob.NewEncoder(zw).Encode(trimmed); err != nil {
+		ctxt.Errorf("model cache %s: %v", key, err)
+		return
+	}
+	if err := zw.Close(); err != nil {
+		ctxt.Errorf("model cache %s: %v", key, err)
+		return
+	}
+	if buf.Len() > maxModelCache {
+		ctxt.Warningf("model cache %s: %d bytes is too large to cache", key, buf.Len())
+		return
+	}
+	memcache.Set(ctxt, &memcache.Item{Key: key, Value: buf.Bytes(), Expiration: modelCacheTime})
+}
+
+// warmModels builds the model cache entries for the public dashboard
+// and the saved views of the configured users, if they are missing.
+func warmModels(ctxt appengine.Context) error {
+	kinds := map[model.Kind]bool{model.AllItems: true}
+	var c warmConfig
+	app.ReadConfig(ctxt, "dash.warm", &c)
+	for _, email := range c.Users {
+		var pref UserPref
+		if err := app.ReadData(ctxt, "UserPref", email, &pref); err != nil {
+			continue
+		}
+		for i := range pref.Views {
+			kinds[pref.Views[i].kind()] = true
+		}
+	}
+
+	labels := releaseLabels(ctxt)
+	for kind := range kinds {
+		key := modelCacheKey(ctxt, labels, kind)
+		if _, err := memcache.Get(ctxt, key); err == nil {
+			continue
+		}
+		groups, warnings, err := loadLabelGroupsPartial(ctxt, labels, kind)
+		if err != nil {
+			return err
+		}
+		if len(warnings) > 0 {
+			return fmt.Errorf("%s", warnings[0])
+		}
+		putCachedGroups(ctxt, key, groups)
+	}
+	return nil
+}
+
+func modelCacheStatus(ctxt appengine.Context) string {
+	hit, _ := memcache.Increment(ctxt, "dash.model.hit", 0, 0)
+	miss, _ := memcache.Increment(ctxt, "dash.model.miss", 0, 0)
+	w := new(bytes.Buffer)
+	fmt.Fprintf(w, "%d hits, %d misses since memcache was last flushed\n", hit, miss)
+	key := modelCacheKey(ctxt, releaseLabels(ctxt), model.AllItems)
+	if it, err := memcache.Get(ctxt, key); err == nil {
+		fmt.Fprintf(w, "public dashboard cached: %d bytes\n", len(it.Value))
+	} else {
+		fmt.Fprintf(w, "public dashboard not cached\n")
+	}
+	return "<pre>" + html.EscapeString(w.String()) + "</pre>"
+}
@@ -0,0 +1,309 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"app"
+	"codereview"
+	"issue"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/mail"
+)
+
+// Watch lists.
+//
+// Users can watch CLs, issues, and directories (UserPref.WatchCLs,
+// WatchIssues, and WatchDirs). When the loaders publish a change to a
+// watched CL or issue, or to a CL in a watched directory, the watchers
+// get a Watched record, which highlights the item on their dashboards
+// for a few days, and, if they asked for them, a mail and a POST to
+// their webhook. Watchers can limit the mail and POSTs to changes to
+// items mentioning an urgency phrase (see issue.Urgency).
+
+// A Watched records a change to an item a user watches.
+// It is stored under the user's email, the item kind ("cl" or "issue"),
+// and the item key, separated by slashes.
+type Watched struct {
+	Email   string
+	Kind    string
+	Key     string
+	Summary string   `datastore:",noindex"`
+	Changes []string `datastore:",noindex"`
+	Urgent  string   `datastore:",noindex"` // urgency phrase of the item, if any
+	Time    time.Time
+
+	// Restricted is set for restricted security issues,
+	// whose changes are not sent by mail or webhook.
+	// Their Watched records omit the summary, changes, and urgency,
+	// since the records are shown to the user (see userdata.go),
+	// who may not be allowed to see the issue.
+	Restricted bool `datastore:"-" json:"-"`
+}
+
+// watchedDays is how long a changed item stays highlighted.
+const watchedDays = 3
+
+// A watchHookMessage is the JSON body POSTed to a user's webhook.
+type watchHookMessage struct {
+	Kind    string
+	Key     string
+	Summary string
+	Changes []string
+	Urgent  string `json:",omitempty"`
+	URL     string
+	Time    time.Time
+}
+
+func init() {
+	app.Subscribe("codereview.changed", "dash.watch.cl", noteCLChange)
+	app.Subscribe("issue.changed", "dash.watch.issue", noteIssueChange)
+}
+
+// noteCLChange notifies the users watching the CL in a codereview.ChangeEvent
+// or any of its directories.
+func noteCLChange(ctxt appengine.Context, e *app.Event) error {
+	var ev codereview.ChangeEvent
+	if err := e.Decode(&ev); err != nil {
+		ctxt.Errorf("bad event %s %s: %v", e.Topic, e.Key, err)
+		return nil
+	}
+	watchers, err := findWatchers(ctxt, "WatchCLs =", ev.CL)
+	if err != nil {
+		return err
+	}
+	for _, dir := range ev.Dirs {
+		for d := dir; ; {
+			list, err := findWatchers(ctxt, "WatchDirs =", d)
+			if err != nil {
+				return err
+			}
+			watchers = append(watchers, list...)
+			i := strings.LastIndex(d, "/")
+			if i < 0 {
+				break
+			}
+			d = d[:i]
+		}
+	}
+	w := &Watched{Kind: "cl", Key: ev.CL, Summary: ev.Summary, Changes: ev.Changes, Urgent: ev.Urgent, Time: e.Time}
+	return notifyWatchers(ctxt, watchers, w, "https://codereview.appspot.com/"+ev.CL)
+}
+
+// noteIssueChange notifies the users watching the issue in an issue.ChangeEvent.
+func noteIssueChange(ctxt appengine.Context, e *app.Event) error {
+	var ev issue.ChangeEvent
+	if err := e.Decode(&ev); err != nil {
+		ctxt.Errorf("bad event %s %s: %v", e.Topic, e.Key, err)
+		return nil
+	}
+	watchers, err := findWatchers(ctxt, "WatchIssues =", ev.ID)
+	if err != nil {
+		return err
+	}
+	w := &Watched{Kind: "issue", Key: strconv.Itoa(ev.ID), Summary: ev.Summary, Changes: ev.Changes, Urgent: ev.Urgent, Time: e.Time}
+	if ev.Restricted {
+		w = &Watched{Kind: "issue", Key: strconv.Itoa(ev.ID), Time: e.Time, Restricted: true}
+	}
+	return notifyWatchers(ctxt, watchers, w, fmt.Sprintf("https://code.google.com/p/go/issues/detail?id=%d", ev.ID))
+}
+
+// findWatchers returns the emails of the users whose preferences match the filter.
+func findWatchers(ctxt appengine.Context, filter string, value interface{}) ([]string, error) {
+	keys, err := datastore.NewQuery("UserPref").
+		Filter(filter, value).
+		KeysOnly().
+		GetAll(ctxt, nil)
+	if err != nil {
+		ctxt.Errorf("finding watchers (%s %v): %v", filter, value, err)
+		return nil, err
+	}
+	var list []string
+	for _, k := range keys {
+		list = append(list, k.StringID())
+	}
+	return list, nil
+}
+
+// notifyWatchers records the change w for each of the watchers and sends
+// the mail and webhook notifications they asked for. Watchers already
+// notified of this change or a later one are skipped, so that a retried
+// delivery does not notify twice.
+func notifyWatchers(ctxt appengine.Context, watchers []string, w *Watched, link string) error {
+	sort.Strings(watchers)
+	for i, email := range watchers {
+		if i > 0 && email == watchers[i-1] {
+			continue
+		}
+		key := email + "/" + w.Kind + "/" + w.Key
+		var old Watched
+		if err := app.ReadData(ctxt, "Watched", key, &old); err == nil && !old.Time.Before(w.Time) {
+			continue
+		}
+		nw := *w
+		nw.Email = email
+		if err := app.WriteData(ctxt, "Watched", key, &nw); err != nil {
+			return err
+		}
+		var pref UserPref
+		if err := app.ReadData(ctxt, "UserPref", email, &pref); err != nil {
+			continue
+		}
+		if pref.WatchUrgent && nw.Urgent == "" || w.Restricted {
+			continue
+		}
+		if pref.WatchMail {
+			mailWatched(ctxt, &nw, link)
+		}
+		if pref.WatchHook != "" {
+			postWatchHook(ctxt, pref.WatchHook, &nw, link)
+		}
+	}
+	if len(watchers) > 0 {
+		bumpPageVersion(ctxt)
+	}
+	return nil
+}
+
+func mailWatched(ctxt appengine.Context, w *Watched, link string) {
+	name := "CL " + w.Key
+	if w.Kind == "issue" {
+		name = "issue " + w.Key
+	}
+	subject := fmt.Sprintf("%s: %s (%s)", name, w.Summary, strings.Join(w.Changes, ", "))
+	if w.Urgent != "" {
+		subject = "[" + w.Urgent + "] " + subject
+	}
+	msg := &mail.Message{
+		Sender:  fmt.Sprintf("Go dashboard <noreply@%s.appspotmail.com>", appengine.AppID(ctxt)),
+		To:      []string{w.Email},
+		Subject: subject,
+		Body: fmt.Sprintf("%s, which you are watching, changed: %s.\n\n%s\n\n"+
+			"Manage your watch list at https://%s/settings\n",
+			name, strings.Join(w.Changes, ", "), link, appengine.DefaultVersionHostname(ctxt)),
+	}
+	if err := mail.Send(ctxt, msg); err != nil {
+		ctxt.Errorf("mailing %s about %s: %v", w.Email, name, err)
+	}
+}
+
+// postWatchHook POSTs the change to the webhook. Failures are logged
+// but not retried: a broken hook must not hold up other notifications.
+func postWatchHook(ctxt appengine.Context, hook string, w *Watched, link string) {
+	js, err := json.Marshal(&watchHookMessage{
+		Kind:    w.Kind,
+		Key:     w.Key,
+		Summary: w.Summary,
+		Changes: w.Changes,
+		Urgent:  w.Urgent,
+		URL:     link,
+		Time:    w.Time,
+	})
+	if err != nil {
+		ctxt.Errorf("encoding watch hook for %s: %v", w.Email, err)
+		return
+	}
+	resp, err := app.Client(ctxt, "dash").Post(hook, "application/json", bytes.NewReader(js))
+	if err != nil {
+		ctxt.Warningf("watch hook for %s: %v", w.Email, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		ctxt.Warningf("watch hook for %s: %s", w.Email, resp.Status)
+	}
+}
+
+// loadWatched loads the recently changed items the user d.email watches into d.watched.
+func (d *display) loadWatched(ctxt appengine.Context) {
+	if d.email == "" {
+		return
+	}
+	var list []*Watched
+	_, err := datastore.NewQuery("Watched").
+		Filter("Email =", d.email).
+		Filter("Time >", time.Now().Add(-days(watchedDays))).
+		GetAll(ctxt, &list)
+	if err != nil {
+		ctxt.Errorf("loading watched items for %s: %v", d.email, err)
+		return
+	}
+	d.watched = make(map[string]bool)
+	for _, w := range list {
+		d.watched[w.Kind+"/"+w.Key] = true
+	}
+}
+
+// isWatched returns css class "watched" if the item of the given kind
+// ("cl" or "issue") is watched and recently changed (see loadWatched).
+func (d *display) isWatched(kind string, key interface{}) string {
+	return d.css("watched", d.watched[kind+"/"+fmt.Sprint(key)])
+}
+
+func watchCLOp(ctxt appengine.Context, req *http.Request, op string) (func(*UserPref), error) {
+	targ := req.FormValue("cl")
+	if _, err := strconv.Atoi(targ); err != nil {
+		return nil, fmt.Errorf("missing cl")
+	}
+	return func(pref *UserPref) {
+		pref.WatchCLs = toggleString(pref.WatchCLs, targ, op == "watchcl")
+	}, nil
+}
+
+func watchIssueOp(ctxt appengine.Context, req *http.Request, op string) (func(*UserPref), error) {
+	targ, err := strconv.Atoi(req.FormValue("issue"))
+	if err != nil || targ <= 0 {
+		return nil, fmt.Errorf("missing issue")
+	}
+	return func(pref *UserPref) {
+		pref.WatchIssues = toggleInt(pref.WatchIssues, targ, op == "watchissue")
+	}, nil
+}
+
+func watchDirOp(ctxt appengine.Context, req *http.Request, op string) (func(*UserPref), error) {
+	targ := strings.Trim(req.FormValue("dir"), "/")
+	if targ == "" {
+		return nil, fmt.Errorf("missing dir")
+	}
+	return func(pref *UserPref) {
+		pref.WatchDirs = toggleString(pref.WatchDirs, targ, op == "watchdir")
+	}, nil
+}
+
+func watchMailOp(ctxt appengine.Context, req *http.Request, op string) (func(*UserPref), error) {
+	return func(pref *UserPref) {
+		pref.WatchMail = op == "watchmail"
+	}, nil
+}
+
+func watchUrgentOp(ctxt appengine.Context, req *http.Request, op string) (func(*UserPref), error) {
+	return func(pref *UserPref) {
+		pref.WatchUrgent = op == "watchurgent"
+	}, nil
+}
+
+func watchHookOp(ctxt appengine.Context, req *http.Request, op string) (func(*UserPref), error) {
+	hook := strings.TrimSpace(req.FormValue("hook"))
+	if hook != "" {
+		u, err := url.Parse(hook)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("webhook must be an https URL")
+		}
+	}
+	return func(pref *UserPref) {
+		pref.WatchHook = hook
+	}, nil
+}
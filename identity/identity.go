@@ -0,0 +1,300 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package identity maps the names a person uses in the different systems
+// the dashboard reads (Rietveld email addresses, issue tracker user names,
+// committer aliases, GitHub logins) to a single Person.
+//
+// The directory starts with the built-in list of committers (see people.go)
+// and is extended and overridden by Identity records in the datastore,
+// which admins edit with the identity.set and identity.delete ops.
+package identity
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"app"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// A Person is a single person known by several names.
+// Person records are stored in the datastore as kind Identity,
+// under the lower-case canonical email address.
+type Person struct {
+	Email     string   // canonical email address
+	Name      string   `datastore:",noindex"`
+	Emails    []string // other addresses, such as an @google.com alias
+	Tracker   []string // issue tracker user names
+	GitHub    string   // GitHub login
+	Committer bool     // can approve and submit CLs
+}
+
+// names returns the email addresses and tracker names identifying p.
+func (p *Person) names() []string {
+	var list []string
+	list = append(list, p.Email)
+	list = append(list, p.Emails...)
+	list = append(list, p.Tracker...)
+	return list
+}
+
+// A Directory is a set of people, indexed by their names.
+type Directory struct {
+	people   []*Person
+	byName   map[string]*Person
+	byGitHub map[string]*Person
+}
+
+// NewDirectory returns a directory holding the given people.
+// If two entries share a canonical email address, the later one wins.
+func NewDirectory(people []*Person) *Directory {
+	d := &Directory{
+		byName:   make(map[string]*Person),
+		byGitHub: make(map[string]*Person),
+	}
+	seen := make(map[string]int)
+	for _, p := range people {
+		key := strings.ToLower(p.Email)
+		if i, ok := seen[key]; ok {
+			d.people[i] = p
+			continue
+		}
+		seen[key] = len(d.people)
+		d.people = append(d.people, p)
+	}
+	for _, p := range d.people {
+		for _, name := range p.names() {
+			if name != "" {
+				d.byName[strings.ToLower(name)] = p
+			}
+		}
+		if p.GitHub != "" {
+			d.byGitHub[strings.ToLower(p.GitHub)] = p
+		}
+	}
+	return d
+}
+
+// People returns the people in the directory, sorted by email address.
+func (d *Directory) People() []*Person {
+	list := append([]*Person(nil), d.people...)
+	sort.Sort(byEmail(list))
+	return list
+}
+
+// Committers returns the canonical email addresses of the committers, sorted.
+func (d *Directory) Committers() []string {
+	var list []string
+	for _, p := range d.people {
+		if p.Committer {
+			list = append(list, p.Email)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+type byEmail []*Person
+
+func (x byEmail) Len() int           { return len(x) }
+func (x byEmail) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+func (x byEmail) Less(i, j int) bool { return x[i].Email < x[j].Email }
+
+// Lookup returns the person with the given email address or tracker
+// user name, or nil if there is none.
+func (d *Directory) Lookup(name string) *Person {
+	if name == "" {
+		return nil
+	}
+	return d.byName[strings.ToLower(name)]
+}
+
+// LookupGitHub returns the person with the given GitHub login, or nil.
+func (d *Directory) LookupGitHub(login string) *Person {
+	return d.byGitHub[strings.ToLower(login)]
+}
+
+// Expand returns the committer whose canonical email address
+// begins with user and an @, or nil if there is none.
+func (d *Directory) Expand(user string) *Person {
+	user = strings.ToLower(user)
+	for _, p := range d.people {
+		if p.Committer && strings.HasPrefix(strings.ToLower(p.Email), user+"@") {
+			return p
+		}
+	}
+	return nil
+}
+
+// Canonical returns the canonical email address for name,
+// or name itself if the directory does not know it.
+func (d *Directory) Canonical(name string) string {
+	if p := d.Lookup(name); p != nil {
+		return p.Email
+	}
+	return name
+}
+
+// Same reports whether the names a and b identify the same person.
+func (d *Directory) Same(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	if a == b {
+		return true
+	}
+	p := d.Lookup(a)
+	return p != nil && p == d.Lookup(b)
+}
+
+// Committer returns the canonical email address of the committer
+// identified by name, or the empty string if name is not a committer.
+func (d *Directory) Committer(name string) string {
+	if p := d.Lookup(name); p != nil && p.Committer {
+		return p.Email
+	}
+	return ""
+}
+
+// cacheTime is how long an instance uses a loaded directory
+// before reading the datastore again.
+const cacheTime = 5 * time.Minute
+
+var cache struct {
+	sync.Mutex
+	dir  *Directory
+	time time.Time
+}
+
+// Current returns the most recently loaded directory,
+// or the built-in one if none has been loaded yet.
+// It is for code without a context; code with one should use Load.
+func Current() *Directory {
+	cache.Lock()
+	defer cache.Unlock()
+	if cache.dir == nil {
+		cache.dir = NewDirectory(builtin)
+	}
+	return cache.dir
+}
+
+// Load returns the directory, reading the datastore if the instance's
+// copy is more than a few minutes old. If the read fails, Load logs the
+// error and returns the previous copy.
+func Load(ctxt appengine.Context) *Directory {
+	cache.Lock()
+	dir, t := cache.dir, cache.time
+	cache.Unlock()
+	if dir != nil && time.Since(t) < cacheTime {
+		return dir
+	}
+
+	var stored []*Person
+	if _, err := datastore.NewQuery("Identity").GetAll(ctxt, &stored); err != nil {
+		ctxt.Errorf("loading identities: %v", err)
+		return Current()
+	}
+	dir = NewDirectory(append(append([]*Person(nil), builtin...), stored...))
+
+	cache.Lock()
+	cache.dir, cache.time = dir, time.Now()
+	cache.Unlock()
+	return dir
+}
+
+// flush makes the next Load read the datastore.
+func flush() {
+	cache.Lock()
+	cache.time = time.Time{}
+	cache.Unlock()
+}
+
+func init() {
+	app.RegisterQuota("identity", "Identity")
+	app.RegisterStatus("identities", status)
+
+	app.RegisterOp("identity.set", "Set the names of the person with the given canonical email address. Lists are comma-separated; committer is 1 or 0.", []string{"email", "name", "emails", "tracker", "github", "committer"}, setOp)
+	app.RegisterOp("identity.delete", "Delete the stored identity record for the given email address. A built-in entry reappears.", []string{"email"}, func(ctxt appengine.Context, args map[string]string) (string, error) {
+		key := strings.ToLower(strings.TrimSpace(args["email"]))
+		if err := app.DeleteData(ctxt, "Identity", key); err != nil {
+			return "", err
+		}
+		flush()
+		return "deleted " + key, nil
+	})
+}
+
+func setOp(ctxt appengine.Context, args map[string]string) (string, error) {
+	email := strings.ToLower(strings.TrimSpace(args["email"]))
+	if !strings.Contains(email, "@") {
+		return "", fmt.Errorf("email must be an email address")
+	}
+	p := &Person{
+		Email:     email,
+		Name:      strings.TrimSpace(args["name"]),
+		Emails:    splitList(args["emails"]),
+		Tracker:   splitList(args["tracker"]),
+		GitHub:    strings.TrimSpace(args["github"]),
+		Committer: args["committer"] == "1",
+	}
+	// Refuse names that already identify someone else:
+	// the directory could not tell the two apart.
+	dir := Load(ctxt)
+	for _, name := range p.names() {
+		if q := dir.Lookup(name); q != nil && !strings.EqualFold(q.Email, email) {
+			return "", fmt.Errorf("%s already identifies %s", name, q.Email)
+		}
+	}
+	if q := dir.LookupGitHub(p.GitHub); p.GitHub != "" && q != nil && !strings.EqualFold(q.Email, email) {
+		return "", fmt.Errorf("GitHub login %s already identifies %s", p.GitHub, q.Email)
+	}
+	if err := app.WriteData(ctxt, "Identity", email, p); err != nil {
+		return "", err
+	}
+	flush()
+	return "set " + email, nil
+}
+
+// splitList splits a comma-separated list, dropping empty elements.
+func splitList(s string) []string {
+	var list []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			list = append(list, f)
+		}
+	}
+	return list
+}
+
+func status(ctxt appengine.Context) string {
+	w := new(bytes.Buffer)
+	for _, p := range Load(ctxt).People() {
+		fmt.Fprintf(w, "%s", p.Email)
+		if p.Name != "" {
+			fmt.Fprintf(w, " (%s)", p.Name)
+		}
+		if p.Committer {
+			fmt.Fprintf(w, " committer")
+		}
+		if len(p.Emails) > 0 {
+			fmt.Fprintf(w, " emails=%s", strings.Join(p.Emails, ","))
+		}
+		if len(p.Tracker) > 0 {
+			fmt.Fprintf(w, " tracker=%s", strings.Join(p.Tracker, ","))
+		}
+		if p.GitHub != "" {
+			fmt.Fprintf(w, " github=%s", p.GitHub)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	return "<pre>" + html.EscapeString(w.String()) + "</pre>"
+}
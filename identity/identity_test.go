@@ -0,0 +1,64 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package identity
+
+import "testing"
+
+var testPeople = []*Person{
+	{Email: "rsc@golang.org", Emails: []string{"rsc@google.com"}, Tracker: []string{"russcox"}, GitHub: "rsc", Committer: true},
+	{Email: "gopher@example.com", GitHub: "gopher"},
+	{Email: "dup@golang.org"},
+	{Email: "dup@golang.org", Committer: true},
+}
+
+func TestDirectory(t *testing.T) {
+	d := NewDirectory(testPeople)
+
+	for _, name := range []string{"rsc@golang.org", "RSC@google.com", "russcox"} {
+		if p := d.Lookup(name); p == nil || p.Email != "rsc@golang.org" {
+			t.Errorf("Lookup(%q) = %v, want rsc@golang.org", name, p)
+		}
+	}
+	if p := d.Lookup("rsc"); p != nil {
+		t.Errorf("Lookup(%q) = %v, want nil", "rsc", p)
+	}
+	if p := d.LookupGitHub("Gopher"); p == nil || p.Email != "gopher@example.com" {
+		t.Errorf("LookupGitHub(%q) = %v, want gopher@example.com", "Gopher", p)
+	}
+	if p := d.Expand("rsc"); p == nil || p.Email != "rsc@golang.org" {
+		t.Errorf("Expand(%q) = %v, want rsc@golang.org", "rsc", p)
+	}
+	if p := d.Expand("gopher"); p != nil {
+		t.Errorf("Expand(%q) = %v, want nil (not a committer)", "gopher", p)
+	}
+
+	var tests = []struct {
+		a, b string
+		same bool
+	}{
+		{"rsc@google.com", "rsc@golang.org", true},
+		{"russcox", "rsc@google.com", true},
+		{"gopher@example.com", "gopher@example.com", true},
+		{"unknown@example.com", "unknown@example.com", true},
+		{"rsc@golang.org", "gopher@example.com", false},
+		{"unknown@example.com", "other@example.com", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if same := d.Same(tt.a, tt.b); same != tt.same {
+			t.Errorf("Same(%q, %q) = %v, want %v", tt.a, tt.b, same, tt.same)
+		}
+	}
+
+	if c := d.Committer("rsc@google.com"); c != "rsc@golang.org" {
+		t.Errorf("Committer(rsc@google.com) = %q, want rsc@golang.org", c)
+	}
+	if c := d.Committer("dup@golang.org"); c != "dup@golang.org" {
+		t.Errorf("Committer(dup@golang.org) = %q, want dup@golang.org (later entry wins)", c)
+	}
+	if c := d.Committers(); len(c) != 2 || c[0] != "dup@golang.org" || c[1] != "rsc@golang.org" {
+		t.Errorf("Committers() = %v", c)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package identity
+
+// builtin is the directory used before any Identity records are loaded:
+// the committers, from https://code.google.com/p/go/people/list
+// as of 2013-12-17. Committers at Google may use either their
+// @golang.org or their @google.com address.
+var builtin = []*Person{
+	{Email: "0xe2.0x9a.0x9b@gmail.com", Committer: true},
+	{Email: "adg@golang.org", Emails: []string{"adg@google.com"}, Committer: true},
+	{Email: "adonovan@google.com", Committer: true},
+	{Email: "agl@golang.org", Emails: []string{"agl@google.com"}, Committer: true},
+	{Email: "alex.brainman@gmail.com", Committer: true},
+	{Email: "ality@pbrane.org", Committer: true},
+	{Email: "bgarcia@golang.org", Emails: []string{"bgarcia@google.com"}, Committer: true},
+	{Email: "bradfitz@golang.org", Emails: []string{"bradfitz@google.com"}, Committer: true},
+	{Email: "campoy@golang.org", Emails: []string{"campoy@google.com"}, Committer: true},
+	{Email: "cmang@golang.org", Emails: []string{"cmang@google.com"}, Committer: true},
+	{Email: "crawshaw@google.com", Committer: true},
+	{Email: "cshapiro@golang.org", Emails: []string{"cshapiro@google.com"}, Committer: true},
+	{Email: "daniel.morsing@gmail.com", Committer: true},
+	{Email: "dave@cheney.net", Committer: true},
+	{Email: "djd@golang.org", Emails: []string{"djd@google.com"}, Committer: true},
+	{Email: "dsymonds@golang.org", Emails: []string{"dsymonds@google.com"}, Committer: true},
+	{Email: "dvyukov@google.com", Committer: true},
+	{Email: "gri@golang.org", Emails: []string{"gri@google.com"}, Committer: true},
+	{Email: "hectorchu@gmail.com", Committer: true},
+	{Email: "iant@golang.org", Emails: []string{"iant@google.com"}, Committer: true},
+	{Email: "jdpoirier@gmail.com", Committer: true},
+	{Email: "jsing@google.com", Committer: true},
+	{Email: "ken@golang.org", Emails: []string{"ken@google.com"}, Committer: true},
+	{Email: "khr@golang.org", Emails: []string{"khr@google.com"}, Committer: true},
+	{Email: "lvd@golang.org", Emails: []string{"lvd@google.com"}, Committer: true},
+	{Email: "mikesamuel@gmail.com", Committer: true},
+	{Email: "mikioh.mikioh@gmail.com", Committer: true},
+	{Email: "minux.ma@gmail.com", Committer: true},
+	{Email: "mpvl@golang.org", Emails: []string{"mpvl@google.com"}, Committer: true},
+	{Email: "n13m3y3r@gmail.com", Committer: true},
+	{Email: "nigeltao@golang.org", Emails: []string{"nigeltao@google.com"}, Committer: true},
+	{Email: "pjw@golang.org", Emails: []string{"pjw@google.com"}, Committer: true},
+	{Email: "r@golang.org", Emails: []string{"r@google.com"}, Committer: true},
+	{Email: "remyoudompheng@gmail.com", Committer: true},
+	{Email: "rminnich@gmail.com", Committer: true},
+	{Email: "rogpeppe@gmail.com", Committer: true},
+	{Email: "rsc@golang.org", Emails: []string{"rsc@google.com"}, Committer: true},
+	{Email: "sameer@golang.org", Emails: []string{"sameer@google.com"}, Committer: true},
+}
@@ -0,0 +1,209 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package issue
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"app"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/taskqueue"
+)
+
+// A BulkJob records a bulk update started by BulkUpdate.
+// It is stored under its Name.
+type BulkJob struct {
+	Name    string
+	Query   string
+	Update  Update
+	DryRun  bool
+	Created time.Time
+
+	IDs     []int    // issues the update changes
+	Done    []int    // issues updated so far
+	Failed  []string `datastore:",noindex"` // failures, as "id: error"
+	Batches int      // batches not yet finished
+}
+
+// bulkArgs are the arguments to the issue.bulk task.
+type bulkArgs struct {
+	Job    string
+	IDs    []int
+	Update Update
+}
+
+const (
+	maxBulk   = 500 // issues a single BulkUpdate can change
+	bulkBatch = 20  // issues updated by a single task
+)
+
+var bulkRetry = &taskqueue.RetryOptions{
+	RetryLimit: 5,
+	MinBackoff: 1 * time.Minute,
+	MaxBackoff: 1 * time.Hour,
+}
+
+func init() {
+	app.JSONTaskFunc("issue.bulk", bulkTask, "default", bulkRetry)
+	app.RegisterStatus("issue bulk updates", bulkStatus)
+	app.RegisterOp("issue.bulk", "Apply an update to every issue matching a search query (App Engine search syntax, such as Label:Go1.3Maybe). Labels are comma-separated; prefix a label with - to remove it. Leave dryrun set to see what would change.", []string{"query", "label", "status", "owner", "comment", "dryrun"}, func(ctxt appengine.Context, args map[string]string) (string, error) {
+		u := Update{
+			Comment: args["comment"],
+			Status:  args["status"],
+			Owner:   args["owner"],
+		}
+		for _, l := range strings.Split(args["label"], ",") {
+			if l = strings.TrimSpace(l); l != "" {
+				u.Label = append(u.Label, l)
+			}
+		}
+		dryRun := args["dryrun"] != "" && args["dryrun"] != "0" && args["dryrun"] != "false"
+		job, err := BulkUpdate(ctxt, args["query"], u, dryRun)
+		if err != nil {
+			return "", err
+		}
+		if job.DryRun {
+			return fmt.Sprintf("dry run %s: would update %d issues: %v", job.Name, len(job.IDs), job.IDs), nil
+		}
+		return fmt.Sprintf("started %s: updating %d issues in %d batches", job.Name, len(job.IDs), job.Batches), nil
+	})
+}
+
+// BulkUpdate posts u to every issue matching query, which uses the
+// App Engine search syntax (see Search), skipping issues the update
+// would not change. The updates are made by tasks, one per batch of
+// issues, whose progress is recorded in the returned BulkJob and
+// shown on /admin/app/status; pending batches can be inspected and
+// edited on /admin/app/tasks.
+//
+// If dryRun is set, BulkUpdate only records which issues would be
+// updated, without starting any tasks.
+func BulkUpdate(ctxt appengine.Context, query string, u Update, dryRun bool) (*BulkJob, error) {
+	if query == "" {
+		return nil, fmt.Errorf("missing query")
+	}
+	if u.Comment == "" && u.Status == "" && u.Owner == "" && len(u.Label) == 0 {
+		return nil, fmt.Errorf("empty update")
+	}
+	issues, err := Search(ctxt, query, maxBulk+1)
+	if err != nil {
+		return nil, err
+	}
+	if len(issues) > maxBulk {
+		return nil, fmt.Errorf("query matches more than %d issues", maxBulk)
+	}
+
+	job := &BulkJob{
+		Name:    fmt.Sprintf("bulk-%d", time.Now().UnixNano()),
+		Query:   query,
+		Update:  u,
+		DryRun:  dryRun,
+		Created: time.Now(),
+	}
+	for _, issue := range issues {
+		if u.changes(issue) {
+			job.IDs = append(job.IDs, issue.ID)
+		}
+	}
+	if !dryRun {
+		job.Batches = (len(job.IDs) + bulkBatch - 1) / bulkBatch
+	}
+	if err := app.WriteData(ctxt, "BulkJob", job.Name, job); err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return job, nil
+	}
+	for i := 0; i < len(job.IDs); i += bulkBatch {
+		ids := job.IDs[i:]
+		if len(ids) > bulkBatch {
+			ids = ids[:bulkBatch]
+		}
+		name := fmt.Sprintf("issue.%s.%d", job.Name, i/bulkBatch)
+		if err := app.Task(ctxt, name, "issue.bulk", bulkArgs{job.Name, ids, u}); err != nil {
+			return job, err
+		}
+	}
+	return job, nil
+}
+
+// changes reports whether posting u to issue would change it.
+func (u *Update) changes(issue *Issue) bool {
+	if u.Comment != "" {
+		return true
+	}
+	x := *issue
+	x.Label = append([]string(nil), issue.Label...)
+	u.apply(&x)
+	return x.Status != issue.Status || x.Owner != issue.Owner || !reflect.DeepEqual(x.Label, issue.Label)
+}
+
+func bulkTask(ctxt appengine.Context, args bulkArgs) error {
+	var done []int
+	var failed []string
+	for _, id := range args.IDs {
+		var issue Issue
+		if err := app.ReadData(ctxt, "Issue", strconv.Itoa(id), &issue); err != nil {
+			failed = append(failed, fmt.Sprintf("%d: %v", id, err))
+			continue
+		}
+		if !args.Update.changes(&issue) {
+			// Already updated, perhaps by an earlier attempt at this task.
+			done = append(done, id)
+			continue
+		}
+		u := args.Update
+		if err := Post(ctxt, id, &u); err != nil {
+			ctxt.Errorf("bulk update %s: issue %d: %v", args.Job, id, err)
+			failed = append(failed, fmt.Sprintf("%d: %v", id, err))
+			continue
+		}
+		done = append(done, id)
+	}
+
+	return app.Transaction(ctxt, func(ctxt appengine.Context) error {
+		var job BulkJob
+		if err := app.ReadData(ctxt, "BulkJob", args.Job, &job); err != nil {
+			return err
+		}
+		job.Done = append(job.Done, done...)
+		job.Failed = append(job.Failed, failed...)
+		job.Batches--
+		return app.WriteData(ctxt, "BulkJob", args.Job, &job)
+	})
+}
+
+func bulkStatus(ctxt appengine.Context) string {
+	var jobs []*BulkJob
+	_, err := datastore.NewQuery("BulkJob").Order("-Created").Limit(10).GetAll(ctxt, &jobs)
+	w := new(bytes.Buffer)
+	if err != nil {
+		fmt.Fprintf(w, "error: %v\n", err)
+	}
+	if len(jobs) == 0 {
+		fmt.Fprintf(w, "no bulk updates\n")
+	}
+	for _, job := range jobs {
+		u := job.Update
+		fmt.Fprintf(w, "%s %v: %q status=%q owner=%q labels=%v", job.Name, job.Created.Format("2006-01-02 15:04"), job.Query, u.Status, u.Owner, u.Label)
+		if job.DryRun {
+			fmt.Fprintf(w, " (dry run): would update %d issues: %v\n", len(job.IDs), job.IDs)
+			continue
+		}
+		fmt.Fprintf(w, ": updated %d of %d issues, %d failures, %d batches pending\n", len(job.Done), len(job.IDs), len(job.Failed), job.Batches)
+		for _, f := range job.Failed {
+			fmt.Fprintf(w, "\t%s\n", f)
+		}
+	}
+	return "<pre>" + html.EscapeString(w.String()) + "</pre>"
+}
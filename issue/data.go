@@ -9,7 +9,7 @@ import "time"
 // An Issue represents a single issue on the tracker.
 // The initial report is Comment[0] and is always present.
 type Issue struct {
-	DV             int `dataversion:"6"`
+	DV             int `dataversion:"8"`
 	ID             int
 	Created        time.Time
 	Modified       time.Time
@@ -24,6 +24,13 @@ type Issue struct {
 	Stars          int
 	ClosedDate     time.Time
 	NeedGithubNote bool
+	FixLanded      time.Time // time of the latest commit saying it fixes the issue (see fixed.go)
+	FixCommits     []string  // URLs of the commits saying they fix the issue
+	Updated        time.Time // last change written by this app (see writeIssue)
+	Indexed        bool      // up to date in the search index (see search.go)
+	Urgent         string    // urgency phrase mentioned, if any (see urgent.go)
+	GitHub         string    // GitHub repository the issue was loaded from, if any
+	Restricted     bool      // security issue stored without its text (see security.go)
 }
 
 // A Comment represents a single comment on an issue.
@@ -50,3 +57,9 @@ type ByID []*Issue
 func (x ByID) Len() int           { return len(x) }
 func (x ByID) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
 func (x ByID) Less(i, j int) bool { return x[i].ID < x[j].ID }
+
+type ByModified []*Issue
+
+func (x ByModified) Len() int           { return len(x) }
+func (x ByModified) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+func (x ByModified) Less(i, j int) bool { return x[i].Modified.Before(x[j].Modified) }
@@ -0,0 +1,52 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package issue
+
+import "fmt"
+
+// A ChangeEvent is published on the "issue.changed" topic (see app.Publish)
+// when the loader finds that an issue has changed. The event key is the
+// issue number. Issues seen for the first time do not generate events,
+// so that the initial load does not announce every issue.
+type ChangeEvent struct {
+	ID      int
+	Summary string
+	Changes []string // descriptions of the changes, such as "closed"
+	Urgent  string   // the issue's urgency phrase, if any (see urgent.go)
+
+	// Restricted reports whether the issue is a restricted
+	// security issue (see security.go), whose summary
+	// must not be sent outside the app.
+	Restricted bool
+}
+
+// issueChanged returns the event describing the changes between old and cur,
+// or nil if there are none worth announcing.
+func issueChanged(old, cur *Issue) *ChangeEvent {
+	var list []string
+	switch {
+	case old.State != "closed" && cur.State == "closed":
+		list = append(list, "closed as "+cur.Status)
+	case old.State == "closed" && cur.State != "closed":
+		list = append(list, "reopened")
+	case old.Status != cur.Status:
+		list = append(list, "status now "+cur.Status)
+	}
+	if old.Owner != cur.Owner && cur.Owner != "" {
+		list = append(list, "owner now "+cur.Owner)
+	}
+	if old.Urgent == "" && cur.Urgent != "" {
+		list = append(list, "flagged urgent: "+cur.Urgent)
+	}
+	if n := len(cur.Comment) - len(old.Comment); n == 1 {
+		list = append(list, "new comment")
+	} else if n > 1 {
+		list = append(list, fmt.Sprintf("%d new comments", n))
+	}
+	if len(list) == 0 {
+		return nil
+	}
+	return &ChangeEvent{ID: cur.ID, Summary: cur.Summary, Changes: list, Urgent: cur.Urgent, Restricted: cur.Restricted}
+}
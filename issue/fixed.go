@@ -0,0 +1,106 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package issue
+
+import (
+	"time"
+
+	"app"
+	"commit"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Issues are marked as fixed by the issue.fixlanded scan, which picks up
+// every commit.Rev written with IssuesLinked == false and records the
+// commit on each issue its log says it fixes. The tracker closes those
+// issues as Fixed; FixedUnverified finds the ones nobody has verified yet.
+
+func init() {
+	app.ScanData("issue.fixlanded", 5*time.Minute,
+		datastore.NewQuery("Rev").Filter("IssuesLinked =", false),
+		linkRev)
+}
+
+func linkRev(ctxt appengine.Context, kind, key string) error {
+	var rev commit.Rev
+	if err := app.ReadData(ctxt, "Rev", key, &rev); err != nil {
+		return err
+	}
+	changed := false
+	for _, id := range rev.FixesIssues {
+		c, err := markFixLanded(ctxt, id, &rev)
+		if err != nil {
+			return err
+		}
+		changed = changed || c
+	}
+	if changed {
+		app.BumpDataVersion(ctxt)
+	}
+	return app.Transaction(ctxt, func(ctxt appengine.Context) error {
+		var rev commit.Rev
+		if err := app.ReadData(ctxt, "Rev", key, &rev); err != nil {
+			return err
+		}
+		rev.IssuesLinked = true
+		return app.WriteData(ctxt, "Rev", key, &rev)
+	})
+}
+
+// markFixLanded records rev as a fix for the issue with the given id.
+// Issues that have not been loaded from the tracker are skipped.
+func markFixLanded(ctxt appengine.Context, id string, rev *commit.Rev) (changed bool, err error) {
+	url := commit.URL(rev.Repo, rev.Hash)
+	err = app.Transaction(ctxt, func(ctxt appengine.Context) error {
+		changed = false
+		var issue Issue
+		if err := app.ReadData(ctxt, "Issue", id, &issue); err != nil {
+			if err == datastore.ErrNoSuchEntity {
+				ctxt.Infof("commit %s fixes unknown issue %s", rev.ShortHash, id)
+				return nil
+			}
+			return err
+		}
+		for _, u := range issue.FixCommits {
+			if u == url {
+				return nil
+			}
+		}
+		issue.FixCommits = append(issue.FixCommits, url)
+		if rev.Time.After(issue.FixLanded) {
+			issue.FixLanded = rev.Time
+		}
+		issue.Updated = time.Now()
+		changed = true
+		return app.WriteData(ctxt, "Issue", id, &issue)
+	})
+	return changed, err
+}
+
+// FixedUnverified returns up to limit issues that a loaded commit says
+// it fixes but that have not been marked Verified, most recently fixed first.
+func FixedUnverified(ctxt appengine.Context, limit int) ([]*Issue, error) {
+	var list []*Issue
+	it := datastore.NewQuery("Issue").
+		Filter("FixLanded >", time.Time{}).
+		Order("-FixLanded").
+		Run(ctxt)
+	for len(list) < limit {
+		issue := new(Issue)
+		_, err := it.Next(issue)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if issue.Status != "Verified" {
+			list = append(list, issue)
+		}
+	}
+	return list, nil
+}
@@ -10,28 +10,28 @@ import (
 	"bytes"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"html"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"app"
+	"identity"
 
 	"appengine"
 	"appengine/datastore"
-	"appengine/urlfetch"
-
-	"github.com/rsc/appstats"
 )
 
 func init() {
-	http.Handle("/admin/issue/show/", appstats.NewHandler(show))
+	app.Handle("/admin/issue/show/", show)
 }
 
 func show(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
@@ -54,6 +54,10 @@ func show(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
 
 func init() {
 	app.RegisterStatus("issue loading", status)
+	app.RegisterQuota("issue", "Issue")
+
+	app.RegisterCounter("issue.count", datastore.NewQuery("Issue"), false)
+	app.RegisterCounter("issue.count.open", datastore.NewQuery("Issue").Filter("State =", "open"), true)
 }
 
 func status(ctxt appengine.Context) string {
@@ -62,6 +66,10 @@ func status(ctxt appengine.Context) string {
 	var count int64
 	app.ReadMeta(ctxt, "issue.count", &count)
 	fmt.Fprintln(w, time.Now())
+	fmt.Fprintf(w, "%d issues total\n", count)
+	count = 0
+	app.ReadMeta(ctxt, "issue.count.open", &count)
+	fmt.Fprintf(w, "%d issues open (as of last recount)\n", count)
 
 	var t1 string
 	app.ReadMeta(ctxt, "issue.mtime", &t1)
@@ -74,10 +82,28 @@ func status(ctxt appengine.Context) string {
 func init() {
 	app.Cron("issue.load", 5*time.Minute, load)
 
-	http.Handle("/admin/issueload", appstats.NewHandler(func(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) { load(ctxt) }))
+	app.Handle("/admin/issueload", func(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) { load(ctxt) })
+
+	app.RegisterOp("issue.recount", "Recount the stored issues and reset issue.count.", nil, func(ctxt appengine.Context, args map[string]string) (string, error) {
+		n, err := app.CountKeys(ctxt, datastore.NewQuery("Issue"))
+		if err != nil {
+			return "", err
+		}
+		if err := app.WriteMeta(ctxt, "issue.count", n); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("issue.count = %d", n), nil
+	})
 }
 
+var backfill = app.RegisterBackfill("issue.load", false)
+
 func load(ctxt appengine.Context) error {
+	if !backfill.Start(ctxt) {
+		return nil
+	}
+	defer backfill.Done(ctxt)
+
 	mtime := time.Date(2009, 1, 1, 0, 0, 0, 0, time.UTC)
 	if appengine.IsDevAppServer() {
 		mtime = time.Now().UTC().Add(-24 * time.Hour)
@@ -92,7 +118,13 @@ func load(ctxt appengine.Context) error {
 	var try int
 	needMore := false
 	for try = 0; ; try++ {
+		if !backfill.Allow(ctxt, 1) {
+			return nil
+		}
 		issues, err = search(ctxt, "go", "all", "", false, mtime, now, maxResults)
+		if app.IsHostDown(err) {
+			return err
+		}
 		if err != nil {
 			ctxt.Errorf("load issues since %v: %v", mtime, err)
 			return nil
@@ -130,21 +162,28 @@ func load(ctxt appengine.Context) error {
 		ctxt.Infof("shortened to %v to %v", mtime, now)
 	}
 
-	issues, err = search(ctxt, "go", "all", "", true, mtime, now, maxResults)
-	if err != nil {
-		ctxt.Errorf("full load of issues from %v to %v: %v", mtime, now, err)
-		return nil
-	}
-
-	if len(issues) == 0 {
-		ctxt.Errorf("unexpected: no issues from %v to %v", mtime, now)
-		return nil
-	}
-
-	for _, issue := range issues {
-		println("WRITE ISSUE", issue.ID)
+	// The full load fetches the comments of each issue separately,
+	// charging each fetch to the budget. Issues are loaded oldest change
+	// first, so that if the budget runs out or a fetch fails, the issues
+	// stored so far can advance issue.mtime and the next run continues
+	// from there.
+	sort.Sort(ByModified(issues))
+	client := trackerClient(ctxt)
+	for i, issue := range issues {
+		if !backfill.Allow(ctxt, 1) {
+			return saveIssueMtime(ctxt, i, mtime)
+		}
+		err := fetchComments(client, "go", issue)
+		if app.IsHostDown(err) {
+			saveIssueMtime(ctxt, i, mtime)
+			return err
+		}
+		if err != nil {
+			ctxt.Errorf("loading comments on issue %d: %v", issue.ID, err)
+			return saveIssueMtime(ctxt, i, mtime)
+		}
 		if err := writeIssue(ctxt, issue, "", nil); err != nil {
-			return nil
+			return saveIssueMtime(ctxt, i, mtime)
 		}
 		if mtime.Before(issue.Modified) {
 			mtime = issue.Modified
@@ -162,12 +201,50 @@ func load(ctxt appengine.Context) error {
 	return nil
 }
 
+// saveIssueMtime records mtime, the modification time of the last of
+// the n issues stored by a load that stopped early, if n > 0.
+func saveIssueMtime(ctxt appengine.Context, n int, mtime time.Time) error {
+	if n > 0 {
+		app.WriteMeta(ctxt, "issue.mtime", mtime.UTC())
+	}
+	return nil
+}
+
+// errGitHubIssue abandons the write of an issue from Google Code
+// over an issue already loaded from GitHub.
+var errGitHubIssue = errors.New("issue loaded from GitHub")
+
+// A staleIssueError reports that the stored copy of an issue
+// was modified more recently than the copy being written.
+type staleIssueError struct {
+	ID     int
+	Source string
+	Have   time.Time
+	Sent   time.Time
+}
+
+func (e *staleIssueError) Error() string {
+	return fmt.Sprintf("issue %v: have %v but %s sent %v", e.ID, e.Have, e.Source, e.Sent)
+}
+
+// writeIssue stores issue, merging it into the stored copy, if any.
+// Once an issue has been loaded from GitHub, copies from Google Code
+// are ignored. If the stored copy is newer than issue, writeIssue
+// returns a *staleIssueError.
 func writeIssue(ctxt appengine.Context, issue *Issue, stateKey string, state interface{}) error {
+	restricted := restrictedLabels(ctxt)
+	changed := false
+	var change *ChangeEvent
 	err := app.Transaction(ctxt, func(ctxt appengine.Context) error {
+		change = nil
 		var old Issue
 		if err := app.ReadData(ctxt, "Issue", fmt.Sprint(issue.ID), &old); err != nil && err != datastore.ErrNoSuchEntity {
 			return err
 		}
+		before := old
+		if old.GitHub != "" && issue.GitHub == "" {
+			return errGitHubIssue
+		}
 		if old.ID == 0 { // no old data
 			var count int64
 			app.ReadMeta(ctxt, "issue.count", &count)
@@ -175,7 +252,11 @@ func writeIssue(ctxt appengine.Context, issue *Issue, stateKey string, state int
 		}
 
 		if old.Modified.After(issue.Modified) {
-			return fmt.Errorf("issue %v: have %v but code.google.com sent %v", issue.ID, old.Modified, issue.Modified)
+			source := "code.google.com"
+			if issue.GitHub != "" {
+				source = "GitHub"
+			}
+			return &staleIssueError{issue.ID, source, old.Modified, issue.Modified}
 		}
 
 		// Copy Issue into original structure.
@@ -194,20 +275,41 @@ func writeIssue(ctxt appengine.Context, issue *Issue, stateKey string, state int
 		old.Modified = issue.Modified
 		old.Stars = issue.Stars
 		old.ClosedDate = issue.ClosedDate
+		old.GitHub = issue.GitHub
+		old.restrict(restricted)
 		updateIssue(&old)
+		changed = !reflect.DeepEqual(before, old)
+		if changed {
+			old.Updated = time.Now()
+			old.Indexed = false
+		}
 
 		if err := app.WriteData(ctxt, "Issue", fmt.Sprint(issue.ID), &old); err != nil {
 			return err
 		}
+		if before.ID != 0 {
+			change = issueChanged(&before, &old)
+		}
 		if stateKey != "" {
 			app.WriteMeta(ctxt, stateKey, state)
 		}
 		return nil
 	})
+	if err == errGitHubIssue {
+		ctxt.Infof("not storing issue %v from code.google.com: already loaded from GitHub", issue.ID)
+		return nil
+	}
 	if err != nil {
 		ctxt.Errorf("storing issue %v: %v", issue.ID, err)
+		return err
+	}
+	if changed {
+		app.BumpDataVersion(ctxt)
+	}
+	if change != nil {
+		app.Publish(ctxt, "issue.changed", fmt.Sprint(issue.ID), change)
 	}
-	return err
+	return nil
 }
 
 func init() {
@@ -215,6 +317,12 @@ func init() {
 }
 
 func updateIssue(issue *Issue) {
+	issue.Urgent = issue.urgency()
+	if issue.GitHub != "" {
+		// Already on GitHub; nothing to note on Google Code.
+		issue.NeedGithubNote = false
+		return
+	}
 	for _, label := range issue.Label {
 		if label == "IssueMoved" {
 			return
@@ -267,10 +375,7 @@ var xmlDebug = false
 // The format of the can string and the query are documented at
 // https://code.google.com/p/support/wiki/IssueTrackerAPI.
 func search(ctxt appengine.Context, project, can, query string, detail bool, updateMin, updateMax time.Time, maxResults int) ([]*Issue, error) {
-	client := urlfetch.Client(ctxt)
-	if client == nil {
-		client = http.DefaultClient
-	}
+	client := trackerClient(ctxt)
 	q := url.Values{
 		"q":           {query},
 		"max-results": {"1000"},
@@ -337,52 +442,366 @@ func search(ctxt appengine.Context, project, can, query string, detail bool, upd
 		}
 		issues = append(issues, p)
 		if detail {
-			u := "https://code.google.com/feeds/issues/p/" + project + "/issues/" + id + "/comments/full"
-			r, err := client.Get(u)
-			if err != nil {
+			if err := fetchComments(client, project, p); err != nil {
 				return nil, err
 			}
+		}
+	}
 
-			var feed _Feed
-			err = xml.NewDecoder(r.Body).Decode(&feed)
-			r.Body.Close()
-			if err != nil {
-				return nil, err
+	sort.Sort(BySummary(issues))
+	return issues, nil
+}
+
+// trackerClient returns the client for requests to code.google.com.
+func trackerClient(ctxt appengine.Context) *http.Client {
+	if client := app.Client(ctxt, "issue"); client != nil {
+		return client
+	}
+	return http.DefaultClient
+}
+
+// fetchComments fetches the comments on the issue p from the tracker
+// and appends them to p.Comment.
+func fetchComments(client *http.Client, project string, p *Issue) error {
+	u := "https://code.google.com/feeds/issues/p/" + project + "/issues/" + fmt.Sprint(p.ID) + "/comments/full"
+	r, err := client.Get(u)
+	if err != nil {
+		return err
+	}
+
+	var feed _Feed
+	err = xml.NewDecoder(r.Body).Decode(&feed)
+	r.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	for i := range feed.Entry {
+		e := &feed.Entry[i]
+		c := Comment{
+			Author: strings.TrimPrefix(e.Title, "Comment by "),
+			Time:   e.Published,
+			Text:   html.UnescapeString(e.Content),
+		}
+		var cc, label []string
+		for _, up := range e.Updates {
+			if up.Summary != "" {
+				c.Summary = up.Summary
+			}
+			if up.Owner != "" {
+				c.Owner = up.Owner
 			}
+			if up.Status != "" {
+				c.Status = up.Status
+			}
+			if up.MergedInto != "" {
+				c.Duplicate, _ = strconv.Atoi(up.MergedInto)
+			}
+			if up.Label != "" {
+				label = append(label, up.Label)
+			}
+			cc = append(cc, up.CC...)
+		}
+		c.CC = strings.Join(cc, ",")
+		c.Label = strings.Join(label, ",")
+		p.Comment = append(p.Comment, c)
+	}
+	return nil
+}
 
-			for i := range feed.Entry {
-				e := &feed.Entry[i]
-				c := Comment{
-					Author: strings.TrimPrefix(e.Title, "Comment by "),
-					Time:   e.Published,
-					Text:   html.UnescapeString(e.Content),
-				}
-				var cc, label []string
-				for _, up := range e.Updates {
-					if up.Summary != "" {
-						c.Summary = up.Summary
-					}
-					if up.Owner != "" {
-						c.Owner = up.Owner
-					}
-					if up.Status != "" {
-						c.Status = up.Status
-					}
-					if up.MergedInto != "" {
-						c.Duplicate, _ = strconv.Atoi(up.MergedInto)
-					}
-					if up.Label != "" {
-						label = append(label, up.Label)
-					}
-					cc = append(cc, up.CC...)
-				}
-				c.CC = strings.Join(cc, ",")
-				c.Label = strings.Join(label, ",")
-				p.Comment = append(p.Comment, c)
+// GitHub loading.
+//
+// The Google Code issue tracker is going away, and its issues are moving
+// to GitHub. The issue.github cron polls the GitHub issues API for each
+// repository listed in the "issue.github" config (see app.ReadConfig),
+// for example {"Repos": [{"Name": "golang/go"}]}, and stores the issues
+// in the same Issue records as the Google Code loader, so the rest of the
+// app need not care where an issue came from. The Issue ID is the GitHub
+// issue number plus the repository's Offset: golang/go keeps the Google
+// Code numbers, so it uses 0, but other repositories need offsets that
+// keep their issues apart.
+//
+// Like the Google Code loader, it keeps a modification time for each
+// repository, in the meta value "issue.github.<name>", and asks only for
+// issues updated since then. It also records the response's ETag and
+// Last-Modified headers and sends them back on the next identical request,
+// so that polling an unchanged repository gets a 304, which does not
+// count against the API rate limit. Requests are authenticated with the
+// token stored in the meta value "github.token", if any.
+//
+// GitHub has no issue status, so loaded issues have status Open or Closed.
+// Their GitHub field names the repository, and they never need a moved
+// note posted on Google Code. Once an issue has been loaded from GitHub,
+// the Google Code loader leaves it alone. An issue whose stored copy is
+// newer than GitHub's is logged and skipped.
+// Logins are mapped to email addresses using the identity directory
+// where possible. Pull requests, which the API lists as issues, are skipped.
+
+type githubConfig struct {
+	Repos []githubRepo
+}
+
+type githubRepo struct {
+	Name   string // owner/repo, such as "golang/go"
+	Offset int    // added to issue numbers to form Issue IDs
+}
+
+// A githubState is the incremental loading state for a repository.
+type githubState struct {
+	Mtime        time.Time // load issues updated at or after Mtime
+	URL          string    // URL of the last complete request
+	ETag         string    // its ETag response header
+	LastModified string    // its Last-Modified response header
+}
+
+// githubPage is the number of issues or comments requested at once,
+// the most the API allows.
+const githubPage = 100
+
+func init() {
+	app.Cron("issue.github", 5*time.Minute, loadGitHub)
+	app.RegisterStatus("issue loading from GitHub", githubStatus)
+}
+
+func githubStatus(ctxt appengine.Context) string {
+	var cfg githubConfig
+	app.ReadConfig(ctxt, "issue.github", &cfg)
+	w := new(bytes.Buffer)
+	if len(cfg.Repos) == 0 {
+		fmt.Fprintf(w, "no repositories configured\n")
+	}
+	for _, repo := range cfg.Repos {
+		var st githubState
+		app.ReadMeta(ctxt, "issue.github."+repo.Name, &st)
+		fmt.Fprintf(w, "%s (offset %d): modifications up to %v\n", repo.Name, repo.Offset, st.Mtime)
+	}
+	return "<pre>" + html.EscapeString(w.String()) + "</pre>"
+}
+
+func loadGitHub(ctxt appengine.Context) error {
+	var cfg githubConfig
+	app.ReadConfig(ctxt, "issue.github", &cfg)
+	more := false
+	for _, repo := range cfg.Repos {
+		m, err := loadGitHubRepo(ctxt, repo)
+		if app.IsHostDown(err) {
+			return err // no point trying the other repos
+		}
+		if err != nil {
+			ctxt.Errorf("loading GitHub issues for %s: %v", repo.Name, err)
+			continue
+		}
+		more = more || m
+	}
+	if more {
+		return app.ErrMoreCron
+	}
+	return nil
+}
+
+// A githubIssue is an issue as returned by the GitHub API.
+type githubIssue struct {
+	Number      int
+	Title       string
+	Body        string
+	State       string // "open" or "closed"
+	User        githubUser
+	Assignee    *githubUser
+	Labels      []struct{ Name string }
+	Comments    int
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	ClosedAt    *time.Time `json:"closed_at"`
+	PullRequest *struct{}  `json:"pull_request"`
+}
+
+type githubUser struct {
+	Login string
+}
+
+// A githubComment is an issue comment as returned by the GitHub API.
+type githubComment struct {
+	User      githubUser
+	Body      string
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// loadGitHubRepo loads the issues in repo updated since the last load.
+// It reports whether there are more to load.
+func loadGitHubRepo(ctxt appengine.Context, repo githubRepo) (more bool, err error) {
+	key := "issue.github." + repo.Name
+	var st githubState
+	if err := app.ReadMeta(ctxt, key, &st); err != nil && err != datastore.ErrNoSuchEntity {
+		return false, err
+	}
+
+	q := url.Values{
+		"state":     {"all"},
+		"sort":      {"updated"},
+		"direction": {"asc"},
+		"per_page":  {fmt.Sprint(githubPage)},
+	}
+	if !st.Mtime.IsZero() {
+		q.Set("since", st.Mtime.UTC().Format(time.RFC3339))
+	}
+	u := "https://api.github.com/repos/" + repo.Name + "/issues?" + q.Encode()
+
+	var list []*githubIssue
+	var hdr http.Header
+	if u == st.URL {
+		hdr = http.Header{"If-None-Match": {st.ETag}, "If-Modified-Since": {st.LastModified}}
+	}
+	resp, err := githubGet(ctxt, u, hdr, &list)
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		return false, nil
+	}
+
+	dir := identity.Load(ctxt)
+	login := func(u *githubUser) string {
+		if u == nil || u.Login == "" {
+			return ""
+		}
+		if p := dir.LookupGitHub(u.Login); p != nil {
+			return p.Email
+		}
+		return u.Login
+	}
+
+	mtime := st.Mtime
+	for _, gi := range list {
+		if gi.UpdatedAt.After(mtime) {
+			mtime = gi.UpdatedAt
+		}
+		if gi.PullRequest != nil {
+			continue
+		}
+		issue := githubToIssue(gi, repo, login(&gi.User), login(gi.Assignee))
+		for page := 1; len(issue.Comment) < 1+gi.Comments; page++ {
+			var comments []*githubComment
+			cu := fmt.Sprintf("https://api.github.com/repos/%s/issues/%d/comments?page=%d&per_page=%d", repo.Name, gi.Number, page, githubPage)
+			if _, err := githubGet(ctxt, cu, nil, &comments); err != nil {
+				return false, err
+			}
+			for _, c := range comments {
+				issue.Comment = append(issue.Comment, Comment{
+					Author: login(&c.User),
+					Time:   c.CreatedAt,
+					Text:   c.Body,
+				})
+			}
+			if len(comments) < githubPage {
+				break
+			}
+		}
+		if err := writeIssue(ctxt, issue, "", nil); err != nil {
+			if _, ok := err.(*staleIssueError); ok {
+				// Logged by writeIssue. Skip it rather than stall the repository.
+				continue
 			}
+			return false, err
 		}
 	}
 
-	sort.Sort(BySummary(issues))
-	return issues, nil
+	if len(list) == githubPage {
+		more = true
+		if !mtime.After(st.Mtime) {
+			// A full page of issues updated at the same second.
+			// Skip past them rather than asking for them forever.
+			ctxt.Errorf("GitHub issues for %s: %d updated at %v", repo.Name, len(list), mtime)
+			mtime = mtime.Add(1 * time.Second)
+		}
+		st = githubState{Mtime: mtime}
+	} else {
+		st = githubState{
+			Mtime:        mtime,
+			URL:          u,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+		}
+	}
+	if err := app.WriteMeta(ctxt, key, &st); err != nil {
+		return false, err
+	}
+	return more, nil
+}
+
+// githubToIssue converts the GitHub issue gi in repo to an Issue,
+// holding only the initial report as its first comment.
+// The author and owner are given as email addresses or GitHub logins.
+func githubToIssue(gi *githubIssue, repo githubRepo, author, owner string) *Issue {
+	issue := &Issue{
+		ID:       gi.Number + repo.Offset,
+		Created:  gi.CreatedAt,
+		Modified: gi.UpdatedAt,
+		Summary:  strings.Replace(gi.Title, "\n", " ", -1),
+		Status:   "Open",
+		Owner:    owner,
+		State:    "open",
+		GitHub:   repo.Name,
+		Comment: []Comment{
+			{
+				Author: author,
+				Time:   gi.CreatedAt,
+				Text:   gi.Body,
+			},
+		},
+	}
+	for _, l := range gi.Labels {
+		issue.Label = append(issue.Label, l.Name)
+	}
+	if gi.State == "closed" {
+		issue.Status = "Closed"
+		issue.State = "closed"
+		if gi.ClosedAt != nil {
+			issue.ClosedDate = *gi.ClosedAt
+		}
+	}
+	return issue
+}
+
+// githubGet fetches the GitHub API URL u, sending the extra headers hdr,
+// and decodes the JSON response into v. A 304 Not Modified response
+// is returned without decoding.
+func githubGet(ctxt appengine.Context, u string, hdr http.Header, v interface{}) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, vv := range hdr {
+		for _, s := range vv {
+			if s != "" {
+				req.Header.Add(k, s)
+			}
+		}
+	}
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	req.Header.Set("User-Agent", "golang-dev-dashboard")
+	var token string
+	if err := app.ReadMeta(ctxt, "github.token", &token); err == nil && token != "" {
+		req.Header.Set("Authorization", "token "+token)
+	}
+
+	resp, err := app.Client(ctxt, "issue").Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// ok
+	case http.StatusNotModified:
+		return resp, nil
+	default:
+		if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+			return nil, fmt.Errorf("%s: rate limit exceeded until %s", u, resp.Header.Get("X-RateLimit-Reset"))
+		}
+		return nil, fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return nil, fmt.Errorf("%s: %v", u, err)
+	}
+	return resp, nil
 }
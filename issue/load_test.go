@@ -0,0 +1,207 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package issue
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"app"
+	"app/apptest"
+)
+
+// The feeds in testdata follow the Atom served by the code.google.com issue tracker.
+// Run the tests with -record to replace them with fresh recordings.
+
+func TestSearch(t *testing.T) {
+	ctxt := apptest.NewContext(t)
+	defer app.SetStore(app.SetStore(apptest.NewStore()))
+	defer app.SetTransport(app.SetTransport(apptest.NewReplay("testdata")))
+
+	issues, err := search(ctxt, "go", "all", "id:7000", true, time.Time{}, time.Time{}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 1 {
+		t.Fatalf("found %d issues, want 1", len(issues))
+	}
+	issue := issues[0]
+	want := &Issue{
+		ID:       7000,
+		Created:  time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC),
+		Modified: time.Date(2014, 3, 5, 17, 21, 45, 0, time.UTC),
+		Summary:  "net/http: Transport leaks connections on  canceled requests",
+		Status:   "Accepted",
+		Owner:    "bradfitz@golang.org",
+		CC:       []string{"dvyukov@google.com"},
+		Label:    []string{"Release-Go1.3", "Type-Bug"},
+		State:    "open",
+		Stars:    3,
+		Comment: []Comment{
+			{
+				Author: "gopher@example.com",
+				Time:   time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC),
+				Text:   "What steps will reproduce the problem?\n1. Cancel a request with Transport.CancelRequest.\n\nWhat is the expected output? The connection is closed.\nWhat do you see instead? It stays in the idle pool <sometimes>.",
+			},
+			{
+				Author: "bradfitz@golang.org",
+				Time:   time.Date(2014, 1, 3, 8, 0, 0, 0, time.UTC),
+				Text:   "I can reproduce this.",
+				Status: "Accepted",
+				Owner:  "bradfitz@golang.org",
+				Label:  "Release-Go1.3",
+			},
+			{
+				Author: "dvyukov@google.com",
+				Time:   time.Date(2014, 3, 5, 17, 21, 45, 0, time.UTC),
+				Text:   "The race detector finds this too.",
+				CC:     "dvyukov@google.com",
+			},
+		},
+	}
+	if !reflect.DeepEqual(issue, want) {
+		t.Errorf("search:\nhave %+v\nwant %+v", issue, want)
+	}
+}
+
+func TestLoadGitHub(t *testing.T) {
+	ctxt := apptest.NewContext(t)
+	defer app.SetStore(app.SetStore(apptest.NewStore()))
+	defer app.SetTransport(app.SetTransport(apptest.NewReplay("testdata")))
+
+	more, err := loadGitHubRepo(ctxt, githubRepo{Name: "golang/go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if more {
+		t.Errorf("loadGitHubRepo reported more issues to load")
+	}
+
+	var issue Issue
+	if err := app.ReadData(ctxt, "Issue", "9001", &issue); err != nil {
+		t.Fatal(err)
+	}
+	issue.DV = 0
+	want := Issue{
+		ID:         9001,
+		Created:    time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC),
+		Modified:   time.Date(2015, 2, 3, 4, 5, 6, 0, time.UTC),
+		Summary:    "net/http: Server ignores ReadTimeout for TLS handshakes",
+		Status:     "Closed",
+		Owner:      "bradfitz",
+		Label:      []string{"Release-Go1.5"},
+		State:      "closed",
+		ClosedDate: time.Date(2015, 2, 3, 4, 5, 6, 0, time.UTC),
+		Comment: []Comment{
+			{
+				Author: "gopher",
+				Time:   time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC),
+				Text:   "The handshake can hang forever.",
+			},
+			{
+				Author: "bradfitz",
+				Time:   time.Date(2015, 2, 3, 4, 5, 6, 0, time.UTC),
+				Text:   "Fixed by the handshake timeout change.",
+			},
+		},
+		GitHub:  "golang/go",
+		Updated: issue.Updated,
+	}
+	if !reflect.DeepEqual(issue, want) {
+		t.Errorf("loaded issue:\nhave %+v\nwant %+v", issue, want)
+	}
+
+	if err := app.ReadData(ctxt, "Issue", "9002", new(Issue)); err == nil {
+		t.Errorf("loaded pull request 9002 as an issue")
+	}
+
+	var st githubState
+	if err := app.ReadMeta(ctxt, "issue.github.golang/go", &st); err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2015, 2, 5, 0, 0, 0, 0, time.UTC); !st.Mtime.Equal(want) {
+		t.Errorf("Mtime = %v, want %v", st.Mtime, want)
+	}
+
+	// A later copy from Google Code must not replace the GitHub one.
+	gc := &Issue{ID: 9001, Summary: "from Google Code", Modified: want.Modified.Add(time.Hour)}
+	if err := writeIssue(ctxt, gc, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	issue = Issue{}
+	if err := app.ReadData(ctxt, "Issue", "9001", &issue); err != nil {
+		t.Fatal(err)
+	}
+	if issue.GitHub != "golang/go" || issue.Summary != want.Summary {
+		t.Errorf("after Google Code write, issue has GitHub %q, Summary %q", issue.GitHub, issue.Summary)
+	}
+
+	// A stored copy newer than GitHub's is skipped, not fatal.
+	issue.Modified = time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := app.WriteData(ctxt, "Issue", "9001", &issue); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.DeleteMeta(ctxt, "issue.github.golang/go"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadGitHubRepo(ctxt, githubRepo{Name: "golang/go"}); err != nil {
+		t.Fatalf("reloading with a newer stored issue: %v", err)
+	}
+	st = githubState{}
+	if err := app.ReadMeta(ctxt, "issue.github.golang/go", &st); err != nil {
+		t.Fatalf("reloading with a newer stored issue: %v", err)
+	}
+}
+
+var urgencyTests = []struct {
+	text string
+	want string
+}{
+	{"net/http: leaks connections", ""},
+	{"This Blocks Release; please look.", "blocks release"},
+	{"runtime: regression in GC pause times", "regression"},
+	{"> this is a security problem\nI disagree.", ""},
+	{"Marking as a release-blocker.", "release-blocker"},
+	{"insecurity", ""},
+}
+
+func TestUrgency(t *testing.T) {
+	for _, tt := range urgencyTests {
+		if have := Urgency(tt.text); have != tt.want {
+			t.Errorf("Urgency(%q) = %q, want %q", tt.text, have, tt.want)
+		}
+	}
+}
+
+func TestRestrict(t *testing.T) {
+	labels := []string{"Restrict-View-Security"}
+	issue := &Issue{
+		Summary: "crypto/tls: embargoed",
+		Label:   []string{"Type-Bug", "Restrict-View-Security"},
+		Comment: []Comment{
+			{Author: "gopher@example.com", Text: "details"},
+			{Author: "agl@golang.org", Text: "more details", Status: "Accepted"},
+		},
+	}
+	issue.restrict(labels)
+	if !issue.Restricted {
+		t.Fatalf("issue not restricted")
+	}
+	for i, c := range issue.Comment {
+		if c.Text != "" {
+			t.Errorf("comment %d text not redacted: %q", i, c.Text)
+		}
+	}
+	if issue.Comment[1].Author != "agl@golang.org" || issue.Comment[1].Status != "Accepted" {
+		t.Errorf("comment metadata lost: %+v", issue.Comment[1])
+	}
+
+	issue.Label = []string{"Type-Bug"}
+	issue.restrict(labels)
+	if issue.Restricted {
+		t.Errorf("issue without restricted label still restricted")
+	}
+}
@@ -5,10 +5,9 @@
 package issue
 
 import (
-	"bytes"
-	"encoding/xml"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"strings"
 	"time"
@@ -16,11 +15,9 @@ import (
 	"app"
 
 	"code.google.com/p/goauth2/oauth"
-	"github.com/rsc/appstats"
 
 	"appengine"
 	"appengine/datastore"
-	"appengine/urlfetch"
 )
 
 func oauthConfig(ctxt appengine.Context) (*oauth.Config, error) {
@@ -45,14 +42,25 @@ func oauthConfig(ctxt appengine.Context) (*oauth.Config, error) {
 	return cfg, nil
 }
 
+// githubNoteFlag gates posting "moved to GitHub" notes on the old issues.
+var githubNoteFlag = app.Flag("issue.githubnote", false)
+
 func init() {
-	http.Handle("/admin/testclose/", appstats.NewHandler(testIssue))
-	http.Handle("/admin/testmove", appstats.NewHandler(doMoves))
+	app.Handle("/admin/testclose/", testIssue)
+	app.Handle("/admin/testmove", doMoves)
 
-	return
-	app.ScanData("issue.github1", 15*time.Minute,
-		datastore.NewQuery("Issue").Filter("NeedGithubNote =", true),
-		postMovedNote)
+	app.Cron("issue.github1", 15*time.Minute, func(ctxt appengine.Context) error {
+		if !githubNoteFlag.On(ctxt) {
+			return nil
+		}
+		// Ask for another run only if this one made progress:
+		// if every post failed, GitHub or Google Code is having trouble,
+		// and the next regular run is soon enough to try again.
+		if n, done := postMovedNotes(ctxt, ioutil.Discard); n == movesPerRun && done > 0 {
+			return app.ErrMoreCron
+		}
+		return nil
+	})
 }
 
 func testIssue(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
@@ -65,8 +73,18 @@ func testIssue(ctxt appengine.Context, w http.ResponseWriter, req *http.Request)
 }
 
 func doMoves(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
+	postMovedNotes(ctxt, w)
+}
+
+// movesPerRun is the number of moved notes posted by a single call to postMovedNotes.
+const movesPerRun = 10
+
+// postMovedNotes posts moved notes for up to movesPerRun issues,
+// reporting progress to w. It returns the number of issues considered
+// and the number of those it dealt with successfully.
+func postMovedNotes(ctxt appengine.Context, w io.Writer) (n, done int) {
 	q := datastore.NewQuery("Issue").Filter("NeedGithubNote =", true).
-		Limit(10)
+		Limit(movesPerRun)
 	it := q.Run(ctxt)
 	for {
 		var old Issue
@@ -74,11 +92,15 @@ func doMoves(ctxt appengine.Context, w http.ResponseWriter, req *http.Request) {
 		if err != nil {
 			break
 		}
+		n++
 		fmt.Fprintf(w, "%s\n", fmt.Sprint(old.ID))
 		if err := postMovedNote(ctxt, "Issue", fmt.Sprint(old.ID)); err != nil {
 			fmt.Fprintf(w, "\t%s\n", err)
+			continue
 		}
+		done++
 	}
+	return n, done
 }
 
 func postMovedNote(ctxt appengine.Context, kind, id string) error {
@@ -99,70 +121,23 @@ func postMovedNote(ctxt appengine.Context, kind, id string) error {
 		return err
 	}
 
-	cfg, err := oauthConfig(ctxt)
-	if err != nil {
-		return fmt.Errorf("oauthconfig: %v", err)
-	}
-
-	var tok oauth.Token
-	if err := app.ReadMeta(ctxt, "codelogin.token", &tok); err != nil {
-		return fmt.Errorf("reading token: %v", err)
+	u := &Update{
+		Comment: fmt.Sprintf("This issue has moved to https://golang.org/issue/%s\n", id),
+		Label:   []string{"IssueMoved", "Restrict-AddIssueComment-Commit"},
 	}
-
-	tr := &oauth.Transport{
-		Config:    cfg,
-		Token:     &tok,
-		Transport: &urlfetch.Transport{Context: ctxt, Deadline: 45 * time.Second},
-	}
-	client := tr.Client()
-
-	status := ""
 	if old.State != "closed" {
-		status = "<issues:status>Moved</issues:status>"
+		u.Status = "Moved"
 	}
-
-	var buf bytes.Buffer
-	buf.WriteString(`<?xml version='1.0' encoding='UTF-8'?>
-<entry xmlns='http://www.w3.org/2005/Atom' xmlns:issues='http://schemas.google.com/projecthosting/issues/2009'>
-  <content type='html'>`)
-	xml.Escape(&buf, []byte(fmt.Sprintf("This issue has moved to https://golang.org/issue/%s\n", id)))
-	buf.WriteString(`</content>
-  <author>
-    <name>ignored</name>
-  </author>
-  <issues:sendEmail>False</issues:sendEmail>
-  <issues:updates>
-    <issues:label>IssueMoved</issues:label>
-    <issues:label>Restrict-AddIssueComment-Commit</issues:label>
-    ` + status + `
-  </issues:updates>
-</entry>
-`)
-	u := "https://code.google.com/feeds/issues/p/go/issues/" + id + "/comments/full"
-	req, err := http.NewRequest("POST", u, &buf)
-	if err != nil {
-		return fmt.Errorf("write: %v", err)
-	}
-	req.Header.Set("Content-Type", "application/atom+xml")
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("write: %v", err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 201 {
-		buf.Reset()
-		io.Copy(&buf, resp.Body)
-		return fmt.Errorf("write: %v\n%s", resp.Status, buf.String())
+	if err := Post(ctxt, old.ID, u); err != nil {
+		return err
 	}
 
-	err = app.Transaction(ctxt, func(ctxt appengine.Context) error {
+	return app.Transaction(ctxt, func(ctxt appengine.Context) error {
 		var old Issue
 		if err := app.ReadData(ctxt, "Issue", id, &old); err != nil {
 			return err
 		}
 		old.NeedGithubNote = false
-		old.Label = append(old.Label, "IssueMoved", "Restrict-AddIssueComment-Commit")
 		return app.WriteData(ctxt, "Issue", id, &old)
 	})
-	return err
 }
@@ -0,0 +1,157 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package issue
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"app"
+
+	"code.google.com/p/goauth2/oauth"
+
+	"appengine"
+	"appengine/urlfetch"
+)
+
+// An Update is a change to post to an issue on the tracker.
+// Empty fields are left unchanged.
+type Update struct {
+	Comment   string   // text of comment
+	Status    string   // new status
+	Owner     string   // new owner
+	Label     []string // labels to add, or to remove if prefixed with "-"
+	SendEmail bool     // notify people watching the issue
+}
+
+// Post posts the update to the issue with the given id on the tracker,
+// using the app's code.google.com credentials, and applies it to
+// the local copy of the issue.
+func Post(ctxt appengine.Context, id int, u *Update) error {
+	cfg, err := oauthConfig(ctxt)
+	if err != nil {
+		return fmt.Errorf("oauthconfig: %v", err)
+	}
+
+	var tok oauth.Token
+	if err := app.ReadMeta(ctxt, "codelogin.token", &tok); err != nil {
+		return fmt.Errorf("reading token: %v", err)
+	}
+
+	tr := &oauth.Transport{
+		Config:    cfg,
+		Token:     &tok,
+		Transport: app.SecureTransport(ctxt, "issue", &urlfetch.Transport{Context: ctxt, Deadline: 45 * time.Second}),
+	}
+	client := tr.Client()
+
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version='1.0' encoding='UTF-8'?>
+<entry xmlns='http://www.w3.org/2005/Atom' xmlns:issues='http://schemas.google.com/projecthosting/issues/2009'>
+  <content type='html'>`)
+	xml.Escape(&buf, []byte(u.Comment))
+	buf.WriteString(`</content>
+  <author>
+    <name>ignored</name>
+  </author>
+  <issues:sendEmail>`)
+	if u.SendEmail {
+		buf.WriteString("True")
+	} else {
+		buf.WriteString("False")
+	}
+	buf.WriteString(`</issues:sendEmail>
+  <issues:updates>
+`)
+	for _, label := range u.Label {
+		buf.WriteString("    <issues:label>")
+		xml.Escape(&buf, []byte(label))
+		buf.WriteString("</issues:label>\n")
+	}
+	if u.Status != "" {
+		buf.WriteString("    <issues:status>")
+		xml.Escape(&buf, []byte(u.Status))
+		buf.WriteString("</issues:status>\n")
+	}
+	if u.Owner != "" {
+		buf.WriteString("    <issues:ownerUpdate>")
+		xml.Escape(&buf, []byte(u.Owner))
+		buf.WriteString("</issues:ownerUpdate>\n")
+	}
+	buf.WriteString(`  </issues:updates>
+</entry>
+`)
+
+	url := fmt.Sprintf("https://code.google.com/feeds/issues/p/go/issues/%d/comments/full", id)
+	req, err := http.NewRequest("POST", url, &buf)
+	if err != nil {
+		return fmt.Errorf("write: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/atom+xml")
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("write: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 201 {
+		buf.Reset()
+		io.Copy(&buf, resp.Body)
+		return fmt.Errorf("write: %v\n%s", resp.Status, buf.String())
+	}
+
+	// Apply the update locally, so that it shows up before
+	// the next load from the tracker.
+	err = app.Transaction(ctxt, func(ctxt appengine.Context) error {
+		var old Issue
+		if err := app.ReadData(ctxt, "Issue", fmt.Sprint(id), &old); err != nil {
+			return err
+		}
+		u.apply(&old)
+		old.Updated = time.Now()
+		old.Indexed = false
+		return app.WriteData(ctxt, "Issue", fmt.Sprint(id), &old)
+	})
+	if err != nil {
+		return err
+	}
+	app.BumpDataVersion(ctxt)
+	return nil
+}
+
+// apply applies the update's status, owner, and label changes to issue.
+func (u *Update) apply(issue *Issue) {
+	if u.Status != "" {
+		issue.Status = u.Status
+	}
+	if u.Owner != "" {
+		issue.Owner = u.Owner
+	}
+	for _, label := range u.Label {
+		if strings.HasPrefix(label, "-") {
+			label = label[1:]
+			for i, l := range issue.Label {
+				if strings.EqualFold(l, label) {
+					issue.Label = append(issue.Label[:i], issue.Label[i+1:]...)
+					break
+				}
+			}
+			continue
+		}
+		found := false
+		for _, l := range issue.Label {
+			if strings.EqualFold(l, label) {
+				found = true
+			}
+		}
+		if !found {
+			issue.Label = append(issue.Label, label)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package issue
+
+import "strings"
+
+// Issue priorities, derived from the Priority-X labels,
+// from least to most urgent. An issue without a priority
+// label has PriorityNone.
+const (
+	PriorityNone = iota
+	PriorityLater
+	PriorityLow
+	PriorityMedium
+	PriorityHigh
+	PriorityCritical
+)
+
+// PriorityRelease is added to the priority of an issue scheduled
+// for a release, so that any release issue outranks all others.
+const PriorityRelease = 10
+
+var priorityLabels = map[string]int{
+	"Priority-Later":    PriorityLater,
+	"Priority-Low":      PriorityLow,
+	"Priority-Medium":   PriorityMedium,
+	"Priority-High":     PriorityHigh,
+	"Priority-Critical": PriorityCritical,
+}
+
+// Priority returns the issue's priority, higher meaning more urgent.
+// An issue counts as scheduled for a release if it has a Release-GoX
+// label, but not a Release-GoXMaybe or Release-None label.
+func (bug *Issue) Priority() int {
+	p := PriorityNone
+	release := false
+	for _, l := range bug.Label {
+		if x := priorityLabels[l]; x > p {
+			p = x
+		}
+		if strings.HasPrefix(l, "Release-Go") && !strings.HasSuffix(l, "Maybe") {
+			release = true
+		}
+	}
+	if release {
+		p += PriorityRelease
+	}
+	return p
+}
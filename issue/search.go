@@ -0,0 +1,122 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package issue
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"app"
+
+	"appengine"
+	"appengine/datastore"
+	fulltext "appengine/search"
+)
+
+// Issues are added to the "Issue" search index by the issue.index scan,
+// which picks up every issue written with Indexed == false.
+// The search package is imported as fulltext to avoid a clash with
+// search in load.go, which searches the issue tracker.
+
+// issueDoc is the search document for an issue.
+type issueDoc struct {
+	ID       fulltext.Atom
+	Summary  string
+	Status   fulltext.Atom
+	Owner    string
+	Label    string
+	Text     string // all comments
+	Modified time.Time
+}
+
+func init() {
+	app.ScanData("issue.index", 5*time.Minute,
+		datastore.NewQuery("Issue").Filter("Indexed =", false),
+		indexIssue)
+}
+
+func indexIssue(ctxt appengine.Context, kind, key string) error {
+	var issue Issue
+	if err := app.ReadData(ctxt, "Issue", key, &issue); err != nil {
+		return err
+	}
+	index, err := fulltext.Open("Issue")
+	if err != nil {
+		return err
+	}
+	if issue.Restricted {
+		if err := index.Delete(ctxt, key); err != nil {
+			return fmt.Errorf("removing restricted issue %s from index: %v", key, err)
+		}
+		return markIndexed(ctxt, key, issue.Updated)
+	}
+	var text []string
+	for _, c := range issue.Comment {
+		text = append(text, c.Text)
+	}
+	doc := &issueDoc{
+		ID:       fulltext.Atom(key),
+		Summary:  issue.Summary,
+		Status:   fulltext.Atom(issue.Status),
+		Owner:    issue.Owner,
+		Label:    strings.Join(issue.Label, " "),
+		Text:     strings.Join(text, "\n"),
+		Modified: issue.Modified,
+	}
+	if _, err := index.Put(ctxt, key, doc); err != nil {
+		return fmt.Errorf("indexing issue %s: %v", key, err)
+	}
+	return markIndexed(ctxt, key, issue.Updated)
+}
+
+// markIndexed records that the issue with the given key
+// is up to date in the search index, unless it has been
+// changed since its last change at updated, which was indexed.
+func markIndexed(ctxt appengine.Context, key string, updated time.Time) error {
+	return app.Transaction(ctxt, func(ctxt appengine.Context) error {
+		var issue Issue
+		if err := app.ReadData(ctxt, "Issue", key, &issue); err != nil {
+			return err
+		}
+		if !issue.Updated.Equal(updated) {
+			// Changed since we read it; the next scan indexes the new copy.
+			return nil
+		}
+		issue.Indexed = true
+		return app.WriteData(ctxt, "Issue", key, &issue)
+	})
+}
+
+// Search returns up to limit issues matching the query,
+// which uses the App Engine search query syntax.
+func Search(ctxt appengine.Context, query string, limit int) ([]*Issue, error) {
+	index, err := fulltext.Open("Issue")
+	if err != nil {
+		return nil, err
+	}
+	var issues []*Issue
+	it := index.Search(ctxt, query, &fulltext.SearchOptions{Limit: limit, IDsOnly: true})
+	for {
+		id, err := it.Next(nil)
+		if err == fulltext.Done {
+			break
+		}
+		if err != nil {
+			ctxt.Errorf("searching issues for %q: %v", query, err)
+			return nil, fmt.Errorf("searching issues failed")
+		}
+		if _, err := strconv.Atoi(id); err != nil {
+			continue
+		}
+		issue := new(Issue)
+		if err := app.ReadData(ctxt, "Issue", id, issue); err != nil {
+			continue
+		}
+		issues = append(issues, issue)
+	}
+	return issues, nil
+}
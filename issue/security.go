@@ -0,0 +1,57 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package issue
+
+import (
+	"app"
+
+	"appengine"
+)
+
+// Restricted issues.
+//
+// Security issues under embargo must not leak through the dashboard.
+// An issue with any of the labels listed in the "issue.security" config
+// (see app.ReadConfig), for example {"Labels": ["Restrict-View-Security"]},
+// is stored with Restricted set and only its metadata: the text of its
+// comments, including the initial report, is dropped before writing, so
+// it never reaches the datastore or the search index. The dashboard shows
+// restricted issues only to users with the security role and leaves them
+// out of its JSON API and feeds altogether.
+//
+// Removing the label makes the next load store the issue in full.
+
+type securityConfig struct {
+	Labels []string // labels marking restricted issues
+}
+
+// restrictedLabels returns the labels marking restricted issues.
+// It must not be called within a transaction (see app.ReadConfig).
+func restrictedLabels(ctxt appengine.Context) []string {
+	var cfg securityConfig
+	app.ReadConfig(ctxt, "issue.security", &cfg)
+	return cfg.Labels
+}
+
+// restrict sets issue.Restricted according to whether the issue has
+// one of the given labels and, if so, redacts the issue's comments.
+func (issue *Issue) restrict(labels []string) {
+	issue.Restricted = false
+	for _, l := range issue.Label {
+		for _, r := range labels {
+			if l == r {
+				issue.Restricted = true
+			}
+		}
+	}
+	if !issue.Restricted {
+		return
+	}
+	for i := range issue.Comment {
+		c := &issue.Comment[i]
+		c.Text = ""
+		c.Summary = ""
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package issue
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Urgency keywords.
+//
+// Issues and CLs whose text mentions one of a few phrases, such as
+// "blocks release" or "security", are flagged as urgent: the loaders
+// store the first matching phrase in the Urgent field, the dashboard
+// highlights the item, and watchers can ask to be notified only about
+// urgent changes. The check is a plain keyword match, so it will flag
+// "this is not a regression" too; it is meant to catch the eye, not
+// to decide anything.
+
+var urgentRE = regexp.MustCompile(`(?i)\b(blocks? (the )?release|release[- ]blocker|security|regression)\b`)
+
+// Urgency returns the first urgency phrase mentioned in text,
+// in lower case, or "" if there is none.
+// Quoted lines, those beginning with >, are ignored,
+// so that a reply does not repeat an earlier message's match.
+func Urgency(text string) string {
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), ">") {
+			continue
+		}
+		if m := urgentRE.FindString(line); m != "" {
+			return strings.ToLower(m)
+		}
+	}
+	return ""
+}
+
+// urgency returns the first urgency phrase in the issue's summary
+// or comments, including the initial report.
+func (issue *Issue) urgency() string {
+	if u := Urgency(issue.Summary); u != "" {
+		return u
+	}
+	for _, c := range issue.Comment {
+		if u := Urgency(c.Text); u != "" {
+			return u
+		}
+	}
+	return ""
+}
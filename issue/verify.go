@@ -0,0 +1,69 @@
+// Copyright 2014 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package issue
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"app"
+
+	"appengine"
+)
+
+func init() {
+	app.RegisterVerifier("issue", "Issue", verifyIssue)
+}
+
+// verifyIssue compares the stored issue with the given ID
+// against a fresh copy from the tracker.
+func verifyIssue(ctxt appengine.Context, key string) ([]string, error) {
+	var old Issue
+	if err := app.ReadData(ctxt, "Issue", key, &old); err != nil {
+		return nil, err
+	}
+	issues, err := search(ctxt, "go", "all", "id:"+key, true, time.Time{}, time.Time{}, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(issues) == 0 {
+		return []string{"missing upstream"}, nil
+	}
+	cur := issues[0]
+	if cur.ID != old.ID {
+		return nil, fmt.Errorf("tracker returned issue %d", cur.ID)
+	}
+	if !cur.Modified.Equal(old.Modified) {
+		return nil, app.ErrStale
+	}
+
+	var diffs []string
+	diff := func(field string, same bool) {
+		if !same {
+			diffs = append(diffs, field)
+		}
+	}
+	diff("Summary", cur.Summary == old.Summary)
+	diff("Status", cur.Status == old.Status)
+	diff("Duplicate", cur.Duplicate == old.Duplicate)
+	diff("Owner", cur.Owner == old.Owner)
+	diff("CC", sameStrings(cur.CC, old.CC))
+	diff("Label", sameStrings(cur.Label, old.Label))
+	diff("State", cur.State == old.State)
+	diff("Created", cur.Created.Equal(old.Created))
+	diff("ClosedDate", cur.ClosedDate.Equal(old.ClosedDate))
+	diff("Comments", len(cur.Comment) == len(old.Comment))
+	if len(cur.Comment) > 0 && len(old.Comment) > 0 {
+		diff("Description", cur.Comment[0].Text == old.Comment[0].Text)
+	}
+	return diffs, nil
+}
+
+// sameStrings reports whether a and b hold the same strings,
+// treating nil and empty lists as equal.
+func sameStrings(a, b []string) bool {
+	return len(a) == 0 && len(b) == 0 || reflect.DeepEqual(a, b)
+}
@@ -5,13 +5,9 @@
 package startup
 
 import (
-	"net/http"
-
 	"app"
-
-	"github.com/rsc/appstats"
 )
 
 func init() {
-	http.Handle("/status", appstats.NewHandler(app.StatusPage))
+	app.Handle("/status", app.StatusPage)
 }
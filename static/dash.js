@@ -1,5 +1,11 @@
 var mode = "all"
 
+// xsrf returns the XSRF token embedded in the page,
+// which must be sent with every /uiop request.
+function xsrf() {
+	return $("meta[name=xsrf]").attr("content");
+}
+
 function readURL() {
 	mode = window.location.hash.substr(1)
 	if(mode.match(/\+muted/)) {
@@ -22,6 +28,11 @@ function show(newmode) {
 }
 
 function redraw() {
+	// Only the main dashboard has the display controls.
+	// Other pages using this script show all their rows.
+	if($("#showcl").length == 0)
+		return;
+
 	// Invariant: a tr containing a td with mine and todo classes itself has class todo.
 	$("tr.todo").removeClass("todo");
 	$("td.mine.todo").parent().addClass("todo");
@@ -89,7 +100,7 @@ function redraw() {
 function mute(ev, dir) {
 	var dirclass = "dir-" + dir.replace(/\//g, "\\/").replace(/\./g, "\\.");
 	
-	var outer = $(ev.delegateTarget);
+	var outer = $(ev.currentTarget);
 	var muting = outer.text() == "mute";
 	var op = "";
 	if(muting) {
@@ -105,7 +116,8 @@ function mute(ev, dir) {
 		"url": "/uiop",
 		"data": {
 			"dir": dir,
-			"op": op
+			"op": op,
+			"xsrf": xsrf()
 		},
 		"success": function() {
 			if(op == "mute") {
@@ -123,16 +135,215 @@ function mute(ev, dir) {
 	})
 }
 
+function muteitem(a) {
+	// The id is mutecl-NNN or muteissue-NNN.
+	var id = a.attr("id").split("-");
+	var data = {"op": id[0], "xsrf": xsrf()};
+	data[id[0].replace("mute", "")] = id[1];
+	a.text("hiding...");
+	$.ajax({
+		"type": "POST",
+		"url": "/uiop",
+		"data": data,
+		"success": function() {
+			var row = a.closest("tr.item");
+			if(id[0] == "muteissue") {
+				// Hide the CLs listed under the issue too.
+				row.nextUntil("tr.item:not(.nest)").remove();
+			}
+			row.remove();
+			redraw();
+		},
+		"error": function(xhr, status) {
+			a.text("failed: " + status)
+		}
+	})
+}
+
+function snoozeitem(a) {
+	// The id is snoozecl-NNN or snoozeissue-NNN.
+	var id = a.attr("id").split("-");
+	var until = prompt("Snooze until (YYYY-MM-DD):");
+	if(!until)
+		return;
+	var data = {"op": "snooze", "until": until, "xsrf": xsrf()};
+	data[id[0].replace("snooze", "")] = id[1];
+	a.text("snoozing...");
+	$.ajax({
+		"type": "POST",
+		"url": "/uiop",
+		"data": data,
+		"success": function() {
+			var row = a.closest("tr.item");
+			if(id[0] == "snoozeissue") {
+				row.nextUntil("tr.item:not(.nest)").remove();
+			}
+			row.remove();
+			redraw();
+		},
+		"error": function(xhr, status) {
+			a.text("failed: " + xhr.responseText)
+		}
+	})
+}
+
+function watchitem(a) {
+	// The id is watchcl-NNN or watchissue-NNN.
+	var id = a.attr("id").split("-");
+	var data = {"op": id[0], "xsrf": xsrf()};
+	data[id[0].replace("watch", "")] = id[1];
+	a.text("watching...");
+	$.ajax({
+		"type": "POST",
+		"url": "/uiop",
+		"data": data,
+		"success": function() {
+			a.replaceWith("watched");
+		},
+		"error": function(xhr, status) {
+			a.text("failed: " + xhr.responseText)
+		}
+	})
+}
+
+// summarymail turns the weekly summary mail on or off.
+function summarymail(box) {
+	var result = $("#summaryresult");
+	result.text("saving...");
+	$.ajax({
+		"type": "POST",
+		"url": "/uiop",
+		"data": {"op": box.is(":checked") ? "summary" : "nosummary", "xsrf": xsrf()},
+		"success": function() {
+			result.text("");
+		},
+		"error": function(xhr, status) {
+			result.text("failed: " + xhr.responseText);
+		}
+	})
+}
+
+// claim assigns the CL to the logged-in user.
+// The reviewer column is updated immediately and restored if the request fails.
+function claim(a) {
+	var clnumber = a.attr("id").replace("claim-", "");
+	var rev = $("#reviewer-" + clnumber);
+	var old = rev.html();
+	rev.text("me");
+	a.hide();
+	$.ajax({
+		"type": "POST",
+		"url": "/uiop",
+		"data": {"op": "claim", "cl": clnumber, "xsrf": xsrf()},
+		"dataType": "json",
+		"success": function(data) {
+			rev.text(data.Short);
+		},
+		"error": function(xhr, status) {
+			rev.html(old);
+			a.show();
+			$("#err-" + clnumber).text("failed: " + xhr.responseText);
+		}
+	})
+}
+
+// sendlgtm posts an LGTM on the CL on behalf of the logged-in user.
+function sendlgtm(a) {
+	var clnumber = a.attr("id").replace("lgtm-", "");
+	if(!confirm("Send LGTM for CL " + clnumber + "?"))
+		return;
+	a.text("sending...");
+	$.ajax({
+		"type": "POST",
+		"url": "/uiop",
+		"data": {"op": "lgtm", "cl": clnumber, "xsrf": xsrf()},
+		"success": function() {
+			a.text("sent LGTM");
+		},
+		"error": function(xhr, status) {
+			a.text("failed: " + xhr.responseText);
+		}
+	})
+}
+
+// needsecond asks for (or withdraws the request for) a second reviewer for the CL.
+function needsecond(a) {
+	var clnumber = a.attr("id").replace("second-", "");
+	a.text("saving...");
+	$.ajax({
+		"type": "POST",
+		"url": "/uiop",
+		"data": {"op": a.attr("data-op"), "cl": clnumber, "xsrf": xsrf()},
+		"success": function() {
+			a.text(a.attr("data-op") == "needs-second" ? "second requested" : "second cleared");
+		},
+		"error": function(xhr, status) {
+			a.text("failed: " + xhr.responseText);
+		}
+	})
+}
+
+// assignto assigns the CL to one of its suggested reviewers.
+function assignto(a) {
+	// The id is assignto-CL-reviewer.
+	var id = a.attr("id").split("-");
+	a.text("assigning...");
+	$.ajax({
+		"type": "POST",
+		"url": "/uiop",
+		"data": {"op": "assign", "cl": id[1], "reviewer": id[2], "xsrf": xsrf()},
+		"dataType": "json",
+		"success": function(data) {
+			$("#reviewer-" + id[1]).text(data.Short);
+			$("a.assignto[id^='assignto-" + id[1] + "-']").remove();
+		},
+		"error": function(xhr, status) {
+			a.text("failed: " + xhr.responseText);
+		}
+	})
+}
+
+// triage applies the triage operation described by the link's data attributes.
+function triage(a) {
+	var data = {
+		"op": a.attr("data-op"),
+		"issue": a.attr("data-issue"),
+		"priority": a.attr("data-priority") || "",
+		"labels": a.attr("data-labels") || "",
+		"xsrf": xsrf()
+	};
+	if(data.op == "setowner") {
+		data.owner = prompt("Owner:");
+		if(!data.owner)
+			return;
+	}
+	var result = a.closest("tr.item").find("span.triageresult");
+	result.text("saving...");
+	$.ajax({
+		"type": "POST",
+		"url": "/uiop",
+		"data": data,
+		"success": function() {
+			a.closest("tr.item").addClass("triaged");
+			result.text("done");
+		},
+		"error": function(xhr, status) {
+			result.text("failed: " + xhr.responseText);
+		}
+	})
+}
+
 function setreviewer(a, rev) {
 	var clnumber = a.attr("id").replace("assign-", "");
-	var who = rev.text();
+	var who = $.trim(rev.text());
 	$.ajax({
 		"type": "POST",
 		"url": "/uiop",
 		"data": {
 			"cl": clnumber,
 			"reviewer": who,
-			"op": "reviewer"
+			"op": "reviewer",
+			"xsrf": xsrf()
 		},
 		"dataType": "text",
 		"success": function(data) {
@@ -149,11 +360,43 @@ function setreviewer(a, rev) {
 	})
 }
 
+// poll checks for changes to the dashboard data since the page was loaded
+// and, if there are any, replaces the table with a freshly loaded copy.
+function poll() {
+	var meta = $("meta[name=dataversion]");
+	if(meta.length == 0)
+		return;
+	$.ajax({
+		"url": "/api/dash/changes",
+		"data": {"since": meta.attr("content")},
+		"dataType": "json",
+		"success": function(data) {
+			if(!data.More && !data.CLs && !data.Issues) {
+				meta.attr("content", data.Version);
+				return;
+			}
+			$.get(window.location.href, function(page) {
+				var table = $(page).filter("table.dash");
+				if(table.length == 0)
+					table = $(page).find("table.dash");
+				if(table.length == 0)
+					return;
+				$("table.dash").replaceWith(table);
+				meta.attr("content", data.Version);
+				redraw();
+			}, "html");
+		}
+	})
+}
+
 $(document).ready(function() {
+	// Handlers are attached to the document, not the links themselves,
+	// so that they keep working when poll replaces the table.
+
 	// Define handler for mute links.
-	$("a.mute").click(function(ev) {
+	$(document).on("click", "a.mute", function(ev) {
 		ev.preventDefault();
-		var classes = $(ev.delegateTarget).attr("class").split(/\s+/);
+		var classes = $(ev.currentTarget).attr("class").split(/\s+/);
 		for(var i in classes) {
 			var cl = classes[i];
 			if(cl.substr(0,4) == "dir-") {
@@ -162,13 +405,89 @@ $(document).ready(function() {
 		}
 	})
 	
+	// Define handler for hiding individual CLs and issues.
+	$(document).on("click", "a.muteitem", function(ev) {
+		ev.preventDefault();
+		muteitem($(ev.currentTarget));
+	})
+	$(document).on("click", "a.snoozeitem", function(ev) {
+		ev.preventDefault();
+		snoozeitem($(ev.currentTarget));
+	})
+	$(document).on("click", "a.watchitem", function(ev) {
+		ev.preventDefault();
+		watchitem($(ev.currentTarget));
+	})
+
+	// Define handlers for saving and deleting views.
+	$(document).on("click", "#saveview", function(ev) {
+		ev.preventDefault();
+		var name = prompt("Name for this view:");
+		if(!name)
+			return;
+		var data = "op=saveview&name=" + encodeURIComponent(name) + "&xsrf=" + encodeURIComponent(xsrf()) + "&" + $(ev.currentTarget).attr("data-query");
+		$.ajax({
+			"type": "POST",
+			"url": "/uiop",
+			"data": data,
+			"success": function() {
+				window.location = "/?view=" + encodeURIComponent(name);
+			},
+			"error": function(xhr, status) {
+				$(ev.currentTarget).text("failed: " + status)
+			}
+		})
+	})
+	$(document).on("click", "a.deleteview", function(ev) {
+		ev.preventDefault();
+		var a = $(ev.currentTarget);
+		var name = a.attr("id").replace("deleteview-", "");
+		$.ajax({
+			"type": "POST",
+			"url": "/uiop",
+			"data": {"op": "deleteview", "name": name, "xsrf": xsrf()},
+			"success": function() {
+				window.location = "/";
+			},
+			"error": function(xhr, status) {
+				a.text("failed: " + status)
+			}
+		})
+	})
+
+	// Define handlers for LGTM and claim links.
+	$(document).on("click", "a.sendlgtm", function(ev) {
+		ev.preventDefault();
+		sendlgtm($(ev.currentTarget));
+	})
+	$(document).on("click", "a.needsecond", function(ev) {
+		ev.preventDefault();
+		needsecond($(ev.currentTarget));
+	})
+	$(document).on("click", "a.assignto", function(ev) {
+		ev.preventDefault();
+		assignto($(ev.currentTarget));
+	})
+	$(document).on("click", "a.triage", function(ev) {
+		ev.preventDefault();
+		triage($(ev.currentTarget));
+	})
+	$(document).on("change", "#summarymail", function(ev) {
+		summarymail($(ev.currentTarget));
+	})
+	$(document).on("click", "a.claim", function(ev) {
+		ev.preventDefault();
+		claim($(ev.currentTarget));
+	})
 	// Define handler for edit-reviewer links.
-	$("a.assignreviewer").click(function(ev) {
+	$(document).on("click", "a.assignreviewer", function(ev) {
 		ev.preventDefault();
-		var a = $(ev.delegateTarget);
+		var a = $(ev.currentTarget);
 		var revid = a.attr("id").replace("assign-", "reviewer-");
 		var rev = $("#" + revid);
 		if(a.text() == "edit") {
+			// Drop the avatar, leaving just the name to edit.
+			rev.text($.trim(rev.text()));
 			rev.attr("contenteditable", "true");
 			rev.focus();
 			a.addClass("big");
@@ -189,4 +508,7 @@ $(document).ready(function() {
 	$("#showmute").change(redraw);
 	$("#showcl").change(redraw);
 	$("#showissue").change(redraw);
+
+	// Check for changes every 30 seconds.
+	setInterval(poll, 30*1000);
 })